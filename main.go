@@ -21,6 +21,10 @@ func main() {
 		cmds.NewSecretsEncryptCommand(),
 		cmds.NewTokenCommand(),
 		cmds.NewCompletionCommand(),
+		cmds.NewImagesCommand(),
+		cmds.NewVerifyInstallCommand(),
+		cmds.NewRollbackCommand(),
+		cmds.NewIngressCommand(),
 	}
 
 	if err := app.Run(configfilearg.MustParse(os.Args)); err != nil && !errors.Is(err, context.Canceled) {
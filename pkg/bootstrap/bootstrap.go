@@ -7,10 +7,12 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
 	"regexp"
-	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/name"
@@ -30,22 +32,34 @@ import (
 	"github.com/rancher/wharfie/pkg/credentialprovider/plugin"
 	"github.com/rancher/wharfie/pkg/extract"
 	"github.com/rancher/wharfie/pkg/registries"
-	"github.com/rancher/wharfie/pkg/tarfile"
 	"github.com/rancher/wrangler/v3/pkg/merr"
 	"github.com/rancher/wrangler/v3/pkg/yaml"
 	"github.com/sirupsen/logrus"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/apimachinery/pkg/util/sets"
+	k8syaml "sigs.k8s.io/yaml"
 )
 
 var (
 	taskDir             = "/run/k3s/containerd/io.containerd.runtime.v2.task/k8s.io"
 	releasePattern      = regexp.MustCompile("^v[0-9]")
 	helmChartGVK        = helmv1.SchemeGroupVersion.WithKind("HelmChart")
+	helmChartConfigGVK  = helmv1.SchemeGroupVersion.WithKind("HelmChartConfig")
 	injectAnnotationKey = version.Program + ".cattle.io/inject-cluster-config"
 	injectEnvKey        = version.ProgramUpper + "_INJECT_CLUSTER_CONFIG"
 	injectDefault       = false
+
+	injectModeAnnotationKey = version.Program + ".cattle.io/inject-cluster-config-mode"
+	injectModeEnvKey        = version.ProgramUpper + "_INJECT_CLUSTER_CONFIG_MODE"
+)
+
+const (
+	// injectModeSet injects cluster configuration values into spec.set, where they take precedence over all other values.
+	injectModeSet = "set"
+	// injectModeValues merges cluster configuration values into spec.valuesContent, where they take precedence
+	// over the chart's own values, but can be overridden by a HelmChartConfig.
+	injectModeValues = "values"
 )
 
 // binDirForDigest returns the path to dataDir/data/refDigest/bin.
@@ -96,6 +110,14 @@ func isRegular(file string) bool {
 	return false
 }
 
+// isDir returns true if a directory exists at the given path.
+func isDir(dir string) bool {
+	if s, err := os.Stat(dir); err == nil && s.IsDir() {
+		return true
+	}
+	return false
+}
+
 // dirHasShims returns true if any container references a containerd shim inside dirPath.
 func dirHasShims(dirPath string) bool {
 	entries, err := os.ReadDir(taskDir)
@@ -117,45 +139,25 @@ func dirHasShims(dirPath string) bool {
 	return false
 }
 
-// cleanDataDirs remove directories from /data that do not match the current version/refdigest.
-func cleanDataDirs(dataDir string, refDigest string) error {
-	datapath := filepath.Join(dataDir, "data")
-	entries, err := os.ReadDir(datapath)
-
+// BinDir returns the bin dir for an image by hashing the image name and tag, or the image digest,
+// depending on what the runtime image reference points at.
+func BinDir(resolver *images.Resolver, cfg cmds.Agent) (string, error) {
+	ref, err := resolver.GetReference(images.Runtime)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil
-		}
-		return err
+		return "", err
 	}
 
-	for _, entry := range entries {
-		if !entry.IsDir() {
-			continue
-		}
-		if entry.Name() == refDigest {
-			continue
-		}
-		if !releasePattern.MatchString(entry.Name()) {
-			continue
-		}
-
-		oldpath := filepath.Join(datapath, entry.Name())
-		if dirHasShims(oldpath) {
-			logrus.Infof("Skipping removal of old RKE2 data directory %s: still referenced by containers", oldpath)
-			continue
-		}
-		logrus.Infof("Removing old RKE2 data directory: %s", oldpath)
-		if err := os.RemoveAll(oldpath); err != nil {
-			logrus.Warnf("Failed to removed old data directory %s: %v", oldpath, err)
-		}
+	refDigest, err := releaseRefDigest(ref)
+	if err != nil {
+		return "", err
 	}
-	return nil
+
+	return binDirForDigest(cfg.DataDir, refDigest), nil
 }
 
-// BinDir returns the bin dir for an image by hashing the image name and tag, or the image digest,
+// ChartsDir returns the charts dir for an image by hashing the image name and tag, or the image digest,
 // depending on what the runtime image reference points at.
-func BinDir(resolver *images.Resolver, cfg cmds.Agent) (string, error) {
+func ChartsDir(resolver *images.Resolver, cfg cmds.Agent) (string, error) {
 	ref, err := resolver.GetReference(images.Runtime)
 	if err != nil {
 		return "", err
@@ -166,16 +168,19 @@ func BinDir(resolver *images.Resolver, cfg cmds.Agent) (string, error) {
 		return "", err
 	}
 
-	return binDirForDigest(cfg.DataDir, refDigest), nil
+	return chartsDirForDigest(cfg.DataDir, refDigest), nil
 }
 
 // Stage extracts binaries and manifests from the runtime image specified in imageConf into the directory
 // at dataDir. It attempts to load the runtime image from a tarball at dataDir/agent/images,
 // falling back to a remote image pull if the image is not found within a tarball.
-// Extraction is skipped if a bin directory for the specified image already exists.
+// Extraction is skipped if a bin directory for the specified image already exists, and its content
+// matches the checksums recorded when it was extracted. If the content does not match, it is either
+// extracted again or an error is returned, depending on the integrity action. Previous runtime data
+// directories are removed once the new content is in place, except for those kept by the retention options.
 // Unique image detection is accomplished by hashing the image name and tag, or the image digest,
 // depending on what the runtime image reference points at.
-func Stage(ctx context.Context, resolver *images.Resolver, nodeConfig *daemonconfig.Node, cfg cmds.Agent) error {
+func Stage(ctx context.Context, resolver *images.Resolver, nodeConfig *daemonconfig.Node, cfg cmds.Agent, opts StageOptions) error {
 	var img v1.Image
 
 	ref, err := resolver.GetReference(images.Runtime)
@@ -193,46 +198,71 @@ func Stage(ctx context.Context, resolver *images.Resolver, nodeConfig *daemoncon
 	refCompleteFile := completionMarkerForDigest(cfg.DataDir, refDigest)
 	imagesDir := imagesDir(cfg.DataDir)
 
-	if dirExists(refBinDir) && dirExists(refChartsDir) && isRegular(refCompleteFile) {
+	extracted := dirExists(refBinDir) && dirExists(refChartsDir) && isRegular(refCompleteFile)
+	if extracted {
+		opts.Status.Set(PhaseVerify, "%s", filepath.Dir(refBinDir))
+		problems, err := verifyChecksums(cfg.DataDir, refDigest)
+		if errors.Is(err, errChecksumsNotRecorded) {
+			// Content extracted by a release that did not record checksums cannot be verified,
+			// so checksums are recorded now, and verified on subsequent starts.
+			logrus.Infof("Recording checksums for runtime image %s content extracted by a previous release", ref.Name())
+			if err := writeChecksums(cfg.DataDir, refDigest); err != nil {
+				logrus.Warnf("Failed to record runtime image checksums: %v", err)
+			}
+		} else if err != nil {
+			problems = append(problems, err.Error())
+		}
+		if len(problems) > 0 {
+			for _, p := range problems {
+				logrus.Warnf("Runtime image %s integrity check failed: %s", ref.Name(), p)
+			}
+			if opts.IntegrityAction == IntegrityFail {
+				return fmt.Errorf("runtime image %s content in %s does not match checksums recorded at extract time", ref.Name(), filepath.Dir(refBinDir))
+			}
+			logrus.Warnf("Re-extracting runtime image %s", ref.Name())
+			for _, path := range []string{refCompleteFile, refBinDir, refChartsDir} {
+				if err := os.RemoveAll(path); err != nil {
+					return errors.WithMessage(err, "failed to remove runtime image content")
+				}
+			}
+			extracted = false
+		}
+	}
+
+	if extracted {
 		logrus.Infof("Runtime image %s bin and charts directories already exist; skipping extract", ref.Name())
 	} else {
-		// Try to use configured runtime image from an airgap tarball
-		img, err = preloadBootstrapFromRuntime(imagesDir, resolver)
+		// Try each of the configured image sources in order, such as airgap tarballs and registries.
+		// Note that this will fail (potentially after a long delay) if a registry cannot be reached.
+		pullStart := time.Now()
+		found, source, err := findRuntimeImage(ctx, resolver, newImageSources(opts.Sources, nodeConfig, cfg), opts)
 		if err != nil {
-			return err
+			return errors.WithMessagef(err, "failed to get runtime image %s", ref.Name())
 		}
+		img = found.Image
 
-		// If we didn't find the requested image in a tarball, pull it from the remote registry.
-		// Note that this will fail (potentially after a long delay) if the registry cannot be reached.
-		if img == nil {
-			registry, err := registries.GetPrivateRegistries(cfg.PrivateRegistry)
-			if err != nil {
-				return errors.WithMessagef(err, "failed to load private registry configuration from %s", cfg.PrivateRegistry)
-			}
-			// Override registry config with version provided by (and potentially modified by) k3s agent setup
-			registry.Registry = nodeConfig.AgentConfig.Registry
-
-			// Try to enable Kubelet image credential provider plugins; fall back to legacy docker credentials
-			if agent.ImageCredProvAvailable(&nodeConfig.AgentConfig) {
-				plugins, err := plugin.RegisterCredentialProviderPlugins(nodeConfig.AgentConfig.ImageCredProvConfig, nodeConfig.AgentConfig.ImageCredProvBinDir)
-				if err != nil {
-					return err
-				}
-				registry.DefaultKeychain = plugins
-			} else {
-				registry.DefaultKeychain = authn.DefaultKeychain
+		// Verify the runtime image signature before using it, under the reference that it was found under
+		verifier := NewImageVerifier(ctx, resolver, nodeConfig, cfg)
+		if err := verifier.VerifyImage(images.Runtime, found.Ref, img, found.IndexDigests...); err != nil {
+			return err
+		}
+		if source.Remote() {
+			// Make sure that the runtime image is also loaded into containerd
+			if err := images.Pull(imagesDir, images.Runtime, found.Ref); err != nil {
+				return errors.WithMessagef(err, "failed to add runtime image %s to pull list", found.Ref.Name())
 			}
 
-			logrus.Infof("Pulling runtime image %s", ref.Name())
-			// Make sure that the runtime image is also loaded into containerd
-			images.Pull(imagesDir, images.Runtime, ref)
-			img, err = registry.Image(ref, remote.WithPlatform(v1.Platform{Architecture: runtime.GOARCH, OS: runtime.GOOS}), remote.WithContext(ctx))
+			// Pull layers into the cache before extracting, so that an interrupted pull does not need to start over
+			img, err = cacheImage(ctx, img, layerCacheDir(cfg.DataDir), opts.Pull, opts.Status, &found.Stats, found.Resume)
 			if err != nil {
-				return errors.WithMessagef(err, "failed to get runtime image %s", ref.Name())
+				return errors.WithMessagef(err, "failed to pull runtime image %s", found.Ref.Name())
 			}
+			found.Stats.Duration = time.Since(pullStart)
 		}
+		opts.Stats.add(found.Stats)
 
 		// Extract binaries and charts
+		opts.Status.Set(PhaseExtract, "%s", ref.Name())
 		extractPaths := map[string]string{
 			"/bin":    refBinDir,
 			"/charts": refChartsDir,
@@ -244,34 +274,47 @@ func Stage(ctx context.Context, resolver *images.Resolver, nodeConfig *daemoncon
 		if err := os.Chmod(refBinDir, 0755); err != nil {
 			return err
 		}
+		// Record checksums of extracted content, so that it can be verified on subsequent starts
+		if err := writeChecksums(cfg.DataDir, refDigest); err != nil {
+			return errors.WithMessage(err, "failed to record runtime image checksums")
+		}
+		// Record component images, so that they can be restored if this runtime image is rolled back to
+		if err := writeImageRefs(cfg.DataDir, refDigest, resolver); err != nil {
+			return errors.WithMessage(err, "failed to record component images")
+		}
 		// Create file to indicate successful extract of all content
 		if err := os.WriteFile(refCompleteFile, []byte(ref.Name()), 0644); err != nil {
 			return err
 		}
+		if err := os.RemoveAll(layerCacheDir(cfg.DataDir)); err != nil {
+			logrus.Warnf("Failed to remove runtime image layer cache: %v", err)
+		}
 	}
 
 	// ignore errors on symlink rewrite
 	_ = os.RemoveAll(symlinkBinDir(cfg.DataDir))
 	_ = os.Symlink(refBinDir, symlinkBinDir(cfg.DataDir))
 
-	if err := cleanDataDirs(cfg.DataDir, refDigest); err != nil {
+	if err := cleanDataDirs(cfg.DataDir, refDigest, opts.Retention); err != nil {
 		logrus.Warnf("Failed to clean old data dirs: %v", err)
 	}
 
+	opts.Status.Set(PhaseComplete, "%s", ref.Name())
 	return nil
 }
 
 // UpdateManifests copies the staged manifests into the server's manifests dir, and applies
 // cluster configuration values to any HelmChart manifests found in the manifests directory.
+// If a charts source is configured, charts from the source replace bundled charts with the same file name.
 // This function is intended to be run in a goroutine, and will block until the apiserver is up to list HelmCharts.
 // TODO: Move this function back out of a goroutine once we no longer support detecting legacy installations of ingress-nginx
-func UpdateManifests(ctx context.Context, resolver *images.Resolver, ingressController []string, nodeConfig *daemonconfig.Node, cfg cmds.Agent, prime bool) {
-	if err := updateManifests(ctx, resolver, ingressController, nodeConfig, cfg, prime); err != nil {
+func UpdateManifests(ctx context.Context, resolver *images.Resolver, nodeConfig *daemonconfig.Node, cfg cmds.Agent, opts ManifestOptions) {
+	if err := updateManifests(ctx, resolver, nodeConfig, cfg, opts); err != nil {
 		signals.RequestShutdown(errors.WithMessage(err, "failed to update manifests"))
 	}
 }
 
-func updateManifests(ctx context.Context, resolver *images.Resolver, ingressController []string, nodeConfig *daemonconfig.Node, cfg cmds.Agent, prime bool) error {
+func updateManifests(ctx context.Context, resolver *images.Resolver, nodeConfig *daemonconfig.Node, cfg cmds.Agent, opts ManifestOptions) error {
 	ref, err := resolver.GetReference(images.Runtime)
 	if err != nil {
 		return err
@@ -290,32 +333,144 @@ func updateManifests(ctx context.Context, resolver *images.Resolver, ingressCont
 
 	// if ingress-controller is not set in config, determine what the default should be.
 	// ingress-nginx is the default if its HelmChart is present in the cluster, otherwise traefik
-	if len(ingressController) == 0 {
+	if len(opts.IngressController) == 0 {
 		logrus.Infof("Reading deployed HelmCharts to determine default ingress-controller...")
 		defaultIngress, err := getDefaultIngressClassFromCharts(ctx, nodeConfig)
 		if err != nil {
 			return errors.WithMessage(err, "failed to determine default ingress-controller from deployed charts")
 		}
-		ingressController = []string{defaultIngress}
+		opts.IngressController = []string{defaultIngress}
 	}
-	logrus.Infof("Using ingress-controller: %v", ingressController)
+	logrus.Infof("Using ingress-controller: %v", opts.IngressController)
 
 	tempChartsDir := refChartsDir + ".tmp"
 	os.RemoveAll(tempChartsDir)
+	defer os.RemoveAll(tempChartsDir)
 
-	// Copy bundled charts into a temp dir for rewriting before they are copied into place
-	if err := copyDir(tempChartsDir, refChartsDir); err != nil {
+	if err := prepareCharts(ctx, resolver, nodeConfig, cfg, opts, tempChartsDir, manifestsDir); err != nil {
+		return err
+	}
+
+	// Back up bundled manifests that have been edited since they were last written, and keep them if configured to do so
+	state, edits, err := protectEditedManifests(tempChartsDir, manifestsDir, opts.ConflictPolicy)
+	if err != nil {
+		return errors.WithMessage(err, "failed to check for edited bundled manifests")
+	}
+	if len(edits) > 0 {
+		go recordManifestEdits(ctx, nodeConfig, edits)
+	}
+
+	// Copy modified charts into the manifests directory, since the K3s
+	// deploy controller will delete ones that are disabled
+	if err := copyDir(manifestsDir, tempChartsDir); err != nil {
+		return errors.WithMessage(err, "failed to copy runtime charts")
+	}
+
+	// Fix up user HelmCharts to pass through configured values
+	if err := setChartValues(manifestsDir, resolver, opts.IngressController[0], nodeConfig, cfg, opts.Prime, opts.GlobalValues); err != nil {
+		logrus.Errorf("Failed to rewrite user HelmChart manifests to pass through CLI values: %v", err)
+	}
+
+	if err := state.write(manifestsDir); err != nil {
+		logrus.Errorf("Failed to record bundled manifest hashes: %v", err)
+	}
+
+	return nil
+}
+
+// RenderManifests writes the bundled charts into dir as they would be copied into the manifests directory, without
+// modifying the node. The charts must already have been extracted from the runtime image, and the charts source, if set,
+// must be a directory. If no ingress controller is set, the default ingress controller for new clusters is used.
+func RenderManifests(ctx context.Context, resolver *images.Resolver, nodeConfig *daemonconfig.Node, cfg cmds.Agent, opts ManifestOptions, dir string) error {
+	ref, err := resolver.GetReference(images.Runtime)
+	if err != nil {
+		return err
+	}
+	refDigest, err := releaseRefDigest(ref)
+	if err != nil {
+		return err
+	}
+	if refChartsDir := chartsDirForDigest(cfg.DataDir, refDigest); !isDir(refChartsDir) {
+		return fmt.Errorf("charts from runtime image %s have not been extracted to %s", ref.Name(), refChartsDir)
+	}
+	if opts.ChartsSource != "" && !isDir(opts.ChartsSource) {
+		return fmt.Errorf("charts source %s must be a directory when rendering manifests", opts.ChartsSource)
+	}
+	if len(opts.IngressController) == 0 {
+		opts.IngressController = []string{cli.IngressItems[0]}
+	}
+
+	os.RemoveAll(dir)
+	return prepareCharts(ctx, resolver, nodeConfig, cfg, opts, dir, manifestsDir(cfg.DataDir))
+}
+
+// prepareCharts copies the bundled charts into chartsDir, replacing them with charts from the charts source if set,
+// and rewrites them to pass through cluster configuration values. Charts that fail validation are removed from chartsDir.
+func prepareCharts(ctx context.Context, resolver *images.Resolver, nodeConfig *daemonconfig.Node, cfg cmds.Agent, opts ManifestOptions, chartsDir, manifestsDir string) error {
+	ref, err := resolver.GetReference(images.Runtime)
+	if err != nil {
+		return err
+	}
+
+	refDigest, err := releaseRefDigest(ref)
+	if err != nil {
+		return err
+	}
+
+	// Copy bundled charts into chartsDir for rewriting before they are copied into place
+	if err := copyDir(chartsDir, chartsDirForDigest(cfg.DataDir, refDigest)); err != nil {
 		return errors.WithMessage(err, "failed to copy temporary charts")
 	}
-	defer os.RemoveAll(tempChartsDir)
+
+	// Record the source of each chart, and replace bundled charts with those from the charts source, if set
+	sources := map[string]string{}
+	manifests, err := listManifests(chartsDir)
+	if err != nil {
+		return err
+	}
+	for _, m := range manifests {
+		sources[m] = ref.Name()
+	}
+	if opts.ChartsSource != "" {
+		verifier := NewImageVerifier(ctx, resolver, nodeConfig, cfg)
+		sourceDir, source, err := resolveChartsSource(ctx, opts.ChartsSource, nodeConfig, cfg, verifier)
+		if err != nil {
+			return errors.WithMessage(err, "failed to load charts source")
+		}
+		manifests, err := listManifests(sourceDir)
+		if err != nil {
+			return errors.WithMessagef(err, "failed to list charts in %s", sourceDir)
+		}
+		archives, err := listChartArchives(sourceDir)
+		if err != nil {
+			return errors.WithMessagef(err, "failed to list chart archives in %s", sourceDir)
+		}
+		logrus.Infof("Using %d charts from %s in place of charts from runtime image %s", len(manifests)+len(archives), source, ref.Name())
+		for _, m := range manifests {
+			if err := copyDir(filepath.Join(chartsDir, m), filepath.Join(sourceDir, m)); err != nil {
+				return errors.WithMessagef(err, "failed to copy chart %s", m)
+			}
+			sources[m] = source
+		}
+		// Chart archives replace the chart content of bundled HelmCharts, after any manifests have been copied
+		for _, a := range archives {
+			m, err := setChartContent(chartsDir, filepath.Join(sourceDir, a))
+			if err != nil {
+				return errors.WithMessagef(err, "failed to load chart archive %s", a)
+			}
+			sources[m] = source
+		}
+	} else {
+		logrus.Infof("Using charts from runtime image %s", ref.Name())
+	}
 
 	// Create empty base and crd AddOn for unselected ingress controllers
 	// We can't disable it this late in startup, so we have to manually truncate them instead
-	controllers := sets.New[string](ingressController...)
+	controllers := sets.New[string](opts.IngressController...)
 	for _, name := range cli.IngressItems {
 		if !controllers.Has(name) {
 			for _, f := range []string{"rke2-" + name + ".yaml", "rke2-" + name + "-crd.yaml"} {
-				if f, err := os.OpenFile(filepath.Join(tempChartsDir, f), os.O_WRONLY|os.O_TRUNC, 0600); err == nil {
+				if f, err := os.OpenFile(filepath.Join(chartsDir, f), os.O_WRONLY|os.O_TRUNC, 0600); err == nil {
 					f.Write([]byte("# disabled by configuration\n"))
 					f.Close()
 				}
@@ -323,25 +478,240 @@ func updateManifests(ctx context.Context, resolver *images.Resolver, ingressCont
 		}
 	}
 
-	// Fix up bundled charts in temp dir
-	if err := setChartValues(tempChartsDir, ingressController[0], nodeConfig, cfg, prime); err != nil {
+	// Fix up bundled charts in chartsDir
+	if err := setChartSources(chartsDir, sources); err != nil {
+		return errors.WithMessage(err, "failed to record HelmChart manifest sources")
+	}
+	if err := setChartValues(chartsDir, resolver, opts.IngressController[0], nodeConfig, cfg, opts.Prime, opts.GlobalValues); err != nil {
 		return errors.WithMessage(err, "failed to rewrite bundled HelmChart manifests to pass through CLI values")
 	}
 
-	// Copy modified charts into the manifests directory, since the K3s
-	// deploy controller will delete ones that are disabled
-	if err := copyDir(manifestsDir, tempChartsDir); err != nil {
-		return errors.WithMessage(err, "failed to copy runtime charts")
+	// Validate bundled charts before they are copied into place, so that invalid charts do not replace the previous copies
+	if err := validateCharts(chartsDir, manifestsDir); err != nil {
+		return errors.WithMessage(err, "failed to validate bundled HelmChart manifests")
 	}
 
-	// Fix up user HelmCharts to pass through configured values
-	if err := setChartValues(manifestsDir, ingressController[0], nodeConfig, cfg, prime); err != nil {
-		logrus.Errorf("Failed to rewrite user HelmChart manifests to pass through CLI values: %v", err)
+	return nil
+}
+
+// privateRegistry returns the private registry configuration, with credentials
+// configured to match those used by the kubelet.
+func privateRegistry(nodeConfig *daemonconfig.Node, cfg cmds.Agent) (images.ImageGetter, error) {
+	// Override registry config with version provided by (and potentially modified by) k3s agent setup
+	return newPrivateRegistry(nodeConfig, cfg, nodeConfig.AgentConfig.Registry)
+}
+
+// newPrivateRegistry returns the private registry configuration using the given registry mirrors and configs,
+// with credentials configured to match those used by the kubelet.
+func newPrivateRegistry(nodeConfig *daemonconfig.Node, cfg cmds.Agent, registryConfig *registries.Registry) (images.ImageGetter, error) {
+	registry, err := registries.GetPrivateRegistries(cfg.PrivateRegistry)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to load private registry configuration from %s", cfg.PrivateRegistry)
+	}
+	registry.Registry = registryConfig
+	registry.DefaultKeychain, err = privateKeychain(nodeConfig)
+	if err != nil {
+		return nil, err
+	}
+	return registry, nil
+}
+
+// privateKeychain returns the keychain used for registries that do not have credentials configured,
+// matching the one used by the kubelet.
+func privateKeychain(nodeConfig *daemonconfig.Node) (authn.Keychain, error) {
+	// Try to enable Kubelet image credential provider plugins; fall back to legacy docker credentials
+	if agent.ImageCredProvAvailable(&nodeConfig.AgentConfig) {
+		return plugin.RegisterCredentialProviderPlugins(nodeConfig.AgentConfig.ImageCredProvConfig, nodeConfig.AgentConfig.ImageCredProvBinDir)
+	}
+	return authn.DefaultKeychain, nil
+}
+
+// ImageVerifier verifies image signatures according to the resolver's signature policy. Signatures are
+// loaded from the airgap image tarballs if available, and otherwise from the registry, using the mirrors
+// and credentials from the node's private registry configuration.
+type ImageVerifier struct {
+	ctx        context.Context
+	policy     *images.SignaturePolicy
+	imagesDir  string
+	nodeConfig *daemonconfig.Node
+	registry   *images.RemoteRegistry
+}
+
+// NewImageVerifier returns an ImageVerifier for the resolver's signature policy.
+func NewImageVerifier(ctx context.Context, resolver *images.Resolver, nodeConfig *daemonconfig.Node, cfg cmds.Agent) *ImageVerifier {
+	return &ImageVerifier{
+		ctx:        ctx,
+		policy:     resolver.SignaturePolicy(),
+		imagesDir:  imagesDir(cfg.DataDir),
+		nodeConfig: nodeConfig,
+	}
+}
+
+// VerifyImage verifies the signature of an image that has already been retrieved. The signature may be
+// for the platform-specific image manifest, the digest that the reference is pinned to, any of the given
+// index digests, or the index that a tag refers to in the registry.
+func (v *ImageVerifier) VerifyImage(i string, ref name.Reference, img v1.Image, indexDigests ...v1.Hash) error {
+	if v.policy.Mode(i) == images.SignatureOff {
+		return nil
+	}
+	registry, err := v.getRegistry()
+	if err != nil {
+		return err
+	}
+	return v.policy.VerifyImage(v.ctx, i, ref, img, v.imagesDir, registry, indexDigests...)
+}
+
+// VerifyReference verifies the signature of an image reference, and returns the reference pinned to the
+// digest that was verified. If verification is off for the image, the reference is returned unchanged.
+func (v *ImageVerifier) VerifyReference(i string, ref name.Reference) (name.Reference, error) {
+	if v.policy.Mode(i) == images.SignatureOff {
+		return ref, nil
+	}
+	registry, err := v.getRegistry()
+	if err != nil {
+		return ref, err
+	}
+	return v.policy.VerifyReference(v.ctx, i, ref, v.imagesDir, registry)
+}
+
+// getRegistry returns the remote registry for the node's private registry configuration, loading it on first use.
+func (v *ImageVerifier) getRegistry() (*images.RemoteRegistry, error) {
+	if v.registry == nil {
+		keychain, err := privateKeychain(v.nodeConfig)
+		if err != nil {
+			return nil, err
+		}
+		v.registry = images.NewRemoteRegistryFromConfig(v.nodeConfig.AgentConfig.Registry, keychain)
+	}
+	return v.registry, nil
+}
+
+// SelectRegistries configures the resolver to use the first of the default registries that is available for each of
+// the component images. Images that are already present in the airgap image archives use the registry that they were
+// found under, without checking the registries. The remaining images are probed at each registry in turn, in parallel,
+// so that each image uses a registry that holds it; if an image is not available, the preferred registry is left in use.
+// This is a no-op if only a single default registry is configured.
+func SelectRegistries(ctx context.Context, resolver *images.Resolver, nodeConfig *daemonconfig.Node, cfg cmds.Agent) error {
+	index, err := images.IndexArchives(imagesDir(cfg.DataDir))
+	if err != nil {
+		return err
+	}
+
+	var pending []string
+	candidates := map[string][]name.Reference{}
+	for _, i := range images.All {
+		// The runtime image is handled separately when staging bootstrap content
+		if i == images.Runtime {
+			continue
+		}
+		refs, err := resolver.GetReferences(i)
+		if err != nil {
+			return err
+		}
+		if len(refs) < 2 {
+			continue
+		}
+		unlocked, err := resolver.GetUnlockedReferences(i)
+		if err != nil {
+			return err
+		}
+		preloaded := false
+		for idx, ref := range refs {
+			archive, ok, err := index.FindImage(ref, unlocked[idx])
+			if err != nil {
+				return err
+			}
+			if ok {
+				if err := resolver.SelectRegistry(i, ref); err != nil {
+					return err
+				}
+				logrus.Infof("Using image %s from airgap image archive %s", ref.Name(), filepath.Base(archive))
+				preloaded = true
+				break
+			}
+		}
+		if !preloaded {
+			pending = append(pending, i)
+			candidates[i] = refs
+		}
+	}
+	if len(pending) == 0 {
+		return nil
 	}
 
+	selected, err := selectAvailable(ctx, pending, candidates, func() (images.ImageGetter, error) {
+		return privateRegistry(nodeConfig, cfg)
+	})
+	if err != nil {
+		return err
+	}
+	for _, i := range pending {
+		ref, ok := selected[i]
+		if !ok {
+			logrus.Warnf("Image %s is not available from any default registry; using %s", i, candidates[i][0].Name())
+			continue
+		}
+		if err := resolver.SelectRegistry(i, ref); err != nil {
+			return err
+		}
+		logrus.Infof("Using image %s", ref.Name())
+	}
 	return nil
 }
 
+// selectAvailable returns the first candidate reference that is available for each of the pending images.
+// The registries are checked in order of preference: each image that has not yet been found is probed
+// in parallel at the next registry, so that a registry is only used for the images that it holds.
+// Images that are not available from any registry are not included in the result.
+func selectAvailable(ctx context.Context, pending []string, candidates map[string][]name.Reference, newRegistry func() (images.ImageGetter, error)) (map[string]name.Reference, error) {
+	selected := map[string]name.Reference{}
+	for idx := 0; len(selected) < len(pending); idx++ {
+		var probes []string
+		for _, i := range pending {
+			if _, ok := selected[i]; !ok && idx < len(candidates[i]) {
+				probes = append(probes, i)
+			}
+		}
+		if len(probes) == 0 {
+			break
+		}
+		available := make([]bool, len(probes))
+		wg := sync.WaitGroup{}
+		for n, i := range probes {
+			// The private registry caches transports without locking, so each probe uses its own instance.
+			registry, err := newRegistry()
+			if err != nil {
+				return nil, err
+			}
+			probe := candidates[i][idx]
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := probeImage(ctx, registry, probe); err != nil {
+					logrus.Warnf("Image %s could not be retrieved from registry %s: %v", probe.Name(), probe.Context().RegistryStr(), err)
+					return
+				}
+				available[n] = true
+			}()
+		}
+		wg.Wait()
+		for n, i := range probes {
+			if available[n] {
+				selected[i] = candidates[i][idx]
+			}
+		}
+	}
+	return selected, nil
+}
+
+// probeImage checks that an image manifest can be retrieved, without pulling any layers.
+func probeImage(ctx context.Context, registry images.ImageGetter, ref name.Reference) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	_, err := registry.Image(ref, remote.WithPlatform(images.Platform()), remote.WithContext(ctx))
+	return err
+}
+
 // releaseRefDigest returns a unique name for an image reference.
 // If the image refers to a tag that appears to be a version string, it returns the tag + the first 12 bytes of the SHA256 hash of the reference string.
 // If the image refers to a digest, it returns the digest, without the alg prefix ("sha256:", etc).
@@ -361,40 +731,6 @@ func releaseRefDigest(ref name.Reference) (string, error) {
 	return "", fmt.Errorf("Runtime image %s is not a not a reference to a digest or version tag matching pattern %s", ref.Name(), releasePattern)
 }
 
-// preloadBootstrapFromRuntime tries to load the runtime image from tarballs, using both the
-// default registry, and the user-configured registry (on the off chance they've retagged the
-// images in the tarball to match their private registry).
-func preloadBootstrapFromRuntime(imagesDir string, resolver *images.Resolver) (v1.Image, error) {
-	var refs []name.Reference
-	runtimeRef, err := resolver.GetReference(images.Runtime)
-	if err != nil {
-		return nil, err
-	}
-
-	if runtimeRef.Context().Registry.Name() == images.DefaultRegistry {
-		// If the image is from the default registry, only check for that.
-		refs = []name.Reference{runtimeRef}
-	} else {
-		// If the image is from a different registry, check the default first, then the configured registry.
-		defaultRef, err := resolver.GetReference(images.Runtime, images.WithRegistry(images.DefaultRegistry))
-		if err != nil {
-			return nil, err
-		}
-		refs = []name.Reference{defaultRef, runtimeRef}
-	}
-
-	for _, ref := range refs {
-		img, err := tarfile.FindImage(imagesDir, ref)
-		if img != nil {
-			return img, err
-		}
-		if err != nil {
-			logrus.Warnf("Failed to load runtime image %s from tarball: %v", ref.Name(), err)
-		}
-	}
-	return nil, nil
-}
-
 // copyDir recursively copies files from source to destination.
 func copyDir(target, source string) error {
 	return copy.Copy(source, target, copy.Options{NumOfWorkers: 0})
@@ -402,8 +738,11 @@ func copyDir(target, source string) error {
 
 // setChartValues scans the directory at manifestDir. It attempts to load all manifests
 // in that directory as HelmCharts. Any manifests that contain a HelmChart are modified to
-// pass through settings to both the Helm job and the chart values.
-func setChartValues(manifestsDir, ingressController string, nodeConfig *daemonconfig.Node, cfg cmds.Agent, prime bool) error {
+// pass through settings to both the Helm job and the chart values. Image rewrite rules are applied
+// to the system default registry, as charts combine it with the image repository themselves.
+// User-defined global values are set alongside the cluster configuration values, but cannot replace them.
+func setChartValues(manifestsDir string, resolver *images.Resolver, ingressController string, nodeConfig *daemonconfig.Node, cfg cmds.Agent, prime bool, globalValues map[string]any) error {
+	systemDefaultRegistry := resolver.RewriteRegistry(nodeConfig.AgentConfig.SystemDefaultRegistry)
 	chartValues := map[string]string{
 		"global.clusterCIDR":                  util.JoinIPNets(nodeConfig.AgentConfig.ClusterCIDRs),
 		"global.clusterCIDRv4":                util.JoinIP4Nets(nodeConfig.AgentConfig.ClusterCIDRs),
@@ -414,9 +753,20 @@ func setChartValues(manifestsDir, ingressController string, nodeConfig *daemonco
 		"global.serviceCIDR":                  util.JoinIPNets(nodeConfig.AgentConfig.ServiceCIDRs),
 		"global.systemDefaultIngressClass":    ingressController,
 		"global.prime.enabled":                strconv.FormatBool(prime),
-		"global.systemDefaultRegistry":        nodeConfig.AgentConfig.SystemDefaultRegistry,
-		"global.cattle.systemDefaultRegistry": nodeConfig.AgentConfig.SystemDefaultRegistry,
+		"global.systemDefaultRegistry":        systemDefaultRegistry,
+		"global.cattle.systemDefaultRegistry": systemDefaultRegistry,
+	}
+	clusterValues := map[string]any{}
+	for k, v := range chartValues {
+		path := strings.Split(k, ".")
+		if hasValuePath(globalValues, path[1:]) {
+			logrus.Warnf("Ignoring chart global value %s: this value is set from cluster configuration", k)
+		}
+		setValuePath(clusterValues, path, typedChartValue(v))
 	}
+	values := mergeValues(map[string]any{"global": globalValues}, clusterValues)
+	setValues := map[string]any{}
+	flattenSetValues("", values, setValues)
 
 	files := map[string]os.FileInfo{}
 	if err := filepath.Walk(manifestsDir, func(path string, info os.FileInfo, err error) error {
@@ -439,7 +789,7 @@ func setChartValues(manifestsDir, ingressController string, nodeConfig *daemonco
 
 	var errs []error
 	for fileName, info := range files {
-		if err := rewriteChart(fileName, info, chartValues); err != nil {
+		if err := rewriteChart(fileName, info, values, setValues); err != nil {
 			errs = append(errs, err)
 		}
 	}
@@ -447,7 +797,8 @@ func setChartValues(manifestsDir, ingressController string, nodeConfig *daemonco
 }
 
 // rewriteChart applies cluster configuration values to the file at fileName with associated info.
-func rewriteChart(fileName string, info os.FileInfo, chartValues map[string]string) error {
+// Values are provided both as nested chart values, and flattened into spec.set values.
+func rewriteChart(fileName string, info os.FileInfo, values, setValues map[string]any) error {
 	fh, err := os.OpenFile(fileName, os.O_RDWR, info.Mode())
 	if err != nil {
 		return errors.WithMessagef(err, "failed to open manifest %s", fileName)
@@ -463,7 +814,6 @@ func rewriteChart(fileName string, info os.FileInfo, chartValues map[string]stri
 
 	var changed bool
 
-OBJECTS:
 	for _, obj := range objs {
 		// Manipulate the HelmChart using Unstructured to avoid dropping unknown fields when rewriting the content.
 		// Ref: https://github.com/rancher/rke2/issues/527
@@ -482,22 +832,15 @@ OBJECTS:
 		var contentChanged bool
 		content := unst.UnstructuredContent()
 
-		// Generally we should avoid using Set on HelmCharts since it cannot be overridden by HelmChartConfig,
-		// but in this case we need to do it in order to avoid potentially mangling the ValuesContent YAML by
-		// blindly appending content to it in order to set values.
-		for k, v := range chartValues {
-			cv, _, err := unstructured.NestedString(content, "spec", "set", k)
-			if err != nil {
-				logrus.Warnf("Failed to get current value from %s/%s in %s: %v", unst.GetNamespace(), unst.GetName(), fileName, err)
-				continue OBJECTS
-			}
-			if cv != v {
-				if err := unstructured.SetNestedField(content, v, "spec", "set", k); err != nil {
-					logrus.Warnf("Failed to write chart value to %s/%s in %s: %v", unst.GetNamespace(), unst.GetName(), fileName, err)
-					continue OBJECTS
-				}
-				contentChanged = true
-			}
+		switch getInjectMode(unst) {
+		case injectModeValues:
+			contentChanged, err = injectValuesContent(content, values)
+		default:
+			contentChanged, err = injectSet(content, setValues)
+		}
+		if err != nil {
+			logrus.Warnf("Failed to write cluster configuration values to %s/%s in %s: %v", unst.GetNamespace(), unst.GetName(), fileName, err)
+			continue
 		}
 
 		if contentChanged {
@@ -536,6 +879,68 @@ OBJECTS:
 	return nil
 }
 
+// injectSet sets cluster configuration values in the spec.set field of HelmChart content.
+func injectSet(content map[string]any, setValues map[string]any) (bool, error) {
+	var changed bool
+	// Generally we should avoid using Set on HelmCharts since it cannot be overridden by HelmChartConfig,
+	// but in this case we need to do it in order to avoid potentially mangling the ValuesContent YAML by
+	// blindly appending content to it in order to set values.
+	for k, v := range setValues {
+		cv, _, err := unstructured.NestedFieldNoCopy(content, "spec", "set", k)
+		if err != nil {
+			return false, errors.WithMessagef(err, "failed to get current value of %s", k)
+		}
+		if !reflect.DeepEqual(cv, v) {
+			if err := unstructured.SetNestedField(content, v, "spec", "set", k); err != nil {
+				return false, errors.WithMessagef(err, "failed to set value of %s", k)
+			}
+			changed = true
+		}
+	}
+	return changed, nil
+}
+
+// injectValuesContent deep-merges cluster configuration values into the spec.valuesContent field of HelmChart content.
+// The valuesContent YAML is only rewritten if the values change, and comments and key order are preserved. Any cluster configuration
+// values previously injected into spec.set are removed, so that they do not take precedence over HelmChartConfig values.
+func injectValuesContent(content map[string]any, clusterValues map[string]any) (bool, error) {
+	valuesContent, _, err := unstructured.NestedString(content, "spec", "valuesContent")
+	if err != nil {
+		return false, errors.WithMessage(err, "failed to get current valuesContent")
+	}
+	values := map[string]any{}
+	if err := k8syaml.Unmarshal([]byte(valuesContent), &values); err != nil {
+		return false, errors.WithMessage(err, "failed to decode valuesContent")
+	}
+
+	var changed bool
+	if merged := mergeValues(values, clusterValues); !reflect.DeepEqual(values, merged) {
+		valuesContent, err := mergeValuesContent(valuesContent, clusterValues)
+		if err != nil {
+			return false, errors.WithMessage(err, "failed to update valuesContent")
+		}
+		if err := unstructured.SetNestedField(content, valuesContent, "spec", "valuesContent"); err != nil {
+			return false, errors.WithMessage(err, "failed to set valuesContent")
+		}
+		changed = true
+	}
+
+	if set, ok, _ := unstructured.NestedMap(content, "spec", "set"); ok {
+		setValues := map[string]any{}
+		flattenSetValues("", clusterValues, setValues)
+		for k := range setValues {
+			if _, ok := set[k]; ok {
+				unstructured.RemoveNestedField(content, "spec", "set", k)
+				changed = true
+			}
+		}
+		if set, _, _ := unstructured.NestedMap(content, "spec", "set"); len(set) == 0 {
+			unstructured.RemoveNestedField(content, "spec", "set")
+		}
+	}
+	return changed, nil
+}
+
 func isInjectEnabled(obj *unstructured.Unstructured) bool {
 	if v, ok := obj.GetAnnotations()[injectAnnotationKey]; ok {
 		if b, err := strconv.ParseBool(v); err == nil {
@@ -552,6 +957,21 @@ func getInjectDefault() bool {
 	return injectDefault
 }
 
+// getInjectMode returns the mode used to inject cluster configuration values into a HelmChart,
+// from the mode annotation or the default setting.
+func getInjectMode(obj *unstructured.Unstructured) string {
+	for _, v := range []string{obj.GetAnnotations()[injectModeAnnotationKey], os.Getenv(injectModeEnvKey)} {
+		switch v {
+		case injectModeSet, injectModeValues:
+			return v
+		case "":
+		default:
+			logrus.Warnf("Ignoring unsupported cluster configuration injection mode %q for %s/%s: must be one of %s, %s", v, obj.GetNamespace(), obj.GetName(), injectModeSet, injectModeValues)
+		}
+	}
+	return injectModeSet
+}
+
 // getDefaultIngressClassFromCharts gets the current default ingress class from installed chart values.
 // If there are no charts present in the cluster, it returns the default.
 func getDefaultIngressClassFromCharts(ctx context.Context, nodeConfig *daemonconfig.Node) (string, error) {
@@ -565,6 +985,12 @@ func getDefaultIngressClassFromCharts(ctx context.Context, nodeConfig *daemoncon
 			if v, ok := h.Spec.Set["global.systemDefaultIngressClass"]; ok && v.Type == intstr.String {
 				return v.StrVal, nil
 			}
+			values := map[string]any{}
+			if err := k8syaml.Unmarshal([]byte(h.Spec.ValuesContent), &values); err == nil {
+				if v, _, _ := unstructured.NestedString(values, "global", "systemDefaultIngressClass"); v != "" {
+					return v, nil
+				}
+			}
 		}
 	}
 	return cli.IngressItems[0], nil
@@ -0,0 +1,393 @@
+package bootstrap
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/k3s-io/k3s/pkg/cli/cmds"
+	daemonconfig "github.com/k3s-io/k3s/pkg/daemons/config"
+	"github.com/rancher/rke2/pkg/images"
+	"github.com/rancher/wrangler/v3/pkg/yaml"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func Test_UnitInjectSet(t *testing.T) {
+	content := map[string]any{
+		"spec": map[string]any{
+			"set": map[string]any{"global.clusterCIDR": "10.42.0.0/16", "replicas": int64(2)},
+		},
+	}
+	setValues := map[string]any{"global.clusterCIDR": "10.42.0.0/16", "global.clusterDNS": "10.43.0.10"}
+
+	changed, err := injectSet(content, setValues)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed {
+		t.Error("expected content to be changed")
+	}
+	want := map[string]any{"global.clusterCIDR": "10.42.0.0/16", "global.clusterDNS": "10.43.0.10", "replicas": int64(2)}
+	if set := content["spec"].(map[string]any)["set"]; !reflect.DeepEqual(set, want) {
+		t.Errorf("expected spec.set %#v, got %#v", want, set)
+	}
+
+	if changed, err := injectSet(content, setValues); err != nil || changed {
+		t.Errorf("expected content to be unchanged on second injection, got changed %t: %v", changed, err)
+	}
+}
+
+func Test_UnitInjectValuesContent(t *testing.T) {
+	clusterValues := map[string]any{"global": map[string]any{"clusterCIDR": "10.42.0.0/16", "systemDefaultRegistry": ""}}
+	const injected = "# chart values\nreplicas: 2\nglobal:\n  clusterCIDR: 10.42.0.0/16\n  systemDefaultRegistry: \"\"\n"
+
+	tests := []struct {
+		name          string
+		spec          map[string]any
+		wantChanged   bool
+		wantValues    string
+		wantSet       map[string]any
+		wantSetExists bool
+	}{
+		{
+			name:        "merged",
+			spec:        map[string]any{"valuesContent": "# chart values\nreplicas: 2\n"},
+			wantChanged: true,
+			wantValues:  injected,
+		},
+		{
+			name:       "unchanged",
+			spec:       map[string]any{"valuesContent": injected},
+			wantValues: injected,
+		},
+		{
+			name: "unchanged with different formatting",
+			spec: map[string]any{"valuesContent": "{global: {systemDefaultRegistry: '', clusterCIDR: 10.42.0.0/16}}"},
+			// Semantically equal values must not be re-encoded
+			wantValues: "{global: {systemDefaultRegistry: '', clusterCIDR: 10.42.0.0/16}}",
+		},
+		{
+			name: "injected set values removed",
+			spec: map[string]any{
+				"valuesContent": injected,
+				"set":           map[string]any{"global.clusterCIDR": "10.42.0.0/16", "global.systemDefaultRegistry": "", "replicas": int64(3)},
+			},
+			wantChanged:   true,
+			wantValues:    injected,
+			wantSet:       map[string]any{"replicas": int64(3)},
+			wantSetExists: true,
+		},
+		{
+			name: "empty set removed",
+			spec: map[string]any{
+				"valuesContent": injected,
+				"set":           map[string]any{"global.clusterCIDR": "10.42.0.0/16"},
+			},
+			wantChanged: true,
+			wantValues:  injected,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := map[string]any{"spec": tt.spec}
+			changed, err := injectValuesContent(content, clusterValues)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if changed != tt.wantChanged {
+				t.Errorf("expected changed %t, got %t", tt.wantChanged, changed)
+			}
+			if got := tt.spec["valuesContent"]; got != tt.wantValues {
+				t.Errorf("expected valuesContent:\n%s\ngot:\n%s", tt.wantValues, got)
+			}
+			set, ok := tt.spec["set"]
+			if ok != tt.wantSetExists || (ok && !reflect.DeepEqual(set, tt.wantSet)) {
+				t.Errorf("expected spec.set %#v, got %#v", tt.wantSet, set)
+			}
+		})
+	}
+}
+
+func Test_UnitGetInjectMode(t *testing.T) {
+	tests := []struct {
+		name       string
+		annotation string
+		env        string
+		want       string
+	}{
+		{
+			name: "default",
+			want: injectModeSet,
+		},
+		{
+			name: "env",
+			env:  injectModeValues,
+			want: injectModeValues,
+		},
+		{
+			name:       "annotation",
+			annotation: injectModeValues,
+			want:       injectModeValues,
+		},
+		{
+			name:       "annotation takes precedence over env",
+			annotation: injectModeSet,
+			env:        injectModeValues,
+			want:       injectModeSet,
+		},
+		{
+			name:       "invalid annotation falls back to env",
+			annotation: "invalid",
+			env:        injectModeValues,
+			want:       injectModeValues,
+		},
+		{
+			name: "invalid env",
+			env:  "invalid",
+			want: injectModeSet,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(injectModeEnvKey, tt.env)
+			obj := &unstructured.Unstructured{}
+			if tt.annotation != "" {
+				obj.SetAnnotations(map[string]string{injectModeAnnotationKey: tt.annotation})
+			}
+			if got := getInjectMode(obj); got != tt.want {
+				t.Errorf("expected mode %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func Test_UnitIsInjectEnabled(t *testing.T) {
+	tests := []struct {
+		name       string
+		annotation string
+		env        string
+		want       bool
+	}{
+		{
+			name: "default",
+			want: injectDefault,
+		},
+		{
+			name: "env",
+			env:  "true",
+			want: true,
+		},
+		{
+			name:       "annotation takes precedence over env",
+			annotation: "false",
+			env:        "true",
+			want:       false,
+		},
+		{
+			name:       "annotation",
+			annotation: "true",
+			env:        "false",
+			want:       true,
+		},
+		{
+			name:       "invalid annotation falls back to env",
+			annotation: "invalid",
+			env:        "true",
+			want:       true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(injectEnvKey, tt.env)
+			obj := &unstructured.Unstructured{}
+			if tt.annotation != "" {
+				obj.SetAnnotations(map[string]string{injectAnnotationKey: tt.annotation})
+			}
+			if got := isInjectEnabled(obj); got != tt.want {
+				t.Errorf("expected enabled %t, got %t", tt.want, got)
+			}
+		})
+	}
+}
+
+// fakeRegistries holds the names of the images that are available, and records the images that were probed.
+type fakeRegistries struct {
+	mu        sync.Mutex
+	available map[string]bool
+	probed    []string
+}
+
+func (r *fakeRegistries) Image(ref name.Reference, _ ...remote.Option) (v1.Image, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.probed = append(r.probed, ref.Name())
+	if !r.available[ref.Name()] {
+		return nil, fmt.Errorf("%s not found", ref.Name())
+	}
+	return random.Image(64, 1)
+}
+
+func Test_UnitSelectAvailable(t *testing.T) {
+	registries := []string{"primary.example.com", "secondary.example.com", "tertiary.example.com"}
+	repos := map[string]string{
+		images.KubeAPIServer: "rancher/hardened-kubernetes:v1",
+		images.ETCD:          "rancher/hardened-etcd:v1",
+		images.Pause:         "rancher/mirrored-pause:3.6",
+	}
+	pending := []string{images.KubeAPIServer, images.ETCD, images.Pause}
+	candidates := map[string][]name.Reference{}
+	for _, i := range pending {
+		for _, registry := range registries {
+			ref, err := name.ParseReference(registry + "/" + repos[i])
+			if err != nil {
+				t.Fatal(err)
+			}
+			candidates[i] = append(candidates[i], ref)
+		}
+	}
+	ref := func(registry int, i string) string {
+		return candidates[i][registry].Name()
+	}
+
+	tests := []struct {
+		name       string
+		available  []string
+		want       map[string]string
+		wantProbes int
+	}{
+		{
+			name:       "all images in the primary registry",
+			available:  []string{ref(0, images.KubeAPIServer), ref(0, images.ETCD), ref(0, images.Pause), ref(1, images.KubeAPIServer)},
+			want:       map[string]string{images.KubeAPIServer: ref(0, images.KubeAPIServer), images.ETCD: ref(0, images.ETCD), images.Pause: ref(0, images.Pause)},
+			wantProbes: 3,
+		},
+		{
+			name:       "registries hold different images",
+			available:  []string{ref(0, images.Pause), ref(1, images.ETCD), ref(1, images.Pause), ref(2, images.KubeAPIServer), ref(2, images.ETCD)},
+			want:       map[string]string{images.KubeAPIServer: ref(2, images.KubeAPIServer), images.ETCD: ref(1, images.ETCD), images.Pause: ref(0, images.Pause)},
+			wantProbes: 6,
+		},
+		{
+			name:       "image not in any registry",
+			available:  []string{ref(1, images.ETCD), ref(1, images.Pause)},
+			want:       map[string]string{images.ETCD: ref(1, images.ETCD), images.Pause: ref(1, images.Pause)},
+			wantProbes: 7,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := &fakeRegistries{available: map[string]bool{}}
+			for _, available := range tt.available {
+				registry.available[available] = true
+			}
+			selected, err := selectAvailable(context.Background(), pending, candidates, func() (images.ImageGetter, error) {
+				return registry, nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := map[string]string{}
+			for i, ref := range selected {
+				got[i] = ref.Name()
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected selected images %v, got %v", tt.want, got)
+			}
+			if len(registry.probed) != tt.wantProbes {
+				t.Errorf("expected %d probes, got %v", tt.wantProbes, registry.probed)
+			}
+		})
+	}
+}
+
+func Test_UnitSetChartValuesRewriteRegistry(t *testing.T) {
+	chart := `apiVersion: helm.cattle.io/v1
+kind: HelmChart
+metadata:
+  name: rke2-coredns
+  namespace: kube-system
+  annotations:
+    ` + injectAnnotationKey + `: "true"
+spec:
+  chart: rke2-coredns
+`
+	tests := []struct {
+		name     string
+		registry string
+		rules    []string
+		want     string
+	}{
+		{
+			name:     "registry rewritten",
+			registry: "harbor.example.com",
+			rules: []string{
+				`^harbor\.example\.com/rancher/(.*)$=harbor.example.com/platform/k8s/$1`,
+				`^harbor\.example\.com$=harbor.example.com/platform/charts`,
+			},
+			want: "harbor.example.com/platform/charts",
+		},
+		{
+			name:     "no matching rule",
+			registry: "registry.example.com",
+			rules:    []string{`^harbor\.example\.com$=harbor.example.com/platform/charts`},
+			want:     "registry.example.com",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolver, err := images.NewResolver(images.ImageOverrideConfig{
+				IgnoreLockFile:        true,
+				SystemDefaultRegistry: tt.registry,
+				RewriteRules:          tt.rules,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			dir := t.TempDir()
+			file := filepath.Join(dir, "rke2-coredns.yaml")
+			if err := os.WriteFile(file, []byte(chart), 0600); err != nil {
+				t.Fatal(err)
+			}
+			nodeConfig := &daemonconfig.Node{}
+			nodeConfig.AgentConfig.SystemDefaultRegistry = tt.registry
+			if err := setChartValues(dir, resolver, "ingress-nginx", nodeConfig, cmds.Agent{DataDir: "/var/lib/rancher/rke2"}, false, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			b, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			objs, err := yaml.ToObjects(bytes.NewReader(b))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(objs) != 1 {
+				t.Fatalf("expected 1 object, got %d", len(objs))
+			}
+			set, _, err := unstructured.NestedMap(objs[0].(*unstructured.Unstructured).Object, "spec", "set")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, k := range []string{"global.systemDefaultRegistry", "global.cattle.systemDefaultRegistry"} {
+				if set[k] != tt.want {
+					t.Errorf("expected %s to be %s, got %v", k, tt.want, set[k])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,206 @@
+package bootstrap
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/k3s-io/k3s/pkg/util/errors"
+	"go.yaml.in/yaml/v3"
+	k8syaml "sigs.k8s.io/yaml"
+)
+
+// ParseChartGlobalValues returns user-defined chart global values, relative to global, from a list of key=value
+// flag values. Keys are relative to global, and may include the global prefix. Values that start with [ or { are
+// decoded as YAML, so that lists and maps can also be set. In the configuration file, values are set as a list of
+// key=value entries, so that they can be appended to by drop-in files in the same way as other list flags.
+func ParseChartGlobalValues(values []string) (map[string]any, error) {
+	globalValues := map[string]any{}
+	for _, value := range values {
+		k, v, ok := strings.Cut(value, "=")
+		k = strings.TrimPrefix(strings.TrimSpace(k), "global.")
+		if !ok || !isValidChartValueKey(k) {
+			return nil, fmt.Errorf("invalid chart global value %q: must be in the form key=value, or a list of key=value entries in the config file", value)
+		}
+		var typed any = v
+		if strings.HasPrefix(v, "[") || strings.HasPrefix(v, "{") {
+			if err := k8syaml.Unmarshal([]byte(v), &typed); err != nil {
+				return nil, errors.WithMessagef(err, "invalid chart global value %q", value)
+			}
+		}
+		setValuePath(globalValues, strings.Split(k, "."), typed)
+	}
+	return globalValues, nil
+}
+
+// isValidChartValueKey returns true if a key is a dotted path of map keys.
+func isValidChartValueKey(key string) bool {
+	if key == "" || strings.ContainsAny(key, " \t[]{}") {
+		return false
+	}
+	for _, k := range strings.Split(key, ".") {
+		if k == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// setValuePath sets a value at a path within nested chart values, replacing any non-map values along the path.
+func setValuePath(values map[string]any, path []string, value any) {
+	for _, k := range path[:len(path)-1] {
+		next, ok := values[k].(map[string]any)
+		if !ok {
+			next = map[string]any{}
+			values[k] = next
+		}
+		values = next
+	}
+	values[path[len(path)-1]] = value
+}
+
+// hasValuePath returns true if a value is set at a path within nested chart values.
+func hasValuePath(values map[string]any, path []string) bool {
+	for _, k := range path[:len(path)-1] {
+		next, ok := values[k].(map[string]any)
+		if !ok {
+			return false
+		}
+		values = next
+	}
+	_, ok := values[path[len(path)-1]]
+	return ok
+}
+
+// typedChartValue returns a cluster configuration value with the type it would have if passed to Helm through spec.set.
+// The helm-controller passes boolean strings to Helm as booleans, and all other strings as strings.
+func typedChartValue(v string) any {
+	switch v {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	return v
+}
+
+// flattenSetValues flattens nested chart values into spec.set values, keyed by Helm --set paths. Lists and maps are
+// flattened into their elements, so empty lists and maps are not set. The helm-controller passes integers, and boolean
+// and null strings, to Helm as typed values, and all other strings as strings, so integers are set as integers and
+// other scalar values as strings.
+func flattenSetValues(prefix string, value any, set map[string]any) {
+	switch v := value.(type) {
+	case map[string]any:
+		for k, e := range v {
+			k = strings.ReplaceAll(k, ".", `\.`)
+			if prefix != "" {
+				k = prefix + "." + k
+			}
+			flattenSetValues(k, e, set)
+		}
+	case []any:
+		for i, e := range v {
+			flattenSetValues(fmt.Sprintf("%s[%d]", prefix, i), e, set)
+		}
+	case string:
+		set[prefix] = v
+	case bool:
+		set[prefix] = strconv.FormatBool(v)
+	case nil:
+		set[prefix] = "null"
+	case int64:
+		set[prefix] = v
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < math.MaxInt64 {
+			set[prefix] = int64(v)
+		} else {
+			set[prefix] = strconv.FormatFloat(v, 'f', -1, 64)
+		}
+	default:
+		set[prefix] = fmt.Sprint(v)
+	}
+}
+
+// mergeValuesContent deep-merges values into valuesContent YAML, in the same way as mergeValues. The YAML is edited
+// rather than decoded and re-encoded, so that comments and the order of existing keys are preserved.
+func mergeValuesContent(valuesContent string, values map[string]any) (string, error) {
+	doc := &yaml.Node{}
+	if err := yaml.Unmarshal([]byte(valuesContent), doc); err != nil {
+		return "", err
+	}
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 {
+		doc = &yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{}}}
+	}
+	if root := doc.Content[0]; root.Kind != yaml.MappingNode {
+		*root = yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", HeadComment: root.HeadComment}
+	}
+	if err := mergeValuesNode(doc.Content[0], values); err != nil {
+		return "", err
+	}
+
+	buf := &bytes.Buffer{}
+	encoder := yaml.NewEncoder(buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(doc); err != nil {
+		return "", err
+	}
+	if err := encoder.Close(); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// mergeValuesNode deep-merges values into a YAML mapping node. Existing keys keep their position and comments,
+// and new keys are added at the end of the mapping in sorted order.
+func mergeValuesNode(node *yaml.Node, values map[string]any) error {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		v := values[k]
+		i := -1
+		for j := 0; j+1 < len(node.Content); j += 2 {
+			if node.Content[j].Value == k {
+				i = j
+			}
+		}
+		if v == nil {
+			if i >= 0 {
+				node.Content = append(node.Content[:i], node.Content[i+2:]...)
+			}
+			continue
+		}
+		if m, ok := v.(map[string]any); ok && i >= 0 && node.Content[i+1].Kind == yaml.MappingNode {
+			if err := mergeValuesNode(node.Content[i+1], m); err != nil {
+				return err
+			}
+			continue
+		}
+
+		valueNode := &yaml.Node{}
+		if err := valueNode.Encode(v); err != nil {
+			return errors.WithMessagef(err, "failed to encode value of %s", k)
+		}
+		if i >= 0 {
+			old := node.Content[i+1]
+			valueNode.HeadComment, valueNode.FootComment = old.HeadComment, old.FootComment
+			if valueNode.Kind == yaml.ScalarNode {
+				valueNode.LineComment = old.LineComment
+			}
+			node.Content[i+1] = valueNode
+			continue
+		}
+		keyNode := &yaml.Node{}
+		if err := keyNode.Encode(k); err != nil {
+			return errors.WithMessagef(err, "failed to encode key %s", k)
+		}
+		node.Content = append(node.Content, keyNode, valueNode)
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package bootstrap
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_UnitParseChartGlobalValues(t *testing.T) {
+	tests := []struct {
+		name    string
+		values  []string
+		want    map[string]any
+		wantErr bool
+	}{
+		{
+			name:   "flag values",
+			values: []string{"proxy.httpProxy=http://proxy:3128", "global.proxy.noProxy=10.0.0.0/8,.svc", "debug=true"},
+			want: map[string]any{
+				"proxy": map[string]any{"httpProxy": "http://proxy:3128", "noProxy": "10.0.0.0/8,.svc"},
+				"debug": "true",
+			},
+		},
+		{
+			name:   "flag values with lists and maps",
+			values: []string{"imagePullSecrets=[{name: regcred}]", "labels={team: platform}"},
+			want: map[string]any{
+				"imagePullSecrets": []any{map[string]any{"name": "regcred"}},
+				"labels":           map[string]any{"team": "platform"},
+			},
+		},
+		{
+			name: "config file list",
+			// The config file parser passes each list entry through as a flag value, including entries
+			// appended by drop-in files
+			values: []string{"imagePullSecrets=[{name: regcred}]", "proxy.httpProxy=http://proxy:3128", "proxy.noProxy=.svc"},
+			want: map[string]any{
+				"imagePullSecrets": []any{map[string]any{"name": "regcred"}},
+				"proxy":            map[string]any{"httpProxy": "http://proxy:3128", "noProxy": ".svc"},
+			},
+		},
+		{
+			name: "config file map",
+			// The config file parser passes a map through to the flag in its string form, which cannot be decoded
+			values:  []string{"[{imagePullSecrets [[{name regcred}]]} {proxy [{httpProxy http://proxy:3128}]}]", "proxy.noProxy=.svc"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid flag value with valid values",
+			values:  []string{"proxy.noProxy=.svc", "proxy.httpProxy"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid flag value",
+			values:  []string{"proxy.httpProxy"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid flag key",
+			values:  []string{"proxy..httpProxy=http://proxy:3128"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid flag YAML",
+			values:  []string{"imagePullSecrets=[{name: regcred"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseChartGlobalValues(tt.values)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseChartGlobalValues() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseChartGlobalValues() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_UnitFlattenSetValues(t *testing.T) {
+	values := map[string]any{
+		"global": map[string]any{
+			"clusterDomain":    "cluster.local",
+			"prime":            map[string]any{"enabled": false},
+			"imagePullSecrets": []any{map[string]any{"name": "regcred"}, map[string]any{"name": "other"}},
+			"replicas":         float64(3),
+			"ratio":            0.5,
+			"unset":            nil,
+			"annotations":      map[string]any{"example.com/team": "platform"},
+			"empty":            []any{},
+		},
+	}
+	want := map[string]any{
+		"global.clusterDomain":                 "cluster.local",
+		"global.prime.enabled":                 "false",
+		"global.imagePullSecrets[0].name":      "regcred",
+		"global.imagePullSecrets[1].name":      "other",
+		"global.replicas":                      int64(3),
+		"global.ratio":                         "0.5",
+		"global.unset":                         "null",
+		`global.annotations.example\.com/team`: "platform",
+	}
+
+	got := map[string]any{}
+	flattenSetValues("", values, got)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("flattenSetValues() = %#v, want %#v", got, want)
+	}
+}
+
+func Test_UnitTypedChartValue(t *testing.T) {
+	tests := map[string]any{
+		"true":  true,
+		"false": false,
+		"True":  "True",
+		"1":     "1",
+		"":      "",
+		"null":  "null",
+	}
+	for v, want := range tests {
+		if got := typedChartValue(v); got != want {
+			t.Errorf("typedChartValue(%q): expected %#v, got %#v", v, want, got)
+		}
+	}
+}
+
+func Test_UnitMergeValuesContent(t *testing.T) {
+	tests := []struct {
+		name          string
+		valuesContent string
+		values        map[string]any
+		want          string
+	}{
+		{
+			name:          "empty",
+			valuesContent: "",
+			values:        map[string]any{"global": map[string]any{"clusterCIDR": "10.42.0.0/16"}},
+			want:          "global:\n  clusterCIDR: 10.42.0.0/16\n",
+		},
+		{
+			name: "comments and order preserved",
+			valuesContent: `# chart values
+replicas: 2 # keep two
+global:
+  # registry for images
+  systemDefaultRegistry: ""
+  debug: true
+image:
+  tag: v1
+`,
+			values: map[string]any{"global": map[string]any{"systemDefaultRegistry": "registry.example.com", "clusterDNS": "10.43.0.10"}},
+			want: `# chart values
+replicas: 2 # keep two
+global:
+  # registry for images
+  systemDefaultRegistry: registry.example.com
+  debug: true
+  clusterDNS: 10.43.0.10
+image:
+  tag: v1
+`,
+		},
+		{
+			name:          "non-map value replaced",
+			valuesContent: "global: null\nreplicas: 1\n",
+			values:        map[string]any{"global": map[string]any{"rke2DataDir": "/var/lib/rancher/rke2"}},
+			want:          "global:\n  rke2DataDir: /var/lib/rancher/rke2\nreplicas: 1\n",
+		},
+		{
+			name:          "null value removed",
+			valuesContent: "global:\n  remove: me\n  keep: me\n",
+			values:        map[string]any{"global": map[string]any{"remove": nil}},
+			want:          "global:\n  keep: me\n",
+		},
+		{
+			name:          "list value replaced",
+			valuesContent: "global:\n  imagePullSecrets:\n    - name: old\n",
+			values:        map[string]any{"global": map[string]any{"imagePullSecrets": []any{map[string]any{"name": "regcred"}}}},
+			want:          "global:\n  imagePullSecrets:\n    - name: regcred\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := mergeValuesContent(tt.valuesContent, tt.values)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("expected valuesContent:\n%s\ngot:\n%s", tt.want, got)
+			}
+		})
+	}
+}
@@ -1,16 +1,31 @@
 package bootstrap
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
 
 	helmv1 "github.com/k3s-io/helm-controller/pkg/apis/helm.cattle.io/v1"
 	helm "github.com/k3s-io/helm-controller/pkg/generated/clientset/versioned/typed/helm.cattle.io/v1"
 	"github.com/k3s-io/k3s/pkg/daemons/executor"
 	"github.com/k3s-io/k3s/pkg/util"
 	"github.com/k3s-io/k3s/pkg/util/errors"
+	"github.com/rancher/wrangler/v3/pkg/yaml"
+	"github.com/sirupsen/logrus"
 	authorizationv1 "k8s.io/api/authorization/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/client-go/tools/clientcmd"
+	k8syaml "sigs.k8s.io/yaml"
 )
 
 // ListHelmCharts waits for the apiserver and RBAC to be ready, then returns a list of all charts in the kube-system namespace.
@@ -42,3 +57,149 @@ func ListHelmCharts(ctx context.Context, kubeConfig string) (*helmv1.HelmChartLi
 
 	return hc.HelmCharts(metav1.NamespaceSystem).List(ctx, metav1.ListOptions{})
 }
+
+// ChartImage is an image referenced by the values of a bundled HelmChart.
+type ChartImage struct {
+	Chart string
+	Image string
+}
+
+// ChartImages returns the images referenced by the HelmCharts in chartsDir. Images are found by
+// searching the values.yaml files in each chart archive, as well as the chart's valuesContent,
+// for maps that contain both a repository and tag key. This is the convention used by all bundled charts.
+func ChartImages(chartsDir string) ([]ChartImage, error) {
+	files, err := os.ReadDir(chartsDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var chartImages []ChartImage
+	for _, file := range files {
+		if file.IsDir() || !(strings.HasSuffix(file.Name(), ".yaml") || strings.HasSuffix(file.Name(), ".yml")) {
+			continue
+		}
+		fileName := filepath.Join(chartsDir, file.Name())
+		b, err := os.ReadFile(fileName)
+		if err != nil {
+			return nil, err
+		}
+
+		// Ignore manifest if it cannot be decoded; disabled charts are truncated to a comment.
+		objs, err := yaml.ToObjects(bytes.NewReader(b))
+		if err != nil {
+			logrus.Warnf("Failed to decode manifest %s: %s", fileName, err)
+			continue
+		}
+
+		for _, obj := range objs {
+			unst, ok := obj.(*unstructured.Unstructured)
+			if !ok || unst.GroupVersionKind() != helmChartGVK {
+				continue
+			}
+
+			refs := sets.New[string]()
+			chartContent, _, _ := unstructured.NestedString(unst.Object, "spec", "chartContent")
+			if chartContent != "" {
+				values, err := chartArchiveValues(chartContent)
+				if err != nil {
+					return nil, errors.WithMessagef(err, "failed to read chart archive for %s in %s", unst.GetName(), fileName)
+				}
+				for _, v := range values {
+					findImages(v, refs)
+				}
+			}
+			valuesContent, _, _ := unstructured.NestedString(unst.Object, "spec", "valuesContent")
+			if valuesContent != "" {
+				values := map[string]any{}
+				if err := k8syaml.Unmarshal([]byte(valuesContent), &values); err != nil {
+					return nil, errors.WithMessagef(err, "failed to decode valuesContent for %s in %s", unst.GetName(), fileName)
+				}
+				findImages(values, refs)
+			}
+
+			for _, ref := range sets.List(refs) {
+				chartImages = append(chartImages, ChartImage{Chart: unst.GetName(), Image: ref})
+			}
+		}
+	}
+	return chartImages, nil
+}
+
+// chartArchiveValues returns the decoded content of all values.yaml files found
+// within a base64-encoded chart archive, including those of any subcharts.
+func chartArchiveValues(chartContent string) ([]map[string]any, error) {
+	var values []map[string]any
+	err := walkChartArchive(chartContent, func(name string, r io.Reader) error {
+		if path.Base(name) != "values.yaml" {
+			return nil
+		}
+		v, err := decodeChartValues(name, r)
+		if err != nil {
+			return err
+		}
+		values = append(values, v)
+		return nil
+	})
+	return values, err
+}
+
+// walkChartArchive calls f with the name and content of each regular file within a base64-encoded chart archive.
+func walkChartArchive(chartContent string, f func(name string, r io.Reader) error) error {
+	b, err := base64.StdEncoding.DecodeString(chartContent)
+	if err != nil {
+		return err
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	t := tar.NewReader(gz)
+	for {
+		h, err := t.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if h.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := f(h.Name, t); err != nil {
+			return err
+		}
+	}
+}
+
+// decodeChartValues decodes the content of a chart values file.
+func decodeChartValues(name string, r io.Reader) (map[string]any, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	v := map[string]any{}
+	if err := k8syaml.Unmarshal(b, &v); err != nil {
+		return nil, errors.WithMessagef(err, "failed to decode %s", name)
+	}
+	return v, nil
+}
+
+// findImages recursively walks chart values, adding any repository:tag pairs to refs.
+func findImages(values any, refs sets.Set[string]) {
+	switch v := values.(type) {
+	case map[string]any:
+		repository, rok := v["repository"].(string)
+		tag, tok := v["tag"]
+		if rok && tok && repository != "" && tag != nil && fmt.Sprint(tag) != "" {
+			refs.Insert(repository + ":" + fmt.Sprint(tag))
+		}
+		for _, child := range v {
+			findImages(child, refs)
+		}
+	case []any:
+		for _, child := range v {
+			findImages(child, refs)
+		}
+	}
+}
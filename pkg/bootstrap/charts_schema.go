@@ -0,0 +1,378 @@
+package bootstrap
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/k3s-io/k3s/pkg/util/errors"
+	"github.com/sirupsen/logrus"
+	"k8s.io/kube-openapi/pkg/validation/spec"
+	"k8s.io/kube-openapi/pkg/validation/strfmt"
+	"k8s.io/kube-openapi/pkg/validation/validate"
+	k8syaml "sigs.k8s.io/yaml"
+)
+
+// maxSetIndex is the largest list index that may be set by spec.set, matching the limit enforced by Helm.
+const maxSetIndex = 65536
+
+// chartSchema is the values schema and default values of a chart, and of each of its subcharts.
+type chartSchema struct {
+	name         string
+	defaults     map[string]any
+	schema       []byte
+	dependencies []chartDependency
+	subcharts    map[string]*chartSchema
+}
+
+// chartDependency is a dependency listed in the Chart.yaml file of a chart.
+type chartDependency struct {
+	Name      string `json:"name"`
+	Alias     string `json:"alias,omitempty"`
+	Condition string `json:"condition,omitempty"`
+}
+
+// loadChartSchema returns the values schemas and default values of the chart in a base64-encoded chart archive,
+// and its subcharts. Subcharts may be directories or chart archives within the charts directory of the chart.
+func loadChartSchema(chartContent string) (*chartSchema, error) {
+	b, err := base64.StdEncoding.DecodeString(chartContent)
+	if err != nil {
+		return nil, err
+	}
+	files, err := readChartArchive(b)
+	if err != nil {
+		return nil, err
+	}
+	return newChartSchema(files)
+}
+
+// readChartArchive returns the content of the files within a chart archive that describe chart values,
+// keyed by their path relative to the chart directory.
+func readChartArchive(archive []byte) (map[string][]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	files := map[string][]byte{}
+	t := tar.NewReader(gz)
+	for {
+		h, err := t.Next()
+		if err == io.EOF {
+			return files, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if h.Typeflag != tar.TypeReg {
+			continue
+		}
+		// Paths within the archive start with the chart directory
+		_, name, ok := strings.Cut(path.Clean(h.Name), "/")
+		if !ok {
+			continue
+		}
+		switch path.Base(name) {
+		case "Chart.yaml", "values.yaml", "values.schema.json":
+		default:
+			if path.Base(path.Dir(name)) != "charts" || path.Ext(name) != ".tgz" {
+				continue
+			}
+		}
+		b, err := io.ReadAll(t)
+		if err != nil {
+			return nil, err
+		}
+		files[name] = b
+	}
+}
+
+// newChartSchema returns the values schema and default values of a chart and its subcharts, from the files read from a chart archive.
+func newChartSchema(files map[string][]byte) (*chartSchema, error) {
+	c := &chartSchema{defaults: map[string]any{}, schema: files["values.schema.json"], subcharts: map[string]*chartSchema{}}
+	if b, ok := files["values.yaml"]; ok {
+		if err := k8syaml.Unmarshal(b, &c.defaults); err != nil {
+			return nil, errors.WithMessage(err, "failed to decode values.yaml")
+		}
+	}
+	if b, ok := files["Chart.yaml"]; ok {
+		metadata := struct {
+			Name         string            `json:"name"`
+			Dependencies []chartDependency `json:"dependencies"`
+		}{}
+		if err := k8syaml.Unmarshal(b, &metadata); err != nil {
+			return nil, errors.WithMessage(err, "failed to decode Chart.yaml")
+		}
+		c.name = metadata.Name
+		c.dependencies = metadata.Dependencies
+	}
+
+	subchartFiles := map[string]map[string][]byte{}
+	for name, b := range files {
+		sub, ok := strings.CutPrefix(name, "charts/")
+		if !ok {
+			continue
+		}
+		if dir, name, ok := strings.Cut(sub, "/"); ok {
+			if subchartFiles[dir] == nil {
+				subchartFiles[dir] = map[string][]byte{}
+			}
+			subchartFiles[dir][name] = b
+		} else if path.Ext(sub) == ".tgz" {
+			f, err := readChartArchive(b)
+			if err != nil {
+				return nil, errors.WithMessagef(err, "failed to read subchart archive %s", sub)
+			}
+			subchartFiles[sub] = f
+		}
+	}
+	for dir, f := range subchartFiles {
+		sub, err := newChartSchema(f)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "failed to read subchart %s", dir)
+		}
+		if sub.name == "" {
+			sub.name = dir
+		}
+		c.subcharts[sub.name] = sub
+	}
+	return c, nil
+}
+
+// validate returns the problems found when validating values against the chart's values schema, and the values of each
+// enabled subchart against the subchart's values schema. Values must already be merged with the chart's default values.
+// As when Helm coalesces values, the values of a subchart are those under its name or alias merged over its default values,
+// with global values passed down from the parent chart.
+func (c *chartSchema) validate(values map[string]any) []string {
+	var problems []string
+	if c.schema != nil {
+		schema := &spec.Schema{}
+		if err := json.Unmarshal(c.schema, schema); err != nil {
+			logrus.Debugf("Skipping values schema validation for chart %s: failed to decode values.schema.json: %v", c.name, err)
+		} else {
+			result := validate.NewSchemaValidator(schema, nil, "", strfmt.Default).Validate(values)
+			for _, err := range result.Errors {
+				problems = append(problems, err.Error())
+			}
+		}
+	}
+
+	// Subcharts are included once for each dependency that refers to them, and once if no dependency refers to them
+	dependencies := c.dependencies
+	names := make([]string, 0, len(c.subcharts))
+	for name := range c.subcharts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !containsDependency(dependencies, name) {
+			dependencies = append(dependencies, chartDependency{Name: name})
+		}
+	}
+
+	for _, dep := range dependencies {
+		sub, ok := c.subcharts[dep.Name]
+		if !ok || !isConditionEnabled(values, dep.Condition) {
+			continue
+		}
+		key := dep.Name
+		if dep.Alias != "" {
+			key = dep.Alias
+		}
+		parentValues, _ := values[key].(map[string]any)
+		subValues := mergeValues(sub.defaults, parentValues)
+		if global, ok := values["global"].(map[string]any); ok {
+			subGlobal, _ := subValues["global"].(map[string]any)
+			subValues["global"] = mergeValues(subGlobal, global)
+		}
+		for _, problem := range sub.validate(subValues) {
+			problems = append(problems, fmt.Sprintf("subchart %s: %s", key, problem))
+		}
+	}
+	return problems
+}
+
+// containsDependency returns true if a dependency refers to the named chart.
+func containsDependency(dependencies []chartDependency, name string) bool {
+	for _, dep := range dependencies {
+		if dep.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// isConditionEnabled returns the value of the first path in a comma-separated dependency condition that is set to a
+// boolean in the values, or true if none are.
+func isConditionEnabled(values map[string]any, condition string) bool {
+	for _, p := range strings.Split(condition, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		var v any = values
+		for _, k := range strings.Split(p, ".") {
+			m, ok := v.(map[string]any)
+			if !ok {
+				v = nil
+				break
+			}
+			v = m[k]
+		}
+		if b, ok := v.(bool); ok {
+			return b
+		}
+	}
+	return true
+}
+
+// applySetValues sets the values from spec.set in values, in the same way that the helm-controller passes them to Helm:
+// integers, and boolean and null strings, are set as typed values, and all other strings are set as strings.
+// Keys are Helm --set paths, which may contain escaped dots and list indexes.
+func applySetValues(values map[string]any, set map[string]any) error {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		var value any
+		switch v := set[k].(type) {
+		case int64:
+			value = v
+		case string:
+			switch strings.ToLower(v) {
+			case "true":
+				value = true
+			case "false":
+				value = false
+			case "null":
+				value = nil
+			default:
+				value = v
+			}
+		default:
+			return fmt.Errorf("%s: must be a string or integer, not %T", k, v)
+		}
+		p, err := parseSetPath(k)
+		if err != nil {
+			return errors.WithMessage(err, k)
+		}
+		setPath(values, p, value)
+	}
+	return nil
+}
+
+// parseSetPath parses a Helm --set path into map keys and list indexes.
+func parseSetPath(key string) ([]any, error) {
+	var p []any
+	var name strings.Builder
+	var afterIndex bool
+	for i := 0; i < len(key); i++ {
+		switch c := key[i]; c {
+		case '\\':
+			if i+1 < len(key) {
+				i++
+			}
+			name.WriteByte(key[i])
+		case '.':
+			if name.Len() == 0 && !afterIndex {
+				return nil, fmt.Errorf("empty key in path")
+			}
+			if name.Len() > 0 {
+				p = append(p, name.String())
+				name.Reset()
+			}
+			afterIndex = false
+			continue
+		case '[':
+			if name.Len() > 0 {
+				p = append(p, name.String())
+				name.Reset()
+			}
+			if len(p) == 0 {
+				return nil, fmt.Errorf("list index without key in path")
+			}
+			end := strings.IndexByte(key[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated list index in path")
+			}
+			n, err := strconv.Atoi(key[i+1 : i+end])
+			if err != nil || n < 0 || n > maxSetIndex {
+				return nil, fmt.Errorf("invalid list index %q in path", key[i+1:i+end])
+			}
+			p = append(p, n)
+			i += end
+			afterIndex = true
+			continue
+		default:
+			if afterIndex {
+				return nil, fmt.Errorf("list index must be followed by . or [ in path")
+			}
+			name.WriteByte(c)
+		}
+	}
+	if name.Len() > 0 {
+		p = append(p, name.String())
+	} else if !afterIndex {
+		return nil, fmt.Errorf("empty key in path")
+	}
+	return p, nil
+}
+
+// setPath sets a value at a path of map keys and list indexes within values, replacing any values of the wrong type
+// along the path, and returns the updated values. Setting a map key to null removes it.
+func setPath(values any, p []any, value any) any {
+	if len(p) == 0 {
+		return value
+	}
+	switch k := p[0].(type) {
+	case string:
+		m, ok := values.(map[string]any)
+		if !ok {
+			m = map[string]any{}
+		}
+		if len(p) == 1 && value == nil {
+			delete(m, k)
+		} else {
+			m[k] = setPath(m[k], p[1:], value)
+		}
+		return m
+	case int:
+		l, _ := values.([]any)
+		for len(l) <= k {
+			l = append(l, nil)
+		}
+		l[k] = setPath(l[k], p[1:], value)
+		return l
+	}
+	return values
+}
+
+// copyValues returns a deep copy of chart values.
+func copyValues(values any) any {
+	switch v := values.(type) {
+	case map[string]any:
+		m := make(map[string]any, len(v))
+		for k, e := range v {
+			m[k] = copyValues(e)
+		}
+		return m
+	case []any:
+		l := make([]any, len(v))
+		for i, e := range v {
+			l[i] = copyValues(e)
+		}
+		return l
+	}
+	return values
+}
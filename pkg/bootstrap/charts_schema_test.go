@@ -0,0 +1,171 @@
+package bootstrap
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// testChartArchive returns a chart archive containing the given files.
+func testChartArchive(t *testing.T, files map[string][]byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(files[name])), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(files[name]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+const testReplicasSchema = `{"type": "object", "properties": {"replicas": {"type": "integer", "minimum": 1}}}`
+
+func Test_UnitChartSchemaValidate(t *testing.T) {
+	// A subchart packaged as an archive, included twice under different aliases, one of which is disabled by default
+	archived := testChartArchive(t, map[string][]byte{
+		"backend/Chart.yaml":         []byte("name: backend\nversion: 1.0.0\n"),
+		"backend/values.yaml":        []byte("replicas: 1\n"),
+		"backend/values.schema.json": []byte(testReplicasSchema),
+	})
+	chartContent := base64.StdEncoding.EncodeToString(testChartArchive(t, map[string][]byte{
+		"app/Chart.yaml": []byte(`name: app
+version: 1.0.0
+dependencies:
+- name: backend
+  alias: primary
+- name: backend
+  alias: secondary
+  condition: secondary.enabled
+`),
+		"app/values.yaml":                         []byte("replicas: 1\nsecondary:\n  enabled: false\n"),
+		"app/values.schema.json":                  []byte(testReplicasSchema),
+		"app/charts/backend-1.0.0.tgz":            archived,
+		"app/charts/frontend/Chart.yaml":          []byte("name: frontend\nversion: 1.0.0\n"),
+		"app/charts/frontend/values.yaml":         []byte("global:\n  registry: docker.io\n"),
+		"app/charts/frontend/values.schema.json":  []byte(`{"type": "object", "properties": {"global": {"type": "object", "properties": {"registry": {"type": "string", "minLength": 1}}}}}`),
+		"app/charts/frontend/templates/test.yaml": []byte("{{ .Values }}"),
+	}))
+
+	tests := []struct {
+		name     string
+		values   map[string]any
+		set      map[string]any
+		problems []string
+	}{
+		{
+			name: "valid",
+		},
+		{
+			name:     "invalid parent value",
+			values:   map[string]any{"replicas": float64(0)},
+			problems: []string{"replicas in body should be greater than or equal to 1"},
+		},
+		{
+			name:     "invalid subchart value",
+			values:   map[string]any{"primary": map[string]any{"replicas": "two"}},
+			problems: []string{"subchart primary: replicas in body must be of type integer"},
+		},
+		{
+			name:   "invalid value of disabled subchart",
+			values: map[string]any{"secondary": map[string]any{"replicas": float64(0)}},
+		},
+		{
+			name:     "invalid value of enabled subchart",
+			values:   map[string]any{"secondary": map[string]any{"enabled": true, "replicas": float64(0)}},
+			problems: []string{"subchart secondary: replicas in body should be greater than or equal to 1"},
+		},
+		{
+			name:     "invalid global value",
+			values:   map[string]any{"global": map[string]any{"registry": ""}},
+			problems: []string{"subchart frontend: global.registry in body should be at least 1 chars long"},
+		},
+		{
+			name:     "invalid set value",
+			set:      map[string]any{"primary.replicas": "0"},
+			problems: []string{"subchart primary: replicas in body must be of type integer"},
+		},
+		{
+			name: "valid set value",
+			set:  map[string]any{"primary.replicas": int64(2)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schema, err := loadChartSchema(chartContent)
+			if err != nil {
+				t.Fatal(err)
+			}
+			values := copyValues(mergeValues(schema.defaults, tt.values)).(map[string]any)
+			if err := applySetValues(values, tt.set); err != nil {
+				t.Fatal(err)
+			}
+			problems := schema.validate(values)
+			if len(problems) != len(tt.problems) {
+				t.Fatalf("expected problems %q, got %q", tt.problems, problems)
+			}
+			for i := range problems {
+				if !strings.Contains(problems[i], tt.problems[i]) {
+					t.Errorf("expected problem %q, got %q", tt.problems[i], problems[i])
+				}
+			}
+		})
+	}
+}
+
+func Test_UnitApplySetValues(t *testing.T) {
+	values := map[string]any{
+		"image":       map[string]any{"tag": "v1"},
+		"tolerations": []any{map[string]any{"key": "a"}},
+		"remove":      "me",
+	}
+	set := map[string]any{
+		"image.tag":                  "v2",
+		"replicas":                   int64(3),
+		"enabled":                    "true",
+		"remove":                     "null",
+		"tolerations[0].effect":      "NoSchedule",
+		"tolerations[1].key":         "b",
+		`annotations.example\.com/a`: "b",
+	}
+	want := map[string]any{
+		"image":       map[string]any{"tag": "v2"},
+		"tolerations": []any{map[string]any{"key": "a", "effect": "NoSchedule"}, map[string]any{"key": "b"}},
+		"replicas":    int64(3),
+		"enabled":     true,
+		"annotations": map[string]any{"example.com/a": "b"},
+	}
+	if err := applySetValues(values, set); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("expected values %#v, got %#v", want, values)
+	}
+
+	for _, key := range []string{"a..b", "[0]", "a[x]", "a[0", "a[0]b", "a."} {
+		if err := applySetValues(map[string]any{}, map[string]any{key: "v"}); err == nil {
+			t.Errorf("expected error for invalid path %q", key)
+		}
+	}
+}
@@ -0,0 +1,337 @@
+package bootstrap
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/k3s-io/k3s/pkg/cli/cmds"
+	daemonconfig "github.com/k3s-io/k3s/pkg/daemons/config"
+	"github.com/k3s-io/k3s/pkg/util/errors"
+	"github.com/k3s-io/k3s/pkg/version"
+	"github.com/rancher/rke2/pkg/images"
+	"github.com/rancher/wharfie/pkg/extract"
+	"github.com/rancher/wharfie/pkg/tarfile"
+	"github.com/rancher/wrangler/v3/pkg/yaml"
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8syaml "sigs.k8s.io/yaml"
+)
+
+// chartsSourceAnnotationKey records where a bundled HelmChart manifest was loaded from.
+var chartsSourceAnnotationKey = version.Program + ".cattle.io/charts-source"
+
+const (
+	// helmChartConfigMediaType is the config media type of Helm chart OCI artifacts.
+	helmChartConfigMediaType = "application/vnd.cncf.helm.config.v1+json"
+	// helmChartContentMediaType is the media type of the chart archive layer of Helm chart OCI artifacts.
+	helmChartContentMediaType = "application/vnd.cncf.helm.chart.content.v1.tar+gzip"
+)
+
+// ManifestOptions configures how bundled charts are copied into the manifests directory.
+type ManifestOptions struct {
+	IngressController []string
+	Prime             bool
+	GlobalValues      map[string]any
+	ChartsSource      string
+	ConflictPolicy    ManifestConflictPolicy
+}
+
+// chartsSourceCacheDir returns the path to the directory that charts are extracted into when the charts source is an image.
+func chartsSourceCacheDir(dataDir string) string {
+	return filepath.Join(dataDir, "data", ".charts")
+}
+
+// resolveChartsSource returns a local directory containing the charts from the charts source, and a description
+// of the source for logging and annotations. The source may be a directory, a reference to an image or OCI artifact
+// with charts in the /charts directory, or a reference to a Helm chart OCI artifact, optionally prefixed with oci://.
+// Images are loaded from the airgap image tarballs if present, or from the registry otherwise, and are extracted into
+// a cache directory keyed by digest; the chart archive from a Helm chart artifact is written to the cache directory.
+// As the charts replace those from the runtime image, image signatures are verified under the runtime image policy.
+func resolveChartsSource(ctx context.Context, source string, nodeConfig *daemonconfig.Node, cfg cmds.Agent, verifier *ImageVerifier) (string, string, error) {
+	if info, err := os.Stat(source); err == nil {
+		if !info.IsDir() {
+			return "", "", fmt.Errorf("charts source %s is not a directory", source)
+		}
+		return source, source, nil
+	}
+
+	ref, err := name.ParseReference(strings.TrimPrefix(source, "oci://"))
+	if err != nil {
+		return "", "", fmt.Errorf("charts source %s is not a directory or OCI artifact reference: %v", source, err)
+	}
+
+	var img v1.Image
+	if _, ok := ref.(name.Tag); ok {
+		img, err = tarfile.FindImage(imagesDir(cfg.DataDir), ref)
+		if err != nil {
+			logrus.Warnf("Failed to load charts image %s from tarball: %v", ref.Name(), err)
+		}
+	}
+	if img == nil {
+		registry, err := privateRegistry(nodeConfig, cfg)
+		if err != nil {
+			return "", "", err
+		}
+		img, err = registry.Image(ref, remote.WithPlatform(images.Platform()), remote.WithContext(ctx))
+		if err != nil {
+			return "", "", errors.WithMessagef(err, "failed to get charts image %s", ref.Name())
+		}
+	}
+	if err := verifier.VerifyImage(images.Runtime, ref, img); err != nil {
+		return "", "", err
+	}
+
+	digest, err := img.Digest()
+	if err != nil {
+		return "", "", err
+	}
+	manifest, err := img.Manifest()
+	if err != nil {
+		return "", "", err
+	}
+	cacheDir := chartsSourceCacheDir(cfg.DataDir)
+	chartsDir := filepath.Join(cacheDir, digest.Hex)
+	completeFile := chartsDir + ".extracted"
+	if !isRegular(completeFile) {
+		os.RemoveAll(chartsDir)
+		if manifest.Config.MediaType == helmChartConfigMediaType {
+			err = extractChartArtifact(img, chartsDir)
+		} else {
+			err = extract.ExtractDirs(img, map[string]string{"/charts": chartsDir})
+		}
+		if err != nil {
+			return "", "", errors.WithMessagef(err, "failed to extract charts image %s", ref.Name())
+		}
+		if err := os.WriteFile(completeFile, []byte(ref.Name()), 0644); err != nil {
+			return "", "", err
+		}
+	}
+
+	// Remove charts extracted from other images
+	if entries, err := os.ReadDir(cacheDir); err == nil {
+		for _, entry := range entries {
+			if n := entry.Name(); n != filepath.Base(chartsDir) && n != filepath.Base(completeFile) {
+				os.RemoveAll(filepath.Join(cacheDir, n))
+			}
+		}
+	}
+
+	return chartsDir, ref.Context().Digest(digest.String()).Name(), nil
+}
+
+// extractChartArtifact writes the chart archive from a Helm chart OCI artifact into dir.
+func extractChartArtifact(img v1.Image, dir string) error {
+	layers, err := img.Layers()
+	if err != nil {
+		return err
+	}
+	for _, layer := range layers {
+		if mediaType, err := layer.MediaType(); err != nil || mediaType != helmChartContentMediaType {
+			continue
+		}
+		rc, err := layer.Compressed()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		f, err := os.Create(filepath.Join(dir, "chart.tgz"))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if _, err := io.Copy(f, rc); err != nil {
+			return err
+		}
+		return f.Close()
+	}
+	return fmt.Errorf("chart artifact does not have a %s layer", helmChartContentMediaType)
+}
+
+// listManifests returns the names of the yaml manifests in a directory.
+func listManifests(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var manifests []string
+	for _, entry := range entries {
+		if !entry.IsDir() && (strings.HasSuffix(entry.Name(), ".yaml") || strings.HasSuffix(entry.Name(), ".yml")) {
+			manifests = append(manifests, entry.Name())
+		}
+	}
+	return manifests, nil
+}
+
+// listChartArchives returns the names of the chart archives in a directory.
+func listChartArchives(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var archives []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".tgz") {
+			archives = append(archives, entry.Name())
+		}
+	}
+	return archives, nil
+}
+
+// chartArchiveName returns the name of the chart in a chart archive, from its Chart.yaml.
+func chartArchiveName(archive []byte) (string, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return "", err
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return "", fmt.Errorf("chart archive does not contain Chart.yaml")
+		}
+		if err != nil {
+			return "", err
+		}
+		// Chart.yaml is in the top-level directory of the archive, which is named after the chart
+		if dir, file := path.Split(path.Clean(h.Name)); file != "Chart.yaml" || strings.Count(dir, "/") != 1 {
+			continue
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			return "", err
+		}
+		chart := struct {
+			Name string `json:"name"`
+		}{}
+		if err := k8syaml.Unmarshal(b, &chart); err != nil {
+			return "", errors.WithMessage(err, "failed to decode Chart.yaml")
+		}
+		if chart.Name == "" || strings.ContainsAny(chart.Name, `/\`) {
+			return "", fmt.Errorf("invalid chart name %q in Chart.yaml", chart.Name)
+		}
+		return chart.Name, nil
+	}
+}
+
+// setChartContent sets the chart content of the HelmChart with the same name as the chart in a chart archive,
+// in the manifest of the same name in chartsDir, so that the chart replaces the bundled chart while keeping the
+// rest of the bundled HelmChart. If there is no such HelmChart, a new HelmChart that installs the chart is added to
+// the manifest. The name of the manifest is returned.
+func setChartContent(chartsDir, archiveFile string) (string, error) {
+	archive, err := os.ReadFile(archiveFile)
+	if err != nil {
+		return "", err
+	}
+	chartName, err := chartArchiveName(archive)
+	if err != nil {
+		return "", err
+	}
+	manifest := chartName + ".yaml"
+	fileName := filepath.Join(chartsDir, manifest)
+
+	var objs []runtime.Object
+	if b, err := os.ReadFile(fileName); err == nil {
+		if objs, err = yaml.ToObjects(bytes.NewReader(b)); err != nil {
+			return "", errors.WithMessagef(err, "failed to decode manifest %s", fileName)
+		}
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	var found bool
+	for _, obj := range objs {
+		unst, ok := obj.(*unstructured.Unstructured)
+		if !ok || unst.GroupVersionKind() != helmChartGVK || unst.GetName() != chartName {
+			continue
+		}
+		content := unst.UnstructuredContent()
+		for _, field := range []string{"chart", "repo", "version", "repoCA", "repoCAConfigMap", "authSecret", "authPassCredentials", "plainHTTP", "insecureSkipTLSVerify"} {
+			unstructured.RemoveNestedField(content, "spec", field)
+		}
+		if err := unstructured.SetNestedField(content, base64.StdEncoding.EncodeToString(archive), "spec", "chartContent"); err != nil {
+			return "", err
+		}
+		unst.SetUnstructuredContent(content)
+		found = true
+	}
+	if !found {
+		unst := &unstructured.Unstructured{}
+		unst.SetGroupVersionKind(helmChartGVK)
+		unst.SetName(chartName)
+		unst.SetNamespace(metav1.NamespaceSystem)
+		if err := unstructured.SetNestedField(unst.Object, base64.StdEncoding.EncodeToString(archive), "spec", "chartContent"); err != nil {
+			return "", err
+		}
+		objs = append(objs, unst)
+	}
+
+	data, err := yaml.Export(objs...)
+	if err != nil {
+		return "", errors.WithMessagef(err, "failed to export manifest %s", fileName)
+	}
+	if err := os.WriteFile(fileName, data, 0600); err != nil {
+		return "", errors.WithMessagef(err, "failed to write manifest %s", fileName)
+	}
+	return manifest, nil
+}
+
+// setChartSources annotates the HelmCharts in each manifest in chartsDir with the source that the manifest was loaded from.
+func setChartSources(chartsDir string, sources map[string]string) error {
+	for file, source := range sources {
+		fileName := filepath.Join(chartsDir, file)
+		b, err := os.ReadFile(fileName)
+		if err != nil {
+			return err
+		}
+		objs, err := yaml.ToObjects(bytes.NewReader(b))
+		if err != nil {
+			logrus.Warnf("Failed to decode manifest %s: %s", fileName, err)
+			continue
+		}
+
+		var changed bool
+		for _, obj := range objs {
+			unst, ok := obj.(*unstructured.Unstructured)
+			if !ok || unst.GroupVersionKind() != helmChartGVK {
+				continue
+			}
+			annotations := unst.GetAnnotations()
+			if annotations == nil {
+				annotations = map[string]string{}
+			}
+			annotations[chartsSourceAnnotationKey] = source
+			unst.SetAnnotations(annotations)
+			changed = true
+		}
+		if !changed {
+			continue
+		}
+
+		data, err := yaml.Export(objs...)
+		if err != nil {
+			return errors.WithMessagef(err, "failed to export modified manifest %s", fileName)
+		}
+		if err := os.WriteFile(fileName, data, 0600); err != nil {
+			return errors.WithMessagef(err, "failed to write modified manifest %s", fileName)
+		}
+	}
+	return nil
+}
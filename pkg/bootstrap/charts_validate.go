@@ -0,0 +1,218 @@
+package bootstrap
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	helmv1 "github.com/k3s-io/helm-controller/pkg/apis/helm.cattle.io/v1"
+	"github.com/rancher/wrangler/v3/pkg/yaml"
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8syaml "sigs.k8s.io/yaml"
+)
+
+// helmChartConfig is a HelmChartConfig found in the manifests directory.
+type helmChartConfig struct {
+	file          string
+	name          string
+	valuesContent string
+}
+
+// validateCharts checks the HelmCharts in each manifest in chartsDir, after cluster configuration values have been applied.
+// The spec of each HelmChart must decode, and if the chart archive includes values schemas for the chart or its subcharts,
+// the chart's values must be valid when merged with the values from any matching HelmChartConfig in manifestsDir, and
+// with the values from spec.set. Manifests that fail validation are removed
+// from chartsDir, so that they do not replace the copies previously written to manifestsDir.
+func validateCharts(chartsDir, manifestsDir string) error {
+	configs, err := readHelmChartConfigs(manifestsDir)
+	if err != nil {
+		return err
+	}
+	manifests, err := listManifests(chartsDir)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range manifests {
+		fileName := filepath.Join(chartsDir, m)
+		b, err := os.ReadFile(fileName)
+		if err != nil {
+			return err
+		}
+
+		// Ignore manifest if it cannot be decoded; disabled charts are truncated to a comment.
+		objs, err := yaml.ToObjects(bytes.NewReader(b))
+		if err != nil {
+			continue
+		}
+
+		var problems []string
+		for _, obj := range objs {
+			unst, ok := obj.(*unstructured.Unstructured)
+			if !ok || unst.GroupVersionKind() != helmChartGVK {
+				continue
+			}
+			problems = append(problems, validateChart(unst, configs)...)
+		}
+		if len(problems) == 0 {
+			continue
+		}
+
+		for _, problem := range problems {
+			logrus.Errorf("Bundled manifest %s failed validation: %s", m, problem)
+		}
+		if isRegular(filepath.Join(manifestsDir, m)) {
+			logrus.Errorf("Keeping the previous copy of bundled manifest %s in %s", m, manifestsDir)
+		} else {
+			logrus.Errorf("Not writing bundled manifest %s to %s", m, manifestsDir)
+		}
+		if err := os.Remove(fileName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readHelmChartConfigs returns the HelmChartConfigs in the manifests in manifestsDir, keyed by namespace and name.
+func readHelmChartConfigs(manifestsDir string) (map[string]helmChartConfig, error) {
+	configs := map[string]helmChartConfig{}
+	manifests, err := listManifests(manifestsDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return configs, nil
+		}
+		return nil, err
+	}
+
+	for _, m := range manifests {
+		b, err := os.ReadFile(filepath.Join(manifestsDir, m))
+		if err != nil {
+			return nil, err
+		}
+		objs, err := yaml.ToObjects(bytes.NewReader(b))
+		if err != nil {
+			continue
+		}
+		for _, obj := range objs {
+			unst, ok := obj.(*unstructured.Unstructured)
+			if !ok || unst.GroupVersionKind() != helmChartConfigGVK {
+				continue
+			}
+			name := namespacedName(unst)
+			valuesContent, _, _ := unstructured.NestedString(unst.Object, "spec", "valuesContent")
+			configs[name] = helmChartConfig{file: m, name: name, valuesContent: valuesContent}
+		}
+	}
+	return configs, nil
+}
+
+// validateChart returns the problems found with a HelmChart, identifying the field or values key at fault.
+func validateChart(unst *unstructured.Unstructured, configs map[string]helmChartConfig) []string {
+	name := namespacedName(unst)
+	prefix := "HelmChart " + name + ": "
+
+	var problems []string
+	var setMap map[string]any
+	set, _, err := unstructured.NestedFieldNoCopy(unst.Object, "spec", "set")
+	if err == nil && set != nil {
+		var ok bool
+		setMap, ok = set.(map[string]any)
+		if !ok {
+			return append(problems, fmt.Sprintf("%sspec.set: must be a map, not %T", prefix, set))
+		}
+		keys := make([]string, 0, len(setMap))
+		for k := range setMap {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			switch setMap[k].(type) {
+			case string, int64:
+			default:
+				problems = append(problems, fmt.Sprintf("%sspec.set.%s: must be a string or integer, not %T", prefix, k, setMap[k]))
+			}
+		}
+	}
+	if vc, ok, _ := unstructured.NestedFieldNoCopy(unst.Object, "spec", "valuesContent"); ok {
+		if _, isString := vc.(string); !isString {
+			problems = append(problems, fmt.Sprintf("%sspec.valuesContent: must be a string, not %T", prefix, vc))
+		}
+	}
+	if len(problems) > 0 {
+		return problems
+	}
+
+	chart := &helmv1.HelmChart{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(unst.Object, chart); err != nil {
+		return append(problems, fmt.Sprintf("%sspec: %v", prefix, err))
+	}
+
+	values := map[string]any{}
+	if err := k8syaml.Unmarshal([]byte(chart.Spec.ValuesContent), &values); err != nil {
+		return append(problems, fmt.Sprintf("%sspec.valuesContent: %v", prefix, err))
+	}
+
+	config, hasConfig := configs[name]
+	configValues := map[string]any{}
+	if hasConfig {
+		prefix = fmt.Sprintf("HelmChartConfig %s in %s: ", config.name, config.file)
+		if err := k8syaml.Unmarshal([]byte(config.valuesContent), &configValues); err != nil {
+			return append(problems, fmt.Sprintf("%sspec.valuesContent: %v", prefix, err))
+		}
+	}
+
+	if chart.Spec.ChartContent == "" {
+		return problems
+	}
+	schema, err := loadChartSchema(chart.Spec.ChartContent)
+	if err != nil {
+		return append(problems, fmt.Sprintf("HelmChart %s: spec.chartContent: %v", name, err))
+	}
+
+	// Values from spec.set are passed to Helm with --set, so they are applied over the values from valuesContent
+	merged := copyValues(mergeValues(mergeValues(schema.defaults, values), configValues)).(map[string]any)
+	if err := applySetValues(merged, setMap); err != nil {
+		return append(problems, fmt.Sprintf("HelmChart %s: spec.set.%v", name, err))
+	}
+	for _, problem := range schema.validate(merged) {
+		problems = append(problems, fmt.Sprintf("%svalues do not match the chart values schema: %s", prefix, problem))
+	}
+	return problems
+}
+
+// mergeValues returns the result of merging values over base, in the same way that Helm merges values.
+// Maps are merged recursively, other values are replaced, and null values remove the key from the result.
+func mergeValues(base, values map[string]any) map[string]any {
+	merged := make(map[string]any, len(base))
+	for k, v := range base {
+		merged[k] = v
+	}
+	for k, v := range values {
+		if v == nil {
+			delete(merged, k)
+			continue
+		}
+		baseMap, baseOk := merged[k].(map[string]any)
+		valuesMap, valuesOk := v.(map[string]any)
+		if baseOk && valuesOk {
+			merged[k] = mergeValues(baseMap, valuesMap)
+		} else {
+			merged[k] = v
+		}
+	}
+	return merged
+}
+
+// namespacedName returns the namespace and name of an object, defaulting to the kube-system namespace.
+func namespacedName(unst *unstructured.Unstructured) string {
+	namespace := unst.GetNamespace()
+	if namespace == "" {
+		namespace = metav1.NamespaceSystem
+	}
+	return namespace + "/" + unst.GetName()
+}
@@ -0,0 +1,120 @@
+package bootstrap
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_UnitValidateCharts(t *testing.T) {
+	chartContent := base64.StdEncoding.EncodeToString(testChartArchive(t, map[string][]byte{
+		"test/Chart.yaml":         []byte("name: test\nversion: 1.0.0\n"),
+		"test/values.yaml":        []byte("replicas: 1\n"),
+		"test/values.schema.json": []byte(testReplicasSchema),
+	}))
+	helmChart := func(valuesContent, set string) string {
+		return fmt.Sprintf(`apiVersion: helm.cattle.io/v1
+kind: HelmChart
+metadata:
+  name: test
+  namespace: kube-system
+spec:
+  chartContent: %s
+  valuesContent: %q
+  set: {%s}
+`, chartContent, valuesContent, set)
+	}
+	const previous = "# previous copy\n"
+
+	tests := []struct {
+		name       string
+		manifest   string
+		config     string
+		previous   bool
+		wantRemove bool
+	}{
+		{
+			name:     "valid",
+			manifest: helmChart("replicas: 2", ""),
+			previous: true,
+		},
+		{
+			name:     "disabled",
+			manifest: "# disabled by configuration\n",
+			previous: true,
+		},
+		{
+			name:       "invalid, previous copy kept",
+			manifest:   helmChart("replicas: 0", ""),
+			previous:   true,
+			wantRemove: true,
+		},
+		{
+			name:       "invalid, not written",
+			manifest:   helmChart("replicas: 0", ""),
+			wantRemove: true,
+		},
+		{
+			name:       "invalid set value",
+			manifest:   helmChart("replicas: 2", `replicas: "two"`),
+			previous:   true,
+			wantRemove: true,
+		},
+		{
+			name:     "invalid value replaced by set value",
+			manifest: helmChart("replicas: 0", "replicas: 2"),
+			previous: true,
+		},
+		{
+			name:     "invalid HelmChartConfig value",
+			manifest: helmChart("replicas: 2", ""),
+			config: `apiVersion: helm.cattle.io/v1
+kind: HelmChartConfig
+metadata:
+  name: test
+  namespace: kube-system
+spec:
+  valuesContent: "replicas: 0"
+`,
+			previous:   true,
+			wantRemove: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chartsDir := t.TempDir()
+			manifestsDir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(chartsDir, "test.yaml"), []byte(tt.manifest), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if tt.config != "" {
+				if err := os.WriteFile(filepath.Join(manifestsDir, "test-config.yaml"), []byte(tt.config), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.previous {
+				if err := os.WriteFile(filepath.Join(manifestsDir, "test.yaml"), []byte(previous), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := validateCharts(chartsDir, manifestsDir); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(filepath.Join(chartsDir, "test.yaml")); os.IsNotExist(err) != tt.wantRemove {
+				t.Errorf("expected manifest to be removed %t, got %v", tt.wantRemove, err)
+			}
+			// Validation must leave any previous copy in the manifests directory in place
+			b, err := os.ReadFile(filepath.Join(manifestsDir, "test.yaml"))
+			if tt.previous && (err != nil || string(b) != previous) {
+				t.Errorf("expected previous copy to be unmodified, got %q: %v", b, err)
+			}
+			if !tt.previous && !os.IsNotExist(err) {
+				t.Errorf("expected no copy in manifests directory, got %q: %v", b, err)
+			}
+		})
+	}
+}
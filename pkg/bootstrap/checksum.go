@@ -0,0 +1,162 @@
+package bootstrap
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/k3s-io/k3s/pkg/util/errors"
+)
+
+// IntegrityAction controls what is done when extracted runtime content does not match the checksums recorded at extract time.
+type IntegrityAction string
+
+const (
+	// IntegrityReextract removes the modified content and extracts it again from the runtime image.
+	IntegrityReextract IntegrityAction = "reextract"
+	// IntegrityFail refuses to start.
+	IntegrityFail IntegrityAction = "fail"
+)
+
+// ParseIntegrityAction validates an integrity action, returning the default if the string is empty.
+func ParseIntegrityAction(s string) (IntegrityAction, error) {
+	switch a := IntegrityAction(s); a {
+	case "":
+		return IntegrityReextract, nil
+	case IntegrityReextract, IntegrityFail:
+		return a, nil
+	}
+	return "", fmt.Errorf("unsupported runtime integrity action %q: must be one of %s, %s", s, IntegrityReextract, IntegrityFail)
+}
+
+// errChecksumsNotRecorded is returned when verifying content that was extracted by a release that did not record checksums.
+var errChecksumsNotRecorded = errors.New("checksums were not recorded when the runtime image was extracted")
+
+// checksumFileForDigest returns the path to the file that records
+// checksums of the content extracted from the runtime image.
+func checksumFileForDigest(dataDir string, refDigest string) string {
+	return filepath.Join(dataDir, "data", refDigest, ".checksums")
+}
+
+// writeChecksums records a checksum for every file in the bin and charts directories extracted from the runtime image.
+// Paths are recorded relative to dataDir/data/refDigest. Symlinks are recorded by their target, instead of a checksum.
+func writeChecksums(dataDir string, refDigest string) error {
+	checksums, err := checksumDirs(dataDir, refDigest)
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(checksums, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(checksumFileForDigest(dataDir, refDigest), b, 0644)
+}
+
+// verifyChecksums compares the bin and charts directories extracted from the runtime image against the recorded checksums.
+// A list of modified, missing, and unexpected files is returned; the list is empty if the content matches.
+// If no checksums were recorded, errChecksumsNotRecorded is returned.
+func verifyChecksums(dataDir string, refDigest string) ([]string, error) {
+	b, err := os.ReadFile(checksumFileForDigest(dataDir, refDigest))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errChecksumsNotRecorded
+	} else if err != nil {
+		return nil, errors.WithMessage(err, "failed to read checksum manifest")
+	}
+	expected := map[string]string{}
+	if err := json.Unmarshal(b, &expected); err != nil {
+		return nil, errors.WithMessage(err, "failed to decode checksum manifest")
+	}
+
+	actual, err := checksumDirs(dataDir, refDigest)
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []string
+	for path, sum := range expected {
+		switch a, ok := actual[path]; {
+		case !ok:
+			problems = append(problems, "missing: "+path)
+		case a != sum:
+			problems = append(problems, "modified: "+path)
+		}
+	}
+	for path := range actual {
+		if _, ok := expected[path]; !ok {
+			problems = append(problems, "unexpected: "+path)
+		}
+	}
+	sort.Strings(problems)
+	return problems, nil
+}
+
+// VerifyInstall checks the runtime content currently in use, as linked from dataDir/bin,
+// against the checksums recorded when it was extracted. The path to the verified content
+// and a list of modified, missing, and unexpected files is returned.
+func VerifyInstall(dataDir string) (string, []string, error) {
+	binDir, err := filepath.EvalSymlinks(symlinkBinDir(dataDir))
+	if err != nil {
+		return "", nil, errors.WithMessage(err, "failed to find current runtime bin directory")
+	}
+	refDir := filepath.Dir(binDir)
+	problems, err := verifyChecksums(dataDir, filepath.Base(refDir))
+	return refDir, problems, err
+}
+
+// checksumDirs returns checksums for all files in the bin and charts directories extracted from the runtime image.
+func checksumDirs(dataDir string, refDigest string) (map[string]string, error) {
+	refDir := filepath.Join(dataDir, "data", refDigest)
+	checksums := map[string]string{}
+	for _, dir := range []string{binDirForDigest(dataDir, refDigest), chartsDirForDigest(dataDir, refDigest)} {
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(refDir, path)
+			if err != nil {
+				return err
+			}
+			rel = filepath.ToSlash(rel)
+			switch {
+			case d.IsDir():
+				return nil
+			case d.Type()&fs.ModeSymlink != 0:
+				target, err := os.Readlink(path)
+				if err != nil {
+					return err
+				}
+				checksums[rel] = "symlink:" + target
+			default:
+				sum, err := checksumFile(path)
+				if err != nil {
+					return err
+				}
+				checksums[rel] = "sha256:" + sum
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, errors.WithMessagef(err, "failed to compute checksums for %s", filepath.Base(dir))
+		}
+	}
+	return checksums, nil
+}
+
+func checksumFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,119 @@
+package bootstrap
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/k3s-io/k3s/pkg/util/errors"
+)
+
+func Test_UnitVerifyChecksums(t *testing.T) {
+	const refDigest = "v1.30.0-rke2r1-0123456789ab"
+
+	tests := []struct {
+		name     string
+		record   bool
+		modify   func(dataDir string) error
+		problems []string
+		wantErr  error
+	}{
+		{
+			name:   "unmodified",
+			record: true,
+		},
+		{
+			name:   "modified, missing and unexpected files",
+			record: true,
+			modify: func(dataDir string) error {
+				binDir := binDirForDigest(dataDir, refDigest)
+				if err := os.WriteFile(filepath.Join(binDir, "kubelet"), []byte("modified"), 0755); err != nil {
+					return err
+				}
+				if err := os.Remove(filepath.Join(chartsDirForDigest(dataDir, refDigest), "rke2-coredns.yaml")); err != nil {
+					return err
+				}
+				return os.WriteFile(filepath.Join(binDir, "extra"), []byte("extra"), 0755)
+			},
+			problems: []string{"missing: charts/rke2-coredns.yaml", "modified: bin/kubelet", "unexpected: bin/extra"},
+		},
+		{
+			name:   "retargeted symlink",
+			record: true,
+			modify: func(dataDir string) error {
+				link := filepath.Join(binDirForDigest(dataDir, refDigest), "kubectl")
+				if err := os.Remove(link); err != nil {
+					return err
+				}
+				return os.Symlink("containerd", link)
+			},
+			problems: []string{"modified: bin/kubectl"},
+		},
+		{
+			name:    "not recorded",
+			wantErr: errChecksumsNotRecorded,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dataDir := t.TempDir()
+			binDir := binDirForDigest(dataDir, refDigest)
+			chartsDir := chartsDirForDigest(dataDir, refDigest)
+			for _, dir := range []string{binDir, chartsDir} {
+				if err := os.MkdirAll(dir, 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for file, content := range map[string]string{
+				filepath.Join(binDir, "kubelet"):              "kubelet",
+				filepath.Join(binDir, "containerd"):           "containerd",
+				filepath.Join(chartsDir, "rke2-coredns.yaml"): "coredns",
+			} {
+				if err := os.WriteFile(file, []byte(content), 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := os.Symlink("kubelet", filepath.Join(binDir, "kubectl")); err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.record {
+				if err := writeChecksums(dataDir, refDigest); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.modify != nil {
+				if err := tt.modify(dataDir); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			problems, err := verifyChecksums(dataDir, refDigest)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(problems, tt.problems) {
+				t.Errorf("expected problems %v, got %v", tt.problems, problems)
+			}
+		})
+	}
+}
+
+func Test_UnitParseIntegrityAction(t *testing.T) {
+	for s, expected := range map[string]IntegrityAction{"": IntegrityReextract, "reextract": IntegrityReextract, "fail": IntegrityFail} {
+		if action, err := ParseIntegrityAction(s); err != nil || action != expected {
+			t.Errorf("expected %q to parse as %s, got %s: %v", s, expected, action, err)
+		}
+	}
+	if _, err := ParseIntegrityAction("ignore"); err == nil {
+		t.Error("expected error for unsupported action")
+	}
+}
@@ -0,0 +1,312 @@
+package bootstrap
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	helmv1 "github.com/k3s-io/helm-controller/pkg/apis/helm.cattle.io/v1"
+	daemonconfig "github.com/k3s-io/k3s/pkg/daemons/config"
+	"github.com/k3s-io/k3s/pkg/daemons/executor"
+	"github.com/k3s-io/k3s/pkg/util/errors"
+	"github.com/k3s-io/k3s/pkg/version"
+	"github.com/rancher/wrangler/v3/pkg/yaml"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// ManifestConflictPolicy selects which version of a bundled manifest is used, when the copy
+// in the manifests directory has been edited since it was last written.
+type ManifestConflictPolicy string
+
+const (
+	// ManifestConflictBundled replaces the edited copy with the bundled manifest.
+	ManifestConflictBundled ManifestConflictPolicy = "bundled"
+	// ManifestConflictLocal keeps the edited copy.
+	ManifestConflictLocal ManifestConflictPolicy = "local"
+)
+
+// maxManifestBackups is the number of edited manifest backup directories that are kept; older backups are removed.
+const maxManifestBackups = 5
+
+// ParseManifestConflictPolicy validates a manifest conflict policy, returning the default if the string is empty.
+func ParseManifestConflictPolicy(s string) (ManifestConflictPolicy, error) {
+	switch p := ManifestConflictPolicy(s); p {
+	case "":
+		return ManifestConflictBundled, nil
+	case ManifestConflictBundled, ManifestConflictLocal:
+		return p, nil
+	}
+	return "", fmt.Errorf("unsupported manifest conflict policy %q: must be one of %s, %s", s, ManifestConflictBundled, ManifestConflictLocal)
+}
+
+// manifestHashes records the hash of the bundled manifest most recently written to the manifests
+// directory, and the hash of the edited copy that was most recently kept in place of it.
+type manifestHashes struct {
+	Bundled string `json:"bundled"`
+	Local   string `json:"local,omitempty"`
+}
+
+// manifestState records the hashes of bundled manifests in the manifests directory, by file name.
+type manifestState map[string]manifestHashes
+
+// manifestEdit describes a bundled manifest that was edited in the manifests directory.
+type manifestEdit struct {
+	file    string
+	backup  string
+	kept    bool
+	objects []corev1.ObjectReference
+}
+
+// manifestStateFile returns the path to the file that records the hashes of bundled manifests.
+// The deploy controller ignores files and directories that start with a dot.
+func manifestStateFile(manifestsDir string) string {
+	return filepath.Join(manifestsDir, ".bundled-manifests.json")
+}
+
+// manifestBackupsDir returns the path to the directory that contains edited manifest backup directories.
+func manifestBackupsDir(manifestsDir string) string {
+	return filepath.Join(manifestsDir, ".backup")
+}
+
+// manifestBackupDir returns the path to the directory that edited manifests are backed up to.
+func manifestBackupDir(manifestsDir string, t time.Time) string {
+	return filepath.Join(manifestBackupsDir(manifestsDir), t.UTC().Format("20060102T150405Z"))
+}
+
+// pruneManifestBackups removes all but the most recent keep edited manifest backup directories.
+// Backup directories are named by timestamp, so they sort in the order they were created.
+func pruneManifestBackups(manifestsDir string, keep int) error {
+	entries, err := os.ReadDir(manifestBackupsDir(manifestsDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var backups []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			backups = append(backups, entry.Name())
+		}
+	}
+	sort.Strings(backups)
+	for len(backups) > keep {
+		backupDir := filepath.Join(manifestBackupsDir(manifestsDir), backups[0])
+		logrus.Infof("Removing edited manifest backup %s", backupDir)
+		if err := os.RemoveAll(backupDir); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// readManifestState reads the hashes recorded when bundled manifests were last written.
+func readManifestState(manifestsDir string) (manifestState, error) {
+	state := manifestState{}
+	b, err := os.ReadFile(manifestStateFile(manifestsDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &state); err != nil {
+		logrus.Warnf("Failed to decode bundled manifest hashes; edits to bundled manifests will not be detected until they are next written: %v", err)
+		return manifestState{}, nil
+	}
+	return state, nil
+}
+
+// write records the hashes of bundled manifests, as they are on disk after cluster configuration values have been applied.
+func (s manifestState) write(manifestsDir string) error {
+	for m, hashes := range s {
+		b, err := os.ReadFile(filepath.Join(manifestsDir, m))
+		if err != nil {
+			delete(s, m)
+			continue
+		}
+		if hashes.Local != "" {
+			hashes.Local = manifestHash(b)
+		} else {
+			hashes.Bundled = manifestHash(b)
+		}
+		s[m] = hashes
+	}
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(manifestStateFile(manifestsDir), b, 0600)
+}
+
+// protectEditedManifests compares the copies of bundled manifests in manifestsDir against the hashes recorded when they were
+// last written, and backs up copies that have been edited. If the local policy is in effect, bundled manifests are removed from
+// chartsDir so that the edited copies are not overwritten. The updated hashes must be written once the bundled manifests have
+// been copied into place. Edits cannot be detected until the hash of a manifest has been recorded. Only the most recent
+// backups are kept.
+func protectEditedManifests(chartsDir, manifestsDir string, policy ManifestConflictPolicy) (manifestState, []manifestEdit, error) {
+	state, err := readManifestState(manifestsDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	manifests, err := listManifests(chartsDir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	var edits []manifestEdit
+	for _, m := range manifests {
+		bundled, err := os.ReadFile(filepath.Join(chartsDir, m))
+		if err != nil {
+			return nil, nil, err
+		}
+		bundledHash := manifestHash(bundled)
+		hashes, recorded := state[m]
+		current, err := os.ReadFile(filepath.Join(manifestsDir, m))
+		currentHash := manifestHash(current)
+
+		switch {
+		case !recorded || err != nil || currentHash == hashes.Bundled:
+			// Not previously written, removed, or not edited; write the bundled manifest
+			state[m] = manifestHashes{Bundled: bundledHash}
+			continue
+		case policy == ManifestConflictLocal && currentHash == hashes.Local:
+			// Edited copy was previously backed up and kept
+			if bundledHash != hashes.Bundled {
+				logrus.Warnf("Bundled manifest %s has changed, but the edited copy in %s is being kept", m, manifestsDir)
+			}
+			state[m] = manifestHashes{Bundled: bundledHash, Local: currentHash}
+			os.Remove(filepath.Join(chartsDir, m))
+			continue
+		}
+
+		backupDir := manifestBackupDir(manifestsDir, now)
+		if err := os.MkdirAll(backupDir, 0700); err != nil {
+			return nil, nil, err
+		}
+		backup := filepath.Join(backupDir, m)
+		if err := os.WriteFile(backup, current, 0600); err != nil {
+			return nil, nil, errors.WithMessagef(err, "failed to back up edited manifest %s", m)
+		}
+
+		edit := manifestEdit{file: m, backup: backup, kept: policy == ManifestConflictLocal, objects: manifestHelmCharts(current)}
+		if edit.kept {
+			logrus.Warnf("Bundled manifest %s has been edited; keeping the edited copy as the manifest conflict policy is %s. A backup has been saved to %s", m, policy, backup)
+			state[m] = manifestHashes{Bundled: bundledHash, Local: currentHash}
+			os.Remove(filepath.Join(chartsDir, m))
+		} else {
+			logrus.Warnf("Bundled manifest %s has been edited; replacing the edited copy as the manifest conflict policy is %s. A backup has been saved to %s", m, policy, backup)
+			state[m] = manifestHashes{Bundled: bundledHash}
+		}
+		edits = append(edits, edit)
+	}
+
+	if len(edits) > 0 {
+		if err := pruneManifestBackups(manifestsDir, maxManifestBackups); err != nil {
+			logrus.Warnf("Failed to remove old edited manifest backups: %v", err)
+		}
+	}
+	return state, edits, nil
+}
+
+// manifestHash returns the hex-encoded SHA256 hash of manifest content.
+func manifestHash(b []byte) string {
+	hash := sha256.Sum256(b)
+	return hex.EncodeToString(hash[:])
+}
+
+// manifestHelmCharts returns references to the HelmCharts in manifest content.
+func manifestHelmCharts(b []byte) []corev1.ObjectReference {
+	objs, err := yaml.ToObjects(bytes.NewReader(b))
+	if err != nil {
+		return nil
+	}
+	var refs []corev1.ObjectReference
+	for _, obj := range objs {
+		unst, ok := obj.(*unstructured.Unstructured)
+		if !ok || unst.GroupVersionKind() != helmChartGVK {
+			continue
+		}
+		namespace := unst.GetNamespace()
+		if namespace == "" {
+			namespace = metav1.NamespaceSystem
+		}
+		refs = append(refs, corev1.ObjectReference{
+			APIVersion: helmv1.SchemeGroupVersion.String(),
+			Kind:       helmChartGVK.Kind,
+			Name:       unst.GetName(),
+			Namespace:  namespace,
+		})
+	}
+	return refs
+}
+
+// recordManifestEdits waits for the apiserver to become ready, and creates a warning Event for each edited manifest.
+// Events are created for the HelmCharts in the edited manifest, or for the Node if the manifest does not contain any HelmCharts.
+func recordManifestEdits(ctx context.Context, nodeConfig *daemonconfig.Node, edits []manifestEdit) {
+	select {
+	case <-executor.APIServerReadyChan():
+	case <-ctx.Done():
+		return
+	}
+
+	restConfig, err := clientcmd.BuildConfigFromFlags("", nodeConfig.AgentConfig.KubeConfigK3sController)
+	if err != nil {
+		logrus.Warnf("Failed to create events for edited manifests: %v", err)
+		return
+	}
+	client, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		logrus.Warnf("Failed to create events for edited manifests: %v", err)
+		return
+	}
+
+	for _, edit := range edits {
+		message := fmt.Sprintf("Bundled manifest %s was edited; the edited copy was replaced by the bundled manifest. A backup was saved to %s", edit.file, edit.backup)
+		if edit.kept {
+			message = fmt.Sprintf("Bundled manifest %s was edited; the edited copy was kept in place of the bundled manifest. A backup was saved to %s", edit.file, edit.backup)
+		}
+		objects := edit.objects
+		if len(objects) == 0 {
+			objects = []corev1.ObjectReference{{APIVersion: "v1", Kind: "Node", Name: nodeConfig.AgentConfig.NodeName}}
+		}
+		for _, obj := range objects {
+			namespace := obj.Namespace
+			if namespace == "" {
+				namespace = metav1.NamespaceDefault
+			}
+			now := metav1.Now()
+			event := &corev1.Event{
+				ObjectMeta: metav1.ObjectMeta{
+					GenerateName: obj.Name + ".",
+					Namespace:    namespace,
+				},
+				InvolvedObject: obj,
+				Reason:         "ManifestEdited",
+				Message:        message,
+				Type:           corev1.EventTypeWarning,
+				Source:         corev1.EventSource{Component: version.Program, Host: nodeConfig.AgentConfig.NodeName},
+				FirstTimestamp: now,
+				LastTimestamp:  now,
+				Count:          1,
+			}
+			if _, err := client.CoreV1().Events(namespace).Create(ctx, event, metav1.CreateOptions{}); err != nil {
+				logrus.Warnf("Failed to create event for edited manifest %s: %v", edit.file, err)
+			}
+		}
+	}
+}
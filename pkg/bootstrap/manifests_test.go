@@ -0,0 +1,201 @@
+package bootstrap
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_UnitProtectEditedManifests(t *testing.T) {
+	const (
+		bundled = "bundled: true\n"
+		updated = "bundled: updated\n"
+		edited  = "edited: true\n"
+	)
+
+	tests := []struct {
+		name     string
+		policy   ManifestConflictPolicy
+		state    manifestState
+		current  string
+		bundled  string
+		wantEdit bool
+		wantKept bool
+		want     manifestHashes
+	}{
+		{
+			name:    "not recorded",
+			policy:  ManifestConflictBundled,
+			current: edited,
+			bundled: updated,
+			want:    manifestHashes{Bundled: manifestHash([]byte(updated))},
+		},
+		{
+			name:    "not edited",
+			policy:  ManifestConflictBundled,
+			state:   manifestState{"test.yaml": {Bundled: manifestHash([]byte(bundled))}},
+			current: bundled,
+			bundled: updated,
+			want:    manifestHashes{Bundled: manifestHash([]byte(updated))},
+		},
+		{
+			name:    "removed",
+			policy:  ManifestConflictLocal,
+			state:   manifestState{"test.yaml": {Bundled: manifestHash([]byte(bundled))}},
+			bundled: bundled,
+			want:    manifestHashes{Bundled: manifestHash([]byte(bundled))},
+		},
+		{
+			name:     "edited and replaced",
+			policy:   ManifestConflictBundled,
+			state:    manifestState{"test.yaml": {Bundled: manifestHash([]byte(bundled))}},
+			current:  edited,
+			bundled:  bundled,
+			wantEdit: true,
+			want:     manifestHashes{Bundled: manifestHash([]byte(bundled))},
+		},
+		{
+			name:     "edited and kept",
+			policy:   ManifestConflictLocal,
+			state:    manifestState{"test.yaml": {Bundled: manifestHash([]byte(bundled))}},
+			current:  edited,
+			bundled:  updated,
+			wantEdit: true,
+			wantKept: true,
+			want:     manifestHashes{Bundled: manifestHash([]byte(updated)), Local: manifestHash([]byte(edited))},
+		},
+		{
+			name:     "previously kept",
+			policy:   ManifestConflictLocal,
+			state:    manifestState{"test.yaml": {Bundled: manifestHash([]byte(bundled)), Local: manifestHash([]byte(edited))}},
+			current:  edited,
+			bundled:  updated,
+			wantKept: true,
+			want:     manifestHashes{Bundled: manifestHash([]byte(updated)), Local: manifestHash([]byte(edited))},
+		},
+		{
+			name:     "previously kept and replaced",
+			policy:   ManifestConflictBundled,
+			state:    manifestState{"test.yaml": {Bundled: manifestHash([]byte(bundled)), Local: manifestHash([]byte(edited))}},
+			current:  edited,
+			bundled:  bundled,
+			wantEdit: true,
+			want:     manifestHashes{Bundled: manifestHash([]byte(bundled))},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chartsDir := t.TempDir()
+			manifestsDir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(chartsDir, "test.yaml"), []byte(tt.bundled), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if tt.current != "" {
+				if err := os.WriteFile(filepath.Join(manifestsDir, "test.yaml"), []byte(tt.current), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.state != nil {
+				b, err := json.Marshal(tt.state)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(manifestStateFile(manifestsDir), b, 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			state, edits, err := protectEditedManifests(chartsDir, manifestsDir, tt.policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(state["test.yaml"], tt.want) {
+				t.Errorf("expected hashes %+v, got %+v", tt.want, state["test.yaml"])
+			}
+			if _, err := os.Stat(filepath.Join(chartsDir, "test.yaml")); os.IsNotExist(err) != tt.wantKept {
+				t.Errorf("expected bundled manifest to be removed %t, got %v", tt.wantKept, err)
+			}
+
+			if !tt.wantEdit {
+				if len(edits) != 0 {
+					t.Fatalf("expected no edits, got %+v", edits)
+				}
+				return
+			}
+			if len(edits) != 1 || edits[0].file != "test.yaml" || edits[0].kept != tt.wantKept {
+				t.Fatalf("expected edit of test.yaml with kept %t, got %+v", tt.wantKept, edits)
+			}
+			if b, err := os.ReadFile(edits[0].backup); err != nil || string(b) != tt.current {
+				t.Errorf("expected backup of edited manifest, got %q: %v", b, err)
+			}
+		})
+	}
+}
+
+func Test_UnitManifestState(t *testing.T) {
+	manifestsDir := t.TempDir()
+	for file, content := range map[string]string{"bundled.yaml": "bundled: true\n", "kept.yaml": "edited: true\n"} {
+		if err := os.WriteFile(filepath.Join(manifestsDir, file), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	state := manifestState{
+		"bundled.yaml": {Bundled: "stale"},
+		"kept.yaml":    {Bundled: "bundled", Local: "stale"},
+		"removed.yaml": {Bundled: "removed"},
+	}
+	if err := state.write(manifestsDir); err != nil {
+		t.Fatal(err)
+	}
+	want := manifestState{
+		"bundled.yaml": {Bundled: manifestHash([]byte("bundled: true\n"))},
+		"kept.yaml":    {Bundled: "bundled", Local: manifestHash([]byte("edited: true\n"))},
+	}
+	got, err := readManifestState(manifestsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected state %+v, got %+v", want, got)
+	}
+
+	if err := os.WriteFile(manifestStateFile(manifestsDir), []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := readManifestState(manifestsDir); err != nil || len(got) != 0 {
+		t.Errorf("expected empty state for corrupt state file, got %+v: %v", got, err)
+	}
+}
+
+func Test_UnitPruneManifestBackups(t *testing.T) {
+	manifestsDir := t.TempDir()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var backups []string
+	for i := 0; i < maxManifestBackups+2; i++ {
+		backupDir := manifestBackupDir(manifestsDir, start.Add(time.Duration(i)*time.Hour))
+		if err := os.MkdirAll(backupDir, 0700); err != nil {
+			t.Fatal(err)
+		}
+		backups = append(backups, filepath.Base(backupDir))
+	}
+
+	if err := pruneManifestBackups(manifestsDir, maxManifestBackups); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(manifestBackupsDir(manifestsDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, entry := range entries {
+		got = append(got, entry.Name())
+	}
+	if want := backups[2:]; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected backups %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,338 @@
+package bootstrap
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/daemon"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/k3s-io/k3s/pkg/util/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// maxPullBackoff caps the delay between runtime image pull retries.
+	maxPullBackoff = 5 * time.Minute
+	// progressInterval is the minimum interval between runtime image pull progress updates.
+	progressInterval = 5 * time.Second
+)
+
+// Phase identifies the step of staging runtime content that is in progress.
+type Phase string
+
+const (
+	PhaseWaitForRegistry Phase = "Waiting for embedded registry"
+	PhaseVerify          Phase = "Verifying extracted runtime content"
+	PhasePull            Phase = "Pulling runtime image"
+	PhaseExtract         Phase = "Extracting runtime image"
+	PhaseComplete        Phase = "Runtime content staged"
+)
+
+// PullOptions configures retries of runtime image pulls from a registry.
+// Failed pulls are retried up to Retries times, starting at Backoff and doubling the delay after each attempt.
+type PullOptions struct {
+	Retries int
+	Backoff time.Duration
+}
+
+// StageStatus tracks the phase of staging runtime content that is in progress.
+// Status updates are logged, and sent to systemd as the service status.
+type StageStatus struct {
+	mu    sync.Mutex
+	phase Phase
+}
+
+// Set records the current phase, and reports it along with an optional message.
+func (s *StageStatus) Set(phase Phase, format string, args ...any) {
+	status := string(phase)
+	if format != "" {
+		status += ": " + fmt.Sprintf(format, args...)
+	}
+	logrus.Info(status)
+	daemon.SdNotify(false, "STATUS="+status+"\n")
+
+	if s != nil {
+		s.mu.Lock()
+		s.phase = phase
+		s.mu.Unlock()
+	}
+}
+
+// Phase returns the current phase.
+func (s *StageStatus) Phase() Phase {
+	if s == nil {
+		return ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.phase
+}
+
+// Failed adds the current phase to an error that caused staging to fail.
+func (s *StageStatus) Failed(err error) error {
+	phase := s.Phase()
+	if phase == "" {
+		return err
+	}
+	return errors.WithMessagef(err, "staging runtime content failed while %s", strings.ToLower(string(phase)))
+}
+
+// layerCacheDir returns the path to the directory that caches runtime image layers pulled from a registry.
+func layerCacheDir(dataDir string) string {
+	return filepath.Join(dataDir, "data", ".layers")
+}
+
+// withRetries calls f until it succeeds, the retries are exhausted, or the context is cancelled.
+func withRetries(ctx context.Context, opts PullOptions, desc string, f func() error) error {
+	backoff := opts.Backoff
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || attempt > opts.Retries {
+			return err
+		}
+		logrus.Warnf("Failed to %s (attempt %d of %d), retrying in %s: %v", desc, attempt, opts.Retries+1, backoff, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxPullBackoff)
+	}
+}
+
+// LayerResumer returns the compressed content of a layer of the given size starting at the given offset, and
+// the offset that the content actually starts at, which is 0 if the source cannot resume from the offset.
+type LayerResumer func(ctx context.Context, digest v1.Hash, offset, size int64) (io.ReadCloser, int64, error)
+
+// layerCache stores the compressed layers of an image in a directory, so that layers that were completely
+// pulled do not need to be pulled again if a later layer fails, or if staging is retried after a restart.
+// Layers that were partially pulled are kept, and resumed from where they stopped if the source supports it.
+type layerCache struct {
+	dir      string
+	progress *pullProgress
+	stats    *ImagePullStats
+	resume   func(digest v1.Hash, offset, size int64) (io.ReadCloser, int64, error)
+}
+
+// cacheImage pulls all layers of the image into the cache, retrying each layer as configured,
+// and returns an image that reads layers from the cache. Bytes pulled and read from the cache are counted in stats.
+// If resume is not nil, it is used to resume layers that were partially pulled.
+func cacheImage(ctx context.Context, img v1.Image, dir string, opts PullOptions, status *StageStatus, stats *ImagePullStats, resume LayerResumer) (v1.Image, error) {
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, err
+	}
+	var total int64
+	for _, layer := range layers {
+		size, err := layer.Size()
+		if err != nil {
+			return nil, err
+		}
+		total += size
+	}
+
+	c := &layerCache{dir: dir, progress: &pullProgress{total: total, status: status}, stats: stats}
+	if resume != nil {
+		c.resume = func(digest v1.Hash, offset, size int64) (io.ReadCloser, int64, error) {
+			return resume(ctx, digest, offset, size)
+		}
+	}
+	for i, layer := range layers {
+		desc := fmt.Sprintf("pull runtime image layer %d of %d", i+1, len(layers))
+		if err := withRetries(ctx, opts, desc, func() error { return c.fetch(layer) }); err != nil {
+			return nil, err
+		}
+	}
+	return &cachedImage{Image: img, cache: c}, nil
+}
+
+// path returns the path to the cached content of a layer.
+func (c *layerCache) path(digest v1.Hash) string {
+	return filepath.Join(c.dir, digest.Algorithm+"-"+digest.Hex)
+}
+
+// fetch pulls the compressed content of a layer into the cache, if it is not already present.
+// Content is written to a partial file, and only moved into place once the digest has been verified.
+// The partial file is kept if the pull fails, so that the next attempt can resume from the end of it.
+func (c *layerCache) fetch(layer v1.Layer) error {
+	digest, err := layer.Digest()
+	if err != nil {
+		return err
+	}
+	size, err := layer.Size()
+	if err != nil {
+		return err
+	}
+	path := c.path(digest)
+	if info, err := os.Stat(path); err == nil && info.Size() == size {
+		logrus.Debugf("Using cached runtime image layer %s", digest)
+		c.progress.add(size)
+		c.stats.addCached(size)
+		return nil
+	}
+
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path+".partial", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Hash the content that was already pulled, so that the pull can be resumed from the end of it
+	h := sha256.New()
+	offset, err := io.Copy(h, f)
+	if err != nil {
+		return err
+	}
+	var n int64
+	if offset != size {
+		rc, start, err := c.open(layer, digest, offset, size)
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		if start != offset {
+			if err := f.Truncate(0); err != nil {
+				return err
+			}
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			h.Reset()
+			offset = 0
+		} else if offset > 0 {
+			logrus.Infof("Resuming pull of runtime image layer %s at %d of %d bytes", digest, offset, size)
+		}
+		c.progress.add(offset)
+		n, err = io.Copy(io.MultiWriter(f, h, c.progress), rc)
+		if err != nil {
+			c.progress.add(-offset - n)
+			return err
+		}
+	} else {
+		c.progress.add(offset)
+	}
+	if digest.Algorithm == "sha256" && hex.EncodeToString(h.Sum(nil)) != digest.Hex {
+		c.progress.add(-offset - n)
+		os.Remove(f.Name())
+		return fmt.Errorf("digest mismatch for runtime image layer %s", digest)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	c.stats.addCached(offset)
+	c.stats.addPulled(n)
+	return os.Rename(f.Name(), path)
+}
+
+// open returns the compressed content of a layer, resuming from offset if possible. The offset that the
+// content starts at is also returned; if the content cannot be resumed, it is returned from the start.
+func (c *layerCache) open(layer v1.Layer, digest v1.Hash, offset, size int64) (io.ReadCloser, int64, error) {
+	if offset > 0 && offset < size && c.resume != nil {
+		return c.resume(digest, offset, size)
+	}
+	rc, err := layer.Compressed()
+	return rc, 0, err
+}
+
+// cachedImage is an image that reads layer content from a layer cache.
+type cachedImage struct {
+	v1.Image
+	cache *layerCache
+}
+
+func (i *cachedImage) Layers() ([]v1.Layer, error) {
+	layers, err := i.Image.Layers()
+	if err != nil {
+		return nil, err
+	}
+	for j, layer := range layers {
+		layers[j] = &cachedLayer{Layer: layer, cache: i.cache}
+	}
+	return layers, nil
+}
+
+func (i *cachedImage) LayerByDigest(h v1.Hash) (v1.Layer, error) {
+	layer, err := i.Image.LayerByDigest(h)
+	if err != nil {
+		return nil, err
+	}
+	return &cachedLayer{Layer: layer, cache: i.cache}, nil
+}
+
+// cachedLayer is a layer that reads content from a layer cache, pulling it into the cache if necessary.
+type cachedLayer struct {
+	v1.Layer
+	cache *layerCache
+}
+
+func (l *cachedLayer) Compressed() (io.ReadCloser, error) {
+	layer, err := l.cached()
+	if err != nil {
+		return nil, err
+	}
+	return layer.Compressed()
+}
+
+func (l *cachedLayer) Uncompressed() (io.ReadCloser, error) {
+	layer, err := l.cached()
+	if err != nil {
+		return nil, err
+	}
+	return layer.Uncompressed()
+}
+
+// cached returns a layer backed by the cached file, pulling it into the cache if it has been removed.
+func (l *cachedLayer) cached() (v1.Layer, error) {
+	digest, err := l.Layer.Digest()
+	if err != nil {
+		return nil, err
+	}
+	path := l.cache.path(digest)
+	if _, err := os.Stat(path); err != nil {
+		if err := l.cache.fetch(l.Layer); err != nil {
+			return nil, err
+		}
+	}
+	return tarball.LayerFromFile(path)
+}
+
+// pullProgress reports the number of bytes pulled, at most once per progress interval.
+type pullProgress struct {
+	mu     sync.Mutex
+	total  int64
+	done   int64
+	last   time.Time
+	status *StageStatus
+}
+
+func (p *pullProgress) Write(b []byte) (int, error) {
+	p.add(int64(len(b)))
+	return len(b), nil
+}
+
+func (p *pullProgress) add(n int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done += n
+	if n <= 0 || (time.Since(p.last) < progressInterval && p.done < p.total) {
+		return
+	}
+	p.last = time.Now()
+	var percent int64
+	if p.total > 0 {
+		percent = p.done * 100 / p.total
+	}
+	p.status.Set(PhasePull, "%.1f of %.1f MiB (%d%%)", float64(p.done)/(1<<20), float64(p.total)/(1<<20), percent)
+}
@@ -0,0 +1,182 @@
+package bootstrap
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http/httptrace"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	daemonconfig "github.com/k3s-io/k3s/pkg/daemons/config"
+	"github.com/sirupsen/logrus"
+)
+
+// ImagePullStats records where the content of an image came from while staging runtime content. Bytes pulled from the
+// embedded registry are counted as served by peers; bytes pulled from any other endpoint are counted as
+// served by upstream. Layers that were already in the layer cache are counted separately.
+type ImagePullStats struct {
+	Image         string
+	Source        string
+	Remote        bool
+	Mirror        string
+	Peer          bool
+	PeerBytes     int64
+	UpstreamBytes int64
+	CachedBytes   int64
+	Duration      time.Duration
+}
+
+// PullStats records the pull statistics for each image pulled while staging runtime content.
+type PullStats struct {
+	mu     sync.Mutex
+	images []ImagePullStats
+}
+
+// add records the statistics for an image.
+func (s *PullStats) add(stats ImagePullStats) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.images = append(s.images, stats)
+}
+
+// Images returns the statistics recorded for each image, in the order that the images were pulled.
+func (s *PullStats) Images() []ImagePullStats {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]ImagePullStats{}, s.images...)
+}
+
+// Log logs the statistics recorded for each image.
+func (s *PullStats) Log() {
+	for _, i := range s.Images() {
+		if !i.Remote {
+			logrus.Infof("Image %s loaded from %s", i.Image, i.Source)
+			continue
+		}
+		mirror := i.Mirror
+		if mirror == "" {
+			mirror = "unknown endpoint"
+		} else if i.Peer {
+			mirror += " (embedded registry)"
+		}
+		logrus.Infof("Image %s pulled from %s in %s: %s from peers, %s from upstream, %s from layer cache",
+			i.Image, mirror, i.Duration.Round(time.Millisecond), formatMiB(i.PeerBytes), formatMiB(i.UpstreamBytes), formatMiB(i.CachedBytes))
+	}
+}
+
+// addPulled counts bytes pulled from the image's mirror.
+func (i *ImagePullStats) addPulled(n int64) {
+	if i == nil {
+		return
+	}
+	if i.Peer {
+		i.PeerBytes += n
+	} else {
+		i.UpstreamBytes += n
+	}
+}
+
+// addCached counts bytes read from the layer cache.
+func (i *ImagePullStats) addCached(n int64) {
+	if i != nil {
+		i.CachedBytes += n
+	}
+}
+
+// formatMiB formats a number of bytes in MiB.
+func formatMiB(n int64) string {
+	return fmt.Sprintf("%.1f MiB", float64(n)/(1<<20))
+}
+
+// endpointTrace records the addresses that registry requests are sent to. The private registry configuration tries each
+// mirror endpoint in turn and returns the image from the first endpoint that has it, so the last endpoint address that a
+// request was sent to is the endpoint that the image content will be pulled from.
+type endpointTrace struct {
+	mu    sync.Mutex
+	addrs []string
+}
+
+// withContext returns a context that records the address of each request made with it.
+func (t *endpointTrace) withContext(ctx context.Context) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GetConn: func(hostPort string) {
+			t.mu.Lock()
+			t.addrs = append(t.addrs, hostPort)
+			t.mu.Unlock()
+		},
+	})
+}
+
+// mirror returns the most recent request address that is one of the endpoint addresses for an image.
+// Requests to other addresses, such as token servers, are ignored.
+func (t *endpointTrace) mirror(endpoints []string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := len(t.addrs) - 1; i >= 0; i-- {
+		for _, endpoint := range endpoints {
+			if t.addrs[i] == endpoint {
+				return endpoint
+			}
+		}
+	}
+	return ""
+}
+
+// registryEndpoints returns the addresses of the mirror endpoints that the private registry configuration tries for
+// an image reference, followed by the default endpoint. Mirrors are selected in the same way as containerd.
+func registryEndpoints(nodeConfig *daemonconfig.Node, ref name.Reference) []string {
+	registry := ref.Context().RegistryStr()
+	keys := []string{registry}
+	if registry == name.DefaultRegistry {
+		keys = append(keys, "docker.io")
+	} else if _, _, err := net.SplitHostPort(registry); err != nil {
+		keys = append(keys, registry+":443", registry+":80")
+	}
+	keys = append(keys, "*")
+
+	var endpoints []string
+	if nodeConfig.AgentConfig.Registry != nil {
+		for _, key := range keys {
+			if mirror, ok := nodeConfig.AgentConfig.Registry.Mirrors[key]; ok {
+				for _, endpoint := range mirror.Endpoints {
+					if addr := endpointAddress(endpoint); addr != "" {
+						endpoints = append(endpoints, addr)
+					}
+				}
+				break
+			}
+		}
+	}
+	if addr := endpointAddress(registry); addr != "" {
+		endpoints = append(endpoints, addr)
+	}
+	return endpoints
+}
+
+// endpointAddress returns the host and port that requests to a registry endpoint are sent to.
+func endpointAddress(endpoint string) string {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "//" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	if u.Port() != "" {
+		return u.Host
+	}
+	if u.Scheme == "http" {
+		return net.JoinHostPort(u.Hostname(), "80")
+	}
+	return net.JoinHostPort(u.Hostname(), "443")
+}
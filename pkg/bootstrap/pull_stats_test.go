@@ -0,0 +1,107 @@
+package bootstrap
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	daemonconfig "github.com/k3s-io/k3s/pkg/daemons/config"
+	"github.com/rancher/wharfie/pkg/registries"
+)
+
+func Test_UnitRegistryEndpoints(t *testing.T) {
+	tests := []struct {
+		name    string
+		mirrors map[string]registries.Mirror
+		ref     string
+		want    []string
+	}{
+		{
+			name: "no registry configuration",
+			ref:  "docker.io/rancher/rke2-runtime:v1",
+			want: []string{"index.docker.io:443"},
+		},
+		{
+			name: "docker hub mirror",
+			mirrors: map[string]registries.Mirror{
+				"docker.io": {Endpoints: []string{"https://127.0.0.1:6443", "http://mirror.example.com"}},
+			},
+			ref:  "rancher/rke2-runtime:v1",
+			want: []string{"127.0.0.1:6443", "mirror.example.com:80", "index.docker.io:443"},
+		},
+		{
+			name: "registry mirror takes precedence over wildcard",
+			mirrors: map[string]registries.Mirror{
+				"registry.example.com": {Endpoints: []string{"mirror.example.com:5000"}},
+				"*":                    {Endpoints: []string{"wildcard.example.com"}},
+			},
+			ref:  "registry.example.com/rancher/rke2-runtime:v1",
+			want: []string{"mirror.example.com:5000", "registry.example.com:443"},
+		},
+		{
+			name: "registry mirror with default port",
+			mirrors: map[string]registries.Mirror{
+				"registry.example.com:443": {Endpoints: []string{"mirror.example.com"}},
+			},
+			ref:  "registry.example.com/rancher/rke2-runtime:v1",
+			want: []string{"mirror.example.com:443", "registry.example.com:443"},
+		},
+		{
+			name: "wildcard mirror",
+			mirrors: map[string]registries.Mirror{
+				"*": {Endpoints: []string{"wildcard.example.com"}},
+			},
+			ref:  "registry.example.com:5000/rancher/rke2-runtime:v1",
+			want: []string{"wildcard.example.com:443", "registry.example.com:5000"},
+		},
+		{
+			name: "invalid endpoints are skipped",
+			mirrors: map[string]registries.Mirror{
+				"registry.example.com": {Endpoints: []string{"https://", "mirror.example.com"}},
+			},
+			ref:  "registry.example.com/rancher/rke2-runtime:v1",
+			want: []string{"mirror.example.com:443", "registry.example.com:443"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodeConfig := &daemonconfig.Node{}
+			if tt.mirrors != nil {
+				nodeConfig.AgentConfig.Registry = &registries.Registry{Mirrors: tt.mirrors}
+			}
+			ref, err := name.ParseReference(tt.ref)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := registryEndpoints(nodeConfig, ref); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected endpoints %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func Test_UnitEndpointAddress(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		want     string
+	}{
+		{endpoint: "registry.example.com", want: "registry.example.com:443"},
+		{endpoint: "registry.example.com:5000", want: "registry.example.com:5000"},
+		{endpoint: "https://registry.example.com/v2", want: "registry.example.com:443"},
+		{endpoint: "http://registry.example.com", want: "registry.example.com:80"},
+		{endpoint: "http://registry.example.com:8080/v2", want: "registry.example.com:8080"},
+		{endpoint: "https://[fd00::1]", want: "[fd00::1]:443"},
+		{endpoint: "127.0.0.1:6443", want: "127.0.0.1:6443"},
+		{endpoint: "https://", want: ""},
+		{endpoint: "http://%zz", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.endpoint, func(t *testing.T) {
+			if got := endpointAddress(tt.endpoint); got != tt.want {
+				t.Errorf("expected address %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
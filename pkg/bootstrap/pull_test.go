@@ -0,0 +1,139 @@
+package bootstrap
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// interruptedLayer is a layer whose compressed content fails after the given number of bytes.
+type interruptedLayer struct {
+	v1.Layer
+	after int64
+}
+
+func (l *interruptedLayer) Compressed() (io.ReadCloser, error) {
+	rc, err := l.Layer.Compressed()
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(io.MultiReader(io.LimitReader(rc, l.after), iotestErrReader{})), nil
+}
+
+type iotestErrReader struct{}
+
+func (iotestErrReader) Read([]byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func Test_UnitLayerCacheFetch(t *testing.T) {
+	layer, err := random.Layer(64*1024, types.DockerLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err := layer.Compressed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, err := layer.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	half := int64(len(content) / 2)
+
+	tests := []struct {
+		name       string
+		resume     func(offset int64) (io.ReadCloser, int64, error)
+		wantOffset int64
+	}{
+		{
+			name: "resumed",
+			resume: func(offset int64) (io.ReadCloser, int64, error) {
+				return io.NopCloser(bytes.NewReader(content[offset:])), offset, nil
+			},
+			wantOffset: half,
+		},
+		{
+			name: "range not supported",
+			resume: func(offset int64) (io.ReadCloser, int64, error) {
+				return io.NopCloser(bytes.NewReader(content)), 0, nil
+			},
+			wantOffset: half,
+		},
+		{
+			name: "resume not available",
+		},
+		{
+			name: "corrupt resumed content",
+			resume: func(offset int64) (io.ReadCloser, int64, error) {
+				corrupt := bytes.Repeat([]byte{0}, len(content))
+				return io.NopCloser(bytes.NewReader(corrupt[offset:])), offset, nil
+			},
+			wantOffset: half,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resumedAt int64
+			c := &layerCache{dir: t.TempDir(), progress: &pullProgress{total: int64(len(content))}, stats: &ImagePullStats{}}
+			if tt.resume != nil {
+				c.resume = func(d v1.Hash, offset, size int64) (io.ReadCloser, int64, error) {
+					if d != digest {
+						t.Errorf("expected resume of %s, got %s", digest, d)
+					}
+					resumedAt = offset
+					return tt.resume(offset)
+				}
+			}
+
+			if err := c.fetch(&interruptedLayer{Layer: layer, after: half}); err == nil {
+				t.Fatal("expected interrupted pull to fail")
+			}
+			partial, err := os.ReadFile(c.path(digest) + ".partial")
+			if err != nil {
+				t.Fatalf("expected partial content to be kept: %v", err)
+			}
+			if int64(len(partial)) != half {
+				t.Fatalf("expected %d bytes of partial content, got %d", half, len(partial))
+			}
+
+			err = c.fetch(layer)
+			if tt.name == "corrupt resumed content" {
+				if err == nil {
+					t.Fatal("expected digest mismatch")
+				}
+				if _, err := os.Stat(c.path(digest) + ".partial"); !os.IsNotExist(err) {
+					t.Errorf("expected corrupt partial content to be removed: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resumedAt != tt.wantOffset {
+				t.Errorf("expected resume at %d, got %d", tt.wantOffset, resumedAt)
+			}
+			cached, err := os.ReadFile(c.path(digest))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(cached, content) {
+				t.Error("cached layer content does not match")
+			}
+			if c.progress.done != int64(len(content)) {
+				t.Errorf("expected progress of %d bytes, got %d", len(content), c.progress.done)
+			}
+		})
+	}
+}
@@ -0,0 +1,327 @@
+package bootstrap
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/k3s-io/k3s/pkg/util/errors"
+	"github.com/rancher/rke2/pkg/cli"
+	"github.com/rancher/rke2/pkg/images"
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// StageOptions configures how content from the runtime image is staged into the data directory.
+type StageOptions struct {
+	IntegrityAction IntegrityAction
+	Retention       Retention
+	Pull            PullOptions
+	Registry        RegistryWaitOptions
+	Sources         []ImageSourceSpec
+	Status          *StageStatus
+	Stats           *PullStats
+}
+
+// Retention limits the previous runtime data directories that are kept after a new runtime image is staged.
+// The most recently extracted directories are kept, up to Count directories using no more than Size bytes.
+// A Size of 0 does not limit the space used.
+type Retention struct {
+	Count int
+	Size  int64
+}
+
+// RuntimeDataDir describes content extracted from a runtime image into dataDir/data.
+type RuntimeDataDir struct {
+	Name      string
+	Path      string
+	Image     string
+	Extracted time.Time
+	Size      int64
+	Current   bool
+}
+
+// NewStageOptions returns the stage options from the CLI config.
+func NewStageOptions(cfg cli.Config) (StageOptions, error) {
+	opts := StageOptions{
+		Retention: Retention{Count: cfg.RuntimeDataRetention},
+		Pull:      PullOptions{Retries: cfg.RuntimeImagePullRetries, Backoff: cfg.RuntimeImagePullBackoff},
+		Registry:  RegistryWaitOptions{MinPeers: cfg.EmbeddedRegistryMinPeers, Timeout: cfg.EmbeddedRegistryWaitTimeout},
+		Status:    &StageStatus{},
+		Stats:     &PullStats{},
+	}
+
+	action, err := ParseIntegrityAction(cfg.RuntimeIntegrityAction)
+	if err != nil {
+		return opts, err
+	}
+	opts.IntegrityAction = action
+
+	sources, err := ParseImageSources(cfg.RuntimeImageSources.Value())
+	if err != nil {
+		return opts, err
+	}
+	opts.Sources = sources
+
+	if opts.Retention.Count < 0 {
+		return opts, fmt.Errorf("invalid runtime data retention count %d: must not be negative", opts.Retention.Count)
+	}
+	if opts.Pull.Retries < 0 {
+		return opts, fmt.Errorf("invalid runtime image pull retries %d: must not be negative", opts.Pull.Retries)
+	}
+	if opts.Registry.MinPeers < 0 {
+		return opts, fmt.Errorf("invalid embedded registry min peers %d: must not be negative", opts.Registry.MinPeers)
+	}
+	if cfg.RuntimeDataRetentionSize != "" {
+		size, err := resource.ParseQuantity(cfg.RuntimeDataRetentionSize)
+		if err != nil {
+			return opts, errors.WithMessage(err, "invalid runtime data retention size")
+		}
+		opts.Retention.Size = size.Value()
+	}
+	return opts, nil
+}
+
+// imageRefsFileForDigest returns the path to the file that records the
+// component images that were in use when the runtime image was extracted.
+func imageRefsFileForDigest(dataDir string, refDigest string) string {
+	return filepath.Join(dataDir, "data", refDigest, ".images")
+}
+
+// writeImageRefs records the images that the resolver returns for each component, so that
+// the matching component images can be restored if the runtime image is rolled back.
+// References are recorded as they were given, as the runtime data directory name is
+// derived from the runtime image reference string.
+func writeImageRefs(dataDir string, refDigest string, resolver *images.Resolver) error {
+	refs := map[string]string{}
+	for _, i := range images.All {
+		ref, err := resolver.GetReference(i)
+		if err != nil {
+			return err
+		}
+		refs[i] = ref.String()
+	}
+	b, err := json.MarshalIndent(refs, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(imageRefsFileForDigest(dataDir, refDigest), b, 0644)
+}
+
+// ReadImageRefs returns the component images recorded when the runtime image was extracted into the named data directory.
+func ReadImageRefs(dataDir string, refDigest string) (map[string]string, error) {
+	b, err := os.ReadFile(imageRefsFileForDigest(dataDir, refDigest))
+	if err != nil {
+		return nil, err
+	}
+	refs := map[string]string{}
+	if err := json.Unmarshal(b, &refs); err != nil {
+		return nil, errors.WithMessage(err, "failed to decode component image list")
+	}
+	return refs, nil
+}
+
+// ListRuntimeDataDirs returns the runtime data directories that were completely extracted,
+// ordered from most to least recently extracted.
+func ListRuntimeDataDirs(dataDir string) ([]RuntimeDataDir, error) {
+	entries, err := os.ReadDir(filepath.Join(dataDir, "data"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var current string
+	if binDir, err := filepath.EvalSymlinks(symlinkBinDir(dataDir)); err == nil {
+		current = filepath.Base(filepath.Dir(binDir))
+	}
+
+	dirs := []RuntimeDataDir{}
+	for _, entry := range entries {
+		if !entry.IsDir() || !releasePattern.MatchString(entry.Name()) {
+			continue
+		}
+		marker := completionMarkerForDigest(dataDir, entry.Name())
+		info, err := os.Stat(marker)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		image, err := os.ReadFile(marker)
+		if err != nil {
+			return nil, err
+		}
+		path := filepath.Join(dataDir, "data", entry.Name())
+		size, err := dirSize(path)
+		if err != nil {
+			return nil, err
+		}
+		dirs = append(dirs, RuntimeDataDir{
+			Name:      entry.Name(),
+			Path:      path,
+			Image:     strings.TrimSpace(string(image)),
+			Extracted: info.ModTime(),
+			Size:      size,
+			Current:   entry.Name() == current,
+		})
+	}
+
+	sort.SliceStable(dirs, func(i, j int) bool {
+		return dirs[i].Extracted.After(dirs[j].Extracted)
+	})
+	return dirs, nil
+}
+
+// FindRollback returns the previously extracted runtime data directory to roll back to. If refDigest is empty,
+// the most recently extracted directory other than the current one is returned. The content of the
+// directory must match the checksums recorded when it was extracted, if any were recorded.
+func FindRollback(dataDir string, refDigest string) (RuntimeDataDir, error) {
+	dirs, err := ListRuntimeDataDirs(dataDir)
+	if err != nil {
+		return RuntimeDataDir{}, err
+	}
+
+	var target *RuntimeDataDir
+	for i := range dirs {
+		if (refDigest == "" && !dirs[i].Current) || dirs[i].Name == refDigest {
+			target = &dirs[i]
+			break
+		}
+	}
+	if target == nil {
+		if refDigest == "" {
+			return RuntimeDataDir{}, fmt.Errorf("no previous runtime data directory is available in %s", filepath.Join(dataDir, "data"))
+		}
+		return RuntimeDataDir{}, fmt.Errorf("runtime data directory %s not found in %s", refDigest, filepath.Join(dataDir, "data"))
+	}
+
+	problems, err := verifyChecksums(dataDir, target.Name)
+	if errors.Is(err, errChecksumsNotRecorded) {
+		logrus.Warnf("Runtime data directory %s was extracted by a release that did not record checksums; its content cannot be verified", target.Name)
+	} else if err != nil {
+		return RuntimeDataDir{}, err
+	}
+	if len(problems) > 0 {
+		return RuntimeDataDir{}, fmt.Errorf("runtime data directory %s does not match checksums recorded at extract time: %s", target.Name, strings.Join(problems, ", "))
+	}
+	return *target, nil
+}
+
+// RuntimeImageForDataDir returns the runtime image reference that selects the named runtime data directory when
+// used as the runtime image override. The directory name is derived from the reference string, which is not
+// always the form that was recorded: directories extracted by previous releases record the fully qualified
+// image name. Equivalent forms of the recorded image are tried until one matches the directory name.
+func RuntimeImageForDataDir(refDigest string, image string) (string, error) {
+	ref, err := name.ParseReference(image, name.WeakValidation)
+	if err != nil {
+		return "", errors.WithMessagef(err, "invalid runtime image %s recorded for %s", image, refDigest)
+	}
+	candidates := []string{image, ref.String(), ref.Name()}
+	if t, ok := ref.(name.Tag); ok {
+		repo := t.Context().RepositoryStr()
+		if t.Context().RegistryStr() == name.DefaultRegistry {
+			candidates = append(candidates, repo+":"+t.TagStr(), "docker.io/"+repo+":"+t.TagStr())
+		}
+	}
+	for _, candidate := range candidates {
+		c, err := name.ParseReference(candidate, name.WeakValidation)
+		if err != nil {
+			continue
+		}
+		if d, err := releaseRefDigest(c); err == nil && d == refDigest {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("runtime image %s does not match runtime data directory %s", image, refDigest)
+}
+
+// Rollback points dataDir/bin at a previously extracted runtime data directory.
+func Rollback(dataDir string, dir RuntimeDataDir) error {
+	symlink := symlinkBinDir(dataDir)
+	if err := os.RemoveAll(symlink); err != nil {
+		return err
+	}
+	return os.Symlink(binDirForDigest(dataDir, dir.Name), symlink)
+}
+
+// cleanDataDirs removes directories from /data that do not match the current version/refdigest, and are not retained.
+// Directories that were not completely extracted are always removed, unless they are still referenced by containers.
+func cleanDataDirs(dataDir string, refDigest string, retention Retention) error {
+	retained := map[string]bool{}
+	dirs, err := ListRuntimeDataDirs(dataDir)
+	if err != nil {
+		return err
+	}
+	var count int
+	var size int64
+	for _, dir := range dirs {
+		if dir.Name == refDigest {
+			continue
+		}
+		if count >= retention.Count || (retention.Size > 0 && size+dir.Size > retention.Size) {
+			continue
+		}
+		logrus.Infof("Retaining previous RKE2 data directory %s for rollback", dir.Path)
+		retained[dir.Name] = true
+		count++
+		size += dir.Size
+	}
+
+	datapath := filepath.Join(dataDir, "data")
+	entries, err := os.ReadDir(datapath)
+
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if entry.Name() == refDigest || retained[entry.Name()] {
+			continue
+		}
+		if !releasePattern.MatchString(entry.Name()) {
+			continue
+		}
+
+		oldpath := filepath.Join(datapath, entry.Name())
+		if dirHasShims(oldpath) {
+			logrus.Infof("Skipping removal of old RKE2 data directory %s: still referenced by containers", oldpath)
+			continue
+		}
+		logrus.Infof("Removing old RKE2 data directory: %s", oldpath)
+		if err := os.RemoveAll(oldpath); err != nil {
+			logrus.Warnf("Failed to removed old data directory %s: %v", oldpath, err)
+		}
+	}
+	return nil
+}
+
+// dirSize returns the total size of the regular files within a directory.
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
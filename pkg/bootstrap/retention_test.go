@@ -0,0 +1,99 @@
+package bootstrap
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/rancher/rke2/pkg/images"
+)
+
+func Test_UnitRollback(t *testing.T) {
+	dataDir := t.TempDir()
+
+	// Extract two releases: the first by a release that recorded the fully qualified image name and no
+	// checksums, and the second by this release, which is in use.
+	extracted := map[string]string{}
+	for _, image := range []string{"rancher/rke2-runtime:v1.30.0-rke2r1", "rancher/rke2-runtime:v1.31.0-rke2r1"} {
+		resolver, err := images.NewResolver(images.ImageOverrideConfig{Runtime: image})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ref, err := resolver.GetReference(images.Runtime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		refDigest, err := releaseRefDigest(ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		extracted[image] = refDigest
+		for _, dir := range []string{binDirForDigest(dataDir, refDigest), chartsDirForDigest(dataDir, refDigest)} {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := os.WriteFile(filepath.Join(binDirForDigest(dataDir, refDigest), "kubelet"), []byte(image), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(completionMarkerForDigest(dataDir, refDigest), []byte(ref.Name()), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if image == "rancher/rke2-runtime:v1.31.0-rke2r1" {
+			if err := writeChecksums(dataDir, refDigest); err != nil {
+				t.Fatal(err)
+			}
+			if err := writeImageRefs(dataDir, refDigest, resolver); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Symlink(binDirForDigest(dataDir, refDigest), symlinkBinDir(dataDir)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	dir, err := FindRollback(dataDir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := extracted["rancher/rke2-runtime:v1.30.0-rke2r1"]; dir.Name != expected {
+		t.Fatalf("expected rollback to %s, got %s", expected, dir.Name)
+	}
+	if err := Rollback(dataDir, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	// The runtime image override written by the rollback must select the same directory on the next start
+	image, err := RuntimeImageForDataDir(dir.Name, dir.Image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver, err := images.NewResolver(images.ImageOverrideConfig{Runtime: image})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := resolver.GetReference(images.Runtime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refDigest, err := releaseRefDigest(ref); err != nil || refDigest != dir.Name {
+		t.Errorf("expected %s to select %s, got %s: %v", image, dir.Name, refDigest, err)
+	}
+	if current, err := filepath.EvalSymlinks(symlinkBinDir(dataDir)); err != nil || filepath.Dir(current) != dir.Path {
+		t.Errorf("expected bin to point to %s, got %s: %v", dir.Path, current, err)
+	}
+
+	// Component images recorded by this release are recorded in the form that selects the same directory
+	refs, err := ReadImageRefs(dataDir, extracted["rancher/rke2-runtime:v1.31.0-rke2r1"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image, err := RuntimeImageForDataDir(extracted["rancher/rke2-runtime:v1.31.0-rke2r1"], refs[images.Runtime]); err != nil || image != refs[images.Runtime] {
+		t.Errorf("expected recorded runtime image %s to be used as-is, got %s: %v", refs[images.Runtime], image, err)
+	}
+
+	if _, err := RuntimeImageForDataDir(dir.Name, name.MustParseReference("rancher/rke2-runtime:v1.32.0-rke2r1").Name()); err == nil {
+		t.Error("expected error for runtime image that does not match the directory")
+	}
+}
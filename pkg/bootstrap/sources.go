@@ -0,0 +1,481 @@
+package bootstrap
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/k3s-io/k3s/pkg/cli/cmds"
+	daemonconfig "github.com/k3s-io/k3s/pkg/daemons/config"
+	"github.com/k3s-io/k3s/pkg/util/errors"
+	"github.com/rancher/rke2/pkg/images"
+	"github.com/rancher/wharfie/pkg/registries"
+	"github.com/rancher/wharfie/pkg/tarfile"
+	"github.com/rancher/wrangler/v3/pkg/merr"
+	"github.com/sirupsen/logrus"
+)
+
+// Runtime image source types, as used in the runtime image sources option.
+const (
+	SourceTarball   = "tarball"
+	SourceOCILayout = "oci-layout"
+	SourcePeers     = "peers"
+	SourceRegistry  = "registry"
+)
+
+// DefaultImageSources are the runtime image sources used if none are configured.
+var DefaultImageSources = []ImageSourceSpec{{Type: SourceTarball}, {Type: SourceRegistry}}
+
+// ImageSource provides the runtime image. Sources are tried in the configured order until one of them has the image.
+// New kinds of source are added by implementing this interface, and adding the source type to newImageSource.
+type ImageSource interface {
+	// String describes the source in log messages.
+	String() string
+	// Remote returns true if the source retrieves content over the network. Remote sources are retried as
+	// configured by the pull options, and their layers are cached while they are pulled.
+	Remote() bool
+	// Image returns the runtime image. If the source does not have the image, an error describing why is returned.
+	Image(ctx context.Context, resolver *images.Resolver) (*SourceImage, error)
+}
+
+// SourceImage is an image found by an image source, with the reference that it was found under,
+// and the statistics to record for it. IndexDigests are the digests of any indexes that the source
+// selected the image from, which the image signature may be for. Resume is set by remote sources
+// that can resume a partially pulled layer.
+type SourceImage struct {
+	Image        v1.Image
+	Ref          name.Reference
+	IndexDigests []v1.Hash
+	Resume       LayerResumer
+	Stats        ImagePullStats
+}
+
+// ImageSourceSpec is a configured image source, in the form type or type:path.
+type ImageSourceSpec struct {
+	Type string
+	Path string
+}
+
+func (s ImageSourceSpec) String() string {
+	if s.Path == "" {
+		return s.Type
+	}
+	return s.Type + ":" + s.Path
+}
+
+// ParseImageSources parses a list of image sources, in the form type or type:path. The tarball source defaults
+// to the airgap images directory, and the oci-layout source requires a path. An empty list returns the default sources.
+func ParseImageSources(specs []string) ([]ImageSourceSpec, error) {
+	var sources []ImageSourceSpec
+	for _, spec := range specs {
+		t, path, _ := strings.Cut(strings.TrimSpace(spec), ":")
+		switch t {
+		case SourceTarball:
+		case SourceOCILayout:
+			if path == "" {
+				return nil, fmt.Errorf("invalid runtime image source %q: %s requires a path", spec, SourceOCILayout)
+			}
+		case SourcePeers, SourceRegistry:
+			if path != "" {
+				return nil, fmt.Errorf("invalid runtime image source %q: %s does not take a path", spec, t)
+			}
+		default:
+			return nil, fmt.Errorf("invalid runtime image source %q: must be one of %s, %s, %s or %s", spec, SourceTarball, SourceOCILayout, SourcePeers, SourceRegistry)
+		}
+		sources = append(sources, ImageSourceSpec{Type: t, Path: path})
+	}
+	if len(sources) == 0 {
+		return DefaultImageSources, nil
+	}
+	return sources, nil
+}
+
+// newImageSources returns the image sources for the configured source specs.
+func newImageSources(specs []ImageSourceSpec, nodeConfig *daemonconfig.Node, cfg cmds.Agent) []ImageSource {
+	if len(specs) == 0 {
+		specs = DefaultImageSources
+	}
+	sources := make([]ImageSource, 0, len(specs))
+	for _, spec := range specs {
+		sources = append(sources, newImageSource(spec, nodeConfig, cfg))
+	}
+	return sources
+}
+
+func newImageSource(spec ImageSourceSpec, nodeConfig *daemonconfig.Node, cfg cmds.Agent) ImageSource {
+	switch spec.Type {
+	case SourceTarball:
+		if spec.Path == "" {
+			spec.Path = imagesDir(cfg.DataDir)
+		}
+		return &tarballSource{dir: spec.Path}
+	case SourceOCILayout:
+		return &layoutSource{path: spec.Path}
+	case SourcePeers:
+		return &peerSource{nodeConfig: nodeConfig}
+	default:
+		return &registrySource{nodeConfig: nodeConfig, cfg: cfg}
+	}
+}
+
+// findRuntimeImage tries each image source in order, returning the image from the first source that has it.
+// Sources are retried as configured by the pull options only if at least one of them is remote, so that
+// a node that only uses local sources fails immediately if the image is missing.
+func findRuntimeImage(ctx context.Context, resolver *images.Resolver, sources []ImageSource, opts StageOptions) (*SourceImage, ImageSource, error) {
+	pullOpts := PullOptions{}
+	for _, source := range sources {
+		if source.Remote() {
+			pullOpts = opts.Pull
+			break
+		}
+	}
+
+	var found *SourceImage
+	var foundSource ImageSource
+	err := withRetries(ctx, pullOpts, "get runtime image", func() error {
+		var errs []error
+		for _, source := range sources {
+			if source.Remote() {
+				opts.Status.Set(PhasePull, "trying %s", source)
+			}
+			si, err := source.Image(ctx, resolver)
+			if err != nil {
+				logrus.Infof("Runtime image not found in %s: %v", source, err)
+				errs = append(errs, errors.WithMessage(err, source.String()))
+				continue
+			}
+			logrus.Infof("Runtime image %s found in %s", si.Ref.Name(), source)
+			si.Stats.Image = si.Ref.Name()
+			si.Stats.Source = source.String()
+			si.Stats.Remote = source.Remote()
+			found, foundSource = si, source
+			return nil
+		}
+		return merr.NewErrors(errs...)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return found, foundSource, nil
+}
+
+// localCandidates returns the references to look for the runtime image under in local sources, using both the
+// default registry, and the user-configured registry (on the off chance they've retagged the images to match
+// their private registry). Local sources are searched by tag, as airgap image tarballs do not include the image
+// index that a locked digest usually refers to; images found by tag are checked with verifyPinnedDigest.
+func localCandidates(resolver *images.Resolver) ([]name.Reference, error) {
+	runtimeRef, err := resolver.GetUnlockedReference(images.Runtime)
+	if err != nil {
+		return nil, err
+	}
+
+	if runtimeRef.Context().Registry.Name() == images.DefaultRegistry {
+		// If the image is from the default registry, only check for that.
+		return []name.Reference{runtimeRef}, nil
+	}
+	// If the image is from a different registry, check the default first, then the configured registry.
+	defaultRef, err := resolver.GetUnlockedReference(images.Runtime, images.WithRegistry(images.DefaultRegistry))
+	if err != nil {
+		return nil, err
+	}
+	return []name.Reference{defaultRef, runtimeRef}, nil
+}
+
+// verifyPinnedDigest checks that an image loaded from a local source matches the digest that the runtime image is
+// pinned to, either by the image lock file or by a digest override. The digest may refer to the image manifest or
+// config, or to one of the given index digests that the image was found under. Image tarballs do not retain the
+// index, so an image that is pinned to an index digest is only accepted from an OCI image layout that contains it.
+func verifyPinnedDigest(resolver *images.Resolver, img v1.Image, indexDigests ...v1.Hash) error {
+	ref, err := resolver.GetReference(images.Runtime)
+	if err != nil {
+		return err
+	}
+	pinned, ok := ref.(name.Digest)
+	if !ok {
+		return nil
+	}
+	want, err := v1.NewHash(pinned.DigestStr())
+	if err != nil {
+		return err
+	}
+	manifestDigest, err := img.Digest()
+	if err != nil {
+		return err
+	}
+	configDigest, err := img.ConfigName()
+	if err != nil {
+		return err
+	}
+	if slices.Contains(append(indexDigests, manifestDigest, configDigest), want) {
+		return nil
+	}
+	return fmt.Errorf("image digest %s does not match pinned digest %s", manifestDigest, want)
+}
+
+// tarballSource loads the runtime image from the airgap image tarballs in a directory.
+type tarballSource struct {
+	dir string
+}
+
+func (s *tarballSource) String() string {
+	return "image tarballs in " + s.dir
+}
+
+func (s *tarballSource) Remote() bool {
+	return false
+}
+
+func (s *tarballSource) Image(_ context.Context, resolver *images.Resolver) (*SourceImage, error) {
+	if _, err := os.Stat(s.dir); err != nil {
+		return nil, err
+	}
+	refs, err := localCandidates(resolver)
+	if err != nil {
+		return nil, err
+	}
+	for _, ref := range refs {
+		img, err := tarfile.FindImage(s.dir, ref)
+		if img != nil {
+			if err != nil {
+				return nil, err
+			}
+			if err := verifyPinnedDigest(resolver, img); err != nil {
+				return nil, errors.WithMessagef(err, "runtime image %s in tarball", ref.Name())
+			}
+			return &SourceImage{Image: img, Ref: ref}, nil
+		}
+		if err != nil {
+			logrus.Warnf("Failed to load runtime image %s from tarball: %v", ref.Name(), err)
+		}
+	}
+	return nil, fmt.Errorf("no tarball contains %s", refNames(refs))
+}
+
+// layoutSource loads the runtime image from an OCI image layout directory, such as one written by the images mirror command.
+type layoutSource struct {
+	path string
+}
+
+func (s *layoutSource) String() string {
+	return "OCI image layout at " + s.path
+}
+
+func (s *layoutSource) Remote() bool {
+	return false
+}
+
+func (s *layoutSource) Image(_ context.Context, resolver *images.Resolver) (*SourceImage, error) {
+	p, err := layout.FromPath(s.path)
+	if err != nil {
+		return nil, err
+	}
+	index, err := p.ImageIndex()
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to read index")
+	}
+	refs, err := localCandidates(resolver)
+	if err != nil {
+		return nil, err
+	}
+	for _, ref := range refs {
+		digest, err := images.FindInIndex(index, ref)
+		if err != nil {
+			continue
+		}
+		img, err := platformImage(index, digest)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "failed to load %s", ref.Name())
+		}
+		if err := verifyPinnedDigest(resolver, img, digest); err != nil {
+			return nil, errors.WithMessagef(err, "runtime image %s in layout", ref.Name())
+		}
+		return &SourceImage{Image: img, Ref: ref, IndexDigests: []v1.Hash{digest}}, nil
+	}
+	return nil, fmt.Errorf("index does not contain %s", refNames(refs))
+}
+
+// platformImage returns the image with the given digest from an index. If the digest refers to
+// a nested index, the image for the current platform is returned.
+func platformImage(index v1.ImageIndex, digest v1.Hash) (v1.Image, error) {
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	for _, desc := range manifest.Manifests {
+		if desc.Digest != digest {
+			continue
+		}
+		if desc.MediaType != types.OCIImageIndex && desc.MediaType != types.DockerManifestList {
+			return index.Image(digest)
+		}
+		child, err := index.ImageIndex(digest)
+		if err != nil {
+			return nil, err
+		}
+		childManifest, err := child.IndexManifest()
+		if err != nil {
+			return nil, err
+		}
+		platform := images.Platform()
+		for _, desc := range childManifest.Manifests {
+			if desc.Platform != nil && desc.Platform.Satisfies(platform) {
+				return child.Image(desc.Digest)
+			}
+		}
+		return nil, fmt.Errorf("no image for platform %s", platform)
+	}
+	return nil, fmt.Errorf("digest %s not found in index", digest)
+}
+
+// registrySource pulls the runtime image from each of the default registries in turn, using the private
+// registry configuration. Mirrors for each registry, including the embedded registry, are tried as configured.
+type registrySource struct {
+	nodeConfig *daemonconfig.Node
+	cfg        cmds.Agent
+}
+
+func (s *registrySource) String() string {
+	return "registries"
+}
+
+func (s *registrySource) Remote() bool {
+	return true
+}
+
+func (s *registrySource) Image(ctx context.Context, resolver *images.Resolver) (*SourceImage, error) {
+	registry, err := privateRegistry(s.nodeConfig, s.cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Try each of the default registries in order, so that an unavailable registry
+	// does not prevent the runtime image from being pulled from a fallback registry.
+	candidates, err := resolver.GetReferences(images.Runtime)
+	if err != nil {
+		return nil, err
+	}
+	var errs []error
+	for _, candidate := range candidates {
+		logrus.Infof("Pulling runtime image %s", candidate.Name())
+		trace := &endpointTrace{}
+		img, err := registry.Image(candidate, remote.WithPlatform(images.Platform()), remote.WithContext(trace.withContext(ctx)))
+		if err != nil {
+			logrus.Warnf("Failed to get runtime image %s: %v", candidate.Name(), err)
+			errs = append(errs, err)
+			continue
+		}
+		mirror := trace.mirror(registryEndpoints(s.nodeConfig, candidate))
+		return &SourceImage{
+			Image:  img,
+			Ref:    candidate,
+			Resume: s.resumer(candidate.Context()),
+			Stats:  ImagePullStats{Mirror: mirror, Peer: mirror != "" && isEmbeddedRegistryEndpoint(s.nodeConfig, mirror)},
+		}, nil
+	}
+	return nil, merr.NewErrors(errs...)
+}
+
+// resumer returns a LayerResumer that requests the remainder of partially pulled layers from the repository,
+// using the same mirrors and credentials as the image was pulled with.
+func (s *registrySource) resumer(repo name.Repository) LayerResumer {
+	var registry *images.RemoteRegistry
+	return func(ctx context.Context, digest v1.Hash, offset, size int64) (io.ReadCloser, int64, error) {
+		if registry == nil {
+			keychain, err := privateKeychain(s.nodeConfig)
+			if err != nil {
+				return nil, 0, err
+			}
+			registry = images.NewRemoteRegistryFromConfig(s.nodeConfig.AgentConfig.Registry, keychain)
+		}
+		return registry.Blob(ctx, repo, digest, offset, size)
+	}
+}
+
+// peerSource pulls the runtime image only from embedded registry peers, without falling back to upstream registries.
+type peerSource struct {
+	nodeConfig *daemonconfig.Node
+}
+
+func (s *peerSource) String() string {
+	return "embedded registry peers"
+}
+
+func (s *peerSource) Remote() bool {
+	return true
+}
+
+func (s *peerSource) Image(ctx context.Context, resolver *images.Resolver) (*SourceImage, error) {
+	if !isEmbeddedRegistryConfigured(s.nodeConfig) {
+		return nil, fmt.Errorf("embedded registry is not enabled, or has no mirrors configured")
+	}
+	keychain, err := privateKeychain(s.nodeConfig)
+	if err != nil {
+		return nil, err
+	}
+	// Requests are only sent to the embedded registry mirror endpoints, so that neither the image
+	// nor any of its layers are pulled from the default endpoint for the registry.
+	registry := images.NewRemoteRegistryFromConfig(embeddedRegistryConfig(s.nodeConfig), keychain).MirrorsOnly()
+	candidates, err := resolver.GetReferences(images.Runtime)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	for _, candidate := range candidates {
+		trace := &endpointTrace{}
+		img, err := registry.Image(trace.withContext(ctx), candidate, remote.WithPlatform(images.Platform()))
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			errs = append(errs, errors.WithMessagef(err, "%s is not available from peers", candidate.Name()))
+			continue
+		}
+		repo := candidate.Context()
+		return &SourceImage{
+			Image: img,
+			Ref:   candidate,
+			Resume: func(ctx context.Context, digest v1.Hash, offset, size int64) (io.ReadCloser, int64, error) {
+				return registry.Blob(ctx, repo, digest, offset, size)
+			},
+			Stats: ImagePullStats{Mirror: trace.mirror(registryEndpoints(s.nodeConfig, candidate)), Peer: true},
+		}, nil
+	}
+	return nil, merr.NewErrors(errs...)
+}
+
+// embeddedRegistryConfig returns a copy of the node's registry configuration,
+// with mirror endpoints limited to the embedded registry.
+func embeddedRegistryConfig(nodeConfig *daemonconfig.Node) *registries.Registry {
+	registry := *nodeConfig.AgentConfig.Registry
+	registry.Mirrors = map[string]registries.Mirror{}
+	for host, mirror := range nodeConfig.AgentConfig.Registry.Mirrors {
+		var endpoints []string
+		for _, endpoint := range mirror.Endpoints {
+			if isEmbeddedRegistryEndpoint(nodeConfig, endpointAddress(endpoint)) {
+				endpoints = append(endpoints, endpoint)
+			}
+		}
+		if len(endpoints) > 0 {
+			registry.Mirrors[host] = registries.Mirror{Endpoints: endpoints, Rewrites: mirror.Rewrites}
+		}
+	}
+	return &registry
+}
+
+// refNames returns the names of a list of references, for use in messages.
+func refNames(refs []name.Reference) string {
+	names := make([]string, 0, len(refs))
+	for _, ref := range refs {
+		names = append(names, ref.Name())
+	}
+	return strings.Join(names, " or ")
+}
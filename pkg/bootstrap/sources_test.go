@@ -0,0 +1,175 @@
+package bootstrap
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/rancher/rke2/pkg/images"
+)
+
+func Test_UnitParseImageSources(t *testing.T) {
+	tests := []struct {
+		name    string
+		specs   []string
+		want    []ImageSourceSpec
+		wantErr bool
+	}{
+		{
+			name: "default",
+			want: DefaultImageSources,
+		},
+		{
+			name:  "all sources",
+			specs: []string{"tarball", " oci-layout:/var/lib/images/layout ", "peers", "registry"},
+			want: []ImageSourceSpec{
+				{Type: SourceTarball},
+				{Type: SourceOCILayout, Path: "/var/lib/images/layout"},
+				{Type: SourcePeers},
+				{Type: SourceRegistry},
+			},
+		},
+		{
+			name:  "tarball with path",
+			specs: []string{"tarball:/opt/images"},
+			want:  []ImageSourceSpec{{Type: SourceTarball, Path: "/opt/images"}},
+		},
+		{
+			name:    "oci-layout without path",
+			specs:   []string{"oci-layout"},
+			wantErr: true,
+		},
+		{
+			name:    "peers with path",
+			specs:   []string{"peers:/opt/images"},
+			wantErr: true,
+		},
+		{
+			name:    "registry with path",
+			specs:   []string{"registry:registry.example.com"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown source",
+			specs:   []string{"tarball", "http"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseImageSources(tt.specs)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseImageSources() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected sources %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+// fakeSource is an image source that fails until it has been called a given number of times.
+type fakeSource struct {
+	remote bool
+	found  int
+	calls  int
+}
+
+func (s *fakeSource) String() string {
+	return fmt.Sprintf("fake source (remote %t)", s.remote)
+}
+
+func (s *fakeSource) Remote() bool {
+	return s.remote
+}
+
+func (s *fakeSource) Image(_ context.Context, _ *images.Resolver) (*SourceImage, error) {
+	s.calls++
+	if s.found == 0 || s.calls < s.found {
+		return nil, fmt.Errorf("image not found")
+	}
+	img, err := random.Image(64, 1)
+	if err != nil {
+		return nil, err
+	}
+	ref, err := name.ParseReference("rancher/rke2-runtime:v1")
+	if err != nil {
+		return nil, err
+	}
+	return &SourceImage{Image: img, Ref: ref}, nil
+}
+
+func Test_UnitFindRuntimeImage(t *testing.T) {
+	opts := StageOptions{Pull: PullOptions{Retries: 2, Backoff: time.Millisecond}}
+	// The backoff is long enough that the test times out if local sources are retried
+	slowOpts := StageOptions{Pull: PullOptions{Retries: 2, Backoff: time.Hour}}
+
+	tests := []struct {
+		name      string
+		sources   []*fakeSource
+		opts      StageOptions
+		wantErr   bool
+		wantFound int
+		wantCalls []int
+	}{
+		{
+			name:      "local sources fail fast",
+			sources:   []*fakeSource{{}, {}},
+			opts:      slowOpts,
+			wantErr:   true,
+			wantCalls: []int{1, 1},
+		},
+		{
+			name:      "first source that has the image",
+			sources:   []*fakeSource{{}, {found: 1}, {found: 1}},
+			opts:      slowOpts,
+			wantFound: 1,
+			wantCalls: []int{1, 1, 0},
+		},
+		{
+			name:      "remote sources are retried",
+			sources:   []*fakeSource{{}, {remote: true, found: 3}},
+			opts:      opts,
+			wantFound: 1,
+			wantCalls: []int{3, 3},
+		},
+		{
+			name:      "retries are exhausted",
+			sources:   []*fakeSource{{}, {remote: true}},
+			opts:      opts,
+			wantErr:   true,
+			wantCalls: []int{3, 3},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sources := make([]ImageSource, 0, len(tt.sources))
+			for _, source := range tt.sources {
+				sources = append(sources, source)
+			}
+			si, source, err := findRuntimeImage(context.Background(), nil, sources, tt.opts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("findRuntimeImage() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr {
+				if source != sources[tt.wantFound] {
+					t.Errorf("expected image from %s, got %s", sources[tt.wantFound], source)
+				}
+				if si.Stats.Source != source.String() || si.Stats.Remote != source.Remote() {
+					t.Errorf("unexpected stats for %s: %+v", source, si.Stats)
+				}
+			}
+			for i, source := range tt.sources {
+				if source.calls != tt.wantCalls[i] {
+					t.Errorf("expected %d calls to source %d, got %d", tt.wantCalls[i], i, source.calls)
+				}
+			}
+		})
+	}
+}
@@ -2,17 +2,26 @@ package bootstrap
 
 import (
 	"context"
+	"net"
 	"net/url"
 	"time"
 
 	"github.com/containerd/containerd/v2/core/remotes/docker"
 	daemonconfig "github.com/k3s-io/k3s/pkg/daemons/config"
 	"github.com/k3s-io/k3s/pkg/spegel"
+	"github.com/k3s-io/k3s/pkg/util"
 	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/wait"
 )
 
-const registryWaitTime = time.Second * 15
+// RegistryWaitOptions configures the wait for embedded registry peers before the runtime image is pulled.
+// A MinPeers of 0 disables the wait. The wait ends after Timeout even if not enough peers are available,
+// so that the runtime image can still be pulled from upstream.
+type RegistryWaitOptions struct {
+	MinPeers int
+	Timeout  time.Duration
+}
 
 // isEmbeddedRegistryConfigured returns true if the embedded registry is enabled
 // and has at least one valid mirror configured.
@@ -27,15 +36,87 @@ func isEmbeddedRegistryConfigured(nodeConfig *daemonconfig.Node) bool {
 	return hasValidMirrors && nodeConfig.EmbeddedRegistry && spegel.DefaultRegistry != nil
 }
 
-// WaitForEmbeddedRegistry waits for the embedded registry to become ready, if it is enabled.
-func WaitForEmbeddedRegistry(ctx context.Context, nodeConfig *daemonconfig.Node) error {
+// isEmbeddedRegistryEndpoint returns true if a registry endpoint address refers to the embedded registry on this node.
+func isEmbeddedRegistryEndpoint(nodeConfig *daemonconfig.Node, hostPort string) bool {
+	host, _, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		host = hostPort
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() {
+		return true
+	}
+	for _, nodeIP := range nodeConfig.AgentConfig.NodeIPs {
+		if ip.Equal(nodeIP) {
+			return true
+		}
+	}
+	return false
+}
+
+// WaitForEmbeddedRegistry waits for the embedded registry to become ready with at least the configured
+// number of peers, if it is enabled. If the timeout expires first, a warning is logged and nil is returned.
+func WaitForEmbeddedRegistry(ctx context.Context, nodeConfig *daemonconfig.Node, opts StageOptions) error {
+	if !isEmbeddedRegistryConfigured(nodeConfig) || opts.Registry.MinPeers == 0 {
+		return nil
+	}
+
 	// if spegel is enabled, wait for it to start up so that we can attempt to pull content through it
-	if isEmbeddedRegistryConfigured(nodeConfig) {
-		logrus.Infof("Waiting up to %s for embedded registry to find peers", registryWaitTime)
-		return wait.PollUntilContextTimeout(ctx, time.Second, registryWaitTime, true, func(ctx context.Context) (bool, error) {
-			ready, _ := spegel.DefaultRegistry.Ready(ctx)
-			return ready, nil
-		})
+	minPeers := opts.Registry.MinPeers
+	opts.Status.Set(PhaseWaitForRegistry, "up to %s for %d peers", opts.Registry.Timeout, minPeers)
+	start := time.Now()
+	var ready bool
+	var peers int
+	err := wait.PollUntilContextTimeout(ctx, time.Second, opts.Registry.Timeout, true, func(ctx context.Context) (bool, error) {
+		ready, _ = spegel.DefaultRegistry.Ready(ctx)
+		if !ready {
+			return false, nil
+		}
+		// The embedded registry is only ready once it has at least one peer, so the peer count only needs to
+		// be checked if more than one peer is required.
+		if minPeers == 1 {
+			peers = 1
+			return true, nil
+		}
+		peers = countRegistryPeers(ctx, nodeConfig)
+		return peers >= minPeers, nil
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		if !ready {
+			logrus.Warnf("Embedded registry did not become ready within %s; the runtime image may be pulled from upstream", opts.Registry.Timeout)
+		} else {
+			logrus.Warnf("Embedded registry found %d of %d peers within %s; the runtime image may be pulled from upstream", peers, minPeers, opts.Registry.Timeout)
+		}
+		return nil
 	}
+	logrus.Infof("Embedded registry ready with %d peers after %s", peers, time.Since(start).Round(time.Second))
 	return nil
 }
+
+// countRegistryPeers returns the number of other nodes that advertise an embedded registry peer address.
+// Errors are logged at debug level and treated as no peers, as the apiserver may not be available yet.
+func countRegistryPeers(ctx context.Context, nodeConfig *daemonconfig.Node) int {
+	client, err := util.GetClientSet(nodeConfig.AgentConfig.KubeConfigKubelet)
+	if err != nil {
+		logrus.Debugf("Failed to create client to count embedded registry peers: %v", err)
+		return 0
+	}
+	nodes, err := client.CoreV1().Nodes().List(ctx, metav1.ListOptions{LabelSelector: spegel.P2pEnabledLabel + "=true"})
+	if err != nil {
+		logrus.Debugf("Failed to list nodes to count embedded registry peers: %v", err)
+		return 0
+	}
+	var peers int
+	for _, node := range nodes.Items {
+		if node.Name != nodeConfig.AgentConfig.NodeName && node.Annotations[spegel.P2pAddressAnnotation] != "" {
+			peers++
+		}
+	}
+	return peers
+}
@@ -62,12 +62,11 @@ var (
 		"bind-address":                      copyFlag,
 		"enable-pprof":                      copyFlag,
 	})
-	deprecatedFlags = []cli.Flag{
+	agentFlags = []cli.Flag{
 		&cli.StringFlag{
 			Name:    "system-default-registry",
-			Usage:   "(deprecated) This flag is no longer supported on agents",
+			Usage:   "(image) Comma-separated list of fallback registries to use if images cannot be pulled from the system default registry set by the server. The first registry should match the server's system default registry",
 			EnvVars: []string{"RKE2_SYSTEM_DEFAULT_REGISTRY"},
-			Hidden:  true,
 		},
 	}
 )
@@ -75,7 +74,7 @@ var (
 func NewAgentCommand() *cli.Command {
 	cmd := k3sAgentBase
 	cmd.Flags = append(cmd.Flags, commonFlag...)
-	cmd.Flags = append(cmd.Flags, deprecatedFlags...)
+	cmd.Flags = append(cmd.Flags, agentFlags...)
 	cmd.Subcommands = agentSubcommands()
 	configfilearg.DefaultParser.ValidFlags[cmd.Name] = cmd.Flags
 	return cmd
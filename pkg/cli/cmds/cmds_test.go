@@ -21,6 +21,10 @@ func Test_NewCommands(t *testing.T) {
 		NewSecretsEncryptCommand(),
 		NewTokenCommand(),
 		NewCompletionCommand(),
+		NewImagesCommand(),
+		NewVerifyInstallCommand(),
+		NewRollbackCommand(),
+		NewIngressCommand(),
 	}
 
 	for _, command := range app.Commands {
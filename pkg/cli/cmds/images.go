@@ -0,0 +1,127 @@
+package cmds
+
+import (
+	"github.com/k3s-io/k3s/pkg/cli/cmds"
+	"github.com/k3s-io/k3s/pkg/configfilearg"
+	"github.com/k3s-io/k3s/pkg/version"
+	"github.com/rancher/rke2/pkg/images"
+	"github.com/rancher/rke2/pkg/rke2"
+	"github.com/rancher/wrangler/v3/pkg/slice"
+	"github.com/urfave/cli/v2"
+)
+
+// privateRegistryFlag sets the private registry configuration used by the images subcommands that access registries.
+var privateRegistryFlag = &cli.StringFlag{
+	Name:    "private-registry",
+	Usage:   "(images) Private registry configuration file, used for registry mirrors, credentials and TLS settings",
+	EnvVars: []string{"RKE2_PRIVATE_REGISTRY"},
+	Value:   "/etc/rancher/" + version.Program + "/registries.yaml",
+}
+
+func NewImagesCommand() *cli.Command {
+	imagesFlags := []cli.Flag{
+		cmds.ConfigFlag,
+		cmds.DebugFlag,
+		&cli.StringFlag{
+			Name:    "data-dir",
+			Aliases: []string{"d"},
+			Usage:   "(data) Folder to hold state",
+			EnvVars: []string{"RKE2_DATA_DIR"},
+			Value:   rke2Path,
+		},
+		&cli.StringFlag{
+			Name:        "system-default-registry",
+			Usage:       "(agent/runtime) Private registry to be used for all system images. A comma-separated list may be provided; additional registries are used as fallbacks, in order",
+			EnvVars:     []string{"RKE2_SYSTEM_DEFAULT_REGISTRY"},
+			Destination: &config.Images.SystemDefaultRegistry,
+		},
+		PrimeFlag,
+	}
+	imagesFlags = append(imagesFlags, imageOverrideFlags()...)
+
+	listFlags := append([]cli.Flag{
+		&cli.StringFlag{
+			Name:    "output",
+			Aliases: []string{"o"},
+			Usage:   "(images) Output format: text, json, yaml",
+			Value:   "text",
+		},
+	}, imagesFlags...)
+
+	lockFlags := append([]cli.Flag{
+		&cli.StringFlag{
+			Name:  "oci-layout",
+			Usage: "(images) Resolve image digests from the OCI image layout at the given path, instead of from the registry",
+		},
+		privateRegistryFlag,
+	}, imagesFlags...)
+
+	mirrorFlags := append([]cli.Flag{
+		&cli.StringFlag{
+			Name:  "registry",
+			Usage: "(images) Registry to copy images into, with optional repository path prefix",
+		},
+		&cli.StringFlag{
+			Name:  "oci-layout",
+			Usage: "(images) Path to an OCI image layout to copy images into; created if it does not exist",
+		},
+		&cli.StringSliceFlag{
+			Name:  "platform",
+			Usage: "(images) Only copy images for the given platform, in the form os/arch[/variant]. Images with platform-specific overrides are copied for each of the given platforms, or for every override if no platform is given. May be specified multiple times",
+		},
+		privateRegistryFlag,
+	}, imagesFlags...)
+
+	cmd := &cli.Command{
+		Name:  "images",
+		Usage: "Inspect the images used by RKE2",
+		Subcommands: []*cli.Command{
+			{
+				Name:   "list",
+				Usage:  "List all images that this node will need, including images used by bundled charts",
+				Flags:  listFlags,
+				Action: ImagesList,
+			},
+			{
+				Name:   "lock",
+				Usage:  "Resolve the current image tags to digests, and write them to the image lock file",
+				Flags:  lockFlags,
+				Action: ImagesLock,
+			},
+			{
+				Name:   "mirror",
+				Usage:  "Copy all images that this node will need, including images used by bundled charts, into a registry or OCI image layout",
+				Flags:  mirrorFlags,
+				Action: ImagesMirror,
+			},
+		},
+	}
+
+	// Allow the config file to be used to set flags for the images subcommands
+	configfilearg.DefaultParser.After = append(configfilearg.DefaultParser.After, cmd.Name+":1")
+	configfilearg.DefaultParser.ValidFlags[cmd.Name] = imagesFlags
+	return cmd
+}
+
+// imageOverrideFlags returns the image override, rewrite, and lock file flags from the flags common to both server and agent.
+func imageOverrideFlags() []cli.Flag {
+	var flags []cli.Flag
+	for _, flag := range commonFlag {
+		if name := parseName(flag); name == "image-lock-file" || name == "image-rewrite" || slice.ContainsString(images.All, name) {
+			flags = append(flags, flag)
+		}
+	}
+	return flags
+}
+
+func ImagesList(clx *cli.Context) error {
+	return rke2.ImagesList(clx, config)
+}
+
+func ImagesLock(clx *cli.Context) error {
+	return rke2.ImagesLock(clx, config)
+}
+
+func ImagesMirror(clx *cli.Context) error {
+	return rke2.ImagesMirror(clx, config)
+}
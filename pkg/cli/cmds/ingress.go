@@ -0,0 +1,60 @@
+package cmds
+
+import (
+	"github.com/k3s-io/k3s/pkg/cli/cmds"
+	"github.com/k3s-io/k3s/pkg/configfilearg"
+	"github.com/rancher/rke2/pkg/rke2"
+	"github.com/urfave/cli/v2"
+)
+
+func NewIngressCommand() *cli.Command {
+	migrateFlags := []cli.Flag{
+		cmds.DebugFlag,
+		&cli.StringFlag{
+			Name:    "kubeconfig",
+			Usage:   "(cluster) Kubeconfig file used to access the cluster",
+			EnvVars: []string{"KUBECONFIG"},
+			Value:   "/etc/rancher/rke2/rke2.yaml",
+		},
+		&cli.StringFlag{
+			Name:  "namespace",
+			Usage: "(migrate) Only migrate Ingresses in this namespace. Defaults to all namespaces",
+		},
+		&cli.BoolFlag{
+			Name:  "apply",
+			Usage: "(migrate) Create Middlewares and move Ingresses to the traefik ingress class. Without this flag, the migration is only reported",
+		},
+		&cli.BoolFlag{
+			Name:  "force",
+			Usage: "(migrate) Migrate Ingresses even if some of their nginx annotations cannot be translated",
+		},
+		&cli.StringFlag{
+			Name:  "rollback-file",
+			Usage: "(migrate) File to record the Ingresses and Middlewares in, before they are changed. Defaults to a timestamped file in the current directory",
+		},
+		&cli.StringFlag{
+			Name:  "rollback",
+			Usage: "(migrate) Roll back the migration recorded in this file",
+		},
+	}
+
+	migrateCmd := &cli.Command{
+		Name:   "migrate",
+		Usage:  "Move Ingresses from the nginx ingress class to traefik, translating nginx annotations into traefik Middlewares",
+		Flags:  migrateFlags,
+		Action: MigrateIngress,
+	}
+
+	cmd := &cli.Command{
+		Name:        "ingress",
+		Usage:       "Manage ingress controllers",
+		Subcommands: []*cli.Command{migrateCmd},
+	}
+
+	configfilearg.DefaultParser.ValidFlags[cmd.Name] = migrateFlags
+	return cmd
+}
+
+func MigrateIngress(clx *cli.Context) error {
+	return rke2.MigrateIngress(clx)
+}
@@ -0,0 +1,44 @@
+package cmds
+
+import (
+	"github.com/k3s-io/k3s/pkg/cli/cmds"
+	"github.com/k3s-io/k3s/pkg/configfilearg"
+	"github.com/rancher/rke2/pkg/rke2"
+	"github.com/urfave/cli/v2"
+)
+
+func NewRollbackCommand() *cli.Command {
+	rollbackFlags := []cli.Flag{
+		cmds.ConfigFlag,
+		cmds.DebugFlag,
+		&cli.StringFlag{
+			Name:    "data-dir",
+			Aliases: []string{"d"},
+			Usage:   "(data) Folder to hold state",
+			EnvVars: []string{"RKE2_DATA_DIR"},
+			Value:   rke2Path,
+		},
+		&cli.StringFlag{
+			Name:  "to",
+			Usage: "(rollback) Name of the runtime data directory to roll back to. Defaults to the most recently extracted directory other than the current one",
+		},
+		&cli.BoolFlag{
+			Name:  "list",
+			Usage: "(rollback) List the runtime data directories that are available to roll back to",
+		},
+	}
+
+	cmd := &cli.Command{
+		Name:   "rollback",
+		Usage:  "Roll back to binaries and images from a previously extracted runtime image",
+		Flags:  rollbackFlags,
+		Action: Rollback,
+	}
+
+	configfilearg.DefaultParser.ValidFlags[cmd.Name] = rollbackFlags
+	return cmd
+}
+
+func Rollback(clx *cli.Context) error {
+	return rke2.Rollback(clx)
+}
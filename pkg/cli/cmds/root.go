@@ -7,6 +7,7 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"time"
 
 	"github.com/k3s-io/k3s/pkg/version"
 	rke2cli "github.com/rancher/rke2/pkg/cli"
@@ -15,6 +16,9 @@ import (
 	"github.com/urfave/cli/v2"
 )
 
+const extraMountUsage = " extra volume mounts, in the form source:destination[:ro|rw[:type]], or as comma-separated key=value options: " +
+	"type (hostPath or emptyDir), source, destination, readOnly, hostPathType, mountPropagation, subPath, medium, sizeLimit, selinuxRelabel"
+
 var (
 	appName    = filepath.Base(os.Args[0])
 	config     = rke2cli.Config{}
@@ -67,12 +71,88 @@ var (
 			EnvVars:     []string{"RKE2_ETCD_IMAGE"},
 			Destination: &config.Images.ETCD,
 		},
+		&cli.StringFlag{
+			Name:        "image-lock-file",
+			Usage:       "(image) Path to a file that pins images to digests (default: " + images.DefaultLockFile + ", if it exists)",
+			EnvVars:     []string{"RKE2_IMAGE_LOCK_FILE"},
+			Destination: &config.Images.LockFile,
+		},
+		&cli.StringFlag{
+			Name:        "image-signature-policy",
+			Usage:       "(image) Path to a file that configures verification of image signatures against public keys on the node. Images loaded from airgap image tarballs must be in OCI-layout archives to be verified",
+			EnvVars:     []string{"RKE2_IMAGE_SIGNATURE_POLICY"},
+			Destination: &config.Images.SignaturePolicy,
+		},
+		&cli.StringSliceFlag{
+			Name:    "image-rewrite",
+			Usage:   "(image) Rewrite rule for image repositories, in the form <regex>=<replacement>. Rules are matched against the fully-qualified repository name, and against the system-default-registry value passed to charts; escape = in the regex as \\=. The first matching rule is applied",
+			EnvVars: []string{"RKE2_IMAGE_REWRITE"},
+		},
 		&cli.StringFlag{
 			Name:        "kubelet-path",
 			Usage:       "(experimental/agent) Override kubelet binary path",
 			EnvVars:     []string{"RKE2_KUBELET_PATH"},
 			Destination: &config.KubeletPath,
 		},
+		&cli.StringFlag{
+			Name:        "runtime-integrity-action",
+			Usage:       "(agent/runtime) Action to take when binaries and charts extracted from the runtime image do not match the checksums recorded at extract time (reextract, fail)",
+			EnvVars:     []string{"RKE2_RUNTIME_INTEGRITY_ACTION"},
+			Value:       "reextract",
+			Destination: &config.RuntimeIntegrityAction,
+		},
+		&cli.IntFlag{
+			Name:        "runtime-data-retention",
+			Usage:       "(agent/runtime) Number of previous runtime data directories to keep for rollback after a new runtime image is extracted. Previous directories are removed if not set",
+			EnvVars:     []string{"RKE2_RUNTIME_DATA_RETENTION"},
+			Destination: &config.RuntimeDataRetention,
+		},
+		&cli.StringFlag{
+			Name:        "runtime-data-retention-size",
+			Usage:       "(agent/runtime) Maximum total size of previous runtime data directories kept for rollback, as a quantity such as 2Gi. Unlimited if not set",
+			EnvVars:     []string{"RKE2_RUNTIME_DATA_RETENTION_SIZE"},
+			Destination: &config.RuntimeDataRetentionSize,
+		},
+		&cli.IntFlag{
+			Name:        "runtime-image-pull-retries",
+			Usage:       "(agent/runtime) Number of times to retry pulling the runtime image from a registry. Layers that were completely pulled are not pulled again",
+			EnvVars:     []string{"RKE2_RUNTIME_IMAGE_PULL_RETRIES"},
+			Value:       5,
+			Destination: &config.RuntimeImagePullRetries,
+		},
+		&cli.DurationFlag{
+			Name:        "runtime-image-pull-backoff",
+			Usage:       "(agent/runtime) Delay before the first retry of a failed runtime image pull; doubled after each retry",
+			EnvVars:     []string{"RKE2_RUNTIME_IMAGE_PULL_BACKOFF"},
+			Value:       10 * time.Second,
+			Destination: &config.RuntimeImagePullBackoff,
+		},
+		&cli.StringSliceFlag{
+			Name:        "runtime-image-sources",
+			Usage:       "(agent/runtime) Ordered list of sources to load the runtime image from: tarball[:dir], oci-layout:dir, peers, or registry (default: tarball,registry). If neither peers nor registry is listed, the runtime image is never pulled over the network",
+			EnvVars:     []string{"RKE2_RUNTIME_IMAGE_SOURCES"},
+			Destination: &config.RuntimeImageSources,
+		},
+		&cli.IntFlag{
+			Name:        "embedded-registry-min-peers",
+			Usage:       "(agent/runtime) Minimum number of embedded registry peers to wait for before pulling the runtime image. Set to 0 to not wait for the embedded registry",
+			EnvVars:     []string{"RKE2_EMBEDDED_REGISTRY_MIN_PEERS"},
+			Value:       1,
+			Destination: &config.EmbeddedRegistryMinPeers,
+		},
+		&cli.DurationFlag{
+			Name:        "embedded-registry-wait-timeout",
+			Usage:       "(agent/runtime) Maximum time to wait for embedded registry peers before pulling the runtime image from upstream",
+			EnvVars:     []string{"RKE2_EMBEDDED_REGISTRY_WAIT_TIMEOUT"},
+			Value:       15 * time.Second,
+			Destination: &config.EmbeddedRegistryWaitTimeout,
+		},
+		&cli.StringFlag{
+			Name:        "dry-run",
+			Usage:       "(experimental) Render the static pod manifests, etcd configuration, admission and audit configuration, and bundled charts that would be written at startup into this directory, instead of starting, without modifying the node. Fails without rendering anything if any of them can only be generated once the node has started",
+			EnvVars:     []string{"RKE2_DRY_RUN"},
+			Destination: &config.DryRun,
+		},
 		&cli.StringFlag{
 			Name:        "cloud-provider-name",
 			Usage:       "(cloud provider) Cloud provider name",
@@ -122,43 +202,56 @@ var (
 		},
 		&cli.StringSliceFlag{
 			Name:        "control-plane-probe-configuration",
-			Usage:       "(components) Control Plane Probe configuration",
+			Usage:       "(components) Control Plane Probe configuration, in the form <component>-<probe>-<setting>=<value>. Settings are initial-delay-seconds, timeout-seconds, failure-threshold, period-seconds, port, and kind, one of exec, http, tcp, grpc, none. The kube-apiserver http probes require anonymous auth",
 			EnvVars:     []string{"RKE2_CONTROL_PLANE_PROBE_CONFIGURATION"},
 			Destination: &config.ControlPlaneProbeConf,
 		},
+		&cli.StringFlag{
+			Name:        "control-plane-pod-overlay-dir",
+			Usage:       "(components) Directory containing strategic merge patches for control plane static pods, named after the component, such as kube-apiserver.yaml",
+			EnvVars:     []string{"RKE2_CONTROL_PLANE_POD_OVERLAY_DIR"},
+			Value:       podtemplate.DefaultPodOverlayDir,
+			Destination: &config.PodOverlayDir,
+		},
+		&cli.StringFlag{
+			Name:        "control-plane-sidecars-file",
+			Usage:       "(components) File containing additional containers to run in control plane static pods, as a map of component name to a list of sidecars",
+			EnvVars:     []string{"RKE2_CONTROL_PLANE_SIDECARS_FILE"},
+			Destination: &config.ControlPlaneSidecarsFile,
+		},
 		&cli.StringSliceFlag{
 			Name:        podtemplate.KubeAPIServer + "-extra-mount",
-			Usage:       "(components) " + podtemplate.KubeAPIServer + " extra volume mounts",
+			Usage:       "(components) " + podtemplate.KubeAPIServer + extraMountUsage,
 			EnvVars:     []string{"RKE2_" + strings.ToUpper(strings.ReplaceAll(podtemplate.KubeAPIServer, "-", "_")) + "_EXTRA_MOUNT"},
 			Destination: &config.ExtraMounts.KubeAPIServer,
 		},
 		&cli.StringSliceFlag{
 			Name:        podtemplate.KubeScheduler + "-extra-mount",
-			Usage:       "(components) " + podtemplate.KubeScheduler + " extra volume mounts",
+			Usage:       "(components) " + podtemplate.KubeScheduler + extraMountUsage,
 			EnvVars:     []string{"RKE2_" + strings.ToUpper(strings.ReplaceAll(podtemplate.KubeScheduler, "-", "_")) + "_EXTRA_MOUNT"},
 			Destination: &config.ExtraMounts.KubeScheduler,
 		},
 		&cli.StringSliceFlag{
 			Name:        podtemplate.KubeControllerManager + "-extra-mount",
-			Usage:       "(components) " + podtemplate.KubeControllerManager + " extra volume mounts",
+			Usage:       "(components) " + podtemplate.KubeControllerManager + extraMountUsage,
 			EnvVars:     []string{"RKE2_" + strings.ToUpper(strings.ReplaceAll(podtemplate.KubeControllerManager, "-", "_")) + "_EXTRA_MOUNT"},
 			Destination: &config.ExtraMounts.KubeControllerManager,
 		},
 		&cli.StringSliceFlag{
 			Name:        podtemplate.KubeProxy + "-extra-mount",
-			Usage:       "(components) " + podtemplate.KubeProxy + " extra volume mounts",
+			Usage:       "(components) " + podtemplate.KubeProxy + extraMountUsage,
 			EnvVars:     []string{"RKE2_" + strings.ToUpper(strings.ReplaceAll(podtemplate.KubeProxy, "-", "_")) + "_EXTRA_MOUNT"},
 			Destination: &config.ExtraMounts.KubeProxy,
 		},
 		&cli.StringSliceFlag{
 			Name:        podtemplate.Etcd + "-extra-mount",
-			Usage:       "(components) " + podtemplate.Etcd + " extra volume mounts",
+			Usage:       "(components) " + podtemplate.Etcd + extraMountUsage,
 			EnvVars:     []string{"RKE2_" + strings.ToUpper(strings.ReplaceAll(podtemplate.Etcd, "-", "_")) + "_EXTRA_MOUNT"},
 			Destination: &config.ExtraMounts.Etcd,
 		},
 		&cli.StringSliceFlag{
 			Name:        podtemplate.CloudControllerManager + "-extra-mount",
-			Usage:       "(components) " + podtemplate.CloudControllerManager + " extra volume mounts",
+			Usage:       "(components) " + podtemplate.CloudControllerManager + extraMountUsage,
 			EnvVars:     []string{"RKE2_" + strings.ToUpper(strings.ReplaceAll(podtemplate.CloudControllerManager, "-", "_")) + "_EXTRA_MOUNT"},
 			Destination: &config.ExtraMounts.CloudControllerManager,
 		},
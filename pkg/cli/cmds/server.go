@@ -36,11 +36,49 @@ var (
 		EnvVars:     []string{"RKE2_INGRESS_CONTROLLER", "RKE_INGRESS_CONTROLLER"},
 		Destination: &config.IngressController,
 	}
+	ChartGlobalValuesFlag = &cli.StringSliceFlag{
+		Name:        "chart-global-values",
+		Usage:       "(components) Global value to set on bundled and user HelmCharts that allow cluster configuration to be injected, in the form key=value. Keys are relative to global, for example proxy.httpProxy=http://proxy:3128; values starting with [ or { are decoded as YAML",
+		EnvVars:     []string{"RKE2_CHART_GLOBAL_VALUES"},
+		Destination: &config.ChartGlobalValues,
+	}
+	ChartsSourceFlag = &cli.StringFlag{
+		Name:        "charts-source",
+		Usage:       "(components) Directory, image or OCI artifact reference with charts in /charts, or Helm chart OCI artifact reference, to load bundled charts from. Chart manifests from this source replace bundled charts with the same file name, and chart archives replace the chart content of the bundled HelmChart with the same name",
+		EnvVars:     []string{"RKE2_CHARTS_SOURCE"},
+		Destination: &config.ChartsSource,
+	}
+	ManifestConflictPolicyFlag = &cli.StringFlag{
+		Name:        "manifest-conflict-policy",
+		Usage:       "(components) Version of a bundled manifest to use when the copy in the manifests directory has been edited, one of bundled, local. Edited copies are backed up to the .backup directory in the manifests directory",
+		EnvVars:     []string{"RKE2_MANIFEST_CONFLICT_POLICY"},
+		Value:       "bundled",
+		Destination: &config.ManifestConflictPolicy,
+	}
 	ServiceLBFlag = &cli.BoolFlag{
 		Name:    "enable-servicelb",
 		Usage:   "(components) Enable rke2 default cloud controller manager's service controller",
 		EnvVars: []string{"RKE2_ENABLE_SERVICELB"},
 	}
+	KMSPluginImageFlag = &cli.StringFlag{
+		Name:        "kms-plugin-image",
+		Usage:       "(experimental/secrets) Image for a KMS v2 plugin to run as a static pod and use to encrypt secrets. Keys managed by secrets-encrypt are retained to read secrets encrypted before the plugin was configured; use secrets-encrypt reencrypt to migrate them. Once secrets-encrypt rotate-keys has been used, secrets are written with the new key, and the plugin can be removed after they have been re-encrypted",
+		EnvVars:     []string{"RKE2_KMS_PLUGIN_IMAGE"},
+		Destination: &config.KMSPluginImage,
+	}
+	KMSPluginArgFlag = &cli.StringSliceFlag{
+		Name:        "kms-plugin-arg",
+		Usage:       "(experimental/secrets) Argument to pass to the KMS plugin",
+		EnvVars:     []string{"RKE2_KMS_PLUGIN_ARG"},
+		Destination: &config.KMSPluginArgs,
+	}
+	KMSPluginSocketFlag = &cli.StringFlag{
+		Name:        "kms-plugin-socket",
+		Usage:       "(experimental/secrets) Path of the unix socket that the KMS plugin listens on",
+		EnvVars:     []string{"RKE2_KMS_PLUGIN_SOCKET"},
+		Value:       "/run/rke2/kms/kms.sock",
+		Destination: &config.KMSPluginSocket,
+	}
 	PrimeFlag = &cli.BoolFlag{
 		Name:    "prime",
 		Usage:   "Configures RKE2 to utilize the Rancher Prime Registry and features",
@@ -51,7 +89,13 @@ var (
 	serverFlag = []cli.Flag{
 		CNIFlag,
 		IngressControllerFlag,
+		ChartGlobalValuesFlag,
+		ChartsSourceFlag,
+		ManifestConflictPolicyFlag,
 		ServiceLBFlag,
+		KMSPluginImageFlag,
+		KMSPluginArgFlag,
+		KMSPluginSocketFlag,
 		PrimeFlag,
 	}
 
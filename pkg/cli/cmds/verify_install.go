@@ -0,0 +1,36 @@
+package cmds
+
+import (
+	"github.com/k3s-io/k3s/pkg/cli/cmds"
+	"github.com/k3s-io/k3s/pkg/configfilearg"
+	"github.com/rancher/rke2/pkg/rke2"
+	"github.com/urfave/cli/v2"
+)
+
+func NewVerifyInstallCommand() *cli.Command {
+	verifyFlags := []cli.Flag{
+		cmds.ConfigFlag,
+		cmds.DebugFlag,
+		&cli.StringFlag{
+			Name:    "data-dir",
+			Aliases: []string{"d"},
+			Usage:   "(data) Folder to hold state",
+			EnvVars: []string{"RKE2_DATA_DIR"},
+			Value:   rke2Path,
+		},
+	}
+
+	cmd := &cli.Command{
+		Name:   "verify-install",
+		Usage:  "Verify that the binaries and charts extracted from the runtime image have not been modified",
+		Flags:  verifyFlags,
+		Action: VerifyInstall,
+	}
+
+	configfilearg.DefaultParser.ValidFlags[cmd.Name] = verifyFlags
+	return cmd
+}
+
+func VerifyInstall(clx *cli.Context) error {
+	return rke2.VerifyInstall(clx)
+}
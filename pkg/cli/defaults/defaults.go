@@ -11,14 +11,17 @@ import (
 	"google.golang.org/grpc/grpclog"
 )
 
-func Set(_ *cli.Context, dataDir string) error {
-	if err := createDataDir(dataDir, 0755); err != nil {
-		return errors.WithMessagef(err, "failed to create directory %s", dataDir)
-	}
-
+func Set(clx *cli.Context, dataDir string) error {
 	logsDir := filepath.Join(dataDir, "agent", "logs")
-	if err := os.MkdirAll(logsDir, 0750); err != nil {
-		return errors.WithMessagef(err, "failed to create directory %s", logsDir)
+
+	// Directories are not created when rendering a dry run, as the node must not be modified
+	if clx.String("dry-run") == "" {
+		if err := createDataDir(dataDir, 0755); err != nil {
+			return errors.WithMessagef(err, "failed to create directory %s", dataDir)
+		}
+		if err := os.MkdirAll(logsDir, 0750); err != nil {
+			return errors.WithMessagef(err, "failed to create directory %s", logsDir)
+		}
 	}
 
 	cmds.ServerConfig.ClusterInit = true
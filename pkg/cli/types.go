@@ -1,6 +1,8 @@
 package cli
 
 import (
+	"time"
+
 	"github.com/rancher/rke2/pkg/images"
 	urfave "github.com/urfave/cli/v2"
 )
@@ -19,11 +21,28 @@ type Config struct {
 	CloudProviderMetadataHostname  bool
 	Images                         images.ImageOverrideConfig
 	KubeletPath                    string
+	RuntimeIntegrityAction         string
+	RuntimeDataRetention           int
+	RuntimeDataRetentionSize       string
+	RuntimeImagePullRetries        int
+	RuntimeImagePullBackoff        time.Duration
+	RuntimeImageSources            urfave.StringSlice
+	EmbeddedRegistryMinPeers       int
+	EmbeddedRegistryWaitTimeout    time.Duration
 	ControlPlaneResourceRequests   urfave.StringSlice
 	ControlPlaneResourceLimits     urfave.StringSlice
 	ControlPlaneProbeConf          urfave.StringSlice
+	PodOverlayDir                  string
+	ControlPlaneSidecarsFile       string
+	KMSPluginImage                 string
+	KMSPluginArgs                  urfave.StringSlice
+	KMSPluginSocket                string
 	CNI                            urfave.StringSlice
 	IngressController              urfave.StringSlice
+	ChartGlobalValues              urfave.StringSlice
+	ChartsSource                   string
+	ManifestConflictPolicy         string
+	DryRun                         string
 	ExtraMounts                    ExtraMounts
 	ExtraEnv                       ExtraEnv
 }
@@ -46,21 +46,25 @@ var (
 )
 
 type PEBinaryConfig struct {
-	CNIPlugin           win.CNIPlugin
-	CloudProvider       *CloudProviderConfig
-	Resolver            *images.Resolver
-	ManifestsDir        string
-	DataDir             string
-	AuditPolicyFile     string
-	KubeletPath         string
-	CNIName             string
-	ImagesDir           string
-	KubeConfigKubeProxy string
-	IngressController   []string
-	CISMode             bool
-	DisableETCD         bool
-	IsServer            bool
-	Prime               bool
+	CNIPlugin              win.CNIPlugin
+	CloudProvider          *CloudProviderConfig
+	Resolver               *images.Resolver
+	ManifestsDir           string
+	DataDir                string
+	AuditPolicyFile        string
+	KubeletPath            string
+	CNIName                string
+	ImagesDir              string
+	KubeConfigKubeProxy    string
+	IngressController      []string
+	ChartGlobalValues      map[string]any
+	ChartsSource           string
+	ManifestConflictPolicy bootstrap.ManifestConflictPolicy
+	StageOptions           bootstrap.StageOptions
+	CISMode                bool
+	DisableETCD            bool
+	IsServer               bool
+	Prime                  bool
 
 	apiServerReady <-chan struct{}
 	criReady       chan struct{}
@@ -97,8 +101,9 @@ func (p *PEBinaryConfig) Bootstrap(ctx context.Context, nodeConfig *config.Node,
 	// static pod manifests can be created before the agent bootstrap is complete. The agent itself
 	// really only needs to know about the runtime and pause images, all of which are configured after the
 	// default registry has been set by the server.
+	// Any additional registries configured locally are retained as fallbacks.
 	if nodeConfig.AgentConfig.SystemDefaultRegistry != "" {
-		if err := p.Resolver.ParseAndSetDefaultRegistry(nodeConfig.AgentConfig.SystemDefaultRegistry); err != nil {
+		if err := p.Resolver.SetPrimaryRegistry(nodeConfig.AgentConfig.SystemDefaultRegistry); err != nil {
 			return err
 		}
 	} else if p.Prime && nodeConfig.AgentConfig.SystemDefaultRegistry == "" {
@@ -108,6 +113,14 @@ func (p *PEBinaryConfig) Bootstrap(ctx context.Context, nodeConfig *config.Node,
 		}
 	}
 
+	if err := bootstrap.SelectRegistries(ctx, p.Resolver, nodeConfig, cfg); err != nil {
+		return err
+	}
+
+	if p.ImagesDir != "" {
+		p.Resolver.LogArchiveSummary(p.ImagesDir, images.Runtime, images.Pause)
+	}
+
 	pauseImage, err := p.Resolver.GetReference(images.Pause)
 	if err != nil {
 		return err
@@ -441,14 +454,21 @@ func (p *PEBinaryConfig) IsSelfHosted() bool {
 
 func (p *PEBinaryConfig) stageData(ctx context.Context, nodeConfig *config.Node, cfg cmds.Agent) error {
 	// if spegel is enabled, wait for it to start up so that we can attempt to pull content through it
-	if err := bootstrap.WaitForEmbeddedRegistry(ctx, nodeConfig); err != nil {
+	if err := bootstrap.WaitForEmbeddedRegistry(ctx, nodeConfig, p.StageOptions); err != nil {
 		logrus.Errorf("Failed to wait for embedded registry to become ready: %v", err)
 	}
-	if err := bootstrap.Stage(ctx, p.Resolver, nodeConfig, cfg); err != nil {
-		return err
+	if err := bootstrap.Stage(ctx, p.Resolver, nodeConfig, cfg, p.StageOptions); err != nil {
+		return p.StageOptions.Status.Failed(err)
 	}
+	p.StageOptions.Stats.Log()
 	if p.IsServer {
-		go bootstrap.UpdateManifests(ctx, p.Resolver, p.IngressController, nodeConfig, cfg, p.Prime)
+		go bootstrap.UpdateManifests(ctx, p.Resolver, nodeConfig, cfg, bootstrap.ManifestOptions{
+			IngressController: p.IngressController,
+			Prime:             p.Prime,
+			GlobalValues:      p.ChartGlobalValues,
+			ChartsSource:      p.ChartsSource,
+			ConflictPolicy:    p.ManifestConflictPolicy,
+		})
 	}
 	return nil
 }
@@ -0,0 +1,305 @@
+//go:build linux
+// +build linux
+
+package staticpod
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/k3s-io/k3s/pkg/util/errors"
+	"github.com/rancher/rke2/pkg/podtemplate"
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// kmsProviderName is the name of the KMS provider in the encryption configuration. The name is stored with
+	// each encrypted object, so it must not be changed once secrets have been encrypted with the provider.
+	kmsProviderName = "rke2-kms"
+	// kmsEncryptionConfigFile is the encryption configuration used by the apiserver when a KMS plugin is configured.
+	kmsEncryptionConfigFile = "encryption-config-kms.json"
+	// kmsStateFile records the key that K3s used to write secrets when the KMS provider started writing them.
+	kmsStateFile = "encryption-config-kms.state"
+)
+
+// encryptionConfig is the subset of the apiserver EncryptionConfiguration that is modified to add the KMS provider.
+// Providers are retained as-is, so that the keys managed by the secrets-encrypt commands are not modified.
+type encryptionConfig struct {
+	Kind       string               `json:"kind"`
+	APIVersion string               `json:"apiVersion"`
+	Resources  []encryptionResource `json:"resources"`
+}
+
+type encryptionResource struct {
+	Resources []string          `json:"resources"`
+	Providers []json.RawMessage `json:"providers"`
+}
+
+// encryptionKeys is the configuration of the providers that use keys managed by the secrets-encrypt commands.
+type encryptionKeys struct {
+	Keys []struct {
+		Name   string `json:"name"`
+		Secret string `json:"secret"`
+	} `json:"keys"`
+}
+
+// kmsPlugin writes the KMS plugin static pod manifest, if a KMS plugin is configured. If a KMS plugin is not
+// configured, any existing manifest is removed.
+func (s *StaticPodConfig) kmsPlugin() error {
+	if s.KMS == nil {
+		manifestPath := filepath.Join(s.dryRunDir, s.ManifestsDir, podtemplate.KMSPlugin+".yaml")
+		if _, err := os.Stat(manifestPath); err != nil {
+			return nil
+		}
+		return s.removeTemplate(podtemplate.KMSPlugin)
+	}
+
+	podSpec, err := s.Config.KMSPlugin()
+	if err != nil {
+		return err
+	}
+	podSpec.Dirs = append(podtemplate.OnlyExisting(podtemplate.SSLDirs), filepath.Dir(s.KMS.Socket))
+	podSpec.HostNetwork = true
+	return s.writeTemplate(podSpec)
+}
+
+// kmsEncryptionConfig replaces the encryption configuration that K3s passes to the apiserver with one that also
+// includes the KMS provider, and keeps it in sync with the K3s configuration as the secrets-encrypt commands modify
+// it. The keys managed by K3s are retained so that secrets encrypted before the KMS plugin was configured can still
+// be read, and can be migrated to the KMS provider with the secrets-encrypt reencrypt command. If a KMS plugin is not
+// configured, but was previously used to write secrets, the apiserver is not started until they have been re-encrypted.
+func (s *StaticPodConfig) kmsEncryptionConfig(ctx context.Context, args []string) ([]string, string, error) {
+	for i, arg := range args {
+		name, src, _ := strings.Cut(arg, "=")
+		if name != "--encryption-provider-config" {
+			continue
+		}
+		dest := filepath.Join(filepath.Dir(src), kmsEncryptionConfigFile)
+		stateFile := filepath.Join(filepath.Dir(src), kmsStateFile)
+		if s.dryRunDir != "" {
+			if s.KMS == nil {
+				return args, "", nil
+			}
+			args[i] = name + "=" + dest
+			return args, dest, nil
+		}
+		if s.KMS == nil {
+			return args, "", removeKMSEncryptionConfig(src, dest, stateFile)
+		}
+		args[i] = name + "=" + dest
+
+		kmsWrites, err := writeKMSEncryptionConfig(src, dest, stateFile, s.KMS.Socket)
+		if err != nil {
+			return nil, "", err
+		}
+		logKMSWrites(kmsWrites)
+		go wait.UntilWithContext(ctx, func(ctx context.Context) {
+			writes, err := writeKMSEncryptionConfig(src, dest, stateFile, s.KMS.Socket)
+			if err != nil {
+				logrus.Errorf("Failed to update KMS encryption config: %v", err)
+				return
+			}
+			if writes != kmsWrites {
+				kmsWrites = writes
+				logKMSWrites(kmsWrites)
+			}
+		}, 5*time.Second)
+		return args, dest, nil
+	}
+	if s.KMS != nil && s.dryRunDir == "" {
+		logrus.Warnf("KMS plugin is configured, but secrets encryption is not enabled; the KMS provider will not be used")
+	}
+	return args, "", nil
+}
+
+// logKMSWrites logs whether the KMS provider is used to write secrets.
+func logKMSWrites(kmsWrites bool) {
+	if kmsWrites {
+		logrus.Infof("Secrets are encrypted with the KMS plugin")
+	} else {
+		logrus.Warnf("Secrets encryption keys have been rotated or disabled since the KMS plugin was configured; secrets are written with the secrets-encrypt key, and the KMS plugin is only used to read secrets")
+	}
+}
+
+// writeKMSEncryptionConfig writes the encryption configuration from src to dest, with the KMS provider added to
+// the providers for secrets, and returns true if the KMS provider is used to write secrets. The KMS provider is used
+// to write secrets until the K3s key used to write them changes, such as when the keys are rotated or encryption is
+// disabled by the secrets-encrypt commands; the K3s key is then used instead, and the KMS provider is only used to
+// read secrets. The file is only written if the content has changed, so that the apiserver only reloads the
+// configuration when necessary.
+func writeKMSEncryptionConfig(src, dest, stateFile, socket string) (bool, error) {
+	config, err := readEncryptionConfig(src)
+	if err != nil {
+		return false, err
+	}
+	writeKey := encryptionWriteKey(config)
+	recorded, err := os.ReadFile(stateFile)
+	if os.IsNotExist(err) {
+		recorded = []byte(writeKey)
+		err = writeFile(stateFile, recorded, 0600)
+	}
+	if err != nil {
+		return false, errors.WithMessage(err, "failed to record KMS encryption state")
+	}
+	kmsWrites := string(recorded) == writeKey
+
+	kms, err := json.Marshal(map[string]any{
+		"kms": map[string]any{
+			"apiVersion": "v2",
+			"name":       kmsProviderName,
+			"endpoint":   "unix://" + socket,
+			"timeout":    "3s",
+		},
+	})
+	if err != nil {
+		return false, err
+	}
+	for i, resource := range config.Resources {
+		if !slices.Contains(resource.Resources, "secrets") {
+			continue
+		}
+		// If the KMS provider is not used to write secrets, or encryption has been disabled, the K3s provider is
+		// first and is used to write secrets; the KMS provider is added after it so that secrets can still be read.
+		idx := 0
+		if len(resource.Providers) > 0 && (!kmsWrites || isIdentityProvider(resource.Providers[0])) {
+			idx = 1
+		}
+		providers := append([]json.RawMessage{}, resource.Providers[:idx]...)
+		providers = append(providers, kms)
+		config.Resources[i].Providers = append(providers, resource.Providers[idx:]...)
+	}
+
+	b, err := json.Marshal(config)
+	if err != nil {
+		return false, err
+	}
+	return kmsWrites, writeFile(dest, b, 0600)
+}
+
+// removeKMSEncryptionConfig removes the KMS encryption configuration and state once the KMS plugin is no longer
+// configured. An error is returned if secrets may still be encrypted with the KMS provider: that is, if the KMS
+// provider was still used to write secrets, or if the secrets have not been re-encrypted since the K3s keys were
+// rotated. The secrets-encrypt reencrypt command removes all but the current key once secrets have been re-encrypted.
+func removeKMSEncryptionConfig(src, dest, stateFile string) error {
+	recorded, err := os.ReadFile(stateFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	config, err := readEncryptionConfig(src)
+	if err != nil {
+		return err
+	}
+	if string(recorded) == encryptionWriteKey(config) {
+		return fmt.Errorf("secrets are encrypted with the KMS plugin; use secrets-encrypt rotate-keys to re-encrypt them with a new key before removing the KMS plugin")
+	}
+	if n := encryptionKeyCount(config); n > 1 {
+		return fmt.Errorf("secrets may be encrypted with the KMS plugin, as %d secrets encryption keys are in use; use secrets-encrypt reencrypt to re-encrypt them before removing the KMS plugin", n)
+	}
+	logrus.Infof("Secrets have been re-encrypted since the KMS plugin was used; removing KMS encryption config")
+	for _, file := range []string{dest, stateFile} {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// readEncryptionConfig reads the encryption configuration written by K3s.
+func readEncryptionConfig(file string) (*encryptionConfig, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to read encryption config")
+	}
+	config := &encryptionConfig{}
+	if err := json.Unmarshal(b, config); err != nil {
+		return nil, errors.WithMessagef(err, "failed to parse encryption config %s", file)
+	}
+	return config, nil
+}
+
+// encryptionWriteKey returns a hash identifying the key that K3s writes secrets with: the first key of the first
+// provider for secrets. Keys added to the end of the provider's list by the secrets-encrypt prepare command are
+// not used to write secrets until they are rotated to the front, so they do not change the hash.
+func encryptionWriteKey(config *encryptionConfig) string {
+	h := sha256.New()
+	for _, resource := range config.Resources {
+		if !slices.Contains(resource.Resources, "secrets") || len(resource.Providers) == 0 {
+			continue
+		}
+		provider := map[string]json.RawMessage{}
+		if err := json.Unmarshal(resource.Providers[0], &provider); err != nil {
+			h.Write(resource.Providers[0])
+			break
+		}
+		for providerType, raw := range provider {
+			h.Write([]byte(providerType))
+			keys := &encryptionKeys{}
+			if err := json.Unmarshal(raw, keys); err == nil && len(keys.Keys) > 0 {
+				h.Write([]byte(keys.Keys[0].Name + "\x00" + keys.Keys[0].Secret))
+			}
+		}
+		break
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// encryptionKeyCount returns the number of keys managed by K3s that secrets may be encrypted with.
+func encryptionKeyCount(config *encryptionConfig) int {
+	var n int
+	for _, resource := range config.Resources {
+		if !slices.Contains(resource.Resources, "secrets") {
+			continue
+		}
+		for _, raw := range resource.Providers {
+			provider := map[string]json.RawMessage{}
+			if err := json.Unmarshal(raw, &provider); err != nil {
+				continue
+			}
+			for _, raw := range provider {
+				keys := &encryptionKeys{}
+				if err := json.Unmarshal(raw, keys); err == nil {
+					n += len(keys.Keys)
+				}
+			}
+		}
+	}
+	return n
+}
+
+// isIdentityProvider returns true if the provider is the identity provider, which stores data without encryption.
+func isIdentityProvider(provider json.RawMessage) bool {
+	p := map[string]json.RawMessage{}
+	if err := json.Unmarshal(provider, &p); err != nil {
+		return false
+	}
+	_, ok := p["identity"]
+	return ok
+}
+
+// waitForKMSSocket waits for the KMS plugin to create its socket, so that the socket can be mounted into the apiserver.
+func (s *StaticPodConfig) waitForKMSSocket(ctx context.Context) error {
+	if s.KMS == nil || s.dryRunDir != "" {
+		return nil
+	}
+	logrus.Infof("Waiting for KMS plugin socket %s", s.KMS.Socket)
+	err := wait.PollUntilContextTimeout(ctx, time.Second, 5*time.Minute, true, func(ctx context.Context) (bool, error) {
+		info, err := os.Stat(s.KMS.Socket)
+		return err == nil && info.Mode().Type() == os.ModeSocket, nil
+	})
+	if err != nil {
+		return errors.WithMessagef(err, "KMS plugin socket %s was not created", s.KMS.Socket)
+	}
+	return nil
+}
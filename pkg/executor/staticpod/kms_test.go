@@ -0,0 +1,223 @@
+//go:build linux
+// +build linux
+
+package staticpod
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apiserver/pkg/server/options/encryptionconfig"
+	"k8s.io/apiserver/pkg/storage/value"
+	"k8s.io/kms/pkg/service"
+)
+
+// mockKMS is a KMS v2 plugin that "encrypts" data by prefixing it with a fixed string.
+type mockKMS struct{}
+
+var mockKMSPrefix = []byte("mock-kms:")
+
+func (mockKMS) Decrypt(_ context.Context, _ string, req *service.DecryptRequest) ([]byte, error) {
+	return bytes.TrimPrefix(req.Ciphertext, mockKMSPrefix), nil
+}
+
+func (mockKMS) Encrypt(_ context.Context, _ string, data []byte) (*service.EncryptResponse, error) {
+	return &service.EncryptResponse{Ciphertext: append(append([]byte{}, mockKMSPrefix...), data...), KeyID: "1"}, nil
+}
+
+func (mockKMS) Status(_ context.Context) (*service.StatusResponse, error) {
+	return &service.StatusResponse{Version: "v2", Healthz: "ok", KeyID: "1"}, nil
+}
+
+// startMockKMS serves the mock KMS plugin on a unix socket, and returns the path to the socket.
+func startMockKMS(t *testing.T) string {
+	// Unix socket paths are limited in length, so the socket is not created in the test's temp dir
+	dir, err := os.MkdirTemp("", "kms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	socket := filepath.Join(dir, "kms.sock")
+	svc := service.NewGRPCService(socket, 3*time.Second, mockKMS{})
+	go svc.ListenAndServe()
+	t.Cleanup(svc.Close)
+	return socket
+}
+
+// writeK3sEncryptionConfig writes an encryption config as managed by the secrets-encrypt commands, with an aescbc
+// provider with the given keys, followed by the identity provider. If encryption is disabled, the identity provider
+// is first.
+func writeK3sEncryptionConfig(t *testing.T, file string, disabled bool, keys ...string) {
+	aescbc := map[string]any{"aescbc": map[string]any{"keys": []map[string]string{}}}
+	for _, key := range keys {
+		secret := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte(key[len(key)-1:]), 32))
+		k := aescbc["aescbc"].(map[string]any)
+		k["keys"] = append(k["keys"].([]map[string]string), map[string]string{"name": key, "secret": secret})
+	}
+	providers := []any{aescbc, map[string]any{"identity": map[string]any{}}}
+	if disabled {
+		providers = []any{map[string]any{"identity": map[string]any{}}, aescbc}
+	}
+	b, err := json.Marshal(map[string]any{
+		"kind":       "EncryptionConfiguration",
+		"apiVersion": "apiserver.config.k8s.io/v1",
+		"resources":  []map[string]any{{"resources": []string{"secrets"}, "providers": providers}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// secretsTransformer loads an encryption config as the apiserver does, and returns the transformer for secrets.
+func secretsTransformer(t *testing.T, file string) value.Transformer {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	config, err := encryptionconfig.LoadEncryptionConfig(ctx, file, false, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config.Transformers[schema.ParseGroupResource("secrets")]
+}
+
+// writeSecret encrypts data with the transformer, and checks that it was written with the given prefix. The
+// write is retried as the KMS provider is not used until it has checked the status of the plugin.
+func writeSecret(t *testing.T, transformer value.Transformer, data, prefix string) []byte {
+	var out []byte
+	err := wait.PollUntilContextTimeout(context.Background(), 100*time.Millisecond, 10*time.Second, true, func(ctx context.Context) (bool, error) {
+		var err error
+		out, err = transformer.TransformToStorage(ctx, []byte(data), value.DefaultContext(data))
+		return err == nil, nil
+	})
+	if err != nil {
+		t.Fatalf("failed to write secret: %v", err)
+	}
+	if !bytes.HasPrefix(out, []byte(prefix)) {
+		t.Fatalf("expected secret to be written with prefix %s, got %q", prefix, out)
+	}
+	return out
+}
+
+// readSecret checks that the data written by writeSecret can be read with the transformer.
+func readSecret(t *testing.T, transformer value.Transformer, stored []byte, data string) {
+	out, _, err := transformer.TransformFromStorage(context.Background(), stored, value.DefaultContext(data))
+	if err != nil {
+		t.Fatalf("failed to read secret %s: %v", data, err)
+	}
+	if string(out) != data {
+		t.Fatalf("expected secret %s, got %s", data, out)
+	}
+}
+
+func Test_UnitKMSEncryptionConfig(t *testing.T) {
+	socket := startMockKMS(t)
+	dir := t.TempDir()
+	src := filepath.Join(dir, "encryption-config.json")
+	dest := filepath.Join(dir, kmsEncryptionConfigFile)
+	stateFile := filepath.Join(dir, kmsStateFile)
+	const kmsPrefix = "k8s:enc:kms:v2:" + kmsProviderName + ":"
+
+	// Secrets written before the KMS plugin is configured
+	writeK3sEncryptionConfig(t, src, false, "aescbckey-0")
+	aesSecret := writeSecret(t, secretsTransformer(t, src), "aes", "k8s:enc:aescbc:v1:aescbckey-0:")
+
+	// The KMS plugin is used to write secrets, and secrets written with the K3s key can still be read
+	kmsWrites, err := writeKMSEncryptionConfig(src, dest, stateFile, socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !kmsWrites {
+		t.Error("expected KMS provider to write secrets")
+	}
+	transformer := secretsTransformer(t, dest)
+	kmsSecret := writeSecret(t, transformer, "kms", kmsPrefix)
+	readSecret(t, transformer, aesSecret, "aes")
+
+	// The plugin cannot be removed while it is used to write secrets
+	if err := removeKMSEncryptionConfig(src, dest, stateFile); err == nil {
+		t.Error("expected error removing KMS plugin that is used to write secrets")
+	}
+
+	// Keys added by secrets-encrypt prepare are not used to write secrets until they are rotated
+	writeK3sEncryptionConfig(t, src, false, "aescbckey-0", "aescbckey-1")
+	if kmsWrites, err := writeKMSEncryptionConfig(src, dest, stateFile, socket); err != nil || !kmsWrites {
+		t.Errorf("expected KMS provider to write secrets after prepare, got %t: %v", kmsWrites, err)
+	}
+
+	// Once the keys are rotated, the new key is used to write secrets, and secrets written with the KMS plugin can
+	// still be read
+	writeK3sEncryptionConfig(t, src, false, "aescbckey-1", "aescbckey-0")
+	kmsWrites, err = writeKMSEncryptionConfig(src, dest, stateFile, socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kmsWrites {
+		t.Error("expected rotated key to write secrets")
+	}
+	transformer = secretsTransformer(t, dest)
+	rotatedSecret := writeSecret(t, transformer, "rotated", "k8s:enc:aescbc:v1:aescbckey-1:")
+	readSecret(t, transformer, kmsSecret, "kms")
+	readSecret(t, transformer, aesSecret, "aes")
+
+	// The plugin cannot be removed until secrets have been re-encrypted
+	if err := removeKMSEncryptionConfig(src, dest, stateFile); err == nil {
+		t.Error("expected error removing KMS plugin before secrets are re-encrypted")
+	}
+
+	// Once secrets have been re-encrypted, only the new key is retained, and the plugin can be removed
+	writeK3sEncryptionConfig(t, src, false, "aescbckey-1")
+	if err := removeKMSEncryptionConfig(src, dest, stateFile); err != nil {
+		t.Fatalf("expected KMS plugin to be removed after secrets are re-encrypted: %v", err)
+	}
+	for _, file := range []string{dest, stateFile} {
+		if _, err := os.Stat(file); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed", file)
+		}
+	}
+	readSecret(t, secretsTransformer(t, src), rotatedSecret, "rotated")
+
+	// Without a state file, there is nothing to remove
+	if err := removeKMSEncryptionConfig(src, dest, stateFile); err != nil {
+		t.Errorf("expected no error removing KMS plugin that was not used: %v", err)
+	}
+}
+
+func Test_UnitKMSEncryptionConfigDisabled(t *testing.T) {
+	socket := startMockKMS(t)
+	dir := t.TempDir()
+	src := filepath.Join(dir, "encryption-config.json")
+	dest := filepath.Join(dir, kmsEncryptionConfigFile)
+	stateFile := filepath.Join(dir, kmsStateFile)
+
+	writeK3sEncryptionConfig(t, src, false, "aescbckey-0")
+	if _, err := writeKMSEncryptionConfig(src, dest, stateFile, socket); err != nil {
+		t.Fatal(err)
+	}
+	kmsSecret := writeSecret(t, secretsTransformer(t, dest), "kms", "k8s:enc:kms:v2:"+kmsProviderName+":")
+
+	// When encryption is disabled, secrets are written without encryption, and secrets written with the KMS
+	// plugin can still be read
+	writeK3sEncryptionConfig(t, src, true, "aescbckey-0")
+	kmsWrites, err := writeKMSEncryptionConfig(src, dest, stateFile, socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kmsWrites {
+		t.Error("expected identity provider to write secrets")
+	}
+	transformer := secretsTransformer(t, dest)
+	if out := writeSecret(t, transformer, "plain", "plain"); string(out) != "plain" {
+		t.Errorf("expected secret to be written without encryption, got %q", out)
+	}
+	readSecret(t, transformer, kmsSecret, "kms")
+}
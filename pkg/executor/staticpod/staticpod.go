@@ -16,6 +16,7 @@ import (
 	"os/exec"
 	"os/user"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -30,6 +31,7 @@ import (
 	"github.com/k3s-io/k3s/pkg/signals"
 	"github.com/k3s-io/k3s/pkg/util"
 	"github.com/k3s-io/k3s/pkg/util/errors"
+	"github.com/opencontainers/selinux/go-selinux/label"
 	"github.com/rancher/rke2/pkg/auth"
 	"github.com/rancher/rke2/pkg/bootstrap"
 	"github.com/rancher/rke2/pkg/images"
@@ -45,27 +47,36 @@ import (
 	"sigs.k8s.io/yaml"
 )
 
+// containerFileLabel is the SELinux label applied to extra mount host paths that are relabeled for use by containers.
+const containerFileLabel = "system_u:object_r:container_file_t:s0"
+
 type StaticPodConfig struct {
 	podtemplate.Config
 
-	stopKubelet       context.CancelFunc
-	CloudProvider     *CloudProviderConfig
-	RuntimeEndpoint   string
-	ManifestsDir      string
-	AuditPolicyFile   string
-	PSAConfigFile     string
-	KubeletPath       string
-	IngressController []string
-	ProfileMode       ProfileMode
-	DisableETCD       bool
-	ExternalDatabase  bool
-	IsServer          bool
-	Prime             bool
+	stopKubelet            context.CancelFunc
+	CloudProvider          *CloudProviderConfig
+	RuntimeEndpoint        string
+	ManifestsDir           string
+	AuditPolicyFile        string
+	PSAConfigFile          string
+	KubeletPath            string
+	IngressController      []string
+	ChartGlobalValues      map[string]any
+	ChartsSource           string
+	ManifestConflictPolicy bootstrap.ManifestConflictPolicy
+	StageOptions           bootstrap.StageOptions
+	ProfileMode            ProfileMode
+	DisableETCD            bool
+	ExternalDatabase       bool
+	IsServer               bool
+	Prime                  bool
 
 	apiServerReady <-chan struct{}
 	etcdReady      chan struct{}
 	criReady       chan struct{}
 	dataReady      chan struct{}
+	imageVerifier  *bootstrap.ImageVerifier
+	dryRunDir      string
 }
 
 // explicit interface check
@@ -88,6 +99,21 @@ func apiserverSyncAndReady(ctx context.Context, nodeConfig *daemonconfig.Node, c
 	return ready
 }
 
+// DryRun prepares the executor to render static pod manifests, and the etcd configuration and audit policy files,
+// into dir, at the same paths relative to dir that they would be written to on the node. Components do not wait for
+// each other to become ready, images are not added to the airgap pull list, and image signatures are not verified.
+func (s *StaticPodConfig) DryRun(dir string) {
+	ready := make(chan struct{})
+	close(ready)
+	s.apiServerReady = ready
+	s.etcdReady = ready
+	s.criReady = ready
+	s.dataReady = ready
+	s.imageVerifier = nil
+	s.ImagesDir = ""
+	s.dryRunDir = dir
+}
+
 // Bootstrap prepares the static executor to run components by setting the system default registry
 // and staging the kubelet and containerd binaries.  On servers, it also ensures that manifests are
 // copied in to place and in sync with the system configuration.
@@ -101,8 +127,9 @@ func (s *StaticPodConfig) Bootstrap(ctx context.Context, nodeConfig *daemonconfi
 	// static pod manifests can be created before the agent bootstrap is complete. The agent itself
 	// really only needs to know about the runtime and pause images, all of which are configured after the
 	// default registry has been set by the server.
+	// Any additional registries configured locally are retained as fallbacks.
 	if nodeConfig.AgentConfig.SystemDefaultRegistry != "" {
-		if err := s.Resolver.ParseAndSetDefaultRegistry(nodeConfig.AgentConfig.SystemDefaultRegistry); err != nil {
+		if err := s.Resolver.SetPrimaryRegistry(nodeConfig.AgentConfig.SystemDefaultRegistry); err != nil {
 			return err
 		}
 	} else if s.Prime && nodeConfig.AgentConfig.SystemDefaultRegistry == "" {
@@ -111,6 +138,15 @@ func (s *StaticPodConfig) Bootstrap(ctx context.Context, nodeConfig *daemonconfi
 			return err
 		}
 	}
+	if err := bootstrap.SelectRegistries(ctx, s.Resolver, nodeConfig, cfg); err != nil {
+		return err
+	}
+	s.imageVerifier = bootstrap.NewImageVerifier(ctx, s.Resolver, nodeConfig, cfg)
+
+	if s.ImagesDir != "" {
+		s.Resolver.LogArchiveSummary(s.ImagesDir, s.requiredImages()...)
+	}
+
 	pauseImage, err := s.Resolver.GetReference(images.Pause)
 	if err != nil {
 		return err
@@ -198,11 +234,21 @@ func (s *StaticPodConfig) APIServerHandlers(ctx context.Context) (authenticator.
 }
 
 // APIServer sets up the apiserver static pod once etcd is available.
-func (s *StaticPodConfig) APIServer(_ context.Context, args []string) error {
+func (s *StaticPodConfig) APIServer(ctx context.Context, args []string) error {
 	if err := s.removeTemplate("kube-apiserver"); err != nil {
 		return err
 	}
 
+	// The encryption config is checked first, so that the KMS plugin is not removed while secrets may still
+	// need it to be read. The KMS plugin is started before the apiserver, so that its socket can be mounted.
+	args, kmsEncryptionConfig, err := s.kmsEncryptionConfig(ctx, args)
+	if err != nil {
+		return err
+	}
+	if err := s.kmsPlugin(); err != nil {
+		return err
+	}
+
 	auditLogFile := ""
 	kubeletPreferredAddressTypesFound := false
 	for i, arg := range args {
@@ -233,7 +279,7 @@ func (s *StaticPodConfig) APIServer(_ context.Context, args []string) error {
 	}
 
 	if s.AuditPolicyFile != "" {
-		if err := podtemplate.WriteDefaultPolicyFile(s.AuditPolicyFile); err != nil {
+		if err := podtemplate.WriteDefaultPolicyFile(filepath.Join(s.dryRunDir, s.AuditPolicyFile)); err != nil {
 			return err
 		}
 		extraArgs := []string{
@@ -269,6 +315,11 @@ func (s *StaticPodConfig) APIServer(_ context.Context, args []string) error {
 	// so we mount the directory to allow the pod to see the updates
 	dirs = append(dirs, filepath.Join(s.DataDir, "server"))
 	excludeFiles = append(excludeFiles, filepath.Join(s.DataDir, "server/cred/encryption-config.json"))
+	sockets := []string{}
+	if kmsEncryptionConfig != "" {
+		excludeFiles = append(excludeFiles, kmsEncryptionConfig)
+		sockets = append(sockets, s.KMS.Socket)
+	}
 
 	podSpec, err := s.Config.APIServer(args)
 	if err != nil {
@@ -277,10 +328,16 @@ func (s *StaticPodConfig) APIServer(_ context.Context, args []string) error {
 
 	podSpec.Files = files
 	podSpec.Dirs = dirs
+	podSpec.Sockets = sockets
 	podSpec.ExcludeFiles = excludeFiles
 	podSpec.HostNetwork = true
 
-	return podtemplate.After(s.ETCDReadyChan(), func() error {
+	return s.after(s.ETCDReadyChan(), func() error {
+		if kmsEncryptionConfig != "" {
+			if err := s.waitForKMSSocket(ctx); err != nil {
+				return err
+			}
+		}
 		return s.writeTemplate(podSpec)
 	})
 }
@@ -302,7 +359,7 @@ func (s *StaticPodConfig) Scheduler(_ context.Context, nodeReady <-chan struct{}
 	podSpec.Files = files
 	podSpec.HostNetwork = true
 
-	return podtemplate.After(s.APIServerReadyChan(), func() error {
+	return s.after(s.APIServerReadyChan(), func() error {
 		return s.writeTemplate(podSpec)
 	})
 }
@@ -338,7 +395,7 @@ func (s *StaticPodConfig) ControllerManager(_ context.Context, args []string) er
 	podSpec.Dirs = podtemplate.OnlyExisting(podtemplate.SSLDirs)
 	podSpec.HostNetwork = true
 
-	return podtemplate.After(s.APIServerReadyChan(), func() error {
+	return s.after(s.APIServerReadyChan(), func() error {
 		return s.writeTemplate(podSpec)
 	})
 }
@@ -354,7 +411,7 @@ func (s *StaticPodConfig) CloudControllerManager(_ context.Context, ccmRBACReady
 	podSpec.Dirs = podtemplate.OnlyExisting(podtemplate.SSLDirs)
 	podSpec.HostNetwork = true
 
-	return podtemplate.After(ccmRBACReady, func() error {
+	return s.after(ccmRBACReady, func() error {
 		return s.writeTemplate(podSpec)
 	})
 }
@@ -382,6 +439,10 @@ func (s *StaticPodConfig) CurrentETCDOptions() (opts executor.InitialOptions, er
 
 // ETCD starts the etcd static pod.
 func (s *StaticPodConfig) ETCD(ctx context.Context, wg *sync.WaitGroup, args *executor.ETCDConfig, extraArgs []string, test executor.TestFunc) error {
+	if s.dryRunDir != "" {
+		return s.dryRunETCD(ctx, args, extraArgs)
+	}
+
 	go func() {
 		for {
 			if err := test(ctx, true); err != nil {
@@ -406,12 +467,47 @@ func (s *StaticPodConfig) ETCD(ctx context.Context, wg *sync.WaitGroup, args *ex
 		return nil
 	}
 
-	initial, err := json.Marshal(args.InitialOptions)
+	confFile, err := args.ToConfigFile(extraArgs)
 	if err != nil {
 		return err
 	}
+	return s.writeETCDTemplate(ctx, args, confFile)
+}
 
-	confFile, err := args.ToConfigFile(extraArgs)
+// dryRunETCD renders the etcd configuration file and static pod into the dry run directory. The configuration file
+// is written by K3s into the etcd data directory, so it is written within the dry run directory, and the data
+// directory that it refers to is then set back to its path on the node.
+func (s *StaticPodConfig) dryRunETCD(ctx context.Context, args *executor.ETCDConfig, extraArgs []string) error {
+	if args == nil {
+		return nil
+	}
+	dryRunArgs := *args
+	dryRunArgs.DataDir = filepath.Join(s.dryRunDir, args.DataDir)
+	confFile, err := dryRunArgs.ToConfigFile(extraArgs)
+	if err != nil {
+		return err
+	}
+	b, err := os.ReadFile(confFile)
+	if err != nil {
+		return err
+	}
+	conf := map[string]any{}
+	if err := yaml.Unmarshal(b, &conf); err != nil {
+		return errors.WithMessagef(err, "failed to decode etcd configuration %s", confFile)
+	}
+	conf["data-dir"] = args.DataDir
+	if b, err = yaml.Marshal(conf); err != nil {
+		return err
+	}
+	if err := os.WriteFile(confFile, b, 0600); err != nil {
+		return err
+	}
+	return s.writeETCDTemplate(ctx, args, strings.TrimPrefix(confFile, s.dryRunDir))
+}
+
+// writeETCDTemplate writes the etcd static pod manifest, for etcd started with the given configuration file.
+func (s *StaticPodConfig) writeETCDTemplate(ctx context.Context, args *executor.ETCDConfig, confFile string) error {
+	initial, err := json.Marshal(args.InitialOptions)
 	if err != nil {
 		return err
 	}
@@ -452,9 +548,11 @@ func (s *StaticPodConfig) ETCD(ctx context.Context, wg *sync.WaitGroup, args *ex
 		podSpec.SecurityContext.RunAsUser = &uid
 		podSpec.SecurityContext.RunAsGroup = &gid
 
-		for _, p := range append(podSpec.Dirs, podSpec.Files...) {
-			if err := chownr(p, int(uid), int(gid)); err != nil {
-				return err
+		if s.dryRunDir == "" {
+			for _, p := range append(podSpec.Dirs, podSpec.Files...) {
+				if err := chownr(p, int(uid), int(gid)); err != nil {
+					return err
+				}
 			}
 		}
 	}
@@ -579,10 +677,18 @@ func (s *StaticPodConfig) stopEtcd() error {
 	return nil
 }
 
+// after calls a function after a message is received from a channel, or immediately when rendering a dry run.
+func (s *StaticPodConfig) after(after <-chan struct{}, f func() error) error {
+	if s.dryRunDir != "" {
+		return f()
+	}
+	return podtemplate.After(after, f)
+}
+
 // removeTemplate cleans up the static pod manifest for the given command from the specified directory.
 // It does not actually stop or remove the static pod from the container runtime.
 func (s *StaticPodConfig) removeTemplate(command string) error {
-	manifestPath := filepath.Join(s.ManifestsDir, command+".yaml")
+	manifestPath := filepath.Join(s.dryRunDir, s.ManifestsDir, command+".yaml")
 	if err := os.Remove(manifestPath); err != nil && !errors.Is(err, os.ErrNotExist) {
 		return errors.WithMessagef(err, "failed to remove %s static pod manifest", command)
 	}
@@ -608,12 +714,35 @@ func (s *StaticPodConfig) writeTemplate(spec *podtemplate.Spec) error {
 				Type: "rke2_service_t",
 			}
 		}
+		if s.dryRunDir == "" {
+			relabelExtraMounts(spec)
+		}
 	}
-	files, err := podtemplate.ReadFiles(spec.Args, spec.ExcludeFiles)
+	// Files rendered into the dry run directory are mounted and hashed as if they had been written to the node
+	spec.RootDir = s.dryRunDir
+	files, err := podtemplate.ReadFiles(s.dryRunDir, spec.Args, spec.ExcludeFiles)
 	if err != nil {
 		return errors.WithMessagef(err, "failed to read files for pod %s", spec.Command)
 	}
 
+	// Verify the image signature before writing the manifest; component image keys are named after the command.
+	// Verified images are pinned to the digest that was verified, so that the kubelet cannot run a different image.
+	if s.imageVerifier != nil {
+		image, err := s.imageVerifier.VerifyReference(spec.Command+"-image", spec.Image)
+		if err != nil {
+			return err
+		}
+		spec.Image = image
+		for i := range spec.Sidecars {
+			sidecar := &spec.Sidecars[i]
+			image, err := s.imageVerifier.VerifyReference(podtemplate.SidecarImageName(spec.Command, sidecar.Name), sidecar.Ref())
+			if err != nil {
+				return err
+			}
+			sidecar.SetRef(image)
+		}
+	}
+
 	// TODO Check to make sure we aren't double mounting directories and the files in those directories
 
 	spec.Files = append(spec.Files, files...)
@@ -638,26 +767,76 @@ func (s *StaticPodConfig) writeTemplate(spec *podtemplate.Spec) error {
 	if err != nil {
 		return err
 	}
+	manifestPath = filepath.Join(s.dryRunDir, manifestPath)
 	if s.ProfileMode.isAnyMode() {
 		return writeFile(manifestPath, b, 0600)
 	}
 	return writeFile(manifestPath, b, 0644)
 }
 
+// relabelExtraMounts relabels the host paths of extra mounts that request it, so that they can be shared with containers.
+func relabelExtraMounts(spec *podtemplate.Spec) {
+	mounts := slices.Clone(spec.ExtraMounts)
+	for _, sidecar := range spec.Sidecars {
+		mounts = append(mounts, sidecar.Mounts...)
+	}
+	for _, rawMount := range mounts {
+		mount, err := podtemplate.ParseExtraMount(rawMount)
+		if err != nil || !mount.SELinuxRelabel {
+			continue
+		}
+		if err := label.Relabel(mount.Source, containerFileLabel, true); err != nil {
+			logrus.Warnf("Failed to relabel extra mount %s for pod %s: %v", mount.Source, spec.Command, err)
+		}
+	}
+}
+
+// requiredImages returns the component images that will be run on this node.
+func (s *StaticPodConfig) requiredImages() []string {
+	required := []string{images.Runtime, images.Pause, images.KubeProxy}
+	if s.IsServer {
+		required = append(required, images.KubeAPIServer, images.KubeControllerManager, images.KubeScheduler)
+		if !s.DisableETCD && !s.ExternalDatabase {
+			required = append(required, images.ETCD)
+		}
+	}
+	return required
+}
+
+// stageData stages content from the runtime image. The current phase is reported by the stage status,
+// and is included in the error if staging fails.
 func (s *StaticPodConfig) stageData(ctx context.Context, nodeConfig *daemonconfig.Node, cfg cmds.Agent) error {
+	status := s.StageOptions.Status
 	// if spegel is enabled, wait for it to start up so that we can attempt to pull content through it
-	if err := bootstrap.WaitForEmbeddedRegistry(ctx, nodeConfig); err != nil {
+	if err := bootstrap.WaitForEmbeddedRegistry(ctx, nodeConfig, s.StageOptions); err != nil {
 		logrus.Errorf("Failed to wait for embedded registry to become ready: %v", err)
 	}
-	if err := bootstrap.Stage(ctx, s.Resolver, nodeConfig, cfg); err != nil {
-		return err
+	if err := bootstrap.Stage(ctx, s.Resolver, nodeConfig, cfg, s.StageOptions); err != nil {
+		return status.Failed(err)
 	}
+	s.StageOptions.Stats.Log()
 	if s.IsServer {
-		go bootstrap.UpdateManifests(ctx, s.Resolver, s.IngressController, nodeConfig, cfg, s.Prime)
+		go bootstrap.UpdateManifests(ctx, s.Resolver, nodeConfig, cfg, bootstrap.ManifestOptions{
+			IngressController: s.IngressController,
+			Prime:             s.Prime,
+			GlobalValues:      s.ChartGlobalValues,
+			ChartsSource:      s.ChartsSource,
+			ConflictPolicy:    s.ManifestConflictPolicy,
+		})
 	}
 	return nil
 }
 
+// RenderManifests writes the bundled charts into dir, rewritten as they would be when copied into the manifests directory.
+func (s *StaticPodConfig) RenderManifests(ctx context.Context, nodeConfig *daemonconfig.Node, cfg cmds.Agent, dir string) error {
+	return bootstrap.RenderManifests(ctx, s.Resolver, nodeConfig, cfg, bootstrap.ManifestOptions{
+		IngressController: s.IngressController,
+		Prime:             s.Prime,
+		GlobalValues:      s.ChartGlobalValues,
+		ChartsSource:      s.ChartsSource,
+	}, dir)
+}
+
 func writeFile(dest string, content []byte, perm fs.FileMode) error {
 	name := filepath.Base(dest)
 	dir := filepath.Dir(dest)
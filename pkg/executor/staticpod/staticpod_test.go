@@ -0,0 +1,176 @@
+//go:build linux
+// +build linux
+
+package staticpod
+
+import (
+	"context"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/k3s-io/k3s/pkg/daemons/executor"
+	"github.com/rancher/rke2/pkg/cli"
+	"github.com/rancher/rke2/pkg/images"
+	"github.com/rancher/rke2/pkg/podtemplate"
+	v1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+var updateGolden = flag.Bool("update", false, "update the golden files in testdata")
+
+func Test_UnitDryRun(t *testing.T) {
+	// Host CA certificate directories are only mounted if they exist, so none are used for a stable result
+	sslDirs := podtemplate.SSLDirs
+	podtemplate.SSLDirs = nil
+	t.Cleanup(func() { podtemplate.SSLDirs = sslDirs })
+
+	const dataDir = "/var/lib/rancher/rke2"
+	config, err := podtemplate.NewConfigFromCLI(dataDir, cli.Config{
+		Images: images.ImageOverrideConfig{
+			IgnoreLockFile:         true,
+			ETCD:                   "registry.example.com/etcd:v1",
+			KubeAPIServer:          "registry.example.com/kubernetes:v1",
+			KubeControllerManager:  "registry.example.com/kubernetes:v1",
+			KubeScheduler:          "registry.example.com/kubernetes:v1",
+			KubeProxy:              "registry.example.com/kubernetes:v1",
+			CloudControllerManager: "registry.example.com/cloud-controller-manager:v1",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	s := &StaticPodConfig{
+		Config:          *config,
+		ManifestsDir:    filepath.Join(dataDir, "agent", "pod-manifests"),
+		AuditPolicyFile: "/etc/rancher/rke2/audit-policy.yaml",
+		PSAConfigFile:   "/etc/rancher/rke2/rke2-pss.yaml",
+		IsServer:        true,
+	}
+	s.DryRun(dir)
+
+	// The admission configuration is rendered into the dry run directory before the apiserver
+	psaConfigFile := filepath.Join(dir, s.PSAConfigFile)
+	if err := os.MkdirAll(filepath.Dir(psaConfigFile), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(psaConfigFile, []byte("apiVersion: apiserver.config.k8s.io/v1\nkind: AdmissionConfiguration\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	etcdConfig := &executor.ETCDConfig{
+		InitialOptions: executor.InitialOptions{
+			AdvertisePeerURL: "https://10.0.0.1:2380",
+			Cluster:          "server-1=https://10.0.0.1:2380",
+			State:            "new",
+		},
+		Name:    "server-1",
+		DataDir: filepath.Join(dataDir, "server", "db", "etcd"),
+		ServerTrust: executor.ServerTrust{
+			CertFile:       filepath.Join(dataDir, "server", "tls", "etcd", "server-client.crt"),
+			KeyFile:        filepath.Join(dataDir, "server", "tls", "etcd", "server-client.key"),
+			ClientCertAuth: true,
+			TrustedCAFile:  filepath.Join(dataDir, "server", "tls", "etcd", "server-ca.crt"),
+		},
+		PeerTrust: executor.PeerTrust{
+			CertFile:       filepath.Join(dataDir, "server", "tls", "etcd", "peer-server-client.crt"),
+			KeyFile:        filepath.Join(dataDir, "server", "tls", "etcd", "peer-server-client.key"),
+			ClientCertAuth: true,
+			TrustedCAFile:  filepath.Join(dataDir, "server", "tls", "etcd", "peer-ca.crt"),
+		},
+	}
+	if err := s.ETCD(ctx, &sync.WaitGroup{}, etcdConfig, []string{"log-level=debug"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.APIServer(ctx, []string{"--anonymous-auth=false"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Scheduler(ctx, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ControllerManager(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CloudControllerManager(ctx, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.KubeProxy(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, component := range []string{"kube-apiserver", "kube-scheduler", "kube-controller-manager", "cloud-controller-manager", "kube-proxy"} {
+		t.Run(component, func(t *testing.T) {
+			got, err := os.ReadFile(filepath.Join(dir, s.ManifestsDir, component+".yaml"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			golden := filepath.Join("testdata", "dry-run", component+".yaml")
+			if *updateGolden {
+				if err := os.WriteFile(golden, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != string(want) {
+				t.Errorf("rendered manifest does not match %s; re-run with -update if the change is expected:\n%s", golden, got)
+			}
+		})
+	}
+
+	// The etcd configuration file is generated by K3s, so the etcd manifest is checked for the configuration file
+	// instead of being compared to a golden file that would include its hash
+	b, err := os.ReadFile(filepath.Join(dir, s.ManifestsDir, "etcd.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pod := &v1.Pod{}
+	if err := yaml.Unmarshal(b, pod); err != nil {
+		t.Fatal(err)
+	}
+	confFile := filepath.Join(etcdConfig.DataDir, "config")
+	if want := []string{"--config-file=" + confFile}; !reflect.DeepEqual(pod.Spec.Containers[0].Args, want) {
+		t.Errorf("etcd args = %v, want %v", pod.Spec.Containers[0].Args, want)
+	}
+	if want := `{"initial-advertise-peer-urls":"https://10.0.0.1:2380","initial-cluster":"server-1=https://10.0.0.1:2380","initial-cluster-state":"new"}`; pod.Annotations["etcd.k3s.io/initial"] != want {
+		t.Errorf("etcd initial options annotation = %s, want %s", pod.Annotations["etcd.k3s.io/initial"], want)
+	}
+	mounted := false
+	for _, volume := range pod.Spec.Volumes {
+		if volume.HostPath != nil && volume.HostPath.Path == confFile {
+			mounted = true
+		}
+	}
+	if !mounted {
+		t.Errorf("etcd configuration %s is not mounted", confFile)
+	}
+
+	// The etcd configuration is rendered into the dry run directory, and refers to the data directory on the node
+	b, err = os.ReadFile(filepath.Join(dir, confFile))
+	if err != nil {
+		t.Fatalf("expected etcd configuration in dry run directory: %v", err)
+	}
+	conf := map[string]any{}
+	if err := yaml.Unmarshal(b, &conf); err != nil {
+		t.Fatal(err)
+	}
+	if conf["data-dir"] != etcdConfig.DataDir {
+		t.Errorf("etcd configuration data-dir = %v, want %s", conf["data-dir"], etcdConfig.DataDir)
+	}
+	if conf["log-level"] != "debug" {
+		t.Errorf("etcd configuration log-level = %v, want debug", conf["log-level"])
+	}
+
+	// The audit policy is rendered into the dry run directory, not written to the node
+	if _, err := os.Stat(filepath.Join(dir, s.AuditPolicyFile)); err != nil {
+		t.Errorf("expected audit policy in dry run directory: %v", err)
+	}
+}
@@ -0,0 +1,387 @@
+package images
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/k3s-io/k3s/pkg/util/errors"
+	"github.com/rancher/wharfie/pkg/tarfile"
+	"github.com/rancher/wharfie/pkg/util"
+	"github.com/sirupsen/logrus"
+)
+
+// ArchiveIndex records the images that are available in the airgap image archives in a directory.
+type ArchiveIndex struct {
+	images map[string]string // image name -> archive path
+}
+
+// archiveIndexFile caches the image names found in each archive in a directory, so that archives
+// do not need to be decompressed again unless they are modified. It is a hidden file, so that it is
+// not mistaken for an image archive.
+const archiveIndexFile = ".archive-index.json"
+
+// archiveEntry records the image names found in an archive, with the size and modification time
+// of the archive when it was read.
+type archiveEntry struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	Names   []string  `json:"names"`
+}
+
+// archiveIndexLock serializes updates to the cached archive index files.
+var archiveIndexLock sync.Mutex
+
+// IndexArchives builds an index of the images in the docker-archive and OCI-layout image archives
+// in dir, in any of the compression formats supported for airgap image tarballs. Archives that
+// cannot be read are logged and skipped. Archives must be decompressed to find the images within
+// them, so the contents of each archive are cached in a file in dir, keyed by the size and
+// modification time of the archive, and archives are only read again if they are modified.
+func IndexArchives(dir string) (*ArchiveIndex, error) {
+	index := &ArchiveIndex{images: map[string]string{}}
+
+	if _, err := os.Stat(dir); err != nil {
+		if os.IsNotExist(err) {
+			return index, nil
+		}
+		logrus.Errorf("unable to stat image directory %s: %v", dir, err)
+		return nil, err
+	}
+
+	var files []string
+	if err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		base := filepath.Base(info.Name())
+		if !info.IsDir() && !strings.HasPrefix(base, ".") && util.HasSuffixI(base, tarfile.SupportedExtensions...) {
+			files = append(files, path)
+		}
+		return nil
+	}); err != nil {
+		return nil, errors.WithMessagef(err, "failed to list images in %s", dir)
+	}
+
+	archiveIndexLock.Lock()
+	defer archiveIndexLock.Unlock()
+
+	cached := readArchiveIndex(dir)
+	entries := map[string]archiveEntry{}
+
+	// Walk returns files in lexical order; images are recorded as coming from the first
+	// archive that they are found in, to match the order in which wharfie searches archives.
+	for _, file := range files {
+		names, entry, err := archiveImages(file, cached)
+		if err != nil {
+			logrus.Warnf("Failed to read image archive %s: %v", file, err)
+			continue
+		}
+		entries[file] = entry
+		for _, n := range names {
+			if _, ok := index.images[n]; !ok {
+				index.images[n] = file
+			}
+		}
+	}
+
+	if !reflect.DeepEqual(cached, entries) {
+		if err := writeArchiveIndex(dir, entries); err != nil {
+			logrus.Debugf("Failed to write image archive index for %s: %v", dir, err)
+		}
+	}
+	return index, nil
+}
+
+// Find returns the archive that contains any of the given references.
+func (a *ArchiveIndex) Find(refs ...name.Reference) (string, bool) {
+	for _, ref := range refs {
+		if ref == nil {
+			continue
+		}
+		if archive, ok := a.images[ref.Name()]; ok {
+			return archive, true
+		}
+	}
+	return "", false
+}
+
+// FindImage returns the archive that contains an image. If the image is pinned to a digest, such as by the
+// image lock file, the archive must contain that digest: an error is returned if the image is only found under
+// its unlocked reference, as the image that would be imported from the archive may not be the one that was
+// locked. Docker-archive tarballs only record image tags, so a locked digest can only be matched in an
+// OCI-layout archive. If the image is not pinned to a digest, it may be found under any of its references.
+func (a *ArchiveIndex) FindImage(ref name.Reference, unlocked ...name.Reference) (string, bool, error) {
+	if archive, ok := a.Find(ref); ok {
+		return archive, true, nil
+	}
+	archive, ok := a.Find(unlocked...)
+	if !ok {
+		return "", false, nil
+	}
+	if _, pinned := ref.(name.Digest); pinned {
+		return "", false, fmt.Errorf("image %s is pinned to a digest that is not in airgap image archive %s, which only contains it by tag; use an OCI-layout archive that contains the pinned digest, or update the image lock file", ref.Name(), filepath.Base(archive))
+	}
+	return archive, true, nil
+}
+
+// Len returns the number of images in the index.
+func (a *ArchiveIndex) Len() int {
+	return len(a.images)
+}
+
+// archiveImages returns the names of the images in an archive, using the cached entry if the file has not been modified.
+func archiveImages(file string, cached map[string]archiveEntry) ([]string, archiveEntry, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, archiveEntry{}, err
+	}
+	if e, ok := cached[file]; ok && e.Size == info.Size() && e.ModTime.Equal(info.ModTime()) {
+		return e.Names, e, nil
+	}
+
+	names, err := readArchiveImages(file)
+	if err != nil {
+		return nil, archiveEntry{}, err
+	}
+	return names, archiveEntry{Size: info.Size(), ModTime: info.ModTime(), Names: names}, nil
+}
+
+// readArchiveIndex reads the cached archive index for a directory. A missing or invalid index is treated as empty.
+func readArchiveIndex(dir string) map[string]archiveEntry {
+	entries := map[string]archiveEntry{}
+	b, err := os.ReadFile(filepath.Join(dir, archiveIndexFile))
+	if err != nil {
+		return entries
+	}
+	if err := json.Unmarshal(b, &entries); err != nil {
+		logrus.Debugf("Ignoring invalid image archive index in %s: %v", dir, err)
+		return map[string]archiveEntry{}
+	}
+	return entries
+}
+
+// writeArchiveIndex writes the cached archive index for a directory. The index is written to a temporary
+// file and renamed into place, so that an interrupted write does not leave a partial index.
+func writeArchiveIndex(dir string, entries map[string]archiveEntry) error {
+	b, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, archiveIndexFile+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(dir, archiveIndexFile))
+}
+
+// readArchiveImages reads the docker-archive manifest.json and OCI-layout index.json
+// from an archive, and returns the names of the images that they reference.
+func readArchiveImages(file string) ([]string, error) {
+	opener, err := tarfile.GetOpener(file)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := opener()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	names := []string{}
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch strings.TrimPrefix(path.Clean(hdr.Name), "./") {
+		case "manifest.json":
+			manifest := []struct {
+				RepoTags []string `json:"RepoTags"`
+			}{}
+			if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+				return nil, errors.WithMessage(err, "failed to decode manifest.json")
+			}
+			for _, m := range manifest {
+				for _, t := range m.RepoTags {
+					names = appendImageName(names, t)
+				}
+			}
+		case "index.json":
+			index := v1.IndexManifest{}
+			if err := json.NewDecoder(tr).Decode(&index); err != nil {
+				return nil, errors.WithMessage(err, "failed to decode index.json")
+			}
+			for _, desc := range index.Manifests {
+				for _, key := range []string{AnnotationContainerdImageName, AnnotationRefName} {
+					a, ok := desc.Annotations[key]
+					if !ok {
+						continue
+					}
+					// The ref.name annotation may be only a tag, which cannot be matched to a repository
+					ref, err := name.ParseReference(a, name.WeakValidation)
+					if err != nil || !strings.Contains(a, "/") {
+						continue
+					}
+					names = appendImageName(names, ref.Name())
+					names = appendImageName(names, ref.Context().Digest(desc.Digest.String()).Name())
+				}
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// appendImageName appends the normalized name of an image to the list, if it can be parsed.
+func appendImageName(names []string, s string) []string {
+	ref, err := name.ParseReference(s, name.WeakValidation)
+	if err != nil {
+		return names
+	}
+	return append(names, ref.Name())
+}
+
+// FindDescriptor returns the archive that contains an image, and the descriptor that the archive's OCI-layout
+// index.json records for it. Docker-archive tarballs record only image tags, and the image manifest that is read
+// from them is generated from the layer tarballs, so its digest does not match the manifest that was pushed to
+// the registry and signed: an error is returned if the image is only found in a docker-archive tarball. If the
+// image is not found in any archive, ok is false.
+func (a *ArchiveIndex) FindDescriptor(ref name.Reference) (string, *v1.Descriptor, bool, error) {
+	archive, ok := a.Find(ref)
+	if !ok {
+		return "", nil, false, nil
+	}
+	b, err := readArchiveFile(archive, "index.json")
+	if os.IsNotExist(err) {
+		return "", nil, false, fmt.Errorf("image %s is in docker-archive tarball %s, which does not preserve the manifest digest of the image; use an OCI-layout archive", ref.Name(), filepath.Base(archive))
+	} else if err != nil {
+		return "", nil, false, err
+	}
+	index, err := v1.ParseIndexManifest(bytes.NewReader(b))
+	if err != nil {
+		return "", nil, false, errors.WithMessagef(err, "failed to decode index.json in %s", archive)
+	}
+	for i, desc := range index.Manifests {
+		for _, key := range []string{AnnotationContainerdImageName, AnnotationRefName} {
+			s, ok := desc.Annotations[key]
+			if !ok {
+				continue
+			}
+			r, err := name.ParseReference(s, name.WeakValidation)
+			if err != nil {
+				continue
+			}
+			if r.Name() == ref.Name() || r.Context().Digest(desc.Digest.String()).Name() == ref.Name() {
+				return archive, &index.Manifests[i], true, nil
+			}
+		}
+	}
+	return "", nil, false, fmt.Errorf("image %s not found in index.json in %s", ref.Name(), archive)
+}
+
+// readArchiveBlob reads a blob from an OCI-layout archive, and checks that its content matches the digest.
+func readArchiveBlob(file string, digest v1.Hash) ([]byte, error) {
+	b, err := readArchiveFile(file, path.Join("blobs", digest.Algorithm, digest.Hex))
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to read blob %s from %s", digest, file)
+	}
+	if h, _, err := v1.SHA256(bytes.NewReader(b)); err != nil {
+		return nil, err
+	} else if h != digest {
+		return nil, fmt.Errorf("blob %s in %s has digest %s", digest, file, h)
+	}
+	return b, nil
+}
+
+// readArchiveFile returns the content of a file in an archive, or an error that satisfies os.IsNotExist
+// if the archive does not contain the file.
+func readArchiveFile(file, name string) ([]byte, error) {
+	opener, err := tarfile.GetOpener(file)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := opener()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimPrefix(path.Clean(hdr.Name), "./") == name {
+			return io.ReadAll(tr)
+		}
+	}
+}
+
+// LogArchiveSummary logs which of the given images are available from the airgap image archives in dir,
+// and which will be pulled from a registry.
+func (r *Resolver) LogArchiveSummary(dir string, required ...string) {
+	index, err := IndexArchives(dir)
+	if err != nil {
+		logrus.Warnf("Failed to index airgap image archives: %v", err)
+		return
+	}
+	if index.Len() == 0 {
+		logrus.Infof("No airgap image archives found in %s; all required images will be pulled", dir)
+		return
+	}
+
+	var present, missing []string
+	for _, i := range required {
+		ref, err := r.GetReference(i)
+		if err != nil {
+			logrus.Warnf("Failed to resolve %s: %v", i, err)
+			continue
+		}
+		unlocked, _ := r.GetUnlockedReference(i)
+		archive, ok, err := index.FindImage(ref, unlocked)
+		if err != nil {
+			logrus.Warnf("Failed to find %s in airgap image archives: %v", i, err)
+		}
+		if ok {
+			present = append(present, ref.Name()+" ("+filepath.Base(archive)+")")
+		} else {
+			missing = append(missing, ref.Name())
+		}
+	}
+	logrus.Infof("Found %d of %d required images in airgap image archives in %s", len(present), len(present)+len(missing), dir)
+	for _, p := range present {
+		logrus.Infof("Image %s is available from airgap image archive", p)
+	}
+	for _, m := range missing {
+		logrus.Infof("Image %s was not found in airgap image archives and will be pulled", m)
+	}
+}
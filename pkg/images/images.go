@@ -4,11 +4,15 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
+	"runtime"
 	"strings"
 
 	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/k3s-io/k3s/pkg/util/errors"
 	"github.com/sirupsen/logrus"
+	"sigs.k8s.io/yaml"
 )
 
 // Image defaults overridden by config passed in and ImageOverrideConfig below
@@ -23,6 +27,27 @@ const (
 	CloudControllerManager = "cloud-controller-manager-image"
 )
 
+// Source describes where the reference for an image was resolved from.
+type Source string
+
+const (
+	SourceOverride              Source = "override"
+	SourceSystemDefaultRegistry Source = "system-default-registry"
+	SourceDefault               Source = "default"
+)
+
+// All contains the names of all images that can be resolved by the Resolver.
+var All = []string{
+	Runtime,
+	KubeAPIServer,
+	KubeControllerManager,
+	KubeProxy,
+	KubeScheduler,
+	ETCD,
+	Pause,
+	CloudControllerManager,
+}
+
 // These defaults are overridden at build time and do not need to be updated here
 var (
 	DefaultRegistry                    = name.DefaultRegistry
@@ -39,14 +64,44 @@ type ResolverOpt func(name.Reference) (name.Reference, error)
 
 // Resolver provides functionality to resolve an RKE2 image name to a reference.
 type Resolver struct {
-	registry  name.Registry
-	repoPath  string // optional path segment to prepend to image repository
-	overrides map[string]name.Reference
+	registries        []defaultRegistry // default registries, in order of preference
+	registrySet       bool              // true if the default registry has been changed from the compile-time default
+	overrides         map[string]name.Reference
+	platformOverrides map[string]map[string]name.Reference // overrides keyed by platform, selected at resolution time
+	platform          v1.Platform                          // platform used to select platform-specific overrides
+	selected          map[string]int                       // index of the default registry selected for an image, if not the first
+	digests           map[string]v1.Hash                   // digests pinned by the image lock file
+	rewrites          []rewriteRule                        // repository rewrite rules, in order of precedence
+	policy            *SignaturePolicy                     // image signature verification policy, if configured
+}
+
+// rewriteRule rewrites image repository names that match a regular expression.
+type rewriteRule struct {
+	match       *regexp.Regexp
+	replacement string
+}
+
+// defaultRegistry is a registry used for images that have not been overridden.
+type defaultRegistry struct {
+	registry name.Registry
+	repoPath string // optional path segment to prepend to image repository
+}
+
+// String returns the registry, with the optional repository path appended.
+func (d defaultRegistry) String() string {
+	if d.repoPath != "" {
+		return d.registry.Name() + "/" + d.repoPath
+	}
+	return d.registry.Name()
 }
 
 // ImageOverrideConfig stores configuration from the CLI.
 type ImageOverrideConfig struct {
 	SystemDefaultRegistry  string
+	LockFile               string
+	IgnoreLockFile         bool // do not load the lock file, such as when it is being regenerated
+	RewriteRules           []string
+	SignaturePolicy        string
 	KubeAPIServer          string
 	KubeControllerManager  string
 	KubeProxy              string
@@ -65,9 +120,12 @@ func NewResolver(c ImageOverrideConfig) (*Resolver, error) {
 	}
 
 	r := Resolver{
-		registry:  registry,
-		repoPath:  "",
-		overrides: map[string]name.Reference{},
+		registries:        []defaultRegistry{{registry: registry}},
+		overrides:         map[string]name.Reference{},
+		platformOverrides: map[string]map[string]name.Reference{},
+		platform:          Platform(),
+		selected:          map[string]int{},
+		digests:           map[string]v1.Hash{},
 	}
 
 	// Validate and set image overrides from config
@@ -97,43 +155,207 @@ func NewResolver(c ImageOverrideConfig) (*Resolver, error) {
 			return nil, errors.WithMessage(err, "failed to parse system-default-registry")
 		}
 	}
+
+	// validate and set repository rewrite rules from config
+	for _, rule := range c.RewriteRules {
+		if err := r.AddRewriteRule(rule); err != nil {
+			return nil, errors.WithMessagef(err, "failed to parse image rewrite rule %q", rule)
+		}
+	}
+
+	// load image digests from the lock file. The default lock file is optional,
+	// but a lock file that has been explicitly configured must exist.
+	lockFile := c.LockFile
+	if c.IgnoreLockFile {
+		lockFile = ""
+	} else if lockFile == "" {
+		if _, err := os.Stat(DefaultLockFile); err == nil {
+			lockFile = DefaultLockFile
+		}
+	}
+	if lockFile != "" {
+		digests, err := ReadLockFile(lockFile)
+		if err != nil {
+			return nil, errors.WithMessage(err, "failed to load image lock file")
+		}
+		logrus.Infof("Using image digests from lock file %s", lockFile)
+		r.digests = digests
+	}
+
+	// load the image signature verification policy
+	if c.SignaturePolicy != "" {
+		policy, err := ReadSignaturePolicy(c.SignaturePolicy)
+		if err != nil {
+			return nil, errors.WithMessage(err, "failed to load image signature policy")
+		}
+		r.policy = policy
+	}
 	return &r, nil
 }
 
+// SignaturePolicy returns the image signature verification policy. A nil policy disables verification.
+func (r *Resolver) SignaturePolicy() *SignaturePolicy {
+	return r.policy
+}
+
 // ParseAndSetDefaultRegistry updates the default registry, if it can be parsed
-// as a valid Registry
+// as a valid Registry. A comma-separated list of registries may be provided; the
+// first registry is preferred, and the remainder are used as fallbacks, in order,
+// if an image cannot be found in the preferred registry.
 func (r *Resolver) ParseAndSetDefaultRegistry(s string) error {
-	host, path := splitRegistryAndPath(s)
+	registries, err := parseDefaultRegistries(s)
+	if err != nil {
+		return err
+	}
 
-	reg, err := name.NewRegistry(host)
+	r.registries = registries
+	r.selected = map[string]int{}
+	r.registrySet = true
+
+	return nil
+}
+
+// SetPrimaryRegistry sets the preferred default registry. If the registry is already
+// one of the configured default registries, it is moved to the front of the list and
+// the remaining registries are retained as fallbacks. Otherwise, the list is replaced.
+// This allows agents to retain locally configured fallback registries when the server
+// provides only the preferred registry.
+func (r *Resolver) SetPrimaryRegistry(s string) error {
+	registries, err := parseDefaultRegistries(s)
 	if err != nil {
 		return err
 	}
+	if len(registries) != 1 || !r.registrySet {
+		return r.ParseAndSetDefaultRegistry(s)
+	}
 
-	r.registry = reg
-	r.repoPath = path
+	for i, d := range r.registries {
+		if d.String() == registries[0].String() {
+			r.registries = append(registries, append(r.registries[:i:i], r.registries[i+1:]...)...)
+			r.selected = map[string]int{}
+			return nil
+		}
+	}
+	return r.ParseAndSetDefaultRegistry(s)
+}
 
+// AddRewriteRule adds a repository rewrite rule, in the form <regex>=<replacement>. The regular
+// expression is matched against the fully-qualified repository name, including the registry; the
+// replacement may reference capture groups using $1 syntax. The rule is split at the first = that is
+// not escaped, so the replacement may contain =, and a literal = in the expression is written as \=.
+// Rules are checked in the order that they are added, and only the first matching rule is applied.
+// Rules apply to both compiled-in defaults and overrides, and to the system-default-registry passed to charts.
+func (r *Resolver) AddRewriteRule(s string) error {
+	i := rewriteRuleSeparator(s)
+	if i < 1 {
+		return fmt.Errorf("rewrite rule must be in the form <regex>=<replacement>")
+	}
+	re, err := regexp.Compile(s[:i])
+	if err != nil {
+		return err
+	}
+	r.rewrites = append(r.rewrites, rewriteRule{match: re, replacement: s[i+1:]})
 	return nil
 }
 
+// rewriteRuleSeparator returns the index of the first = in a rewrite rule that is not escaped with a backslash, or -1.
+func rewriteRuleSeparator(s string) int {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '=':
+			return i
+		}
+	}
+	return -1
+}
+
+// RewriteRegistry applies the rewrite rules to a registry name, with optional repository path prefix. This is
+// used to rewrite the system-default-registry value passed through to charts, which combine it with the image
+// repository themselves. The registry is returned unmodified if no rule matches.
+func (r *Resolver) RewriteRegistry(s string) string {
+	if s == "" {
+		return s
+	}
+	if rewritten, ok := r.rewrite(s); ok {
+		return rewritten
+	}
+	return s
+}
+
+// rewrite applies the first matching rewrite rule to a string.
+func (r *Resolver) rewrite(s string) (string, bool) {
+	for _, rule := range r.rewrites {
+		if rule.match.MatchString(s) {
+			return rule.match.ReplaceAllString(s, rule.replacement), true
+		}
+	}
+	return s, false
+}
+
+// RewriteReference applies the first matching rewrite rule to the repository of a reference,
+// retaining the tag or digest. The reference is returned unmodified if no rule matches.
+func (r *Resolver) RewriteReference(ref name.Reference) (name.Reference, error) {
+	repo, ok := r.rewrite(ref.Context().Name())
+	if !ok {
+		return ref, nil
+	}
+	var s string
+	switch t := ref.(type) {
+	case name.Tag:
+		s = repo + ":" + t.TagStr()
+	case name.Digest:
+		s = repo + "@" + t.DigestStr()
+	default:
+		return nil, fmt.Errorf("unhandled Reference type: %T", ref)
+	}
+	rewritten, err := name.ParseReference(s, name.WeakValidation)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "invalid rewritten reference for %s", ref.Name())
+	}
+	return rewritten, nil
+}
+
+// PrimaryRegistry returns the first registry from a comma-separated list of registries.
+func PrimaryRegistry(s string) string {
+	primary, _, _ := strings.Cut(s, ",")
+	return strings.TrimSpace(primary)
+}
+
 // ParseAndSetOverride sets an image override from a string, if it can be parsed as
-// a valid Reference.
+// a valid Reference. Overrides may also be keyed by platform, to allow a single
+// configuration to be shared by nodes of different architectures. Platform-specific
+// overrides are given as a comma-separated list of platform=reference pairs, or as a
+// mapping such as {linux/arm64: reference, default: reference}. A mapping in the config file
+// is flattened into the form map[linux/arm64:reference default:reference], which is also accepted.
+// Platforms are in the form os/arch or os, and the default key is used if no platform matches.
 func (r *Resolver) ParseAndSetOverride(i, n string) error {
 	n = strings.TrimSpace(n)
 	if n == "" {
 		return nil
 	}
+	if strings.HasPrefix(n, "{") || strings.HasPrefix(n, "map[") || strings.Contains(n, "=") {
+		overrides, err := parsePlatformOverrides(n)
+		if err != nil {
+			return err
+		}
+		delete(r.overrides, i)
+		r.platformOverrides[i] = overrides
+		return nil
+	}
 	ref, err := name.ParseReference(n, name.WeakValidation)
 	if err != nil {
 		return err
 	}
-	r.overrides[i] = ref
+	r.SetOverride(i, ref)
 	return nil
 }
 
 // SetOverride set an image override from a Reference. If the reference is nil,
 // the override is cleared.
 func (r *Resolver) SetOverride(i string, n name.Reference) {
+	delete(r.platformOverrides, i)
 	if n == nil {
 		delete(r.overrides, i)
 	} else {
@@ -141,12 +363,150 @@ func (r *Resolver) SetOverride(i string, n name.Reference) {
 	}
 }
 
+// override returns the override for an image, selecting platform-specific overrides by the resolver's platform.
+func (r *Resolver) override(i string) (name.Reference, bool) {
+	if o, ok := r.overrides[i]; ok {
+		return o, true
+	}
+	if key, ok := r.platformOverrideKey(i); ok {
+		return r.platformOverrides[i][key], true
+	}
+	return nil, false
+}
+
+// platformOverrideKey returns the key of the platform-specific override selected for an image by the resolver's platform.
+func (r *Resolver) platformOverrideKey(i string) (string, bool) {
+	overrides, ok := r.platformOverrides[i]
+	if !ok {
+		return "", false
+	}
+	for _, key := range []string{r.platform.OS + "/" + r.platform.Architecture, r.platform.OS, "default"} {
+		if _, ok := overrides[key]; ok {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// lockKey returns the key that an image is pinned by in the lock file. Images with platform-specific
+// overrides are pinned separately for each platform, as the overrides may be entirely different images.
+func (r *Resolver) lockKey(i string) string {
+	if _, ok := r.overrides[i]; ok {
+		return i
+	}
+	if key, ok := r.platformOverrideKey(i); ok {
+		return LockKey(i, key)
+	}
+	return i
+}
+
+// GetPlatformReferences returns a reference to each of the platform-specific overrides for an image,
+// keyed by platform, without the lock file applied. Nil is returned if the image does not have
+// platform-specific overrides.
+func (r *Resolver) GetPlatformReferences(i string) (map[string]name.Reference, error) {
+	if _, ok := r.overrides[i]; ok {
+		return nil, nil
+	}
+	overrides, ok := r.platformOverrides[i]
+	if !ok {
+		return nil, nil
+	}
+	refs := map[string]name.Reference{}
+	for key, o := range overrides {
+		ref, err := r.RewriteReference(o)
+		if err != nil {
+			return nil, err
+		}
+		refs[key] = ref
+	}
+	return refs, nil
+}
+
+// ForPlatform returns a copy of the resolver that selects platform-specific overrides for the given
+// platform, instead of the platform of this node. All other settings are shared with this resolver.
+func (r *Resolver) ForPlatform(platform v1.Platform) *Resolver {
+	pr := *r
+	pr.platform = platform
+	return &pr
+}
+
 // GetReference returns a reference to an image. If an override is set it is used,
 // otherwise the compile-time default is retrieved and default-registry settings applied.
-// Options can be passed to modify the reference before it is returned.
+// If the image is pinned by the lock file, a reference to the locked digest is returned
+// instead of the tag. Options can be passed to modify the reference before it is returned.
 func (r *Resolver) GetReference(i string, opts ...ResolverOpt) (name.Reference, error) {
+	ref, err := r.getReference(i, r.selected[i], true)
+	if err != nil {
+		return nil, err
+	}
+	return applyOpts(ref, opts...)
+}
+
+// GetUnlockedReference returns a reference to an image, without the lock file applied.
+// This is generally only useful when the image needs to be found by tag,
+// as when searching airgap image tarballs, or when generating the lock file.
+func (r *Resolver) GetUnlockedReference(i string, opts ...ResolverOpt) (name.Reference, error) {
+	ref, err := r.getReference(i, r.selected[i], false)
+	if err != nil {
+		return nil, err
+	}
+	return applyOpts(ref, opts...)
+}
+
+// GetReferences returns a reference to an image in each of the default registries, in order of
+// preference. If an override is set, only the override is returned, as it does not use the default registry.
+func (r *Resolver) GetReferences(i string) ([]name.Reference, error) {
+	return r.getReferences(i, true)
+}
+
+// GetUnlockedReferences returns a reference to an image in each of the default registries, in the same
+// order as GetReferences, without the lock file applied.
+func (r *Resolver) GetUnlockedReferences(i string) ([]name.Reference, error) {
+	return r.getReferences(i, false)
+}
+
+func (r *Resolver) getReferences(i string, locked bool) ([]name.Reference, error) {
+	if _, ok := r.override(i); ok {
+		ref, err := r.getReference(i, 0, locked)
+		if err != nil {
+			return nil, err
+		}
+		return []name.Reference{ref}, nil
+	}
+
+	refs := make([]name.Reference, 0, len(r.registries))
+	for idx := range r.registries {
+		ref, err := r.getReference(i, idx, locked)
+		if err != nil {
+			return nil, err
+		}
+		refs = append(refs, ref)
+	}
+	return refs, nil
+}
+
+// SelectRegistry sets the default registry used for an image to the registry of the given reference,
+// which must be one of the references returned by GetReferences.
+func (r *Resolver) SelectRegistry(i string, ref name.Reference) error {
+	refs, err := r.GetReferences(i)
+	if err != nil {
+		return err
+	}
+	for idx, candidate := range refs {
+		if candidate.Name() == ref.Name() {
+			if _, ok := r.override(i); !ok {
+				r.selected[i] = idx
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not in a default registry for %s", ref.Name(), i)
+}
+
+// getReference returns a reference to an image, using the default registry at the given index if there is no override.
+func (r *Resolver) getReference(i string, idx int, locked bool) (name.Reference, error) {
 	var ref name.Reference
-	if o, ok := r.overrides[i]; ok {
+	if o, ok := r.override(i); ok {
 		// Use override if set
 		ref = o
 	} else {
@@ -155,31 +515,90 @@ func (r *Resolver) GetReference(i string, opts ...ResolverOpt) (name.Reference,
 		if err != nil {
 			return nil, err
 		}
-		ref = d
-
-		reg := r.registry.Name()
-		if r.repoPath != "" {
-			reg = reg + "/" + r.repoPath
+		if idx >= len(r.registries) {
+			idx = 0
 		}
 		// Apply registry override
-		d, err = setRegistry(ref, reg)
+		d, err = setRegistry(d, r.registries[idx].String())
 		if err != nil {
 			return nil, err
 		}
 		ref = d
 	}
 
-	// Apply additional options
-	for _, o := range opts {
-		r, err := o(ref)
-		if err != nil {
-			return nil, err
+	// Apply rewrite rules to both defaults and overrides
+	ref, err := r.RewriteReference(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	// Pin tags to the locked digest, if set. References that are already to a
+	// digest are left as-is, as the override was explicitly pinned by the user.
+	if d, ok := r.digests[r.lockKey(i)]; ok && locked {
+		if t, ok := ref.(name.Tag); ok {
+			ref = t.Context().Digest(d.String())
 		}
-		ref = r
 	}
 	return ref, nil
 }
 
+// GetLockedDigest returns the digest that an image is pinned to by the lock file, if any.
+func (r *Resolver) GetLockedDigest(i string) (v1.Hash, bool) {
+	d, ok := r.digests[r.lockKey(i)]
+	return d, ok
+}
+
+// GetSource returns the source that the reference for an image is resolved from:
+// an explicit override, the system-default-registry, or the compile-time default.
+func (r *Resolver) GetSource(i string) Source {
+	if _, ok := r.override(i); ok {
+		return SourceOverride
+	}
+	if r.registrySet {
+		return SourceSystemDefaultRegistry
+	}
+	return SourceDefault
+}
+
+// ParseReference parses an image name that is not managed by the resolver, such as an
+// image referenced by a bundled chart, and applies default-registry settings to it.
+// Rewrite rules are not applied; see ParseChartReference.
+func (r *Resolver) ParseReference(s string) (name.Reference, Source, error) {
+	ref, err := name.ParseReference(s, name.WeakValidation)
+	if err != nil {
+		return nil, "", err
+	}
+	source := SourceDefault
+	if r.registrySet {
+		ref, err = setRegistry(ref, r.registries[0].String())
+		if err != nil {
+			return nil, "", err
+		}
+		source = SourceSystemDefaultRegistry
+	}
+	return ref, source, nil
+}
+
+// ParseChartReference parses an image referenced by a bundled chart, and returns the reference that the
+// chart will use. Charts combine the system-default-registry with the image repository themselves, so the
+// rewrite rules are applied to the registry, as they are to the value passed to charts, and not to the
+// repository.
+func (r *Resolver) ParseChartReference(s string) (name.Reference, Source, error) {
+	ref, err := name.ParseReference(s, name.WeakValidation)
+	if err != nil {
+		return nil, "", err
+	}
+	source := SourceDefault
+	if r.registrySet {
+		ref, err = setRegistry(ref, r.RewriteRegistry(r.registries[0].String()))
+		if err != nil {
+			return nil, "", err
+		}
+		source = SourceSystemDefaultRegistry
+	}
+	return ref, source, nil
+}
+
 func (r *Resolver) MustGetReference(i string, opts ...ResolverOpt) name.Reference {
 	ref, err := r.GetReference(i, opts...)
 	if err != nil {
@@ -188,6 +607,18 @@ func (r *Resolver) MustGetReference(i string, opts ...ResolverOpt) name.Referenc
 	return ref
 }
 
+// applyOpts applies resolver options to a reference.
+func applyOpts(ref name.Reference, opts ...ResolverOpt) (name.Reference, error) {
+	for _, o := range opts {
+		r, err := o(ref)
+		if err != nil {
+			return nil, err
+		}
+		ref = r
+	}
+	return ref, nil
+}
+
 // WithRegistry overrides the registry when resolving the reference to an image.
 func WithRegistry(registry string) ResolverOpt {
 	return func(r name.Reference) (name.Reference, error) {
@@ -258,17 +689,27 @@ func getDefaultImage(i string) (name.Reference, error) {
 	return name.ParseReference(s, name.WeakValidation)
 }
 
-// Pull checks for preloaded images in dir. If they are available, nothing is done.
-// If they are not available, it adds the image to name.txt in dir.
-// This is used to get K3s to pre-pull images for static pods.
-func Pull(dir, name string, image name.Reference) error {
+// Pull checks the airgap image archives in dir for the image. If it is available, nothing is done.
+// If it is not available, it adds the image to name.txt in dir. If the image is not pinned to a digest,
+// it is also considered to be available if any of the unlocked references are found in an archive. An
+// error is returned if the image is pinned to a digest, but an archive only contains the unlocked
+// reference, such as the tag that a locked digest was resolved from. This is used to get K3s to
+// pre-pull images for static pods.
+func Pull(dir, name string, image name.Reference, unlocked ...name.Reference) error {
 	if dir == "" {
 		return nil
 	}
 
-	if imagesExist, err := checkPreloadedImages(dir); err != nil {
+	index, err := IndexArchives(dir)
+	if err != nil {
+		return err
+	}
+	archive, ok, err := index.FindImage(image, unlocked...)
+	if err != nil {
 		return err
-	} else if imagesExist {
+	}
+	if ok {
+		logrus.Debugf("Image %s found in %s; not adding to pull list", image.Name(), archive)
 		return nil
 	}
 
@@ -280,33 +721,81 @@ func Pull(dir, name string, image name.Reference) error {
 	return os.WriteFile(dest, []byte(image.Name()+"\n"), 0644)
 }
 
-// checkPreloadedImages returns true if there are any files in dir that do not
-// end with a .txt or .json extension. The presence of at least one such file
-// is presumed to indicate that there is an airgap image tarball available.
-func checkPreloadedImages(dir string) (bool, error) {
-	if _, err := os.Stat(dir); err != nil {
-		if os.IsNotExist(err) {
-			return false, nil
+// Platform returns the platform used to select images for this node.
+func Platform() v1.Platform {
+	return v1.Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}
+}
+
+// parsePlatformOverrides parses image overrides keyed by platform.
+func parsePlatformOverrides(s string) (map[string]name.Reference, error) {
+	entries := map[string]string{}
+	if strings.HasPrefix(s, "{") {
+		if err := yaml.UnmarshalStrict([]byte(s), &entries); err != nil {
+			return nil, errors.WithMessage(err, "failed to parse platform overrides")
+		}
+	} else if m, ok := strings.CutPrefix(s, "map["); ok {
+		// Platform keys cannot contain a colon, so each entry is split at the first one
+		for _, entry := range strings.Fields(strings.TrimSuffix(m, "]")) {
+			key, value, ok := strings.Cut(entry, ":")
+			if !ok {
+				return nil, fmt.Errorf("platform override %q must be in the form platform:reference", entry)
+			}
+			entries[key] = value
+		}
+	} else {
+		for _, entry := range strings.Split(s, ",") {
+			key, value, ok := strings.Cut(entry, "=")
+			if !ok {
+				return nil, fmt.Errorf("platform override %q must be in the form platform=reference", entry)
+			}
+			entries[strings.TrimSpace(key)] = strings.TrimSpace(value)
 		}
-		logrus.Errorf("unable to stat image directory %s: %v", dir, err)
-		return false, err
 	}
 
-	fileInfos, err := os.ReadDir(dir)
-	if err != nil {
-		logrus.Errorf("unable to list images in %s: %v", dir, err)
-		return false, nil
+	overrides := map[string]name.Reference{}
+	for key, value := range entries {
+		if err := validatePlatformKey(key); err != nil {
+			return nil, err
+		}
+		ref, err := name.ParseReference(value, name.WeakValidation)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "invalid reference for %s", key)
+		}
+		overrides[key] = ref
+	}
+	return overrides, nil
+}
+
+// validatePlatformKey checks that a platform override key is a valid platform, or default.
+func validatePlatformKey(key string) error {
+	if key == "default" {
+		return nil
+	}
+	if _, err := v1.ParsePlatform(key); err != nil {
+		return errors.WithMessagef(err, "invalid platform %q", key)
 	}
-	for _, fileInfo := range fileInfos {
-		if fileInfo.IsDir() {
+	return nil
+}
+
+// parseDefaultRegistries parses a comma-separated list of registries, with optional paths.
+func parseDefaultRegistries(s string) ([]defaultRegistry, error) {
+	var registries []defaultRegistry
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
 			continue
 		}
-		// return true if there is a file that doesn't end with .txt or .json
-		if name := fileInfo.Name(); !strings.HasSuffix(name, ".txt") && !strings.HasSuffix(name, ".json") {
-			return true, nil
+		host, path := splitRegistryAndPath(entry)
+		reg, err := name.NewRegistry(host)
+		if err != nil {
+			return nil, err
 		}
+		registries = append(registries, defaultRegistry{registry: reg, repoPath: path})
+	}
+	if len(registries) == 0 {
+		return nil, fmt.Errorf("no registries found in %q", s)
 	}
-	return false, nil
+	return registries, nil
 }
 
 func splitRegistryAndPath(in string) (host, prefix string) {
@@ -1,7 +1,13 @@
 package images
 
 import (
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
 )
 
 func Test_UnitResolver_NewResolver(t *testing.T) {
@@ -149,3 +155,394 @@ func Test_UnitsplitRegistryAndPath(t *testing.T) {
 		})
 	}
 }
+
+func Test_UnitResolver_GetSource(t *testing.T) {
+	tests := []struct {
+		name           string
+		cfg            ImageOverrideConfig
+		ref            string
+		chartImage     string
+		expectedSource Source
+		expectedChart  string
+	}{
+		{
+			name:           "default registry without override",
+			cfg:            ImageOverrideConfig{},
+			ref:            Runtime,
+			chartImage:     "rancher/hardened-coredns:v1.0.0",
+			expectedSource: SourceDefault,
+			expectedChart:  "index.docker.io/rancher/hardened-coredns:v1.0.0",
+		},
+		{
+			name: "custom registry without override",
+			cfg: ImageOverrideConfig{
+				SystemDefaultRegistry: "example.com/path",
+			},
+			ref:            Runtime,
+			chartImage:     "rancher/hardened-coredns:v1.0.0",
+			expectedSource: SourceSystemDefaultRegistry,
+			expectedChart:  "example.com/path/rancher/hardened-coredns:v1.0.0",
+		},
+		{
+			name: "custom registry with override",
+			cfg: ImageOverrideConfig{
+				SystemDefaultRegistry: "example.com",
+				Runtime:               "registry.example.com/rke2-runtime:v1.0.0",
+			},
+			ref:            Runtime,
+			chartImage:     "rancher/hardened-coredns:v1.0.0",
+			expectedSource: SourceOverride,
+			expectedChart:  "example.com/rancher/hardened-coredns:v1.0.0",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolver, err := NewResolver(tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if source := resolver.GetSource(tt.ref); source != tt.expectedSource {
+				t.Errorf("expected source %s, got %s", tt.expectedSource, source)
+			}
+
+			ref, _, err := resolver.ParseReference(tt.chartImage)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ref.Name() != tt.expectedChart {
+				t.Errorf("expected %s, got %s", tt.expectedChart, ref.Name())
+			}
+		})
+	}
+}
+
+func Test_UnitResolver_LockFile(t *testing.T) {
+	digest := "sha256:0000000000000000000000000000000000000000000000000000000000000001"
+	tests := []struct {
+		name     string
+		cfg      ImageOverrideConfig
+		lock     string
+		expected map[string]string
+		wantErr  bool
+	}{
+		{
+			name: "locked default image",
+			lock: "images:\n  runtime-image: " + digest + "\n",
+			expected: map[string]string{
+				Runtime: "index.docker.io/rancher/rke2-runtime@" + digest,
+				ETCD:    "index.docker.io/rancher/hardened-etcd:latest",
+			},
+		},
+		{
+			name: "locked image with custom registry",
+			cfg: ImageOverrideConfig{
+				SystemDefaultRegistry: "example.com/path",
+			},
+			lock: "images:\n  etcd-image: " + digest + "\n",
+			expected: map[string]string{
+				ETCD: "example.com/path/rancher/hardened-etcd@" + digest,
+			},
+		},
+		{
+			name: "locked override",
+			cfg: ImageOverrideConfig{
+				ETCD: "registry.example.com/etcd:v1.0.0",
+			},
+			lock: "images:\n  etcd-image: " + digest + "\n",
+			expected: map[string]string{
+				ETCD: "registry.example.com/etcd@" + digest,
+			},
+		},
+		{
+			name:    "unknown image",
+			lock:    "images:\n  foo-image: " + digest + "\n",
+			wantErr: true,
+		},
+		{
+			name:    "invalid digest",
+			lock:    "images:\n  etcd-image: latest\n",
+			wantErr: true,
+		},
+		{
+			name: "ignored invalid lock file",
+			cfg: ImageOverrideConfig{
+				IgnoreLockFile: true,
+			},
+			lock: "images:\n  etcd-image: latest\n",
+			expected: map[string]string{
+				ETCD: "index.docker.io/rancher/hardened-etcd:latest",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.LockFile = filepath.Join(t.TempDir(), "images.lock.yaml")
+			if err := os.WriteFile(tt.cfg.LockFile, []byte(tt.lock), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			resolver, err := NewResolver(tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewResolver() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			for i, expected := range tt.expected {
+				ref, err := resolver.GetReference(i)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if ref.Name() != expected {
+					t.Errorf("expected %s, got %s", expected, ref.Name())
+				}
+			}
+		})
+	}
+}
+
+func Test_UnitResolver_FallbackRegistries(t *testing.T) {
+	resolver, err := NewResolver(ImageOverrideConfig{
+		SystemDefaultRegistry: "local.example.com, regional.example.com/mirror",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refs, err := resolver.GetReferences(KubeAPIServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != 2 {
+		t.Fatalf("expected 2 references, got %d", len(refs))
+	}
+	if reg := refs[0].Context().RegistryStr(); reg != "local.example.com" {
+		t.Errorf("expected primary registry local.example.com, got %s", reg)
+	}
+	if repo := refs[1].Context().Name(); !strings.HasPrefix(repo, "regional.example.com/mirror/") {
+		t.Errorf("expected fallback repository under regional.example.com/mirror, got %s", repo)
+	}
+
+	unlocked, err := resolver.GetUnlockedReferences(KubeAPIServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unlocked) != len(refs) || unlocked[1].Name() != refs[1].Name() {
+		t.Errorf("expected unlocked references to match %v, got %v", refs, unlocked)
+	}
+
+	if err := resolver.SelectRegistry(KubeAPIServer, refs[1]); err != nil {
+		t.Fatal(err)
+	}
+	ref, err := resolver.GetReference(KubeAPIServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref.Name() != refs[1].Name() {
+		t.Errorf("expected selected reference %s, got %s", refs[1].Name(), ref.Name())
+	}
+
+	// Setting the primary registry to one already in the list retains the remaining registries as fallbacks
+	if err := resolver.SetPrimaryRegistry("regional.example.com/mirror"); err != nil {
+		t.Fatal(err)
+	}
+	refs, err = resolver.GetReferences(Pause)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != 2 || refs[1].Context().RegistryStr() != "local.example.com" {
+		t.Errorf("expected local.example.com to be retained as a fallback, got %v", refs)
+	}
+
+	if err := resolver.SetPrimaryRegistry("other.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if refs, _ = resolver.GetReferences(Pause); len(refs) != 1 {
+		t.Errorf("expected registry list to be replaced, got %v", refs)
+	}
+}
+
+func Test_UnitResolver_RewriteRules(t *testing.T) {
+	resolver, err := NewResolver(ImageOverrideConfig{
+		SystemDefaultRegistry: "harbor.example.com",
+		Pause:                 "harbor.example.com/rancher/pause:3.6",
+		RewriteRules: []string{
+			`^harbor\.example\.com/rancher/hardened-(.*)$=harbor.example.com/platform/k8s/hardened-$1`,
+			`^harbor\.example\.com/rancher/(.*)$=harbor.example.com/platform/misc/$1`,
+			`^harbor\.example\.com$=harbor.example.com/platform/charts`,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		image        string
+		expectedRepo string
+	}{
+		{KubeAPIServer, "harbor.example.com/platform/k8s/hardened-kubernetes"},
+		{Pause, "harbor.example.com/platform/misc/pause"},
+	}
+	for _, tt := range tests {
+		ref, err := resolver.GetReference(tt.image)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if repo := ref.Context().Name(); repo != tt.expectedRepo {
+			t.Errorf("expected %s repository %s, got %s", tt.image, tt.expectedRepo, repo)
+		}
+	}
+
+	// Charts combine the registry with the repository themselves, so the rules are applied to the registry
+	if reg := resolver.RewriteRegistry("harbor.example.com"); reg != "harbor.example.com/platform/charts" {
+		t.Errorf("expected rewritten registry harbor.example.com/platform/charts, got %s", reg)
+	}
+	if reg := resolver.RewriteRegistry("registry.example.com"); reg != "registry.example.com" {
+		t.Errorf("expected registry without a matching rule to not be rewritten, got %s", reg)
+	}
+	ref, _, err := resolver.ParseChartReference("rancher/hardened-coredns:v1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref.Name() != "harbor.example.com/platform/charts/rancher/hardened-coredns:v1.0.0" {
+		t.Errorf("expected chart image to use the rewritten registry, got %s", ref.Name())
+	}
+
+	// Rules are split at the first unescaped =, so that = can be used in both the expression and the replacement
+	if i := rewriteRuleSeparator(`^a\=b$=c=d`); i != 6 {
+		t.Errorf("expected rule to be split at index 6, got %d", i)
+	}
+	resolver, err = NewResolver(ImageOverrideConfig{
+		RewriteRules: []string{`^index\.docker\.io/rancher/(x\=y)?mirrored-(.*)$=example.com/mirror/$2`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref, err := resolver.GetReference(Pause); err != nil {
+		t.Error(err)
+	} else if repo := ref.Context().Name(); repo != "example.com/mirror/pause" {
+		t.Errorf("expected repository example.com/mirror/pause, got %s", repo)
+	}
+
+	if _, err := NewResolver(ImageOverrideConfig{RewriteRules: []string{"no-replacement"}}); err == nil {
+		t.Error("expected error for invalid rewrite rule")
+	}
+}
+
+func Test_UnitResolver_PlatformOverrides(t *testing.T) {
+	tests := []struct {
+		name     string
+		override string
+		platform v1.Platform
+		expected string
+	}{
+		{
+			name:     "matching platform",
+			override: "linux/arm64=example.com/etcd-arm64:v1, default=example.com/etcd:v1",
+			platform: v1.Platform{OS: "linux", Architecture: "arm64"},
+			expected: "example.com/etcd-arm64:v1",
+		},
+		{
+			name:     "default platform",
+			override: "{linux/arm64: example.com/etcd-arm64:v1, default: example.com/etcd:v1}",
+			platform: v1.Platform{OS: "linux", Architecture: "amd64"},
+			expected: "example.com/etcd:v1",
+		},
+		{
+			name:     "flattened config file mapping",
+			override: "map[default:example.com/etcd:v1 linux/arm64:example.com/etcd-arm64:v1]",
+			platform: v1.Platform{OS: "linux", Architecture: "arm64"},
+			expected: "example.com/etcd-arm64:v1",
+		},
+		{
+			name:     "os only platform",
+			override: "map[linux:example.com/etcd-linux:v1 windows:example.com/etcd-windows:v1]",
+			platform: v1.Platform{OS: "linux", Architecture: "s390x"},
+			expected: "example.com/etcd-linux:v1",
+		},
+		{
+			name:     "no matching platform",
+			override: "linux/arm64=example.com/etcd-arm64:v1",
+			platform: v1.Platform{OS: "linux", Architecture: "amd64"},
+			expected: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolver, err := NewResolver(ImageOverrideConfig{ETCD: tt.override})
+			if err != nil {
+				t.Fatal(err)
+			}
+			resolver.platform = tt.platform
+
+			ref, err := resolver.GetReference(ETCD)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.expected == "" {
+				if resolver.GetSource(ETCD) != SourceDefault {
+					t.Errorf("expected default image, got %s", ref.Name())
+				}
+				return
+			}
+			expected, err := name.ParseReference(tt.expected)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ref.Name() != expected.Name() {
+				t.Errorf("expected %s, got %s", expected.Name(), ref.Name())
+			}
+		})
+	}
+}
+
+func Test_UnitResolver_PlatformOverridesLocked(t *testing.T) {
+	arm64Digest := "sha256:" + strings.Repeat("a", 64)
+	defaultDigest := "sha256:" + strings.Repeat("d", 64)
+	lockFile := filepath.Join(t.TempDir(), "images.lock.yaml")
+	lock := "images:\n  etcd-image@linux/arm64: " + arm64Digest + "\n  etcd-image@default: " + defaultDigest + "\n"
+	if err := os.WriteFile(lockFile, []byte(lock), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	resolver, err := NewResolver(ImageOverrideConfig{
+		ETCD:     "map[default:example.com/etcd:v1 linux/arm64:example.com/etcd-arm64:v1]",
+		LockFile: lockFile,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for platform, expected := range map[string]string{
+		"arm64": "example.com/etcd-arm64@" + arm64Digest,
+		"amd64": "example.com/etcd@" + defaultDigest,
+	} {
+		resolver.platform = v1.Platform{OS: "linux", Architecture: platform}
+		ref, err := resolver.GetReference(ETCD)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ref.Name() != expected {
+			t.Errorf("expected %s for %s, got %s", expected, platform, ref.Name())
+		}
+	}
+
+	refs, err := resolver.GetPlatformReferences(ETCD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != 2 || refs["linux/arm64"].Name() != "example.com/etcd-arm64:v1" {
+		t.Errorf("expected references for each platform, got %v", refs)
+	}
+
+	if err := os.WriteFile(lockFile, []byte("images:\n  etcd-image@linux/arm64/v8/extra: "+arm64Digest+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadLockFile(lockFile); err == nil {
+		t.Error("expected error for invalid platform in lock file")
+	}
+}
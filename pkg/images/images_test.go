@@ -1,11 +1,20 @@
 package images
 
 import (
+	"archive/tar"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
 )
 
 func Test_UnitPull(t *testing.T) {
@@ -86,6 +95,64 @@ func Test_UnitPull(t *testing.T) {
 			teardown: func(a *args) error {
 				return os.RemoveAll(a.dir)
 			},
+
+			wantTxtFile: true,
+		},
+		{
+			name: "Pull with image in archive",
+			args: args{
+				name: KubeScheduler,
+			},
+			setup: func(a *args) error {
+				var err error
+				a.image, err = getDefaultImage(KubeScheduler)
+				if err != nil {
+					return err
+				}
+				a.dir, err = os.MkdirTemp("", "*")
+				if err != nil {
+					return err
+				}
+				img, err := random.Image(64, 1)
+				if err != nil {
+					return err
+				}
+				return tarball.WriteToFile(a.dir+"/images.tar", a.image, img)
+			},
+			teardown: func(a *args) error {
+				return os.RemoveAll(a.dir)
+			},
+		},
+		{
+			name: "Pull with other image in archive",
+			args: args{
+				name: KubeScheduler,
+			},
+			setup: func(a *args) error {
+				var err error
+				a.image, err = getDefaultImage(KubeScheduler)
+				if err != nil {
+					return err
+				}
+				a.dir, err = os.MkdirTemp("", "*")
+				if err != nil {
+					return err
+				}
+				other, err := getDefaultImage(ETCD)
+				if err != nil {
+					return err
+				}
+				img, err := random.Image(64, 1)
+				if err != nil {
+					return err
+				}
+				return tarball.WriteToFile(a.dir+"/images.tar", other, img)
+			},
+			teardown: func(a *args) error {
+				return os.RemoveAll(a.dir)
+			},
+
+			wantTxtFile: true,
 		},
 	}
 	for _, tt := range tests {
@@ -97,11 +164,9 @@ func Test_UnitPull(t *testing.T) {
 			if err := Pull(tt.args.dir, tt.args.name, tt.args.image); (err != nil) != tt.wantErr {
 				t.Errorf("Pull() error = %v, wantErr %v", err, tt.wantErr)
 			}
-			if tt.wantTxtFile {
-				fileName := tt.args.name + ".txt"
-				if _, err := os.Stat(tt.args.dir + "/" + fileName); os.IsNotExist(err) {
-					t.Errorf("File generate by Pull() %s, does not exists, wantFile %v", fileName, tt.wantTxtFile)
-				}
+			fileName := tt.args.name + ".txt"
+			if _, err := os.Stat(tt.args.dir + "/" + fileName); tt.wantTxtFile == os.IsNotExist(err) && tt.args.dir != "" {
+				t.Errorf("File generate by Pull() %s, exists = %v, wantFile %v", fileName, !os.IsNotExist(err), tt.wantTxtFile)
 			}
 			if err := tt.teardown(&tt.args); err != nil {
 				t.Errorf("Teardown for Pull() failed = %v", err)
@@ -109,3 +174,168 @@ func Test_UnitPull(t *testing.T) {
 		})
 	}
 }
+
+func Test_UnitIndexArchives(t *testing.T) {
+	dir := t.TempDir()
+	image, err := getDefaultImage(KubeScheduler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(dir, "images.tar")
+	if err := tarball.WriteToFile(archive, image, img); err != nil {
+		t.Fatal(err)
+	}
+
+	index, err := IndexArchives(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := index.Find(image); !ok {
+		t.Fatalf("expected %s to be found in archive", image.Name())
+	}
+	entries := readArchiveIndex(dir)
+	if _, ok := entries[archive]; !ok {
+		t.Fatalf("expected archive index to be cached, got %v", entries)
+	}
+
+	// The cached entry is used while the archive is unmodified
+	other, err := getDefaultImage(ETCD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := entries[archive]
+	entry.Names = []string{other.Name()}
+	entries[archive] = entry
+	if err := writeArchiveIndex(dir, entries); err != nil {
+		t.Fatal(err)
+	}
+	if index, err = IndexArchives(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := index.Find(other); !ok {
+		t.Errorf("expected cached archive index to be used")
+	}
+
+	// The archive is read again once it is modified
+	modTime := time.Now().Add(time.Hour)
+	if err := os.Chtimes(archive, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	if index, err = IndexArchives(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := index.Find(image); !ok {
+		t.Errorf("expected modified archive to be read again")
+	}
+	if _, ok := index.Find(other); ok {
+		t.Errorf("expected stale archive index entry to be replaced")
+	}
+}
+
+// writeOCIArchive writes an OCI-layout tar archive containing the image, annotated with the image name.
+func writeOCIArchive(t *testing.T, file string, ref name.Reference, img v1.Image) {
+	dir := t.TempDir()
+	p, err := layout.Write(dir, empty.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.AppendImage(img, layout.WithAnnotations(map[string]string{AnnotationContainerdImageName: ref.Name()})); err != nil {
+		t.Fatal(err)
+	}
+	writeTar(t, file, dir)
+}
+
+// writeTar writes the content of a directory to a tar file.
+func writeTar(t *testing.T, file, dir string) {
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	defer tw.Close()
+	if err := tw.AddFS(os.DirFS(dir)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_UnitPullLocked(t *testing.T) {
+	img, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag, err := getDefaultImage(KubeScheduler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	locked := tag.Context().Digest(digest.String())
+	otherLocked := tag.Context().Digest("sha256:" + strings.Repeat("0", 64))
+
+	tests := []struct {
+		name        string
+		oci         bool
+		image       name.Reference
+		unlocked    []name.Reference
+		wantTxtFile bool
+		wantErr     bool
+	}{
+		{
+			name:     "tag found in docker archive",
+			image:    tag,
+			unlocked: []name.Reference{tag},
+		},
+		{
+			name:     "locked digest with tag in docker archive",
+			image:    locked,
+			unlocked: []name.Reference{tag},
+			wantErr:  true,
+		},
+		{
+			name:     "locked digest found in OCI archive",
+			oci:      true,
+			image:    locked,
+			unlocked: []name.Reference{tag},
+		},
+		{
+			name:     "different locked digest with tag in OCI archive",
+			oci:      true,
+			image:    otherLocked,
+			unlocked: []name.Reference{tag},
+			wantErr:  true,
+		},
+		{
+			name:        "locked digest not in archives",
+			image:       otherLocked,
+			wantTxtFile: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if tt.oci {
+				writeOCIArchive(t, filepath.Join(dir, "images.tar"), tag, img)
+			} else if err := tarball.WriteToFile(filepath.Join(dir, "images.tar"), tag, img); err != nil {
+				t.Fatal(err)
+			}
+			err := Pull(dir, KubeScheduler, tt.image, tt.unlocked...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Pull() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), tt.image.Name()) {
+				t.Errorf("expected error to name image %s, got %v", tt.image.Name(), err)
+			}
+			if _, err := os.Stat(filepath.Join(dir, KubeScheduler+".txt")); tt.wantTxtFile == os.IsNotExist(err) {
+				t.Errorf("expected pull list file to exist = %t", tt.wantTxtFile)
+			}
+		})
+	}
+}
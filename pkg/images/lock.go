@@ -0,0 +1,118 @@
+package images
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/k3s-io/k3s/pkg/util/errors"
+	"github.com/k3s-io/k3s/pkg/version"
+	"sigs.k8s.io/yaml"
+)
+
+// DefaultLockFile is the image lock file that is used if it exists, and no other lock file is configured.
+var DefaultLockFile = "/etc/rancher/" + version.Program + "/images.lock.yaml"
+
+// Annotations used to record the image name of manifests in an OCI image layout index.
+const (
+	AnnotationRefName             = "org.opencontainers.image.ref.name"
+	AnnotationContainerdImageName = "io.containerd.image.name"
+)
+
+// LockFile pins images to an immutable digest. Images are keyed by the same
+// names as the image override flags, such as kube-apiserver-image. Images with
+// platform-specific overrides are keyed by image name and platform, such as
+// etcd-image@linux/arm64, as each platform may use a different image.
+type LockFile struct {
+	Images map[string]string `json:"images"`
+}
+
+// LockKey returns the lock file key for the override of an image for a platform.
+func LockKey(i, platform string) string {
+	return i + "@" + platform
+}
+
+// ReadLockFile reads and validates the image lock file at the given path.
+func ReadLockFile(path string) (map[string]v1.Hash, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	lock := LockFile{}
+	if err := yaml.UnmarshalStrict(b, &lock); err != nil {
+		return nil, errors.WithMessagef(err, "failed to decode image lock file %s", path)
+	}
+
+	digests := map[string]v1.Hash{}
+	for i, d := range lock.Images {
+		image, platform, ok := strings.Cut(i, "@")
+		if _, err := getDefaultImage(image); err != nil {
+			return nil, errors.WithMessagef(err, "invalid image in lock file %s", path)
+		}
+		if ok {
+			if err := validatePlatformKey(platform); err != nil {
+				return nil, errors.WithMessagef(err, "invalid image %s in lock file %s", i, path)
+			}
+		}
+		h, err := v1.NewHash(d)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "invalid digest for %s in lock file %s", i, path)
+		}
+		digests[i] = h
+	}
+	return digests, nil
+}
+
+// WriteLockFile writes the image lock file to the given path.
+func WriteLockFile(path string, digests map[string]v1.Hash) error {
+	lock := LockFile{Images: map[string]string{}}
+	for i, d := range digests {
+		lock.Images[i] = d.String()
+	}
+
+	b, err := yaml.Marshal(lock)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0644)
+}
+
+// FindInIndex returns the digest of the manifest in an OCI image layout index that is
+// annotated with the given reference. Both the full image name and tag-only forms of the
+// ref.name annotation are accepted, as different tools populate the annotation differently.
+func FindInIndex(index v1.ImageIndex, ref name.Reference) (v1.Hash, error) {
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		return v1.Hash{}, err
+	}
+
+	var matches []string
+	for _, desc := range manifest.Manifests {
+		for _, key := range []string{AnnotationContainerdImageName, AnnotationRefName} {
+			a, ok := desc.Annotations[key]
+			if !ok {
+				continue
+			}
+			if t, ok := ref.(name.Tag); ok && a == t.TagStr() {
+				return desc.Digest, nil
+			}
+			if r, err := name.ParseReference(a, name.WeakValidation); err == nil {
+				if r.Name() == ref.Name() {
+					return desc.Digest, nil
+				}
+				matches = append(matches, r.Name())
+			}
+		}
+	}
+	sort.Strings(matches)
+	return v1.Hash{}, fmt.Errorf("image %s not found in index; found %v", ref.Name(), matches)
+}
@@ -0,0 +1,430 @@
+package images
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/k3s-io/k3s/pkg/util/errors"
+	"github.com/rancher/wharfie/pkg/registries"
+	"github.com/rancher/wrangler/v3/pkg/merr"
+	"github.com/sirupsen/logrus"
+)
+
+// RemoteRegistry provides access to image manifests and indexes using the mirrors, rewrites, credentials and TLS
+// settings from the private registry configuration. The private registry returned by wharfie only resolves references
+// to a single-platform image, which is not sufficient to lock or copy multi-platform images by their index digest,
+// so endpoints are selected here following the same rules as wharfie and containerd.
+type RemoteRegistry struct {
+	registry    *registries.Registry
+	keychain    authn.Keychain
+	transports  map[string]http.RoundTripper
+	mirrorsOnly bool
+}
+
+// remoteEndpoint is a registry endpoint that requests for an image are sent to.
+type remoteEndpoint struct {
+	url *url.URL
+	ref name.Reference
+}
+
+// NewRemoteRegistry loads the private registry configuration from the given file.
+// If the file does not exist, the default registry endpoints are used with the default keychain.
+func NewRemoteRegistry(privateRegistry string) (*RemoteRegistry, error) {
+	registry, err := registries.GetPrivateRegistries(privateRegistry)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to load private registry configuration from %s", privateRegistry)
+	}
+	return NewRemoteRegistryFromConfig(registry.Registry, registry.DefaultKeychain), nil
+}
+
+// NewRemoteRegistryFromConfig returns a RemoteRegistry for an already loaded private registry configuration,
+// using the given keychain for endpoints that do not have credentials configured.
+func NewRemoteRegistryFromConfig(registry *registries.Registry, keychain authn.Keychain) *RemoteRegistry {
+	if registry == nil {
+		registry = &registries.Registry{}
+	}
+	if keychain == nil {
+		keychain = authn.DefaultKeychain
+	}
+	return &RemoteRegistry{
+		registry:   registry,
+		keychain:   keychain,
+		transports: map[string]http.RoundTripper{},
+	}
+}
+
+// MirrorsOnly returns a RemoteRegistry with the same configuration that only sends requests to mirror endpoints,
+// without falling back to the default endpoint for the registry.
+func (r *RemoteRegistry) MirrorsOnly() *RemoteRegistry {
+	return &RemoteRegistry{
+		registry:    r.registry,
+		keychain:    r.keychain,
+		transports:  r.transports,
+		mirrorsOnly: true,
+	}
+}
+
+// Get returns the descriptor for a reference from the first endpoint that has it. Mirror endpoints
+// are tried in order, followed by the default endpoint for the registry.
+func (r *RemoteRegistry) Get(ctx context.Context, ref name.Reference) (*remote.Descriptor, error) {
+	var desc *remote.Descriptor
+	err := r.try(ctx, ref, func(epRef name.Reference, opts []remote.Option) (err error) {
+		desc, err = remote.Get(epRef, opts...)
+		return err
+	})
+	return desc, err
+}
+
+// Head returns the descriptor for a reference from the first endpoint that has it, without fetching the manifest.
+func (r *RemoteRegistry) Head(ctx context.Context, ref name.Reference) (*v1.Descriptor, error) {
+	var desc *v1.Descriptor
+	err := r.try(ctx, ref, func(epRef name.Reference, opts []remote.Option) (err error) {
+		desc, err = remote.Head(epRef, opts...)
+		return err
+	})
+	return desc, err
+}
+
+// Image returns the image for a reference from the first endpoint that has it. The reference must
+// refer to an image manifest, not an index, unless a platform is selected by the given options.
+func (r *RemoteRegistry) Image(ctx context.Context, ref name.Reference, options ...remote.Option) (v1.Image, error) {
+	var img v1.Image
+	err := r.try(ctx, ref, func(epRef name.Reference, opts []remote.Option) (err error) {
+		img, err = remote.Image(epRef, append(opts, options...)...)
+		return err
+	})
+	return img, err
+}
+
+// Options returns options for sending requests directly to a registry host, such as when writing images to it.
+// Mirrors are not used, as they only apply to pulls.
+func (r *RemoteRegistry) Options(ctx context.Context, host string) ([]remote.Option, error) {
+	u, err := normalizeEndpoint(host)
+	if err != nil {
+		return nil, err
+	}
+	transport, err := r.transport(u)
+	if err != nil {
+		return nil, err
+	}
+	return []remote.Option{remote.WithTransport(transport), remote.WithAuthFromKeychain(r.keychainFor(u)), remote.WithContext(ctx)}, nil
+}
+
+// Blob returns the content of a blob of the given size in a repository from the first endpoint that has it, starting
+// at the given offset, so that an interrupted pull can be resumed. The offset that the content starts at is also returned;
+// this is 0 if the endpoint does not support range requests, in which case the content is returned from the start.
+func (r *RemoteRegistry) Blob(ctx context.Context, repo name.Repository, digest v1.Hash, offset, size int64) (io.ReadCloser, int64, error) {
+	var rc io.ReadCloser
+	var start int64
+	err := r.tryEndpoints(repo.Digest(digest.String()), func(ep remoteEndpoint, rt http.RoundTripper) error {
+		epRepo := ep.ref.Context()
+		auth, err := authn.Resolve(ctx, r.keychainFor(ep.url), epRepo)
+		if err != nil {
+			return err
+		}
+		rt, err = transport.NewWithContext(ctx, epRepo.Registry, auth, rt, []string{epRepo.Scope(transport.PullScope)})
+		if err != nil {
+			return err
+		}
+		u := url.URL{Scheme: epRepo.Scheme(), Host: epRepo.RegistryStr(), Path: "/v2/" + epRepo.RepositoryStr() + "/blobs/" + digest.String()}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+		if err != nil {
+			return err
+		}
+		if offset > 0 && offset < size {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, size-1))
+		}
+		resp, err := (&http.Client{Transport: rt}).Do(req)
+		if err != nil {
+			return err
+		}
+		if err := transport.CheckError(resp, http.StatusOK, http.StatusPartialContent); err != nil {
+			resp.Body.Close()
+			return err
+		}
+		rc, start = resp.Body, 0
+		if resp.StatusCode == http.StatusPartialContent {
+			start = offset
+		}
+		return nil
+	})
+	return rc, start, err
+}
+
+// try calls fn with the reference and options for each endpoint in turn, until one succeeds.
+func (r *RemoteRegistry) try(ctx context.Context, ref name.Reference, fn func(name.Reference, []remote.Option) error) error {
+	return r.tryEndpoints(ref, func(ep remoteEndpoint, rt http.RoundTripper) error {
+		return fn(ep.ref, []remote.Option{remote.WithTransport(rt), remote.WithAuthFromKeychain(r.keychainFor(ep.url)), remote.WithContext(ctx)})
+	})
+}
+
+// tryEndpoints calls fn with each endpoint for a reference and a transport that sends requests to it, until one succeeds.
+func (r *RemoteRegistry) tryEndpoints(ref name.Reference, fn func(remoteEndpoint, http.RoundTripper) error) error {
+	endpoints, err := r.endpoints(ref)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, ep := range endpoints {
+		transport, err := r.transport(ep.url)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		rt := &endpointTransport{url: ep.url, host: ep.ref.Context().RegistryStr(), transport: transport}
+		logrus.Debugf("Trying endpoint %s for %s", ep.url, ref.Name())
+		if err := fn(ep, rt); err != nil {
+			errs = append(errs, errors.WithMessage(err, ep.url.Host))
+			continue
+		}
+		return nil
+	}
+	return merr.NewErrors(errs...)
+}
+
+// endpoints returns the endpoints for a reference: the endpoints of the first mirror configured for the registry,
+// with the mirror's repository rewrites applied, followed by the default endpoint for the registry unless only
+// mirrors are used.
+func (r *RemoteRegistry) endpoints(ref name.Reference) ([]remoteEndpoint, error) {
+	registry := ref.Context().RegistryStr()
+	var endpoints []remoteEndpoint
+	if mirror, ok := r.mirror(registry); ok {
+		for _, s := range mirror.Endpoints {
+			u, err := normalizeEndpoint(s)
+			if err != nil {
+				logrus.Warnf("Ignoring invalid endpoint %s for registry %s: %v", s, registry, err)
+				continue
+			}
+			epRef := ref
+			if registryNamespace(u.Host) != registryNamespace(registry) {
+				epRef = rewriteRepository(ref, mirror.Rewrites)
+			}
+			endpoints = append(endpoints, remoteEndpoint{url: u, ref: epRef})
+		}
+	}
+	if r.mirrorsOnly {
+		if len(endpoints) == 0 {
+			return nil, fmt.Errorf("no mirror endpoints configured for registry %s", registry)
+		}
+		return endpoints, nil
+	}
+	u, err := normalizeEndpoint(registry)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to construct default endpoint for registry %s", registry)
+	}
+	return append(endpoints, remoteEndpoint{url: u, ref: ref}), nil
+}
+
+// mirror returns the mirror configured for a registry, checking the same keys as containerd.
+func (r *RemoteRegistry) mirror(registry string) (registries.Mirror, bool) {
+	keys := []string{registry}
+	if registry == name.DefaultRegistry {
+		keys = append(keys, "docker.io")
+	} else if _, _, err := net.SplitHostPort(registry); err != nil {
+		keys = append(keys, registry+":443", registry+":80")
+	}
+	keys = append(keys, "*")
+	for _, key := range keys {
+		if mirror, ok := r.registry.Mirrors[key]; ok {
+			return mirror, true
+		}
+	}
+	return registries.Mirror{}, false
+}
+
+// config returns the configuration for an endpoint host, checking the same keys as containerd.
+func (r *RemoteRegistry) config(host string) (registries.RegistryConfig, bool) {
+	keys := []string{host}
+	if host == name.DefaultRegistry {
+		keys = append(keys, "docker.io")
+	}
+	keys = append(keys, "*")
+	for _, key := range keys {
+		if config, ok := r.registry.Configs[key]; ok {
+			return config, true
+		}
+	}
+	return registries.RegistryConfig{}, false
+}
+
+// keychainFor returns the credentials for an endpoint. If no credentials are configured for the endpoint,
+// the default keychain is used.
+func (r *RemoteRegistry) keychainFor(u *url.URL) authn.Keychain {
+	if config, ok := r.config(u.Host); ok && config.Auth != nil {
+		return staticKeychain{authn.FromConfig(authn.AuthConfig{
+			Username:      config.Auth.Username,
+			Password:      config.Auth.Password,
+			Auth:          config.Auth.Auth,
+			IdentityToken: config.Auth.IdentityToken,
+		})}
+	}
+	return r.keychain
+}
+
+// transport returns the transport for an endpoint, with the TLS settings configured for the endpoint host.
+// Transports are cached, so that connections to each host are reused.
+func (r *RemoteRegistry) transport(u *url.URL) (http.RoundTripper, error) {
+	if u.Scheme != "https" {
+		return remote.DefaultTransport, nil
+	}
+	if t, ok := r.transports[u.Host]; ok {
+		return t, nil
+	}
+	config, ok := r.config(u.Host)
+	if !ok || config.TLS == nil {
+		r.transports[u.Host] = remote.DefaultTransport
+		return remote.DefaultTransport, nil
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.TLS.InsecureSkipVerify}
+	if config.TLS.CertFile != "" || config.TLS.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.TLS.CertFile, config.TLS.KeyFile)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "failed to load client certificate for %s", u.Host)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if config.TLS.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			return nil, err
+		}
+		ca, err := os.ReadFile(config.TLS.CAFile)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "failed to load CA file for %s", u.Host)
+		}
+		pool.AppendCertsFromPEM(ca)
+		tlsConfig.RootCAs = pool
+	}
+	transport := remote.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	r.transports[u.Host] = transport
+	return transport, nil
+}
+
+// endpointTransport sends requests for a registry to a mirror endpoint, in the same way as containerd.
+type endpointTransport struct {
+	url       *url.URL
+	host      string
+	transport http.RoundTripper
+}
+
+func (t *endpointTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Requests to other hosts, such as token servers that the registry redirected to, are sent as-is.
+	if req.URL.Host != t.host {
+		return t.transport.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	if t.url.Path != "/v2" && strings.HasPrefix(req.URL.Path, "/v2") {
+		req.URL.Path = t.url.Path + strings.TrimPrefix(req.URL.Path, "/v2")
+		req.URL.RawPath = ""
+	}
+	if ns := registryNamespace(t.host); ns != registryNamespace(t.url.Host) {
+		q := req.URL.Query()
+		q.Set("ns", ns)
+		req.URL.RawQuery = q.Encode()
+	}
+	req.Host = t.url.Host
+	req.URL.Host = t.url.Host
+	req.URL.Scheme = t.url.Scheme
+	return t.transport.RoundTrip(req)
+}
+
+// staticKeychain returns the same credentials for all registries.
+type staticKeychain struct {
+	auth authn.Authenticator
+}
+
+func (k staticKeychain) Resolve(authn.Resource) (authn.Authenticator, error) {
+	return k.auth, nil
+}
+
+// rewriteRepository applies the first matching mirror rewrite to the repository of a reference.
+// Rewrites are checked in order of their patterns, so that the result does not depend on map order.
+func rewriteRepository(ref name.Reference, rewrites map[string]string) name.Reference {
+	patterns := make([]string, 0, len(rewrites))
+	for pattern := range rewrites {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+
+	repository := ref.Context().RepositoryStr()
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			logrus.Warnf("Failed to compile rewrite %s for %s", pattern, ref.Context().RegistryStr())
+			continue
+		}
+		rewritten := re.ReplaceAllString(repository, rewrites[pattern])
+		if rewritten == repository {
+			continue
+		}
+		repo, err := name.NewRepository(ref.Context().RegistryStr()+"/"+rewritten, name.WeakValidation)
+		if err != nil {
+			logrus.Warnf("Invalid repository rewrite %s for %s", rewritten, ref.Context().RegistryStr())
+			continue
+		}
+		switch t := ref.(type) {
+		case name.Tag:
+			t.Repository = repo
+			return t
+		case name.Digest:
+			t.Repository = repo
+			return t
+		}
+	}
+	return ref
+}
+
+// normalizeEndpoint parses a registry endpoint address, defaulting the scheme and path in the same way as containerd.
+func normalizeEndpoint(endpoint string) (*url.URL, error) {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "//" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid URL without host: %s", endpoint)
+	}
+	if u.Scheme == "" {
+		u.Scheme = "https"
+		if host, port, err := net.SplitHostPort(u.Host); err == nil && port != "443" {
+			if ip := net.ParseIP(host); host == "localhost" || (ip != nil && ip.IsLoopback()) {
+				u.Scheme = "http"
+			}
+		}
+	}
+	switch u.Path {
+	case "", "/", "/v2":
+		u.Path = "/v2"
+	default:
+		u.Path = path.Clean(u.Path)
+	}
+	return u, nil
+}
+
+// registryNamespace returns the namespace of a registry host, treating the Docker Hub registry host as docker.io.
+func registryNamespace(host string) string {
+	if host == name.DefaultRegistry {
+		return "docker.io"
+	}
+	return host
+}
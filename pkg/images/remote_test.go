@@ -0,0 +1,224 @@
+package images
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+func Test_UnitRemoteRegistry(t *testing.T) {
+	server := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	index, err := random.Index(64, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, err := index.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, repo := range []string{"rancher/rke2-runtime", "mirrored/rancher/rke2-runtime"} {
+		ref, err := name.ParseReference(host + "/" + repo + ":v1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := remote.WriteIndex(ref, index); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		config  string
+		ref     string
+		wantErr bool
+	}{
+		{
+			name: "default endpoint",
+			ref:  host + "/rancher/rke2-runtime:v1",
+		},
+		{
+			name:   "mirror endpoint",
+			config: "mirrors:\n  registry.invalid:\n    endpoint:\n      - http://" + host + "\n",
+			ref:    "registry.invalid/rancher/rke2-runtime:v1",
+		},
+		{
+			name:   "mirror endpoint with rewrite",
+			config: "mirrors:\n  registry.invalid:\n    endpoint:\n      - http://" + host + "\n    rewrite:\n      \"^(.*)$\": \"mirrored/$1\"\n",
+			ref:    "registry.invalid/rancher/rke2-runtime:v1",
+		},
+		{
+			name:    "missing tag",
+			config:  "mirrors:\n  registry.invalid:\n    endpoint:\n      - http://" + host + "\n",
+			ref:     "registry.invalid/rancher/rke2-runtime:v2",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "registries.yaml")
+			if tt.config != "" {
+				if err := os.WriteFile(file, []byte(tt.config), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			r, err := NewRemoteRegistry(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ref, err := name.ParseReference(tt.ref)
+			if err != nil {
+				t.Fatal(err)
+			}
+			desc, err := r.Head(context.Background(), ref)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Head() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if desc.Digest != digest {
+				t.Errorf("expected digest %s, got %s", digest, desc.Digest)
+			}
+			if !desc.MediaType.IsIndex() {
+				t.Errorf("expected index, got %s", desc.MediaType)
+			}
+		})
+	}
+}
+
+func Test_UnitRemoteRegistryBlob(t *testing.T) {
+	server := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	layer, err := random.Layer(1024, types.DockerLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, err := layer.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err := layer.Compressed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo, err := name.NewRepository(host + "/rancher/rke2-runtime")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.WriteLayer(repo, layer); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewRemoteRegistry(filepath.Join(t.TempDir(), "registries.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, offset := range []int64{0, 100} {
+		rc, start, err := r.Blob(context.Background(), repo, digest, offset, int64(len(content)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if start != offset {
+			t.Errorf("expected content to start at %d, got %d", offset, start)
+		}
+		if !bytes.Equal(b, content[start:]) {
+			t.Errorf("content from offset %d does not match", offset)
+		}
+	}
+}
+
+func Test_UnitRemoteRegistryMirrorsOnly(t *testing.T) {
+	server := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	img, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := name.ParseReference(host + "/rancher/rke2-runtime:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name            string
+		config          string
+		ref             string
+		wantMirrorsOnly bool
+	}{
+		{
+			name:            "no mirrors",
+			ref:             host + "/rancher/rke2-runtime:v1",
+			wantMirrorsOnly: true,
+		},
+		{
+			name:            "unavailable mirror",
+			config:          "mirrors:\n  " + host + ":\n    endpoint:\n      - http://127.0.0.1:1\n",
+			ref:             host + "/rancher/rke2-runtime:v1",
+			wantMirrorsOnly: true,
+		},
+		{
+			name:   "available mirror",
+			config: "mirrors:\n  registry.invalid:\n    endpoint:\n      - http://" + host + "\n",
+			ref:    "registry.invalid/rancher/rke2-runtime:v1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "registries.yaml")
+			if tt.config != "" {
+				if err := os.WriteFile(file, []byte(tt.config), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			r, err := NewRemoteRegistry(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ref, err := name.ParseReference(tt.ref)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := r.Image(context.Background(), ref); err != nil {
+				t.Errorf("expected image from default endpoint: %v", err)
+			}
+			// Requests must not fall back to the default endpoint, which has the image
+			_, err = r.MirrorsOnly().Image(context.Background(), ref)
+			if (err != nil) != tt.wantMirrorsOnly {
+				t.Errorf("MirrorsOnly().Image() error = %v, wantErr %v", err, tt.wantMirrorsOnly)
+			}
+		})
+	}
+}
@@ -0,0 +1,454 @@
+package images
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/k3s-io/k3s/pkg/util/errors"
+	"github.com/sirupsen/logrus"
+	"sigs.k8s.io/yaml"
+)
+
+// SignatureMode controls how image signature verification failures are handled.
+type SignatureMode string
+
+const (
+	SignatureEnforce SignatureMode = "enforce"
+	SignatureWarn    SignatureMode = "warn"
+	SignatureOff     SignatureMode = "off"
+)
+
+// cosignSignatureAnnotation is the layer annotation that holds the signature of a cosign simple signing payload.
+const cosignSignatureAnnotation = "dev.cosignproject.cosign/signature"
+
+// ImageGetter retrieves images from a registry. This is satisfied by the private registry configuration returned by wharfie.
+type ImageGetter interface {
+	Image(ref name.Reference, options ...remote.Option) (v1.Image, error)
+}
+
+// SignaturePolicy configures verification of cosign image signatures against public keys on the node.
+// Images are keyed by the same names as the image override flags, such as kube-apiserver-image.
+type SignaturePolicy struct {
+	Keys    []string                 `json:"keys"`
+	Default SignatureMode            `json:"default"`
+	Images  map[string]SignatureMode `json:"images"`
+
+	publicKeys []crypto.PublicKey
+}
+
+// simpleSigningPayload is the subset of the cosign simple signing payload that is verified.
+type simpleSigningPayload struct {
+	Critical struct {
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+	} `json:"critical"`
+}
+
+// ReadSignaturePolicy reads and validates the signature policy file at the given path, and loads the public keys that it references.
+func ReadSignaturePolicy(path string) (*SignaturePolicy, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := &SignaturePolicy{}
+	if err := yaml.UnmarshalStrict(b, policy); err != nil {
+		return nil, errors.WithMessagef(err, "failed to decode image signature policy %s", path)
+	}
+
+	if policy.Default == "" {
+		policy.Default = SignatureOff
+	}
+	if err := validateSignatureMode(policy.Default); err != nil {
+		return nil, errors.WithMessage(err, "invalid default mode")
+	}
+	for i, mode := range policy.Images {
+		if _, err := getDefaultImage(i); err != nil {
+			return nil, errors.WithMessagef(err, "invalid image in signature policy %s", path)
+		}
+		if err := validateSignatureMode(mode); err != nil {
+			return nil, errors.WithMessagef(err, "invalid mode for %s", i)
+		}
+	}
+
+	for _, keyFile := range policy.Keys {
+		key, err := readPublicKey(keyFile)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "failed to load public key %s", keyFile)
+		}
+		policy.publicKeys = append(policy.publicKeys, key)
+	}
+	if len(policy.publicKeys) == 0 {
+		return nil, fmt.Errorf("no public keys configured in image signature policy %s", path)
+	}
+	return policy, nil
+}
+
+// Mode returns the verification mode for an image. Verification is off if there is no policy.
+func (p *SignaturePolicy) Mode(i string) SignatureMode {
+	if p == nil {
+		return SignatureOff
+	}
+	if mode, ok := p.Images[i]; ok {
+		return mode
+	}
+	return p.Default
+}
+
+// Verify checks for a cosign signature of any of the given image manifest digests, signed by any of the
+// configured public keys. Signatures are stored alongside the image, as an image tagged with the signed
+// digest and a .sig suffix. The signature image is loaded from the airgap image tarballs in imagesDir if
+// present, or from the registry otherwise. Failures are returned as errors if the policy for the image is
+// enforce, and logged as warnings if the policy is warn.
+func (p *SignaturePolicy) Verify(ctx context.Context, i string, ref name.Reference, digests []v1.Hash, imagesDir string, registry *RemoteRegistry) error {
+	if p.Mode(i) == SignatureOff {
+		return nil
+	}
+	if d, ok := ref.(name.Digest); ok {
+		if h, err := v1.NewHash(d.DigestStr()); err == nil {
+			digests = append(digests, h)
+		}
+	}
+	return p.Failed(i, p.verifyDigests(ctx, i, ref, digests, imagesDir, registry))
+}
+
+// VerifyImage verifies the signature of an image that has already been retrieved. The signature may be for
+// the platform-specific image manifest, the digest that the reference is pinned to, or any of the given index
+// digests. As cosign normally signs the index of multi-platform images, if none of these are signed and the
+// reference is a tag, the index that the tag refers to in the registry is also checked, as long as it
+// contains the image.
+func (p *SignaturePolicy) VerifyImage(ctx context.Context, i string, ref name.Reference, img v1.Image, imagesDir string, registry *RemoteRegistry, indexDigests ...v1.Hash) error {
+	if p.Mode(i) == SignatureOff {
+		return nil
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		return err
+	}
+	digests := append([]v1.Hash{digest}, indexDigests...)
+	if d, ok := ref.(name.Digest); ok {
+		if h, err := v1.NewHash(d.DigestStr()); err == nil {
+			digests = append(digests, h)
+		}
+	}
+	err = p.verifyDigests(ctx, i, ref, digests, imagesDir, registry)
+	if _, ok := ref.(name.Tag); ok && err != nil && registry != nil {
+		if index, ierr := indexContaining(ctx, registry, ref, digest); ierr != nil {
+			logrus.Debugf("Failed to get index for %s: %v", ref.Name(), ierr)
+		} else if !slices.Contains(digests, index) {
+			if ierr := p.verifyDigests(ctx, i, ref, []v1.Hash{index}, imagesDir, registry); ierr == nil {
+				err = nil
+			}
+		}
+	}
+	return p.Failed(i, err)
+}
+
+// VerifyReference verifies the signature of an image reference, and returns the reference pinned to the digest
+// that was verified, so that the image that is run cannot differ from the one that was verified. References that
+// are already pinned to a digest are returned unchanged. Tags are resolved to the manifest or index that the tag
+// refers to in the airgap image tarballs if present, or otherwise in the registry, in which case the signature may
+// be for either the index or the image manifest for the current platform.
+// Only OCI-layout tarballs record the digest of the manifest that was pushed to the registry and signed, so
+// verification fails for images that are found in docker-archive tarballs.
+// The reference is returned unchanged if verification is off for the image.
+func (p *SignaturePolicy) VerifyReference(ctx context.Context, i string, ref name.Reference, imagesDir string, registry *RemoteRegistry) (name.Reference, error) {
+	if p.Mode(i) == SignatureOff {
+		return ref, nil
+	}
+	if _, ok := ref.(name.Digest); ok {
+		return ref, p.Verify(ctx, i, ref, nil, imagesDir, registry)
+	}
+
+	desc, index, err := findArchiveManifest(imagesDir, ref)
+	if err != nil {
+		return ref, p.Failed(i, errors.WithMessagef(err, "failed to get image %s to verify signature", ref.Name()))
+	}
+	if desc == nil {
+		if registry == nil {
+			return ref, p.Failed(i, fmt.Errorf("failed to get image %s to verify signature: not found in airgap image tarballs", ref.Name()))
+		}
+		if desc, index, err = findRemoteManifest(ctx, registry, ref); err != nil {
+			return ref, p.Failed(i, errors.WithMessagef(err, "failed to get image %s to verify signature", ref.Name()))
+		}
+	}
+
+	digests := []v1.Hash{desc.Digest}
+	if index != nil {
+		digest, err := platformManifest(index)
+		if err != nil {
+			return ref, p.Failed(i, errors.WithMessagef(err, "failed to get image %s to verify signature", ref.Name()))
+		}
+		digests = append(digests, digest)
+	}
+	return ref.Context().Digest(desc.Digest.String()), p.Failed(i, p.verifyDigests(ctx, i, ref, digests, imagesDir, registry))
+}
+
+// findArchiveManifest returns the descriptor of an image in the OCI-layout airgap image tarballs in imagesDir,
+// and its index manifest if it is an index. A nil descriptor is returned if the image is not in any tarball.
+func findArchiveManifest(imagesDir string, ref name.Reference) (*v1.Descriptor, *v1.IndexManifest, error) {
+	archives, err := IndexArchives(imagesDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	archive, desc, ok, err := archives.FindDescriptor(ref)
+	if err != nil || !ok {
+		return nil, nil, err
+	}
+	if !desc.MediaType.IsIndex() {
+		return desc, nil, nil
+	}
+	b, err := readArchiveBlob(archive, desc.Digest)
+	if err != nil {
+		return nil, nil, err
+	}
+	index, err := v1.ParseIndexManifest(bytes.NewReader(b))
+	if err != nil {
+		return nil, nil, err
+	}
+	return desc, index, nil
+}
+
+// findRemoteManifest returns the descriptor of an image in the registry, and its index manifest if it is an index.
+func findRemoteManifest(ctx context.Context, registry *RemoteRegistry, ref name.Reference) (*v1.Descriptor, *v1.IndexManifest, error) {
+	desc, err := registry.Get(ctx, ref)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !desc.MediaType.IsIndex() {
+		return &desc.Descriptor, nil, nil
+	}
+	index, err := desc.ImageIndex()
+	if err != nil {
+		return nil, nil, err
+	}
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &desc.Descriptor, manifest, nil
+}
+
+// verifyDigests returns nil if there is a valid signature for any of the given digests.
+func (p *SignaturePolicy) verifyDigests(ctx context.Context, i string, ref name.Reference, digests []v1.Hash, imagesDir string, registry *RemoteRegistry) error {
+	var errs []error
+	for _, digest := range digests {
+		err := p.verifyDigest(ctx, ref.Context(), digest, imagesDir, registry)
+		if err == nil {
+			logrus.Infof("Verified signature for %s %s", i, ref.Context().Digest(digest.String()).Name())
+			return nil
+		}
+		errs = append(errs, err)
+	}
+	return fmt.Errorf("failed to verify signature for %s %s: %v", i, ref.Name(), errs)
+}
+
+// Failed handles a signature verification failure for an image. The error is returned if the policy
+// for the image is enforce, and logged as a warning if the policy is warn.
+func (p *SignaturePolicy) Failed(i string, err error) error {
+	switch p.Mode(i) {
+	case SignatureOff:
+		return nil
+	case SignatureWarn:
+		logrus.Warnf("%v", err)
+		return nil
+	}
+	return err
+}
+
+// verifyDigest verifies the signature image for a single digest. The signature image is read from the OCI-layout
+// airgap image tarballs in imagesDir if present, or from the registry otherwise.
+func (p *SignaturePolicy) verifyDigest(ctx context.Context, repo name.Repository, digest v1.Hash, imagesDir string, registry *RemoteRegistry) error {
+	sigRef := repo.Tag(digest.Algorithm + "-" + digest.Hex + ".sig")
+
+	manifest, readLayer, err := findArchiveSignature(imagesDir, sigRef)
+	if err != nil {
+		return err
+	}
+	if manifest == nil {
+		if registry == nil {
+			return fmt.Errorf("signature %s not found in airgap image tarballs", sigRef.Name())
+		}
+		sigImage, err := registry.Image(ctx, sigRef)
+		if err != nil {
+			return errors.WithMessagef(err, "failed to get signature %s", sigRef.Name())
+		}
+		if manifest, err = sigImage.Manifest(); err != nil {
+			return err
+		}
+		readLayer = func(digest v1.Hash) ([]byte, error) {
+			return layerPayload(sigImage, digest)
+		}
+	}
+
+	for _, desc := range manifest.Layers {
+		sig, ok := desc.Annotations[cosignSignatureAnnotation]
+		if !ok {
+			continue
+		}
+		payload, err := readLayer(desc.Digest)
+		if err != nil {
+			return err
+		}
+		if err := p.verifyPayload(payload, sig, digest); err != nil {
+			logrus.Debugf("Signature in %s did not verify: %v", sigRef.Name(), err)
+			continue
+		}
+		return nil
+	}
+	return fmt.Errorf("no valid signature found in %s", sigRef.Name())
+}
+
+// findArchiveSignature returns the manifest of a signature image in the OCI-layout airgap image tarballs in
+// imagesDir, and a function that reads its layers. A nil manifest is returned if the signature is not in any tarball.
+func findArchiveSignature(imagesDir string, sigRef name.Reference) (*v1.Manifest, func(v1.Hash) ([]byte, error), error) {
+	archives, err := IndexArchives(imagesDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	archive, desc, ok, err := archives.FindDescriptor(sigRef)
+	if err != nil || !ok {
+		return nil, nil, err
+	}
+	b, err := readArchiveBlob(archive, desc.Digest)
+	if err != nil {
+		return nil, nil, err
+	}
+	manifest, err := v1.ParseManifest(bytes.NewReader(b))
+	if err != nil {
+		return nil, nil, errors.WithMessagef(err, "failed to decode signature %s", sigRef.Name())
+	}
+	return manifest, func(digest v1.Hash) ([]byte, error) {
+		return readArchiveBlob(archive, digest)
+	}, nil
+}
+
+// verifyPayload checks that the payload refers to the expected digest, and that the signature is valid for any public key.
+func (p *SignaturePolicy) verifyPayload(payload []byte, sig string, digest v1.Hash) error {
+	ssp := simpleSigningPayload{}
+	if err := json.Unmarshal(payload, &ssp); err != nil {
+		return errors.WithMessage(err, "failed to decode signature payload")
+	}
+	if ssp.Critical.Image.DockerManifestDigest != digest.String() {
+		return fmt.Errorf("signature is for %s, not %s", ssp.Critical.Image.DockerManifestDigest, digest)
+	}
+
+	rawSig, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil {
+		return errors.WithMessage(err, "failed to decode signature")
+	}
+	hash := sha256.Sum256(payload)
+	for _, key := range p.publicKeys {
+		switch k := key.(type) {
+		case *ecdsa.PublicKey:
+			if ecdsa.VerifyASN1(k, hash[:], rawSig) {
+				return nil
+			}
+		case *rsa.PublicKey:
+			if rsa.VerifyPKCS1v15(k, crypto.SHA256, hash[:], rawSig) == nil {
+				return nil
+			}
+		case ed25519.PublicKey:
+			if ed25519.Verify(k, payload, rawSig) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("signature does not match any configured public key")
+}
+
+// indexContaining returns the digest of the index that a tag refers to in the registry, if it contains the given image manifest.
+func indexContaining(ctx context.Context, registry *RemoteRegistry, ref name.Reference, digest v1.Hash) (v1.Hash, error) {
+	desc, err := registry.Get(ctx, ref)
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	if !desc.MediaType.IsIndex() {
+		return v1.Hash{}, fmt.Errorf("%s is not an index", ref.Name())
+	}
+	index, err := desc.ImageIndex()
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	for _, m := range manifest.Manifests {
+		if m.Digest == digest {
+			return desc.Digest, nil
+		}
+	}
+	return v1.Hash{}, fmt.Errorf("index %s does not contain %s", desc.Digest, digest)
+}
+
+// platformManifest returns the digest of the image manifest for the current platform from an index.
+func platformManifest(manifest *v1.IndexManifest) (v1.Hash, error) {
+	platform := Platform()
+	for _, m := range manifest.Manifests {
+		if m.Platform != nil && m.Platform.Satisfies(platform) {
+			return m.Digest, nil
+		}
+	}
+	return v1.Hash{}, fmt.Errorf("no image for platform %s", platform)
+}
+
+// layerPayload returns the content of a signature image layer.
+func layerPayload(img v1.Image, digest v1.Hash) ([]byte, error) {
+	layer, err := img.LayerByDigest(digest)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := layer.Compressed()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// readPublicKey reads a PEM-encoded ECDSA, RSA, or Ed25519 public key.
+func readPublicKey(path string) (crypto.PublicKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch key.(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey, ed25519.PublicKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported public key type %T", key)
+}
+
+func validateSignatureMode(mode SignatureMode) error {
+	switch mode {
+	case SignatureEnforce, SignatureWarn, SignatureOff:
+		return nil
+	}
+	return fmt.Errorf("unsupported mode %q: must be one of %s, %s, %s", mode, SignatureEnforce, SignatureWarn, SignatureOff)
+}
@@ -0,0 +1,296 @@
+package images
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"log"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+func Test_UnitSignaturePolicy(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "cosign.pub")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	policyFile := filepath.Join(dir, "policy.yaml")
+	if err := os.WriteFile(policyFile, []byte("keys: ["+keyFile+"]\ndefault: warn\nimages:\n  runtime-image: enforce\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	policy, err := ReadSignaturePolicy(policyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := policy.Mode(Runtime); mode != SignatureEnforce {
+		t.Errorf("expected %s mode for %s, got %s", SignatureEnforce, Runtime, mode)
+	}
+	if mode := policy.Mode(KubeAPIServer); mode != SignatureWarn {
+		t.Errorf("expected %s mode for %s, got %s", SignatureWarn, KubeAPIServer, mode)
+	}
+
+	digest := v1.Hash{Algorithm: "sha256", Hex: "0000000000000000000000000000000000000000000000000000000000000001"}
+	payload := []byte(`{"critical":{"image":{"docker-manifest-digest":"` + digest.String() + `"},"type":"cosign container image signature"}}`)
+	hash := sha256.Sum256(payload)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := policy.verifyPayload(payload, base64.StdEncoding.EncodeToString(sig), digest); err != nil {
+		t.Errorf("expected signature to verify: %v", err)
+	}
+	other := v1.Hash{Algorithm: "sha256", Hex: "0000000000000000000000000000000000000000000000000000000000000002"}
+	if err := policy.verifyPayload(payload, base64.StdEncoding.EncodeToString(sig), other); err == nil {
+		t.Error("expected signature for a different digest to fail verification")
+	}
+	sig[len(sig)-1] ^= 0xff
+	if err := policy.verifyPayload(payload, base64.StdEncoding.EncodeToString(sig), digest); err == nil {
+		t.Error("expected modified signature to fail verification")
+	}
+}
+
+func Test_UnitSignaturePolicyVerifyReference(t *testing.T) {
+	server := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := &SignaturePolicy{Default: SignatureEnforce, publicKeys: []crypto.PublicKey{&key.PublicKey}}
+	remoteRegistry, err := NewRemoteRegistry(filepath.Join(t.TempDir(), "registries.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each repository holds an index with an image for the current platform; only the index is signed,
+	// as cosign does for multi-platform images, except in the unsigned repository.
+	platform := Platform()
+	pushed := map[string]struct {
+		index v1.Hash
+		image v1.Image
+	}{}
+	for _, repo := range []string{"rancher/signed", "rancher/unsigned"} {
+		img, err := random.Image(64, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		index := mutate.AppendManifests(empty.Index, mutate.IndexAddendum{Add: img, Descriptor: v1.Descriptor{Platform: &platform}})
+		digest, err := index.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ref, err := name.ParseReference(host + "/" + repo + ":v1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := remote.WriteIndex(ref, index); err != nil {
+			t.Fatal(err)
+		}
+		pushed[repo] = struct {
+			index v1.Hash
+			image v1.Image
+		}{digest, img}
+	}
+	writeSignature(t, key, host+"/rancher/signed", pushed["rancher/signed"].index)
+
+	ctx := context.Background()
+	imagesDir := t.TempDir()
+	signed, err := name.ParseReference(host + "/rancher/signed:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsigned, err := name.ParseReference(host + "/rancher/unsigned:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("tag pinned to signed index", func(t *testing.T) {
+		pinned, err := policy.VerifyReference(ctx, Runtime, signed, imagesDir, remoteRegistry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := signed.Context().Digest(pushed["rancher/signed"].index.String()).Name(); pinned.Name() != expected {
+			t.Errorf("expected reference pinned to %s, got %s", expected, pinned.Name())
+		}
+		if _, err := policy.VerifyReference(ctx, Runtime, pinned, imagesDir, remoteRegistry); err != nil {
+			t.Errorf("expected pinned reference to verify: %v", err)
+		}
+	})
+
+	t.Run("image from signed index", func(t *testing.T) {
+		if err := policy.VerifyImage(ctx, Runtime, signed, pushed["rancher/signed"].image, imagesDir, remoteRegistry); err != nil {
+			t.Errorf("expected image to verify against the signed index: %v", err)
+		}
+		if err := policy.VerifyImage(ctx, Runtime, signed, pushed["rancher/unsigned"].image, imagesDir, remoteRegistry); err == nil {
+			t.Error("expected image that is not in the signed index to fail verification")
+		}
+	})
+
+	t.Run("unsigned", func(t *testing.T) {
+		if _, err := policy.VerifyReference(ctx, Runtime, unsigned, imagesDir, remoteRegistry); err == nil {
+			t.Error("expected unsigned image to fail verification")
+		}
+		warn := &SignaturePolicy{Default: SignatureWarn, publicKeys: policy.publicKeys}
+		pinned, err := warn.VerifyReference(ctx, Runtime, unsigned, imagesDir, remoteRegistry)
+		if err != nil {
+			t.Errorf("expected unsigned image to only warn: %v", err)
+		}
+		if _, ok := pinned.(name.Digest); !ok {
+			t.Errorf("expected reference to be pinned to a digest, got %s", pinned.Name())
+		}
+	})
+
+	t.Run("off", func(t *testing.T) {
+		ref, err := name.ParseReference("registry.invalid/rancher/unsigned:v1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var off *SignaturePolicy
+		pinned, err := off.VerifyReference(ctx, Runtime, ref, imagesDir, remoteRegistry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pinned != ref {
+			t.Errorf("expected reference to be unchanged, got %s", pinned.Name())
+		}
+	})
+}
+
+func Test_UnitSignaturePolicyVerifyReferenceArchive(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := &SignaturePolicy{Default: SignatureEnforce, publicKeys: []crypto.PublicKey{&key.PublicKey}}
+	ctx := context.Background()
+
+	platform := Platform()
+	img, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := mutate.AppendManifests(empty.Index, mutate.IndexAddendum{Add: img, Descriptor: v1.Descriptor{Platform: &platform}})
+	digest, err := index.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := name.ParseReference("registry.invalid/rancher/signed:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sigRef := ref.Context().Tag(digest.Algorithm + "-" + digest.Hex + ".sig")
+
+	t.Run("OCI layout", func(t *testing.T) {
+		layoutDir := t.TempDir()
+		p, err := layout.Write(layoutDir, empty.Index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := p.AppendIndex(index, layout.WithAnnotations(map[string]string{AnnotationContainerdImageName: ref.Name()})); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.AppendImage(signatureImage(t, key, digest), layout.WithAnnotations(map[string]string{AnnotationContainerdImageName: sigRef.Name()})); err != nil {
+			t.Fatal(err)
+		}
+		imagesDir := t.TempDir()
+		writeTar(t, filepath.Join(imagesDir, "images.tar"), layoutDir)
+
+		// The registry is not used, as the image and its signature are both in the archive
+		pinned, err := policy.VerifyReference(ctx, Runtime, ref, imagesDir, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := ref.Context().Digest(digest.String()).Name(); pinned.Name() != expected {
+			t.Errorf("expected reference pinned to %s, got %s", expected, pinned.Name())
+		}
+		if _, err := policy.VerifyReference(ctx, Runtime, pinned, imagesDir, nil); err != nil {
+			t.Errorf("expected pinned reference to verify: %v", err)
+		}
+	})
+
+	t.Run("docker archive", func(t *testing.T) {
+		imagesDir := t.TempDir()
+		if err := tarball.MultiRefWriteToFile(filepath.Join(imagesDir, "images.tar"), map[name.Reference]v1.Image{
+			ref:    img,
+			sigRef: signatureImage(t, key, digest),
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := policy.VerifyReference(ctx, Runtime, ref, imagesDir, nil)
+		if err == nil || !strings.Contains(err.Error(), "docker-archive") {
+			t.Errorf("expected error for image in docker-archive tarball, got %v", err)
+		}
+		warn := &SignaturePolicy{Default: SignatureWarn, publicKeys: policy.publicKeys}
+		if pinned, err := warn.VerifyReference(ctx, Runtime, ref, imagesDir, nil); err != nil || pinned != ref {
+			t.Errorf("expected unchanged reference with only a warning, got %s: %v", pinned.Name(), err)
+		}
+	})
+}
+
+// writeSignature pushes a cosign signature image for a digest to a repository.
+func writeSignature(t *testing.T, key *ecdsa.PrivateKey, repo string, digest v1.Hash) {
+	t.Helper()
+	ref, err := name.ParseReference(repo + ":" + digest.Algorithm + "-" + digest.Hex + ".sig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(ref, signatureImage(t, key, digest)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// signatureImage returns a cosign signature image for a digest.
+func signatureImage(t *testing.T, key *ecdsa.PrivateKey, digest v1.Hash) v1.Image {
+	t.Helper()
+	payload := []byte(`{"critical":{"image":{"docker-manifest-digest":"` + digest.String() + `"},"type":"cosign container image signature"}}`)
+	hash := sha256.Sum256(payload)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := mutate.Append(empty.Image, mutate.Addendum{
+		Layer:       static.NewLayer(payload, types.MediaType("application/vnd.dev.cosign.simplesigning.v1+json")),
+		Annotations: map[string]string{cosignSignatureAnnotation: base64.StdEncoding.EncodeToString(sig)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
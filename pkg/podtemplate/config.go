@@ -2,13 +2,18 @@ package podtemplate
 
 import (
 	"fmt"
+	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
 
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/k3s-io/k3s/pkg/util/errors"
 	rke2cli "github.com/rancher/rke2/pkg/cli"
 	"github.com/rancher/rke2/pkg/images"
 	"github.com/urfave/cli/v2"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/yaml"
 )
 
 func NewConfigFromCLI(dataDir string, cfg rke2cli.Config) (*Config, error) {
@@ -37,14 +42,27 @@ func NewConfigFromCLI(dataDir string, cfg rke2cli.Config) (*Config, error) {
 		return nil, err
 	}
 
+	sidecars, err := parseControlPlaneSidecars(cfg.ControlPlaneSidecarsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	kms, err := parseKMSPlugin(cfg)
+	if err != nil {
+		return nil, err
+	}
+
 	return &Config{
-		Resolver:  resolver,
-		ImagesDir: filepath.Join(dataDir, "agent", "images"),
-		DataDir:   dataDir,
-		Resources: controlPlaneResources,
-		Probes:    controlPlaneProbeConfs,
-		Env:       env,
-		Mounts:    mounts,
+		Resolver:   resolver,
+		ImagesDir:  filepath.Join(dataDir, "agent", "images"),
+		DataDir:    dataDir,
+		OverlayDir: cfg.PodOverlayDir,
+		Resources:  controlPlaneResources,
+		Probes:     controlPlaneProbeConfs,
+		Env:        env,
+		Mounts:     mounts,
+		Sidecars:   sidecars,
+		KMS:        kms,
 	}, nil
 }
 
@@ -309,6 +327,7 @@ func parseControlPlaneProbeConfs(probeConfs *cli.StringSlice) (*ControlPlaneProb
 	}
 
 	parsedProbeConf := make(map[string]int32)
+	parsedProbeKinds := make(map[string]ProbeKind)
 
 	for _, conf := range probeConfs.Value() {
 		for _, rawConf := range strings.Split(conf, ",") {
@@ -316,10 +335,22 @@ func parseControlPlaneProbeConfs(probeConfs *cli.StringSlice) (*ControlPlaneProb
 			if len(v) != 2 {
 				return nil, fmt.Errorf("incorrectly formatted control probe config specified: %s", rawConf)
 			}
+			if strings.HasSuffix(v[0], "-"+Kind) {
+				switch kind := ProbeKind(v[1]); kind {
+				case ProbeKindExec, ProbeKindHTTP, ProbeKindTCP, ProbeKindGRPC, ProbeKindNone:
+					parsedProbeKinds[v[0]] = kind
+				default:
+					return nil, fmt.Errorf("invalid control plane probe kind specified: %s", rawConf)
+				}
+				continue
+			}
 			val, err := strconv.ParseInt(v[1], 10, 32)
 			if err != nil || val < 0 {
 				return nil, fmt.Errorf("invalid control plane probe config value specified: %s", rawConf)
 			}
+			if strings.HasSuffix(v[0], "-"+Port) && val > 65535 {
+				return nil, fmt.Errorf("invalid control plane probe port specified: %s", rawConf)
+			}
 			parsedProbeConf[v[0]] = int32(val)
 		}
 	}
@@ -337,6 +368,27 @@ func parseControlPlaneProbeConfs(probeConfs *cli.StringSlice) (*ControlPlaneProb
 		}
 	}
 
+	// The probe kind and port are not defaulted, as the default depends on the component.
+	components := map[string]*ProbeConfs{
+		KubeAPIServer:          &controlPlaneProbes.KubeAPIServer,
+		KubeScheduler:          &controlPlaneProbes.KubeScheduler,
+		KubeControllerManager:  &controlPlaneProbes.KubeControllerManager,
+		KubeProxy:              &controlPlaneProbes.KubeProxy,
+		Etcd:                   &controlPlaneProbes.Etcd,
+		CloudControllerManager: &controlPlaneProbes.CloudControllerManager,
+	}
+	for component, confs := range components {
+		for probeName, conf := range map[string]*ProbeConf{Liveness: &confs.Liveness, Readiness: &confs.Readiness, Startup: &confs.Startup} {
+			k := component + "-" + probeName + "-"
+			if kind, ok := parsedProbeKinds[k+Kind]; ok {
+				conf.Kind = kind
+			}
+			if port, ok := parsedProbeConf[k+Port]; ok {
+				conf.Port = port
+			}
+		}
+	}
+
 	return &controlPlaneProbes, nil
 }
 
@@ -352,12 +404,84 @@ func parseControlPlaneEnv(extraEnv rke2cli.ExtraEnv) (*ControlPlaneEnv, error) {
 }
 
 func parseControlPlaneMounts(extraMounts rke2cli.ExtraMounts) (*ControlPlaneMounts, error) {
-	return &ControlPlaneMounts{
+	mounts := &ControlPlaneMounts{
 		KubeAPIServer:          extraMounts.KubeAPIServer.Value(),
 		KubeScheduler:          extraMounts.KubeScheduler.Value(),
 		KubeControllerManager:  extraMounts.KubeControllerManager.Value(),
 		KubeProxy:              extraMounts.KubeProxy.Value(),
 		Etcd:                   extraMounts.Etcd.Value(),
 		CloudControllerManager: extraMounts.CloudControllerManager.Value(),
+	}
+	for component, m := range map[string][]string{
+		KubeAPIServer:          mounts.KubeAPIServer,
+		KubeScheduler:          mounts.KubeScheduler,
+		KubeControllerManager:  mounts.KubeControllerManager,
+		KubeProxy:              mounts.KubeProxy,
+		Etcd:                   mounts.Etcd,
+		CloudControllerManager: mounts.CloudControllerManager,
+	} {
+		if err := ValidateExtraMounts(m); err != nil {
+			return nil, errors.WithMessagef(err, "invalid %s-extra-mount", component)
+		}
+	}
+	return mounts, nil
+}
+
+// parseControlPlaneSidecars reads the sidecars for each component from a file, as a map of component
+// name to a list of sidecars. No sidecars are configured if the file is not set.
+func parseControlPlaneSidecars(file string) (map[string][]Sidecar, error) {
+	if file == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to read control plane sidecars file")
+	}
+	sidecars := map[string][]Sidecar{}
+	if err := yaml.UnmarshalStrict(b, &sidecars); err != nil {
+		return nil, errors.WithMessagef(err, "failed to parse control plane sidecars file %s", file)
+	}
+
+	for component, list := range sidecars {
+		switch component {
+		case KubeAPIServer, KubeScheduler, KubeControllerManager, KubeProxy, Etcd, CloudControllerManager, KMSPlugin:
+		default:
+			return nil, fmt.Errorf("invalid component %q in control plane sidecars file %s", component, file)
+		}
+		names := map[string]bool{component: true}
+		for _, sidecar := range list {
+			if errs := validation.IsDNS1123Label(sidecar.Name); len(errs) > 0 {
+				return nil, fmt.Errorf("invalid name %q for %s sidecar: %s", sidecar.Name, component, strings.Join(errs, ", "))
+			}
+			if names[sidecar.Name] {
+				return nil, fmt.Errorf("duplicate name %q for %s sidecar", sidecar.Name, component)
+			}
+			names[sidecar.Name] = true
+			if _, err := name.ParseReference(sidecar.Image, name.WeakValidation); err != nil {
+				return nil, errors.WithMessagef(err, "invalid image for %s sidecar %s", component, sidecar.Name)
+			}
+			if err := ValidateExtraMounts(sidecar.Mounts); err != nil {
+				return nil, errors.WithMessagef(err, "invalid mounts for %s sidecar %s", component, sidecar.Name)
+			}
+		}
+	}
+	return sidecars, nil
+}
+
+// parseKMSPlugin returns the KMS plugin configuration, or nil if a KMS plugin image is not configured.
+func parseKMSPlugin(cfg rke2cli.Config) (*KMSPluginConfig, error) {
+	if cfg.KMSPluginImage == "" {
+		return nil, nil
+	}
+	if _, err := name.ParseReference(cfg.KMSPluginImage, name.WeakValidation); err != nil {
+		return nil, errors.WithMessage(err, "invalid KMS plugin image")
+	}
+	if !filepath.IsAbs(cfg.KMSPluginSocket) {
+		return nil, fmt.Errorf("invalid KMS plugin socket %q: must be an absolute path", cfg.KMSPluginSocket)
+	}
+	return &KMSPluginConfig{
+		Image:  cfg.KMSPluginImage,
+		Args:   cfg.KMSPluginArgs.Value(),
+		Socket: cfg.KMSPluginSocket,
 	}, nil
 }
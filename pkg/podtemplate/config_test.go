@@ -0,0 +1,98 @@
+package podtemplate
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_UnitParseControlPlaneSidecars(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		want    map[string]int
+		wantErr bool
+	}{
+		{
+			name: "sidecars",
+			file: `
+kube-apiserver:
+- name: log-shipper
+  image: docker.elastic.co/beats/filebeat:8.0.0
+  sharedMounts: [/var/lib/rancher/rke2/server/logs]
+- name: proxy
+  image: rancher/proxy:v1
+  mounts: [/etc/proxy:/etc/proxy]
+etcd:
+- name: backup
+  image: rancher/backup:v1
+`,
+			want: map[string]int{KubeAPIServer: 2, Etcd: 1},
+		},
+		{
+			name:    "unknown component",
+			file:    "kubelet:\n- name: sidecar\n  image: busybox\n",
+			wantErr: true,
+		},
+		{
+			name:    "invalid name",
+			file:    "kube-apiserver:\n- name: Log_Shipper\n  image: busybox\n",
+			wantErr: true,
+		},
+		{
+			name:    "missing name",
+			file:    "kube-apiserver:\n- image: busybox\n",
+			wantErr: true,
+		},
+		{
+			name:    "duplicate name",
+			file:    "kube-apiserver:\n- name: sidecar\n  image: busybox\n- name: sidecar\n  image: busybox\n",
+			wantErr: true,
+		},
+		{
+			name:    "name of component container",
+			file:    "kube-apiserver:\n- name: kube-apiserver\n  image: busybox\n",
+			wantErr: true,
+		},
+		{
+			name:    "invalid image",
+			file:    "kube-apiserver:\n- name: sidecar\n  image: Busybox:@\n",
+			wantErr: true,
+		},
+		{
+			name:    "invalid mount",
+			file:    "kube-apiserver:\n- name: sidecar\n  image: busybox\n  mounts: [relative/path]\n",
+			wantErr: true,
+		},
+		{
+			name:    "unknown field",
+			file:    "kube-apiserver:\n- name: sidecar\n  image: busybox\n  volumes: []\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "sidecars.yaml")
+			if err := os.WriteFile(file, []byte(tt.file), 0600); err != nil {
+				t.Fatal(err)
+			}
+			sidecars, err := parseControlPlaneSidecars(file)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseControlPlaneSidecars() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(sidecars) != len(tt.want) {
+				t.Errorf("expected sidecars for %d components, got %d", len(tt.want), len(sidecars))
+			}
+			for component, n := range tt.want {
+				if len(sidecars[component]) != n {
+					t.Errorf("expected %d sidecars for %s, got %d", n, component, len(sidecars[component]))
+				}
+			}
+		})
+	}
+
+	if sidecars, err := parseControlPlaneSidecars(""); err != nil || sidecars != nil {
+		t.Errorf("expected no sidecars without a file, got %v: %v", sidecars, err)
+	}
+}
@@ -0,0 +1,170 @@
+package podtemplate
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/k3s-io/k3s/pkg/util/errors"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const (
+	mountTypeHostPath = "hostPath"
+	mountTypeEmptyDir = "emptyDir"
+)
+
+// ExtraMount is an extra volume mount for a static pod container.
+type ExtraMount struct {
+	Type             string
+	Source           string
+	Destination      string
+	ReadOnly         bool
+	HostPathType     v1.HostPathType
+	MountPropagation *v1.MountPropagationMode
+	SubPath          string
+	Medium           v1.StorageMedium
+	SizeLimit        *resource.Quantity
+	SELinuxRelabel   bool
+}
+
+// ParseExtraMount parses an extra mount. Mounts are given either in the form source:destination[:ro|rw[:type]],
+// or as a comma-separated list of key=value options, which allows paths that contain colons:
+//
+//	type=hostPath|emptyDir     the kind of volume; defaults to hostPath
+//	source=<path>              the host path to mount; required for hostPath volumes
+//	destination=<path>         the path to mount the volume at in the container; required
+//	readOnly=true|false        mount the volume read-only
+//	hostPathType=<type>        the hostPath type, such as DirectoryOrCreate; detected from the host path if not set
+//	mountPropagation=<mode>    one of None, HostToContainer, Bidirectional
+//	subPath=<path>             the path within the volume to mount
+//	medium=Memory              the emptyDir medium; Memory creates a tmpfs
+//	sizeLimit=<quantity>       the emptyDir size limit
+//	selinuxRelabel=true|false  relabel the host path so that it can be shared with containers, when SELinux is enabled
+func ParseExtraMount(s string) (ExtraMount, error) {
+	key, _, ok := strings.Cut(s, "=")
+	if !ok || strings.ContainsAny(key, "/:") {
+		return parseShortExtraMount(s)
+	}
+
+	m := ExtraMount{Type: mountTypeHostPath}
+	for _, opt := range strings.Split(s, ",") {
+		key, value, ok := strings.Cut(opt, "=")
+		if !ok {
+			return m, fmt.Errorf("option %q is not in the form key=value", opt)
+		}
+		var err error
+		switch key {
+		case "type":
+			m.Type = value
+		case "source", "src":
+			m.Source = value
+		case "destination", "dst", "target":
+			m.Destination = value
+		case "readOnly", "ro":
+			m.ReadOnly, err = strconv.ParseBool(value)
+		case "hostPathType":
+			m.HostPathType = v1.HostPathType(value)
+		case "mountPropagation":
+			propagation := v1.MountPropagationMode(value)
+			m.MountPropagation = &propagation
+		case "subPath":
+			m.SubPath = value
+		case "medium":
+			m.Medium = v1.StorageMedium(value)
+		case "sizeLimit":
+			var q resource.Quantity
+			q, err = resource.ParseQuantity(value)
+			m.SizeLimit = &q
+		case "selinuxRelabel":
+			m.SELinuxRelabel, err = strconv.ParseBool(value)
+		default:
+			return m, fmt.Errorf("unknown option %q", key)
+		}
+		if err != nil {
+			return m, errors.WithMessagef(err, "invalid value for option %s", key)
+		}
+	}
+	return m, m.validate()
+}
+
+// parseShortExtraMount parses an extra mount in the form source:destination[:ro|rw[:type]].
+func parseShortExtraMount(s string) (ExtraMount, error) {
+	m := ExtraMount{Type: mountTypeHostPath}
+	mount := strings.Split(s, ":")
+	switch len(mount) {
+	case 2: // In the case of 2 elements, we expect this to be a traditional source:dest volume mount.
+	case 3, 4:
+		switch strings.ToLower(mount[2]) {
+		case "ro":
+			m.ReadOnly = true
+		case "rw":
+			m.ReadOnly = false
+		default:
+			return m, fmt.Errorf("unknown mount option %s", mount[2])
+		}
+		if len(mount) == 4 {
+			m.HostPathType = v1.HostPathType(mount[3])
+		}
+	default:
+		return m, fmt.Errorf("mount is not in the form source:destination[:ro|rw[:type]]; use key=value options for paths that contain colons")
+	}
+	m.Source, m.Destination = mount[0], mount[1]
+	return m, m.validate()
+}
+
+// validate checks that the options are valid for the type of volume.
+func (m ExtraMount) validate() error {
+	if !filepath.IsAbs(m.Destination) {
+		return fmt.Errorf("destination %q must be an absolute path", m.Destination)
+	}
+	switch m.Type {
+	case mountTypeHostPath:
+		if !filepath.IsAbs(m.Source) {
+			return fmt.Errorf("source %q must be an absolute path", m.Source)
+		}
+		switch m.HostPathType {
+		case v1.HostPathUnset, v1.HostPathDirectoryOrCreate, v1.HostPathDirectory, v1.HostPathFileOrCreate, v1.HostPathFile,
+			v1.HostPathSocket, v1.HostPathCharDev, v1.HostPathBlockDev:
+		default:
+			return fmt.Errorf("unknown hostPath type %s", m.HostPathType)
+		}
+		if m.Medium != v1.StorageMediumDefault || m.SizeLimit != nil {
+			return fmt.Errorf("medium and sizeLimit can only be set for %s volumes", mountTypeEmptyDir)
+		}
+	case mountTypeEmptyDir:
+		if m.Source != "" || m.HostPathType != v1.HostPathUnset || m.SELinuxRelabel {
+			return fmt.Errorf("source, hostPathType and selinuxRelabel can only be set for %s volumes", mountTypeHostPath)
+		}
+		switch m.Medium {
+		case v1.StorageMediumDefault, v1.StorageMediumMemory, v1.StorageMediumHugePages:
+		default:
+			return fmt.Errorf("unknown emptyDir medium %s", m.Medium)
+		}
+	default:
+		return fmt.Errorf("unknown volume type %s: must be one of %s, %s", m.Type, mountTypeHostPath, mountTypeEmptyDir)
+	}
+	if m.MountPropagation != nil {
+		switch *m.MountPropagation {
+		case v1.MountPropagationNone, v1.MountPropagationHostToContainer, v1.MountPropagationBidirectional:
+		default:
+			return fmt.Errorf("unknown mount propagation mode %s", *m.MountPropagation)
+		}
+	}
+	if filepath.IsAbs(m.SubPath) || strings.HasPrefix(filepath.Clean(m.SubPath), "..") {
+		return fmt.Errorf("subPath %q must be a relative path within the volume", m.SubPath)
+	}
+	return nil
+}
+
+// ValidateExtraMounts checks that each of the extra mounts can be parsed.
+func ValidateExtraMounts(extraMounts []string) error {
+	for _, rawMount := range extraMounts {
+		if _, err := ParseExtraMount(rawMount); err != nil {
+			return errors.WithMessagef(err, "invalid extra mount %q", rawMount)
+		}
+	}
+	return nil
+}
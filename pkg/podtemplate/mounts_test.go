@@ -0,0 +1,253 @@
+package podtemplate
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_UnitParseExtraMount(t *testing.T) {
+	propagation := func(mode v1.MountPropagationMode) *v1.MountPropagationMode {
+		return &mode
+	}
+	quantity := func(s string) *resource.Quantity {
+		q := resource.MustParse(s)
+		return &q
+	}
+	tests := []struct {
+		name    string
+		mount   string
+		want    ExtraMount
+		wantErr bool
+	}{
+		{
+			name:  "legacy source and destination",
+			mount: "/var/log/audit:/var/log/audit",
+			want:  ExtraMount{Type: mountTypeHostPath, Source: "/var/log/audit", Destination: "/var/log/audit"},
+		},
+		{
+			name:  "legacy read-only",
+			mount: "/etc/ssl/certs:/etc/ssl/certs:RO",
+			want:  ExtraMount{Type: mountTypeHostPath, Source: "/etc/ssl/certs", Destination: "/etc/ssl/certs", ReadOnly: true},
+		},
+		{
+			name:  "legacy read-write with hostPath type",
+			mount: "/run/foo.sock:/run/foo.sock:rw:Socket",
+			want:  ExtraMount{Type: mountTypeHostPath, Source: "/run/foo.sock", Destination: "/run/foo.sock", HostPathType: v1.HostPathSocket},
+		},
+		{
+			name:  "legacy path containing equals sign",
+			mount: "/data/a=b:/mnt/a=b",
+			want:  ExtraMount{Type: mountTypeHostPath, Source: "/data/a=b", Destination: "/mnt/a=b"},
+		},
+		{
+			name:    "legacy unknown mount option",
+			mount:   "/data:/mnt:rx",
+			wantErr: true,
+		},
+		{
+			name:    "legacy path containing colon",
+			mount:   "/data/a:b:/mnt/a:b",
+			wantErr: true,
+		},
+		{
+			name:    "legacy missing destination",
+			mount:   "/data",
+			wantErr: true,
+		},
+		{
+			name:  "options with paths containing colons and equals signs",
+			mount: "src=/data/a:b=c,dst=/mnt/a:b=c,ro=true",
+			want:  ExtraMount{Type: mountTypeHostPath, Source: "/data/a:b=c", Destination: "/mnt/a:b=c", ReadOnly: true},
+		},
+		{
+			name:  "options with long keys and hostPath type",
+			mount: "type=hostPath,source=/data,destination=/mnt,readOnly=false,hostPathType=DirectoryOrCreate",
+			want:  ExtraMount{Type: mountTypeHostPath, Source: "/data", Destination: "/mnt", HostPathType: v1.HostPathDirectoryOrCreate},
+		},
+		{
+			name:  "emptyDir",
+			mount: "type=emptyDir,dst=/tmp",
+			want:  ExtraMount{Type: mountTypeEmptyDir, Destination: "/tmp"},
+		},
+		{
+			name:  "emptyDir in memory with size limit",
+			mount: "type=emptyDir,destination=/cache,medium=Memory,sizeLimit=64Mi",
+			want:  ExtraMount{Type: mountTypeEmptyDir, Destination: "/cache", Medium: v1.StorageMediumMemory, SizeLimit: quantity("64Mi")},
+		},
+		{
+			name:  "propagation, subPath and relabel",
+			mount: "src=/var/lib/data,dst=/data,mountPropagation=HostToContainer,subPath=app/logs,selinuxRelabel=true",
+			want: ExtraMount{
+				Type:             mountTypeHostPath,
+				Source:           "/var/lib/data",
+				Destination:      "/data",
+				MountPropagation: propagation(v1.MountPropagationHostToContainer),
+				SubPath:          "app/logs",
+				SELinuxRelabel:   true,
+			},
+		},
+		{
+			name:    "unknown option",
+			mount:   "src=/data,dst=/mnt,readonly=true",
+			wantErr: true,
+		},
+		{
+			name:    "option without value",
+			mount:   "src=/data,dst=/mnt,ro",
+			wantErr: true,
+		},
+		{
+			name:    "invalid boolean",
+			mount:   "src=/data,dst=/mnt,ro=yes",
+			wantErr: true,
+		},
+		{
+			name:    "invalid size limit",
+			mount:   "type=emptyDir,dst=/cache,sizeLimit=lots",
+			wantErr: true,
+		},
+		{
+			name:    "unknown volume type",
+			mount:   "type=configMap,dst=/mnt",
+			wantErr: true,
+		},
+		{
+			name:    "relative destination",
+			mount:   "src=/data,dst=mnt",
+			wantErr: true,
+		},
+		{
+			name:    "hostPath without source",
+			mount:   "dst=/mnt",
+			wantErr: true,
+		},
+		{
+			name:    "relative source",
+			mount:   "data:/mnt",
+			wantErr: true,
+		},
+		{
+			name:    "unknown hostPath type",
+			mount:   "src=/data,dst=/mnt,hostPathType=Directory2",
+			wantErr: true,
+		},
+		{
+			name:    "hostPath with medium",
+			mount:   "src=/data,dst=/mnt,medium=Memory",
+			wantErr: true,
+		},
+		{
+			name:    "hostPath with size limit",
+			mount:   "src=/data,dst=/mnt,sizeLimit=1Gi",
+			wantErr: true,
+		},
+		{
+			name:    "emptyDir with source",
+			mount:   "type=emptyDir,src=/data,dst=/mnt",
+			wantErr: true,
+		},
+		{
+			name:    "emptyDir with hostPath type",
+			mount:   "type=emptyDir,dst=/mnt,hostPathType=Directory",
+			wantErr: true,
+		},
+		{
+			name:    "emptyDir with relabel",
+			mount:   "type=emptyDir,dst=/mnt,selinuxRelabel=true",
+			wantErr: true,
+		},
+		{
+			name:    "unknown emptyDir medium",
+			mount:   "type=emptyDir,dst=/mnt,medium=Disk",
+			wantErr: true,
+		},
+		{
+			name:    "unknown mount propagation",
+			mount:   "src=/data,dst=/mnt,mountPropagation=Shared",
+			wantErr: true,
+		},
+		{
+			name:    "absolute subPath",
+			mount:   "src=/data,dst=/mnt,subPath=/logs",
+			wantErr: true,
+		},
+		{
+			name:    "subPath outside the volume",
+			mount:   "src=/data,dst=/mnt,subPath=logs/../../etc",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseExtraMount(tt.mount)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseExtraMount() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !equality.Semantic.DeepEqual(got, tt.want) {
+				t.Errorf("ParseExtraMount() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_UnitAddExtraMounts(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(dir, "missing")
+
+	hostPathType := func(t v1.HostPathType) *v1.HostPathType {
+		return &t
+	}
+	propagation := v1.MountPropagationBidirectional
+	sizeLimit := resource.MustParse("64Mi")
+
+	p := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: KubeAPIServer},
+		Spec:       v1.PodSpec{Containers: []v1.Container{{Name: KubeAPIServer}}},
+	}
+	addExtraMounts(p, &p.Spec.Containers[0], extraMountPrefix, []string{
+		dir + ":/dir:ro",
+		file + ":/file",
+		missing + ":/missing",
+		"src=" + dir + ",dst=/socket,hostPathType=Socket",
+		"type=emptyDir,dst=/cache,medium=Memory,sizeLimit=64Mi,subPath=app",
+		"src=" + dir + ",dst=/shared,mountPropagation=Bidirectional",
+		"src=" + dir + ",dst=relative",
+	})
+
+	wantVolumes := []v1.Volume{
+		{Name: extraMountPrefix + "-0", VolumeSource: v1.VolumeSource{HostPath: &v1.HostPathVolumeSource{Path: dir, Type: hostPathType(v1.HostPathDirectory)}}},
+		{Name: extraMountPrefix + "-1", VolumeSource: v1.VolumeSource{HostPath: &v1.HostPathVolumeSource{Path: file, Type: hostPathType(v1.HostPathFile)}}},
+		{Name: extraMountPrefix + "-2", VolumeSource: v1.VolumeSource{HostPath: &v1.HostPathVolumeSource{Path: missing, Type: hostPathType(v1.HostPathDirectoryOrCreate)}}},
+		{Name: extraMountPrefix + "-3", VolumeSource: v1.VolumeSource{HostPath: &v1.HostPathVolumeSource{Path: dir, Type: hostPathType(v1.HostPathSocket)}}},
+		{Name: extraMountPrefix + "-4", VolumeSource: v1.VolumeSource{EmptyDir: &v1.EmptyDirVolumeSource{Medium: v1.StorageMediumMemory, SizeLimit: &sizeLimit}}},
+		{Name: extraMountPrefix + "-5", VolumeSource: v1.VolumeSource{HostPath: &v1.HostPathVolumeSource{Path: dir, Type: hostPathType(v1.HostPathDirectory)}}},
+	}
+	// The invalid mount is skipped
+	wantMounts := []v1.VolumeMount{
+		{Name: extraMountPrefix + "-0", MountPath: "/dir", ReadOnly: true},
+		{Name: extraMountPrefix + "-1", MountPath: "/file"},
+		{Name: extraMountPrefix + "-2", MountPath: "/missing"},
+		{Name: extraMountPrefix + "-3", MountPath: "/socket"},
+		{Name: extraMountPrefix + "-4", MountPath: "/cache", SubPath: "app"},
+		{Name: extraMountPrefix + "-5", MountPath: "/shared", MountPropagation: &propagation},
+	}
+	if !equality.Semantic.DeepEqual(p.Spec.Volumes, wantVolumes) {
+		t.Errorf("volumes = %+v, want %+v", p.Spec.Volumes, wantVolumes)
+	}
+	if !equality.Semantic.DeepEqual(p.Spec.Containers[0].VolumeMounts, wantMounts) {
+		t.Errorf("volume mounts = %+v, want %+v", p.Spec.Containers[0].VolumeMounts, wantMounts)
+	}
+}
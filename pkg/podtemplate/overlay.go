@@ -0,0 +1,73 @@
+package podtemplate
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/k3s-io/k3s/pkg/util/errors"
+	"github.com/k3s-io/k3s/pkg/version"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"sigs.k8s.io/yaml"
+)
+
+// OverlayHashAnnotation records the hash of the overlay file applied to a pod, so that the pod is
+// restarted when the overlay changes.
+var OverlayHashAnnotation = version.Program + ".io/pod-overlay-hash"
+
+// overlayFile returns the path to the overlay file for a component, or an empty string if overlays are not configured.
+func (c *Config) overlayFile(component string) string {
+	if c.OverlayDir == "" {
+		return ""
+	}
+	return filepath.Join(c.OverlayDir, component+".yaml")
+}
+
+// applyOverlay applies the overlay file to the pod as a strategic merge patch, and returns the patched pod.
+// Containers, volumes and other lists are merged by name in the same way as kubectl patch, so an overlay
+// can modify the component container, or add sidecars, tolerations and volumes.
+// If the overlay file does not exist, the pod is returned unmodified.
+func applyOverlay(p *v1.Pod, file string) (*v1.Pod, error) {
+	if file == "" {
+		return p, nil
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return p, nil
+		}
+		return nil, err
+	}
+
+	patch, err := yaml.YAMLToJSON(b)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to parse pod overlay %s", file)
+	}
+	original, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	patched, err := strategicpatch.StrategicMergePatch(original, patch, v1.Pod{})
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to apply pod overlay %s", file)
+	}
+	overlaid := &v1.Pod{}
+	if err := json.Unmarshal(patched, overlaid); err != nil {
+		return nil, errors.WithMessagef(err, "failed to apply pod overlay %s", file)
+	}
+
+	// The pod identity is set by RKE2, and cannot be changed by the overlay.
+	overlaid.TypeMeta = p.TypeMeta
+	overlaid.Name = p.Name
+	overlaid.Namespace = p.Namespace
+
+	h := sha256.Sum256(b)
+	if overlaid.Annotations == nil {
+		overlaid.Annotations = map[string]string{}
+	}
+	overlaid.Annotations[OverlayHashAnnotation] = hex.EncodeToString(h[:])
+	return overlaid, nil
+}
@@ -0,0 +1,170 @@
+package podtemplate
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_UnitApplyOverlay(t *testing.T) {
+	pod := func() *v1.Pod {
+		return &v1.Pod{
+			TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        KubeAPIServer,
+				Namespace:   "kube-system",
+				Annotations: map[string]string{"component": KubeAPIServer},
+			},
+			Spec: v1.PodSpec{
+				Containers: []v1.Container{{
+					Name:  KubeAPIServer,
+					Image: "rancher/hardened-kubernetes:v1",
+					Env:   []v1.EnvVar{{Name: "FILE_HASH", Value: "0"}},
+				}},
+				Volumes: []v1.Volume{{Name: "dir0"}},
+			},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		overlay string
+		noFile  bool
+		wantErr bool
+		check   func(t *testing.T, p *v1.Pod)
+	}{
+		{
+			name:   "missing overlay",
+			noFile: true,
+			check: func(t *testing.T, p *v1.Pod) {
+				if _, ok := p.Annotations[OverlayHashAnnotation]; ok {
+					t.Error("expected no overlay hash annotation")
+				}
+			},
+		},
+		{
+			name: "component container merged by name",
+			overlay: `
+spec:
+  containers:
+  - name: kube-apiserver
+    env:
+    - name: GOMAXPROCS
+      value: "4"
+`,
+			check: func(t *testing.T, p *v1.Pod) {
+				if len(p.Spec.Containers) != 1 {
+					t.Fatalf("expected 1 container, got %d", len(p.Spec.Containers))
+				}
+				c := p.Spec.Containers[0]
+				if c.Image != "rancher/hardened-kubernetes:v1" {
+					t.Errorf("expected image to be kept, got %s", c.Image)
+				}
+				if len(c.Env) != 2 {
+					t.Errorf("expected env to be merged, got %v", c.Env)
+				}
+			},
+		},
+		{
+			name: "sidecar, volume and toleration added",
+			overlay: `
+spec:
+  containers:
+  - name: log-shipper
+    image: registry.example.com/log-shipper:v1
+  volumes:
+  - name: logs
+    emptyDir: {}
+  tolerations:
+  - operator: Exists
+`,
+			check: func(t *testing.T, p *v1.Pod) {
+				if len(p.Spec.Containers) != 2 {
+					t.Fatalf("expected 2 containers, got %d", len(p.Spec.Containers))
+				}
+				if len(p.Spec.Volumes) != 2 {
+					t.Errorf("expected 2 volumes, got %d", len(p.Spec.Volumes))
+				}
+				if len(p.Spec.Tolerations) != 1 {
+					t.Errorf("expected 1 toleration, got %d", len(p.Spec.Tolerations))
+				}
+			},
+		},
+		{
+			name: "pod identity kept",
+			overlay: `
+apiVersion: v2
+kind: Deployment
+metadata:
+  name: other
+  namespace: default
+  labels:
+    tier: control-plane
+`,
+			check: func(t *testing.T, p *v1.Pod) {
+				if p.APIVersion != "v1" || p.Kind != "Pod" || p.Name != KubeAPIServer || p.Namespace != "kube-system" {
+					t.Errorf("expected pod identity to be kept, got %s %s %s/%s", p.APIVersion, p.Kind, p.Namespace, p.Name)
+				}
+				if p.Labels["tier"] != "control-plane" {
+					t.Errorf("expected labels to be merged, got %v", p.Labels)
+				}
+				if p.Annotations["component"] != KubeAPIServer {
+					t.Errorf("expected annotations to be kept, got %v", p.Annotations)
+				}
+			},
+		},
+		{
+			name:    "invalid overlay",
+			overlay: "spec: [",
+			wantErr: true,
+		},
+		{
+			name:    "invalid patch",
+			overlay: "spec:\n  containers: invalid\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), KubeAPIServer+".yaml")
+			if !tt.noFile {
+				if err := os.WriteFile(file, []byte(tt.overlay), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			p, err := applyOverlay(pod(), file)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("applyOverlay() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !tt.noFile && p.Annotations[OverlayHashAnnotation] == "" {
+				t.Error("expected overlay hash annotation")
+			}
+			tt.check(t, p)
+		})
+	}
+
+	// The hash annotation changes with the overlay, so that the pod is restarted
+	dir := t.TempDir()
+	var hashes []string
+	for i, overlay := range []string{"metadata:\n  labels:\n    a: b\n", "metadata:\n  labels:\n    a: c\n"} {
+		file := filepath.Join(dir, KubeAPIServer+".yaml")
+		if err := os.WriteFile(file, []byte(overlay), 0600); err != nil {
+			t.Fatal(err)
+		}
+		p, err := applyOverlay(pod(), file)
+		if err != nil {
+			t.Fatalf("overlay %d: %v", i, err)
+		}
+		hashes = append(hashes, p.Annotations[OverlayHashAnnotation])
+	}
+	if hashes[0] == hashes[1] {
+		t.Errorf("expected overlay hash to change, got %s", hashes[0])
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"io"
 	"io/fs"
 	"os"
+	"path/filepath"
 	"sort"
 	"strings"
 
@@ -28,11 +29,16 @@ const (
 	file             typeVolume = "file"
 )
 
-func hashFiles(files []string) (string, error) {
+// hashFiles returns a hash of the content of files. If root is set, files are read from within root if they exist
+// there, and files that do not exist within root or on the host are not hashed.
+func hashFiles(root string, files []string) (string, error) {
 	h := sha256.New()
 	for _, file := range files {
-		f, err := os.Open(file)
+		f, err := os.Open(rootPath(root, file))
 		if err != nil {
+			if root != "" && errors.Is(err, os.ErrNotExist) {
+				continue
+			}
 			return "", err
 		}
 		_, err = io.Copy(h, f)
@@ -50,7 +56,7 @@ func Pod(spec *Spec) (*v1.Pod, error) {
 		return nil, nil
 	}
 
-	filehash, err := hashFiles(spec.Files)
+	filehash, err := hashFiles(spec.RootDir, spec.Files)
 	if err != nil {
 		return nil, errors.WithMessagef(err, "failed to hash files for pod %s", spec.Command)
 	}
@@ -151,14 +157,22 @@ func Pod(spec *Spec) (*v1.Pod, error) {
 		}
 	}
 
+	if spec.ImageEntrypoint {
+		p.Spec.Containers[0].Command = nil
+	}
+
 	addVolumes(p, spec.Sockets, socket)
 	addVolumes(p, spec.Dirs, dir)
 	addVolumes(p, spec.Files, file)
 
-	addExtraMounts(p, spec.ExtraMounts)
-	addExtraEnv(p, spec.ExtraEnv)
+	addExtraMounts(p, &p.Spec.Containers[0], extraMountPrefix, spec.ExtraMounts)
+	addExtraEnv(p, &p.Spec.Containers[0], spec.ExtraEnv)
+	if err := addSidecars(p, spec.Sidecars); err != nil {
+		return nil, errors.WithMessagef(err, "failed to add sidecars to pod %s", spec.Command)
+	}
 
-	return p, nil
+	// The overlay is applied last, so that it can modify anything set from the other options.
+	return applyOverlay(p, spec.OverlayFile)
 }
 
 func addVolumes(p *v1.Pod, src []string, volume typeVolume) {
@@ -200,87 +214,124 @@ func addVolumes(p *v1.Pod, src []string, volume typeVolume) {
 	}
 }
 
-func addExtraMounts(p *v1.Pod, extraMounts []string) {
+// addExtraMounts adds a volume to the pod for each extra mount, and mounts it in the container.
+// Mounts are validated when the configuration is parsed, so an invalid mount is only logged and skipped.
+func addExtraMounts(p *v1.Pod, c *v1.Container, prefix string, extraMounts []string) {
 	for i, rawMount := range extraMounts {
-		var sourceType v1.HostPathType
-		mount := strings.Split(rawMount, ":")
-		var ro bool
-		switch len(mount) {
-		case 2: // In the case of 2 elements, we expect this to be a traditional source:dest volume mount and should noop.
-		case 3:
-			switch strings.ToLower(mount[2]) {
-			case "ro":
-				ro = true
-			case "rw":
-				ro = false
-			default:
-				logrus.Errorf("Unknown mount option: %s encountered in extra mount %s for pod %s", mount[2], rawMount, p.Name)
-				continue
-			}
-		case 4:
-			sourceType = v1.HostPathType(mount[3])
-		default:
-			logrus.Errorf("Extra mount for pod %s %s was not valid", p.Name, rawMount)
+		mount, err := ParseExtraMount(rawMount)
+		if err != nil {
+			logrus.Errorf("Extra mount for pod %s %s was not valid: %v", p.Name, rawMount, err)
 			continue
 		}
 
-		// If the source type was not specified, try to auto-detect.
-		// Paths that cannot be stat-ed are handled as DirectoryOrCreate.
-		// Only sockets, directories, and files are supported for auto-detection.
-		if sourceType == v1.HostPathUnset {
-			if info, err := os.Stat(mount[0]); err != nil {
-				if !os.IsNotExist(err) {
-					logrus.Warnf("Failed to stat mount for pod %s %s: %v", p.Name, mount[0], err)
-				}
-				sourceType = v1.HostPathDirectoryOrCreate
-			} else {
-				switch {
-				case info.Mode().Type() == fs.ModeSocket:
-					sourceType = v1.HostPathSocket
-				case info.IsDir():
-					sourceType = v1.HostPathDirectory
-				default:
-					sourceType = v1.HostPathFile
+		name := fmt.Sprintf("%s-%d", prefix, i)
+		volume := v1.Volume{Name: name}
+		if mount.Type == mountTypeEmptyDir {
+			volume.EmptyDir = &v1.EmptyDirVolumeSource{
+				Medium:    mount.Medium,
+				SizeLimit: mount.SizeLimit,
+			}
+		} else {
+			sourceType := mount.HostPathType
+			// If the source type was not specified, try to auto-detect.
+			// Paths that cannot be stat-ed are handled as DirectoryOrCreate.
+			// Only sockets, directories, and files are supported for auto-detection.
+			if sourceType == v1.HostPathUnset {
+				if info, err := os.Stat(mount.Source); err != nil {
+					if !os.IsNotExist(err) {
+						logrus.Warnf("Failed to stat mount for pod %s %s: %v", p.Name, mount.Source, err)
+					}
+					sourceType = v1.HostPathDirectoryOrCreate
+				} else {
+					switch {
+					case info.Mode().Type() == fs.ModeSocket:
+						sourceType = v1.HostPathSocket
+					case info.IsDir():
+						sourceType = v1.HostPathDirectory
+					default:
+						sourceType = v1.HostPathFile
+					}
 				}
 			}
+			volume.HostPath = &v1.HostPathVolumeSource{
+				Path: mount.Source,
+				Type: &sourceType,
+			}
 		}
 
-		name := fmt.Sprintf("%s-%d", extraMountPrefix, i)
-		p.Spec.Volumes = append(p.Spec.Volumes, v1.Volume{
-			Name: name,
-			VolumeSource: v1.VolumeSource{
-				HostPath: &v1.HostPathVolumeSource{
-					Path: mount[0],
-					Type: &sourceType,
-				},
-			},
-		})
-		p.Spec.Containers[0].VolumeMounts = append(p.Spec.Containers[0].VolumeMounts, v1.VolumeMount{
-			Name:      name,
-			ReadOnly:  ro,
-			MountPath: mount[1],
+		p.Spec.Volumes = append(p.Spec.Volumes, volume)
+		c.VolumeMounts = append(c.VolumeMounts, v1.VolumeMount{
+			Name:             name,
+			ReadOnly:         mount.ReadOnly,
+			MountPath:        mount.Destination,
+			SubPath:          mount.SubPath,
+			MountPropagation: mount.MountPropagation,
 		})
 	}
 }
 
-func addExtraEnv(p *v1.Pod, extraEnv []string) {
+func addExtraEnv(p *v1.Pod, c *v1.Container, extraEnv []string) {
 	for _, rawEnv := range extraEnv {
 		env := strings.SplitN(rawEnv, "=", 2)
 		if len(env) != 2 {
 			logrus.Errorf("environment variable for pod %s %s was not valid", p.Name, rawEnv)
 			continue
 		}
-		p.Spec.Containers[0].Env = append(p.Spec.Containers[0].Env, v1.EnvVar{
+		c.Env = append(c.Env, v1.EnvVar{
 			Name:  env[0],
 			Value: env[1],
 		})
 	}
 }
 
+// addSidecars adds a container to the pod for each sidecar. Volumes for the sidecar's own mounts are
+// named after the sidecar; shared mounts reuse the volumes mounted in the component container.
+func addSidecars(p *v1.Pod, sidecars []Sidecar) error {
+	for _, sidecar := range sidecars {
+		if sidecar.ref == nil {
+			return fmt.Errorf("image for sidecar %s has not been resolved", sidecar.Name)
+		}
+		p.Spec.Containers = append(p.Spec.Containers, v1.Container{
+			Name:            sidecar.Name,
+			Image:           sidecar.ref.Name(),
+			Command:         sidecar.Command,
+			Args:            sidecar.Args,
+			Resources:       sidecar.Resources,
+			LivenessProbe:   sidecar.LivenessProbe,
+			ReadinessProbe:  sidecar.ReadinessProbe,
+			StartupProbe:    sidecar.StartupProbe,
+			ImagePullPolicy: v1.PullIfNotPresent,
+			SecurityContext: sidecar.SecurityContext,
+		})
+		c := &p.Spec.Containers[len(p.Spec.Containers)-1]
+		for _, path := range sidecar.SharedMounts {
+			mount, ok := findVolumeMount(p.Spec.Containers[0].VolumeMounts, path)
+			if !ok {
+				return fmt.Errorf("sidecar %s shared mount %s is not mounted in container %s", sidecar.Name, path, p.Spec.Containers[0].Name)
+			}
+			c.VolumeMounts = append(c.VolumeMounts, mount)
+		}
+		addExtraMounts(p, c, sidecar.Name+"-mount", sidecar.Mounts)
+		addExtraEnv(p, c, sidecar.Env)
+	}
+	return nil
+}
+
+// findVolumeMount returns the volume mount with the given mount path.
+func findVolumeMount(mounts []v1.VolumeMount, path string) (v1.VolumeMount, bool) {
+	for _, mount := range mounts {
+		if mount.MountPath == path {
+			return mount, true
+		}
+	}
+	return v1.VolumeMount{}, false
+}
+
 // ReadFiles takes in the arguments passed to the static pod and returns a list of all files
 // embedded in those arguments to be included in the pod manifest as volumes.
-// excludeFiles are not included in the returned list.
-func ReadFiles(args, excludeFiles []string) ([]string, error) {
+// excludeFiles are not included in the returned list. If root is set, files that exist
+// within root are included as if they existed on the host.
+func ReadFiles(root string, args, excludeFiles []string) ([]string, error) {
 	files := map[string]bool{}
 	excludes := map[string]bool{}
 
@@ -291,11 +342,11 @@ func ReadFiles(args, excludeFiles []string) ([]string, error) {
 	for _, arg := range args {
 		parts := strings.SplitN(arg, "=", 2)
 		if len(parts) == 2 && strings.HasPrefix(parts[1], string(os.PathSeparator)) {
-			if stat, err := os.Stat(parts[1]); err == nil && !stat.IsDir() && !excludes[parts[1]] {
+			if stat, err := os.Stat(rootPath(root, parts[1])); err == nil && !stat.IsDir() && !excludes[parts[1]] {
 				files[parts[1]] = true
 
 				if parts[0] == "--kubeconfig" {
-					certs, err := kubeconfigFiles(parts[1])
+					certs, err := kubeconfigFiles(rootPath(root, parts[1]))
 					if err != nil {
 						return nil, err
 					}
@@ -315,6 +366,17 @@ func ReadFiles(args, excludeFiles []string) ([]string, error) {
 	return result, nil
 }
 
+// rootPath returns the path to a file within root, if root is set and the file exists there, or the path itself otherwise.
+func rootPath(root, path string) string {
+	if root != "" {
+		p := filepath.Join(root, path)
+		if _, err := os.Stat(p); err == nil {
+			return p
+		}
+	}
+	return path
+}
+
 func kubeconfigFiles(kubeconfig string) ([]string, error) {
 	var result []string
 
@@ -372,9 +434,11 @@ func (s *Spec) startupProbe() *v1.Probe {
 }
 
 // createProbe creates a Probe using the provided configuration.
-// If command is set, an ExecAction Probe is returned.
-// If command is empty but port is set, a HTTPGetAction Probe is returned.
-// If neither is set, no Probe is returned.
+// The kind of probe is selected by the configuration; by default, if command is set, an ExecAction
+// Probe is returned, and if command is empty but port is set, a HTTPGetAction Probe is returned.
+// The port may be overridden by the configuration. TCP and gRPC probes connect to the port.
+// If the selected kind cannot be used because the command or port is not set, the default is used instead.
+// If the kind is none, or neither the command or port is set, no Probe is returned.
 func createProbe(command []string, scheme, host, path string, port int32, conf ProbeConf) *v1.Probe {
 	probe := &v1.Probe{
 		InitialDelaySeconds: conf.InitialDelaySeconds,
@@ -382,15 +446,34 @@ func createProbe(command []string, scheme, host, path string, port int32, conf P
 		FailureThreshold:    conf.FailureThreshold,
 		PeriodSeconds:       conf.PeriodSeconds,
 	}
-	if len(command) != 0 {
+	if conf.Port != 0 {
+		port = conf.Port
+	}
+
+	kind := conf.Kind
+	if (kind == ProbeKindExec && len(command) == 0) || (kind != ProbeKindExec && kind != ProbeKindNone && kind != ProbeKindDefault && port == 0) {
+		logrus.Warnf("Cannot use %s probe without a command or port; using the default probe", kind)
+		kind = ProbeKindDefault
+	}
+	if kind == ProbeKindDefault {
+		if len(command) != 0 {
+			kind = ProbeKindExec
+		} else if port != 0 {
+			kind = ProbeKindHTTP
+		} else {
+			return nil
+		}
+	}
+
+	switch kind {
+	case ProbeKindExec:
 		probe.Exec = &v1.ExecAction{
 			Command: command,
 		}
 		if probe.PeriodSeconds < 5 {
 			probe.PeriodSeconds = 5
 		}
-		return probe
-	} else if port != 0 {
+	case ProbeKindHTTP:
 		probe.HTTPGet = &v1.HTTPGetAction{
 			Path:   path,
 			Host:   host,
@@ -405,7 +488,19 @@ func createProbe(command []string, scheme, host, path string, port int32, conf P
 		if probe.HTTPGet.Path == "" {
 			probe.HTTPGet.Path = "/livez"
 		}
-		return probe
+	case ProbeKindTCP:
+		probe.TCPSocket = &v1.TCPSocketAction{
+			Host: host,
+			Port: intstr.IntOrString{
+				IntVal: port,
+			},
+		}
+	case ProbeKindGRPC:
+		probe.GRPC = &v1.GRPCAction{
+			Port: port,
+		}
+	default:
+		return nil
 	}
-	return nil
+	return probe
 }
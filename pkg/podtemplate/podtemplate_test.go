@@ -0,0 +1,212 @@
+package podtemplate
+
+import (
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+func Test_UnitAddSidecars(t *testing.T) {
+	ref, err := name.ParseReference("docker.elastic.co/beats/filebeat:8.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sidecar := func(s Sidecar) Sidecar {
+		s.SetRef(ref)
+		return s
+	}
+	pod := func() *v1.Pod {
+		return &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: KubeAPIServer},
+			Spec: v1.PodSpec{
+				Containers: []v1.Container{{
+					Name: KubeAPIServer,
+					VolumeMounts: []v1.VolumeMount{
+						{Name: "dir0", MountPath: "/var/lib/rancher/rke2/server/logs"},
+						{Name: "file0", MountPath: "/etc/rancher/rke2/audit-policy.yaml", ReadOnly: true},
+					},
+				}},
+				Volumes: []v1.Volume{{Name: "dir0"}, {Name: "file0"}},
+			},
+		}
+	}
+
+	t.Run("sidecars", func(t *testing.T) {
+		p := pod()
+		err := addSidecars(p, []Sidecar{
+			sidecar(Sidecar{
+				Name:         "log-shipper",
+				Args:         []string{"-e"},
+				Env:          []string{"LOG_LEVEL=debug"},
+				Mounts:       []string{"/etc/filebeat:/etc/filebeat:ro", "type=emptyDir,dst=/tmp"},
+				SharedMounts: []string{"/var/lib/rancher/rke2/server/logs", "/etc/rancher/rke2/audit-policy.yaml"},
+			}),
+			sidecar(Sidecar{Name: "proxy", Mounts: []string{"/etc/proxy:/etc/proxy"}}),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(p.Spec.Containers) != 3 {
+			t.Fatalf("expected 3 containers, got %d", len(p.Spec.Containers))
+		}
+
+		c := p.Spec.Containers[1]
+		if c.Name != "log-shipper" || c.Image != ref.Name() || c.ImagePullPolicy != v1.PullIfNotPresent {
+			t.Errorf("unexpected sidecar container %s image %s pull policy %s", c.Name, c.Image, c.ImagePullPolicy)
+		}
+		if len(c.Env) != 1 || c.Env[0].Name != "LOG_LEVEL" || c.Env[0].Value != "debug" {
+			t.Errorf("unexpected sidecar env %v", c.Env)
+		}
+		// Shared mounts reuse the component's volumes, and the sidecar's own mounts get volumes named after it
+		wantMounts := []v1.VolumeMount{
+			{Name: "dir0", MountPath: "/var/lib/rancher/rke2/server/logs"},
+			{Name: "file0", MountPath: "/etc/rancher/rke2/audit-policy.yaml", ReadOnly: true},
+			{Name: "log-shipper-mount-0", MountPath: "/etc/filebeat", ReadOnly: true},
+			{Name: "log-shipper-mount-1", MountPath: "/tmp"},
+		}
+		if len(c.VolumeMounts) != len(wantMounts) {
+			t.Fatalf("expected %d sidecar mounts, got %v", len(wantMounts), c.VolumeMounts)
+		}
+		for i, want := range wantMounts {
+			got := c.VolumeMounts[i]
+			if got.Name != want.Name || got.MountPath != want.MountPath || got.ReadOnly != want.ReadOnly {
+				t.Errorf("expected mount %d to be %+v, got %+v", i, want, got)
+			}
+		}
+
+		wantVolumes := []string{"dir0", "file0", "log-shipper-mount-0", "log-shipper-mount-1", "proxy-mount-0"}
+		if len(p.Spec.Volumes) != len(wantVolumes) {
+			t.Fatalf("expected volumes %v, got %v", wantVolumes, p.Spec.Volumes)
+		}
+		for i, want := range wantVolumes {
+			if p.Spec.Volumes[i].Name != want {
+				t.Errorf("expected volume %d to be %s, got %s", i, want, p.Spec.Volumes[i].Name)
+			}
+		}
+		if p.Spec.Volumes[3].EmptyDir == nil {
+			t.Errorf("expected emptyDir volume for %s", p.Spec.Volumes[3].Name)
+		}
+		if len(p.Spec.Containers[0].VolumeMounts) != 2 {
+			t.Errorf("expected component mounts to be unchanged, got %v", p.Spec.Containers[0].VolumeMounts)
+		}
+	})
+
+	t.Run("shared mount not mounted in component", func(t *testing.T) {
+		err := addSidecars(pod(), []Sidecar{sidecar(Sidecar{Name: "log-shipper", SharedMounts: []string{"/var/log"}})})
+		if err == nil {
+			t.Error("expected error for shared mount that is not mounted in the component container")
+		}
+	})
+
+	t.Run("unresolved image", func(t *testing.T) {
+		err := addSidecars(pod(), []Sidecar{{Name: "log-shipper", Image: "busybox"}})
+		if err == nil {
+			t.Error("expected error for sidecar image that has not been resolved")
+		}
+	})
+}
+
+func Test_UnitCreateProbe(t *testing.T) {
+	command := []string{"kubectl", "get", "--raw=/livez"}
+	conf := ProbeConf{InitialDelaySeconds: 10, TimeoutSeconds: 15, FailureThreshold: 8, PeriodSeconds: 1}
+	withKind := func(kind ProbeKind, port int32) ProbeConf {
+		c := conf
+		c.Kind = kind
+		c.Port = port
+		return c
+	}
+	port := func(p int32) intstr.IntOrString { return intstr.IntOrString{IntVal: p} }
+
+	tests := []struct {
+		name    string
+		command []string
+		scheme  string
+		path    string
+		port    int32
+		conf    ProbeConf
+		want    *v1.Probe
+	}{
+		{
+			name:    "default exec",
+			command: command,
+			port:    6443,
+			conf:    conf,
+			want:    &v1.Probe{ProbeHandler: v1.ProbeHandler{Exec: &v1.ExecAction{Command: command}}, PeriodSeconds: 5},
+		},
+		{
+			name: "default http",
+			port: 10257,
+			conf: conf,
+			want: &v1.Probe{ProbeHandler: v1.ProbeHandler{HTTPGet: &v1.HTTPGetAction{Path: "/livez", Host: "localhost", Scheme: v1.URISchemeHTTPS, Port: port(10257)}}, PeriodSeconds: 1},
+		},
+		{
+			name:   "http with scheme and path",
+			scheme: "HTTP",
+			path:   "/health?serializable=true",
+			port:   2381,
+			conf:   conf,
+			want:   &v1.Probe{ProbeHandler: v1.ProbeHandler{HTTPGet: &v1.HTTPGetAction{Path: "/health?serializable=true", Host: "localhost", Scheme: v1.URISchemeHTTP, Port: port(2381)}}, PeriodSeconds: 1},
+		},
+		{
+			name:    "http kind with command",
+			command: command,
+			path:    "/readyz",
+			port:    6443,
+			conf:    withKind(ProbeKindHTTP, 0),
+			want:    &v1.Probe{ProbeHandler: v1.ProbeHandler{HTTPGet: &v1.HTTPGetAction{Path: "/readyz", Host: "localhost", Scheme: v1.URISchemeHTTPS, Port: port(6443)}}, PeriodSeconds: 1},
+		},
+		{
+			name:    "tcp kind with port override",
+			command: command,
+			port:    6443,
+			conf:    withKind(ProbeKindTCP, 16443),
+			want:    &v1.Probe{ProbeHandler: v1.ProbeHandler{TCPSocket: &v1.TCPSocketAction{Host: "localhost", Port: port(16443)}}, PeriodSeconds: 1},
+		},
+		{
+			name: "grpc kind",
+			port: 2379,
+			conf: withKind(ProbeKindGRPC, 0),
+			want: &v1.Probe{ProbeHandler: v1.ProbeHandler{GRPC: &v1.GRPCAction{Port: 2379}}, PeriodSeconds: 1},
+		},
+		{
+			name: "exec kind without command uses default",
+			port: 10259,
+			conf: withKind(ProbeKindExec, 0),
+			want: &v1.Probe{ProbeHandler: v1.ProbeHandler{HTTPGet: &v1.HTTPGetAction{Path: "/livez", Host: "localhost", Scheme: v1.URISchemeHTTPS, Port: port(10259)}}, PeriodSeconds: 1},
+		},
+		{
+			name:    "tcp kind without port uses default",
+			command: command,
+			conf:    withKind(ProbeKindTCP, 0),
+			want:    &v1.Probe{ProbeHandler: v1.ProbeHandler{Exec: &v1.ExecAction{Command: command}}, PeriodSeconds: 5},
+		},
+		{
+			name:    "none kind",
+			command: command,
+			port:    6443,
+			conf:    withKind(ProbeKindNone, 0),
+		},
+		{
+			name: "no command or port",
+			conf: conf,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.want != nil {
+				tt.want.InitialDelaySeconds = conf.InitialDelaySeconds
+				tt.want.TimeoutSeconds = conf.TimeoutSeconds
+				tt.want.FailureThreshold = conf.FailureThreshold
+			}
+			got := createProbe(tt.command, tt.scheme, "localhost", tt.path, tt.port, tt.conf)
+			if !equality.Semantic.DeepEqual(got, tt.want) {
+				t.Errorf("expected probe %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
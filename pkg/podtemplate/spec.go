@@ -2,18 +2,28 @@ package podtemplate
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 
 	"github.com/google/go-containerregistry/pkg/name"
 	"github.com/k3s-io/k3s/pkg/cli/cmds"
+	"github.com/k3s-io/k3s/pkg/util/errors"
 	"github.com/rancher/rke2/pkg/images"
 	v1 "k8s.io/api/core/v1"
 )
 
 func (c *Config) APIServer(args []string) (*Spec, error) {
+	if err := checkAPIServerProbes(args, c.Probes.KubeAPIServer); err != nil {
+		return nil, err
+	}
 	image, err := c.resolveAndPull(images.KubeAPIServer)
 	if err != nil {
 		return nil, err
 	}
+	sidecars, err := c.resolveSidecars(KubeAPIServer)
+	if err != nil {
+		return nil, err
+	}
 
 	server := fmt.Sprintf("https://localhost:%d/", cmds.ServerConfig.APIServerPort)
 
@@ -28,6 +38,20 @@ func (c *Config) APIServer(args []string) (*Spec, error) {
 		ExtraEnv:      c.Env.KubeAPIServer,
 		ExtraMounts:   c.Mounts.KubeAPIServer,
 		ProbeConfs:    c.Probes.KubeAPIServer,
+		OverlayFile:   c.overlayFile(KubeAPIServer),
+		Sidecars:      sidecars,
+		// The exec probes are used by default; the health endpoints are used if the probe kind is set
+		// to http, which avoids running kubectl but requires anonymous access to the health endpoints,
+		// so it cannot be used when anonymous auth is disabled.
+		StartupPort:   int32(cmds.ServerConfig.APIServerPort),
+		StartupScheme: "HTTPS",
+		StartupPath:   "/livez",
+		HealthPort:    int32(cmds.ServerConfig.APIServerPort),
+		HealthScheme:  "HTTPS",
+		HealthPath:    "/livez",
+		ReadyPort:     int32(cmds.ServerConfig.APIServerPort),
+		ReadyScheme:   "HTTPS",
+		ReadyPath:     "/readyz",
 		StartupExec: []string{
 			"kubectl",
 			"get",
@@ -61,11 +85,39 @@ func (c *Config) APIServer(args []string) (*Spec, error) {
 	}, nil
 }
 
+// checkAPIServerProbes returns an error if http probes are configured for the apiserver, but anonymous
+// auth is disabled, as is done by the CIS profile. The kubelet does not authenticate http probes, so
+// they would fail, and the apiserver would be restarted continuously.
+func checkAPIServerProbes(args []string, probes ProbeConfs) error {
+	anonymousAuth := true
+	for _, arg := range args {
+		if name, val, ok := strings.Cut(arg, "="); ok && name == "--anonymous-auth" {
+			anonymousAuth, _ = strconv.ParseBool(val)
+		}
+	}
+	if anonymousAuth {
+		return nil
+	}
+	for _, probe := range []struct {
+		name string
+		conf ProbeConf
+	}{{Liveness, probes.Liveness}, {Readiness, probes.Readiness}, {Startup, probes.Startup}} {
+		if probe.conf.Kind == ProbeKindHTTP {
+			return fmt.Errorf("cannot use %s probe kind for %s-%s with --anonymous-auth=false, as the health endpoints require anonymous access; use the %s probe kind instead", ProbeKindHTTP, KubeAPIServer, probe.name, ProbeKindExec)
+		}
+	}
+	return nil
+}
+
 func (c *Config) ETCD(args []string) (*Spec, error) {
 	image, err := c.resolveAndPull(images.ETCD)
 	if err != nil {
 		return nil, err
 	}
+	sidecars, err := c.resolveSidecars(Etcd)
+	if err != nil {
+		return nil, err
+	}
 
 	return &Spec{
 		Command:       "etcd",
@@ -84,6 +136,8 @@ func (c *Config) ETCD(args []string) (*Spec, error) {
 		ExtraEnv:      c.Env.Etcd,
 		ExtraMounts:   c.Mounts.Etcd,
 		ProbeConfs:    c.Probes.Etcd,
+		OverlayFile:   c.overlayFile(Etcd),
+		Sidecars:      sidecars,
 		Ports: []v1.ContainerPort{
 			{Name: "client", Protocol: v1.ProtocolTCP, ContainerPort: 2379},
 			{Name: "peer", Protocol: v1.ProtocolTCP, ContainerPort: 2380},
@@ -97,6 +151,10 @@ func (c *Config) Scheduler(args []string) (*Spec, error) {
 	if err != nil {
 		return nil, err
 	}
+	sidecars, err := c.resolveSidecars(KubeScheduler)
+	if err != nil {
+		return nil, err
+	}
 
 	return &Spec{
 		Command:       "kube-scheduler",
@@ -116,6 +174,8 @@ func (c *Config) Scheduler(args []string) (*Spec, error) {
 		ExtraEnv:      c.Env.KubeScheduler,
 		ExtraMounts:   c.Mounts.KubeScheduler,
 		ProbeConfs:    c.Probes.KubeScheduler,
+		OverlayFile:   c.overlayFile(KubeScheduler),
+		Sidecars:      sidecars,
 		Ports: []v1.ContainerPort{
 			{Name: "metrics", Protocol: v1.ProtocolTCP, ContainerPort: 10259},
 		},
@@ -127,6 +187,10 @@ func (c *Config) ControllerManager(args []string) (*Spec, error) {
 	if err != nil {
 		return nil, err
 	}
+	sidecars, err := c.resolveSidecars(KubeControllerManager)
+	if err != nil {
+		return nil, err
+	}
 
 	return &Spec{
 		Command:       "kube-controller-manager",
@@ -145,6 +209,8 @@ func (c *Config) ControllerManager(args []string) (*Spec, error) {
 		ExtraEnv:      c.Env.KubeControllerManager,
 		ExtraMounts:   c.Mounts.KubeControllerManager,
 		ProbeConfs:    c.Probes.KubeControllerManager,
+		OverlayFile:   c.overlayFile(KubeControllerManager),
+		Sidecars:      sidecars,
 		Ports: []v1.ContainerPort{
 			{Name: "metrics", Protocol: v1.ProtocolTCP, ContainerPort: 10257},
 		},
@@ -156,6 +222,10 @@ func (c *Config) CloudControllerManager(args []string) (*Spec, error) {
 	if err != nil {
 		return nil, err
 	}
+	sidecars, err := c.resolveSidecars(CloudControllerManager)
+	if err != nil {
+		return nil, err
+	}
 
 	return &Spec{
 		Command:       "cloud-controller-manager",
@@ -174,6 +244,8 @@ func (c *Config) CloudControllerManager(args []string) (*Spec, error) {
 		ExtraEnv:      c.Env.CloudControllerManager,
 		ExtraMounts:   c.Mounts.CloudControllerManager,
 		ProbeConfs:    c.Probes.CloudControllerManager,
+		OverlayFile:   c.overlayFile(CloudControllerManager),
+		Sidecars:      sidecars,
 		Ports: []v1.ContainerPort{
 			{Name: "metrics", Protocol: v1.ProtocolTCP, ContainerPort: 10258},
 		},
@@ -185,6 +257,10 @@ func (c *Config) KubeProxy(args []string) (*Spec, error) {
 	if err != nil {
 		return nil, err
 	}
+	sidecars, err := c.resolveSidecars(KubeProxy)
+	if err != nil {
+		return nil, err
+	}
 
 	return &Spec{
 		Command:       "kube-proxy",
@@ -199,6 +275,8 @@ func (c *Config) KubeProxy(args []string) (*Spec, error) {
 		ExtraEnv:      c.Env.KubeProxy,
 		ExtraMounts:   c.Mounts.KubeProxy,
 		ProbeConfs:    c.Probes.KubeProxy,
+		OverlayFile:   c.overlayFile(KubeProxy),
+		Sidecars:      sidecars,
 		Privileged:    true,
 		Ports: []v1.ContainerPort{
 			{Name: "metrics", Protocol: v1.ProtocolTCP, ContainerPort: 10256},
@@ -211,6 +289,58 @@ func (c *Config) resolveAndPull(imageName string) (name.Reference, error) {
 	if err != nil {
 		return image, err
 	}
+	if c.ImagesDir != "" {
+		// Airgap image archives can only be searched by tag, so also check for the unlocked reference
+		unlocked, err := c.Resolver.GetUnlockedReference(imageName)
+		if err != nil {
+			return image, err
+		}
+		if err := images.Pull(c.ImagesDir, imageName, image, unlocked); err != nil {
+			return image, err
+		}
+	}
+	return image, nil
+}
+
+// KMSPlugin returns the spec for the KMS plugin static pod.
+func (c *Config) KMSPlugin() (*Spec, error) {
+	image, err := c.parseAndPull(KMSPlugin+"-image", c.KMS.Image)
+	if err != nil {
+		return nil, err
+	}
+	sidecars, err := c.resolveSidecars(KMSPlugin)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Spec{
+		Command:         KMSPlugin,
+		Args:            c.KMS.Args,
+		Image:           image,
+		ImageEntrypoint: true,
+		OverlayFile:     c.overlayFile(KMSPlugin),
+		Sidecars:        sidecars,
+	}, nil
+}
+
+// parseAndPull resolves an image that is not managed by the resolver, and adds it to the pull list
+// if it is not in the airgap image archives, in the same way as the component images. Only images
+// that do not name a registry are moved to the system default registry.
+func (c *Config) parseAndPull(imageName, s string) (name.Reference, error) {
+	var image name.Reference
+	var err error
+	if hasRegistry(s) {
+		image, err = name.ParseReference(s, name.WeakValidation)
+	} else {
+		image, _, err = c.Resolver.ParseReference(s)
+	}
+	if err != nil {
+		return image, err
+	}
+	image, err = c.Resolver.RewriteReference(image)
+	if err != nil {
+		return image, err
+	}
 	if c.ImagesDir != "" {
 		if err := images.Pull(c.ImagesDir, imageName, image); err != nil {
 			return image, err
@@ -218,3 +348,29 @@ func (c *Config) resolveAndPull(imageName string) (name.Reference, error) {
 	}
 	return image, nil
 }
+
+// hasRegistry returns true if an image name starts with a registry host, which is the case
+// if the first component of the name contains a . or :, as when the name is parsed.
+func hasRegistry(s string) bool {
+	host, _, ok := strings.Cut(s, "/")
+	return ok && strings.ContainsAny(host, ".:")
+}
+
+// resolveSidecars returns the sidecars for a component, with their images resolved.
+func (c *Config) resolveSidecars(component string) ([]Sidecar, error) {
+	var sidecars []Sidecar
+	for _, sidecar := range c.Sidecars[component] {
+		ref, err := c.parseAndPull(SidecarImageName(component, sidecar.Name), sidecar.Image)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "failed to resolve image for %s sidecar %s", component, sidecar.Name)
+		}
+		sidecar.ref = ref
+		sidecars = append(sidecars, sidecar)
+	}
+	return sidecars, nil
+}
+
+// SidecarImageName returns the name used for a sidecar image in the pull list and image signature verification.
+func SidecarImageName(component, sidecar string) string {
+	return component + "-" + sidecar + "-sidecar-image"
+}
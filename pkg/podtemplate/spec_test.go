@@ -0,0 +1,104 @@
+package podtemplate
+
+import (
+	"testing"
+
+	"github.com/rancher/rke2/pkg/images"
+)
+
+func Test_UnitResolveSidecars(t *testing.T) {
+	resolver, err := images.NewResolver(images.ImageOverrideConfig{
+		IgnoreLockFile:        true,
+		SystemDefaultRegistry: "registry.example.com",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		image string
+		want  string
+	}{
+		{image: "busybox", want: "registry.example.com/busybox:latest"},
+		{image: "rancher/log-shipper:v1", want: "registry.example.com/rancher/log-shipper:v1"},
+		{image: "docker.elastic.co/beats/filebeat:8.0.0", want: "docker.elastic.co/beats/filebeat:8.0.0"},
+		{image: "docker.io/rancher/log-shipper:v1", want: "index.docker.io/rancher/log-shipper:v1"},
+		{image: "mirror:5000/log-shipper:v1", want: "mirror:5000/log-shipper:v1"},
+		{image: "localhost:5000/log-shipper:v1", want: "localhost:5000/log-shipper:v1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			c := &Config{
+				Resolver: resolver,
+				Sidecars: map[string][]Sidecar{KubeAPIServer: {{Name: "sidecar", Image: tt.image}}},
+			}
+			sidecars, err := c.resolveSidecars(KubeAPIServer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(sidecars) != 1 {
+				t.Fatalf("expected 1 sidecar, got %d", len(sidecars))
+			}
+			if got := sidecars[0].Ref().Name(); got != tt.want {
+				t.Errorf("expected image %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func Test_UnitCheckAPIServerProbes(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		probes  ProbeConfs
+		wantErr bool
+	}{
+		{
+			name:   "default probes without anonymous auth",
+			args:   []string{"--anonymous-auth=false"},
+			probes: ProbeConfs{},
+		},
+		{
+			name:   "http probes with anonymous auth",
+			args:   []string{"--allow-privileged=true"},
+			probes: ProbeConfs{Liveness: ProbeConf{Kind: ProbeKindHTTP}, Readiness: ProbeConf{Kind: ProbeKindHTTP}},
+		},
+		{
+			name:   "tcp probes without anonymous auth",
+			args:   []string{"--anonymous-auth=false"},
+			probes: ProbeConfs{Liveness: ProbeConf{Kind: ProbeKindTCP}, Readiness: ProbeConf{Kind: ProbeKindExec}},
+		},
+		{
+			name:    "http liveness probe without anonymous auth",
+			args:    []string{"--anonymous-auth=false"},
+			probes:  ProbeConfs{Liveness: ProbeConf{Kind: ProbeKindHTTP}},
+			wantErr: true,
+		},
+		{
+			name:    "http readiness probe without anonymous auth",
+			args:    []string{"--anonymous-auth=true", "--anonymous-auth=false"},
+			probes:  ProbeConfs{Readiness: ProbeConf{Kind: ProbeKindHTTP}},
+			wantErr: true,
+		},
+		{
+			name:    "http startup probe without anonymous auth",
+			args:    []string{"--anonymous-auth=0"},
+			probes:  ProbeConfs{Startup: ProbeConf{Kind: ProbeKindHTTP}},
+			wantErr: true,
+		},
+		{
+			name:   "anonymous auth enabled by last arg",
+			args:   []string{"--anonymous-auth=false", "--anonymous-auth=true"},
+			probes: ProbeConfs{Readiness: ProbeConf{Kind: ProbeKindHTTP}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkAPIServerProbes(tt.args, tt.probes); (err != nil) != tt.wantErr {
+				t.Errorf("checkAPIServerProbes() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
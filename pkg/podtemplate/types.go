@@ -2,6 +2,7 @@ package podtemplate
 
 import (
 	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/k3s-io/k3s/pkg/version"
 	"github.com/rancher/rke2/pkg/images"
 	v1 "k8s.io/api/core/v1"
 )
@@ -13,6 +14,7 @@ const (
 	KubeProxy              = "kube-proxy"
 	Etcd                   = "etcd"
 	CloudControllerManager = "cloud-controller-manager"
+	KMSPlugin              = "kms-plugin"
 
 	CPURequest    = "cpu-request"
 	CPULimit      = "cpu-limit"
@@ -27,6 +29,21 @@ const (
 	TimeoutSeconds      = "timeout-seconds"
 	FailureThreshold    = "failure-threshold"
 	PeriodSeconds       = "period-seconds"
+	Kind                = "kind"
+	Port                = "port"
+)
+
+// ProbeKind selects the kind of probe used for a component. The default kind uses the
+// component's exec command if it has one, or an HTTP GET request to its health port otherwise.
+type ProbeKind string
+
+const (
+	ProbeKindDefault ProbeKind = ""
+	ProbeKindExec    ProbeKind = "exec"
+	ProbeKindHTTP    ProbeKind = "http"
+	ProbeKindTCP     ProbeKind = "tcp"
+	ProbeKindGRPC    ProbeKind = "grpc"
+	ProbeKindNone    ProbeKind = "none"
 )
 
 var (
@@ -38,16 +55,20 @@ var (
 		"/usr/share/ca-certificates",
 	}
 	DefaultAuditPolicyFile = "/etc/rancher/rke2/audit-policy.yaml"
+	DefaultPodOverlayDir   = "/etc/rancher/" + version.Program + "/pod-overlays"
 )
 
 type Config struct {
-	ImagesDir string
-	DataDir   string
-	Resolver  *images.Resolver
-	Env       *ControlPlaneEnv
-	Mounts    *ControlPlaneMounts
-	Probes    *ControlPlaneProbeConfs
-	Resources *ControlPlaneResources
+	ImagesDir  string
+	DataDir    string
+	OverlayDir string
+	Resolver   *images.Resolver
+	Env        *ControlPlaneEnv
+	Mounts     *ControlPlaneMounts
+	Probes     *ControlPlaneProbeConfs
+	Resources  *ControlPlaneResources
+	Sidecars   map[string][]Sidecar
+	KMS        *KMSPluginConfig
 }
 
 type Spec struct {
@@ -58,6 +79,7 @@ type Spec struct {
 	Files           []string
 	Sockets         []string
 	ExcludeFiles    []string
+	RootDir         string
 	StartupExec     []string
 	StartupPort     int32
 	StartupScheme   string
@@ -76,12 +98,15 @@ type Spec struct {
 	MemoryLimit     string
 	ExtraMounts     []string
 	ExtraEnv        []string
+	OverlayFile     string
+	Sidecars        []Sidecar
 	ProbeConfs      ProbeConfs
 	SecurityContext *v1.PodSecurityContext
 	Ports           []v1.ContainerPort
 	Annotations     map[string]string
 	Privileged      bool
 	HostNetwork     bool
+	ImageEntrypoint bool
 }
 
 type ControlPlaneResources struct {
@@ -143,6 +168,8 @@ type ProbeConf struct {
 	TimeoutSeconds      int32
 	FailureThreshold    int32
 	PeriodSeconds       int32
+	Kind                ProbeKind
+	Port                int32
 }
 
 type ProbeConfs struct {
@@ -150,3 +177,43 @@ type ProbeConfs struct {
 	Readiness ProbeConf
 	Startup   ProbeConf
 }
+
+// Sidecar is an additional container run alongside the component in a control-plane static pod.
+// Images that do not name a registry are pulled from the system default registry, and rewrite rules
+// are applied in the same way as for the component images.
+// Mounts use the same syntax as the component extra mounts. SharedMounts are the paths at which
+// volumes are mounted in the component container, which are mounted at the same path in the sidecar.
+type Sidecar struct {
+	Name            string                  `json:"name"`
+	Image           string                  `json:"image"`
+	Command         []string                `json:"command,omitempty"`
+	Args            []string                `json:"args,omitempty"`
+	Env             []string                `json:"env,omitempty"`
+	Mounts          []string                `json:"mounts,omitempty"`
+	SharedMounts    []string                `json:"sharedMounts,omitempty"`
+	Resources       v1.ResourceRequirements `json:"resources,omitempty"`
+	LivenessProbe   *v1.Probe               `json:"livenessProbe,omitempty"`
+	ReadinessProbe  *v1.Probe               `json:"readinessProbe,omitempty"`
+	StartupProbe    *v1.Probe               `json:"startupProbe,omitempty"`
+	SecurityContext *v1.SecurityContext     `json:"securityContext,omitempty"`
+
+	ref name.Reference
+}
+
+// Ref returns the resolved reference to the sidecar image.
+func (s Sidecar) Ref() name.Reference {
+	return s.ref
+}
+
+// SetRef replaces the resolved reference to the sidecar image, such as with one pinned to a verified digest.
+func (s *Sidecar) SetRef(ref name.Reference) {
+	s.ref = ref
+}
+
+// KMSPluginConfig configures a KMS v2 encryption provider plugin, run as a static pod on servers.
+// The plugin is run using the image entrypoint, and must listen on Socket.
+type KMSPluginConfig struct {
+	Image  string
+	Args   []string
+	Socket string
+}
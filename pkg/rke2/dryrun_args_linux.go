@@ -0,0 +1,305 @@
+//go:build linux
+// +build linux
+
+package rke2
+
+import (
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	daemonconfig "github.com/k3s-io/k3s/pkg/daemons/config"
+	"github.com/k3s-io/k3s/pkg/daemons/executor"
+	"github.com/k3s-io/k3s/pkg/util"
+	"github.com/k3s-io/k3s/pkg/version"
+)
+
+// k3sConfig is the configuration that K3s generates the arguments of the components that it starts through the
+// executor from. When rendering a dry run, it is read from the command line and the node in the same way as K3s
+// does at startup, so that the executor renders the same manifests as it would when started by K3s.
+type k3sConfig struct {
+	dataDir              string
+	nodeName             string
+	nodeIP               net.IP
+	advertiseIP          string
+	advertisePort        int
+	clusterCIDRs         []*net.IPNet
+	serviceCIDRs         []*net.IPNet
+	clusterDomain        string
+	serviceNodePortRange string
+	apiServerPort        int
+	apiServerBindAddress string
+	egressSelectorMode   string
+	datastoreEndpoint    string
+	datastoreCAFile      string
+	datastoreCertFile    string
+	datastoreKeyFile     string
+	kine                 bool
+	managedETCD          bool
+	etcdName             string
+	etcdInitialOptions   executor.InitialOptions
+	etcdExposeMetrics    bool
+	disableCCM           bool
+	disableServiceLB     bool
+}
+
+// serverPath returns the path of a file in the server data directory.
+func (c *k3sConfig) serverPath(elem ...string) string {
+	return filepath.Join(append([]string{c.dataDir, "server"}, elem...)...)
+}
+
+// agentPath returns the path of a file in the agent data directory.
+func (c *k3sConfig) agentPath(elem ...string) string {
+	return filepath.Join(append([]string{c.dataDir, "agent"}, elem...)...)
+}
+
+// loopback returns the loopback address for the IP family of the cluster, bracketed if urlSafe is set and it is IPv6.
+func (c *k3sConfig) loopback(urlSafe bool) string {
+	if len(c.serviceCIDRs) > 0 && c.serviceCIDRs[0].IP.To4() == nil {
+		if urlSafe {
+			return "[::1]"
+		}
+		return "::1"
+	}
+	return "127.0.0.1"
+}
+
+// storageArgs sets the storage backend arguments of the apiserver.
+func (c *k3sConfig) storageArgs(argsMap map[string]string) {
+	argsMap["storage-backend"] = "etcd3"
+	switch {
+	case c.managedETCD:
+		argsMap["etcd-servers"] = "https://" + c.loopback(true) + ":2379"
+		argsMap["etcd-cafile"] = c.serverPath("tls", "etcd", "server-ca.crt")
+		argsMap["etcd-certfile"] = c.serverPath("tls", "etcd", "client.crt")
+		argsMap["etcd-keyfile"] = c.serverPath("tls", "etcd", "client.key")
+	case c.kine:
+		argsMap["etcd-servers"] = "unixs://" + c.serverPath("kine.sock")
+		argsMap["etcd-cafile"] = c.serverPath("tls", "etcd", "server-ca.crt")
+		argsMap["etcd-certfile"] = c.serverPath("tls", "etcd", "client.crt")
+		argsMap["etcd-keyfile"] = c.serverPath("tls", "etcd", "client.key")
+	default:
+		argsMap["etcd-servers"] = c.datastoreEndpoint
+		if c.datastoreCAFile != "" {
+			argsMap["etcd-cafile"] = c.datastoreCAFile
+		}
+		if c.datastoreCertFile != "" {
+			argsMap["etcd-certfile"] = c.datastoreCertFile
+		}
+		if c.datastoreKeyFile != "" {
+			argsMap["etcd-keyfile"] = c.datastoreKeyFile
+		}
+	}
+}
+
+// apiServerArgs returns the arguments that K3s starts the apiserver with.
+func (c *k3sConfig) apiServerArgs(extraArgs []string) []string {
+	argsMap := map[string]string{}
+	c.storageArgs(argsMap)
+
+	argsMap["cert-dir"] = c.serverPath("tls", "temporary-certs")
+	argsMap["allow-privileged"] = "true"
+	argsMap["enable-bootstrap-token-auth"] = "true"
+	argsMap["authorization-mode"] = "Node,RBAC"
+	argsMap["service-account-signing-key-file"] = c.serverPath("tls", "service.current.key")
+	argsMap["service-cluster-ip-range"] = util.JoinIPNets(c.serviceCIDRs)
+	argsMap["service-node-port-range"] = c.serviceNodePortRange
+	argsMap["advertise-port"] = strconv.Itoa(c.advertisePort)
+	if c.advertiseIP != "" {
+		argsMap["advertise-address"] = c.advertiseIP
+	}
+	argsMap["secure-port"] = strconv.Itoa(c.apiServerPort)
+	if c.apiServerBindAddress == "" {
+		argsMap["bind-address"] = c.loopback(false)
+	} else {
+		argsMap["bind-address"] = c.apiServerBindAddress
+	}
+	argsMap["tls-cert-file"] = c.serverPath("tls", "serving-kube-apiserver.crt")
+	argsMap["tls-private-key-file"] = c.serverPath("tls", "serving-kube-apiserver.key")
+	argsMap["service-account-key-file"] = c.serverPath("tls", "service.key")
+	argsMap["service-account-issuer"] = "https://kubernetes.default.svc." + c.clusterDomain
+	argsMap["api-audiences"] = "https://kubernetes.default.svc." + c.clusterDomain + "," + version.Program
+	argsMap["kubelet-certificate-authority"] = c.serverPath("tls", "server-ca.crt")
+	argsMap["kubelet-client-certificate"] = c.serverPath("tls", "client-kube-apiserver.crt")
+	argsMap["kubelet-client-key"] = c.serverPath("tls", "client-kube-apiserver.key")
+	argsMap["requestheader-client-ca-file"] = c.serverPath("tls", "request-header-ca.crt")
+	argsMap["requestheader-allowed-names"] = "system:auth-proxy"
+	argsMap["proxy-client-cert-file"] = c.serverPath("tls", "client-auth-proxy.crt")
+	argsMap["proxy-client-key-file"] = c.serverPath("tls", "client-auth-proxy.key")
+	argsMap["requestheader-extra-headers-prefix"] = "X-Remote-Extra-"
+	argsMap["requestheader-group-headers"] = "X-Remote-Group"
+	argsMap["requestheader-username-headers"] = "X-Remote-User"
+	argsMap["client-ca-file"] = c.serverPath("tls", "client-ca.crt")
+	argsMap["enable-admission-plugins"] = "NodeRestriction"
+	argsMap["anonymous-auth"] = "false"
+	argsMap["profiling"] = "false"
+	// RKE2 always enables secrets encryption
+	argsMap["encryption-provider-config"] = c.serverPath("cred", "encryption-config.json")
+	argsMap["encryption-provider-config-automatic-reload"] = "true"
+	if c.egressSelectorMode != "disabled" {
+		argsMap["egress-selector-config-file"] = c.serverPath("etc", "egress-selector-config.yaml")
+	}
+	return daemonconfig.GetArgs(argsMap, extraArgs)
+}
+
+// schedulerArgs returns the arguments that K3s starts the scheduler with.
+func (c *k3sConfig) schedulerArgs(extraArgs []string) []string {
+	kubeconfig := c.serverPath("cred", "scheduler.kubeconfig")
+	argsMap := map[string]string{
+		"kubeconfig":                kubeconfig,
+		"authorization-kubeconfig":  kubeconfig,
+		"authentication-kubeconfig": kubeconfig,
+		"bind-address":              c.loopback(false),
+		"secure-port":               "10259",
+		"profiling":                 "false",
+	}
+	return daemonconfig.GetArgs(argsMap, extraArgs)
+}
+
+// controllerManagerArgs returns the arguments that K3s starts the controller manager with.
+func (c *k3sConfig) controllerManagerArgs(extraArgs []string) []string {
+	kubeconfig := c.serverPath("cred", "controller.kubeconfig")
+	argsMap := map[string]string{
+		"controllers":                      "*,tokencleaner",
+		"kubeconfig":                       kubeconfig,
+		"authorization-kubeconfig":         kubeconfig,
+		"authentication-kubeconfig":        kubeconfig,
+		"service-account-private-key-file": c.serverPath("tls", "service.current.key"),
+		"allocate-node-cidrs":              "true",
+		"service-cluster-ip-range":         util.JoinIPNets(c.serviceCIDRs),
+		"cluster-cidr":                     util.JoinIPNets(c.clusterCIDRs),
+		"root-ca-file":                     c.serverPath("tls", "server-ca.crt"),
+		"profiling":                        "false",
+		"bind-address":                     c.loopback(false),
+		"secure-port":                      "10257",
+		"use-service-account-credentials":  "true",
+		"cluster-signing-kube-apiserver-client-cert-file": c.serverPath("tls", "client-ca.nochain.crt"),
+		"cluster-signing-kube-apiserver-client-key-file":  c.serverPath("tls", "client-ca.key"),
+		"cluster-signing-kubelet-client-cert-file":        c.serverPath("tls", "client-ca.nochain.crt"),
+		"cluster-signing-kubelet-client-key-file":         c.serverPath("tls", "client-ca.key"),
+		"cluster-signing-kubelet-serving-cert-file":       c.serverPath("tls", "server-ca.nochain.crt"),
+		"cluster-signing-kubelet-serving-key-file":        c.serverPath("tls", "server-ca.key"),
+		"cluster-signing-legacy-unknown-cert-file":        c.serverPath("tls", "server-ca.nochain.crt"),
+		"cluster-signing-legacy-unknown-key-file":         c.serverPath("tls", "server-ca.key"),
+	}
+	if !c.disableCCM {
+		argsMap["configure-cloud-routes"] = "false"
+		argsMap["controllers"] = argsMap["controllers"] + ",-service,-route,-cloud-node-lifecycle"
+	}
+	return daemonconfig.GetArgs(argsMap, extraArgs)
+}
+
+// runCloudControllerManager returns true if K3s starts the cloud controller manager.
+func (c *k3sConfig) runCloudControllerManager() bool {
+	return !c.disableCCM || !c.disableServiceLB
+}
+
+// cloudControllerManagerArgs returns the arguments that K3s starts the cloud controller manager with.
+func (c *k3sConfig) cloudControllerManagerArgs(extraArgs []string) []string {
+	kubeconfig := c.serverPath("cred", "cloud-controller.kubeconfig")
+	argsMap := map[string]string{
+		"profiling":                    "false",
+		"allocate-node-cidrs":          "true",
+		"leader-elect-resource-name":   version.Program + "-cloud-controller-manager",
+		"cloud-config":                 c.serverPath("etc", "cloud-config.yaml"),
+		"cloud-provider":               version.Program,
+		"cluster-cidr":                 util.JoinIPNets(c.clusterCIDRs),
+		"configure-cloud-routes":       "false",
+		"controllers":                  "*,-route",
+		"kubeconfig":                   kubeconfig,
+		"authorization-kubeconfig":     kubeconfig,
+		"authentication-kubeconfig":    kubeconfig,
+		"node-status-update-frequency": "1m0s",
+		"bind-address":                 c.loopback(false),
+	}
+	if c.disableCCM {
+		argsMap["controllers"] = argsMap["controllers"] + ",-cloud-node,-cloud-node-lifecycle"
+		argsMap["secure-port"] = "0"
+	}
+	if c.disableServiceLB {
+		argsMap["controllers"] = argsMap["controllers"] + ",-service"
+	}
+	return daemonconfig.GetArgs(argsMap, extraArgs)
+}
+
+// kubeProxyArgs returns the arguments that the K3s agent starts kube-proxy with.
+func (c *k3sConfig) kubeProxyArgs(extraArgs []string) []string {
+	bindAddress := "127.0.0.1"
+	if c.nodeIP.To4() == nil {
+		bindAddress = "::1"
+	}
+	argsMap := map[string]string{
+		"proxy-mode":                        "iptables",
+		"healthz-bind-address":              bindAddress,
+		"kubeconfig":                        c.agentPath("kubeproxy.kubeconfig"),
+		"cluster-cidr":                      util.JoinIPNets(c.clusterCIDRs),
+		"conntrack-max-per-core":            "0",
+		"conntrack-tcp-timeout-established": "0s",
+		"conntrack-tcp-timeout-close-wait":  "0s",
+		"hostname-override":                 c.nodeName,
+	}
+	return daemonconfig.GetArgs(argsMap, extraArgs)
+}
+
+// etcdConfig returns the configuration that K3s starts etcd with.
+func (c *k3sConfig) etcdConfig() *executor.ETCDConfig {
+	address := c.nodeIP.String()
+	clientURL := "https://" + net.JoinHostPort(address, "2379")
+	peerURL := "https://" + net.JoinHostPort(address, "2380")
+	metricsURLs := "http://" + c.loopback(true) + ":2381"
+	if c.etcdExposeMetrics {
+		metricsURLs += ",http://" + net.JoinHostPort(address, "2381")
+	}
+
+	tlsDir := c.serverPath("tls", "etcd")
+	return &executor.ETCDConfig{
+		Name:                c.etcdName,
+		InitialOptions:      c.etcdInitialOptions,
+		ListenClientURLs:    "https://" + c.loopback(true) + ":2379," + clientURL,
+		ListenMetricsURLs:   metricsURLs,
+		ListenPeerURLs:      "https://" + c.loopback(true) + ":2380," + peerURL,
+		AdvertiseClientURLs: clientURL,
+		DataDir:             c.serverPath("db", "etcd"),
+		ServerTrust: executor.ServerTrust{
+			CertFile:       filepath.Join(tlsDir, "server-client.crt"),
+			KeyFile:        filepath.Join(tlsDir, "server-client.key"),
+			ClientCertAuth: true,
+			TrustedCAFile:  filepath.Join(tlsDir, "server-ca.crt"),
+		},
+		PeerTrust: executor.PeerTrust{
+			CertFile:       filepath.Join(tlsDir, "peer-server-client.crt"),
+			KeyFile:        filepath.Join(tlsDir, "peer-server-client.key"),
+			ClientCertAuth: true,
+			TrustedCAFile:  filepath.Join(tlsDir, "peer-ca.crt"),
+		},
+		SnapshotCount:                           10000,
+		ElectionTimeout:                         5000,
+		HeartbeatInterval:                       500,
+		Logger:                                  "zap",
+		LogOutputs:                              []string{"stderr"},
+		ListenClientHTTPURLs:                    "https://" + c.loopback(true) + ":2382",
+		ExperimentalInitialCorruptCheck:         true,
+		ExperimentalWatchProgressNotifyInterval: 5 * time.Second,
+	}
+}
+
+// newETCDInitialOptions returns the initial options that K3s starts etcd with when creating a new cluster.
+func (c *k3sConfig) newETCDInitialOptions() executor.InitialOptions {
+	peerURL := "https://" + net.JoinHostPort(c.nodeIP.String(), "2380")
+	return executor.InitialOptions{
+		AdvertisePeerURL: peerURL,
+		Cluster:          c.etcdName + "=" + peerURL,
+		State:            "new",
+	}
+}
+
+// extraArgs returns the extra component args from the configuration, as passed to K3s.
+func extraArgs(values []string) []string {
+	var args []string
+	for _, arg := range values {
+		args = append(args, strings.TrimPrefix(arg, "--"))
+	}
+	return args
+}
@@ -0,0 +1,162 @@
+//go:build linux
+// +build linux
+
+package rke2
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func Test_UnitK3sConfigArgs(t *testing.T) {
+	mustParseCIDRs := func(values ...string) []*net.IPNet {
+		cidrs, err := parseCIDRs(values, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cidrs
+	}
+	newConfig := func() *k3sConfig {
+		return &k3sConfig{
+			dataDir:              "/var/lib/rancher/rke2",
+			nodeName:             "server-1",
+			nodeIP:               net.ParseIP("10.0.0.1"),
+			advertiseIP:          "10.0.0.1",
+			advertisePort:        6443,
+			clusterCIDRs:         mustParseCIDRs("10.42.0.0/16"),
+			serviceCIDRs:         mustParseCIDRs("10.43.0.0/16"),
+			clusterDomain:        "cluster.local",
+			serviceNodePortRange: "30000-32767",
+			apiServerPort:        6443,
+			egressSelectorMode:   "agent",
+			managedETCD:          true,
+			etcdName:             "server-1-abcdef01",
+			disableServiceLB:     true,
+		}
+	}
+
+	tests := []struct {
+		name      string
+		config    func(*k3sConfig)
+		args      func(*k3sConfig) []string
+		want      []string
+		wantNotIn []string
+	}{
+		{
+			name: "apiserver with managed etcd",
+			args: func(c *k3sConfig) []string { return c.apiServerArgs(nil) },
+			want: []string{
+				"--etcd-servers=https://127.0.0.1:2379",
+				"--etcd-cafile=/var/lib/rancher/rke2/server/tls/etcd/server-ca.crt",
+				"--advertise-address=10.0.0.1",
+				"--bind-address=127.0.0.1",
+				"--service-account-issuer=https://kubernetes.default.svc.cluster.local",
+				"--api-audiences=https://kubernetes.default.svc.cluster.local,rke2",
+				"--encryption-provider-config=/var/lib/rancher/rke2/server/cred/encryption-config.json",
+				"--egress-selector-config-file=/var/lib/rancher/rke2/server/etc/egress-selector-config.yaml",
+			},
+		},
+		{
+			name: "apiserver with external datastore and extra args",
+			config: func(c *k3sConfig) {
+				c.managedETCD = false
+				c.datastoreEndpoint = "https://etcd.example.com:2379"
+				c.datastoreCAFile = "/etc/etcd/ca.crt"
+				c.egressSelectorMode = "disabled"
+			},
+			args: func(c *k3sConfig) []string { return c.apiServerArgs([]string{"profiling=true"}) },
+			want: []string{
+				"--etcd-servers=https://etcd.example.com:2379",
+				"--etcd-cafile=/etc/etcd/ca.crt",
+				"--profiling=true",
+			},
+			wantNotIn: []string{
+				"--etcd-certfile=",
+				"--egress-selector-config-file=",
+			},
+		},
+		{
+			name: "controller manager with cloud controller manager",
+			args: func(c *k3sConfig) []string { return c.controllerManagerArgs(nil) },
+			want: []string{
+				"--controllers=*,tokencleaner,-service,-route,-cloud-node-lifecycle",
+				"--configure-cloud-routes=false",
+				"--cluster-cidr=10.42.0.0/16",
+			},
+		},
+		{
+			name:   "cloud controller manager with disabled cloud controller",
+			config: func(c *k3sConfig) { c.disableCCM = true },
+			args:   func(c *k3sConfig) []string { return c.cloudControllerManagerArgs(nil) },
+			want: []string{
+				"--controllers=*,-route,-cloud-node,-cloud-node-lifecycle,-service",
+				"--secure-port=0",
+				"--cloud-provider=rke2",
+			},
+		},
+		{
+			name: "kube-proxy with IPv6",
+			config: func(c *k3sConfig) {
+				c.nodeIP = net.ParseIP("fd00::1")
+				c.clusterCIDRs = mustParseCIDRs("fd42::/56")
+			},
+			args: func(c *k3sConfig) []string { return c.kubeProxyArgs(nil) },
+			want: []string{
+				"--healthz-bind-address=::1",
+				"--cluster-cidr=fd42::/56",
+				"--hostname-override=server-1",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newConfig()
+			if tt.config != nil {
+				tt.config(c)
+			}
+			args := tt.args(c)
+			joined := strings.Join(args, "\n") + "\n"
+			for _, want := range tt.want {
+				if !strings.Contains(joined, want+"\n") {
+					t.Errorf("args = %v, missing %s", args, want)
+				}
+			}
+			for _, notIn := range tt.wantNotIn {
+				if strings.Contains(joined, notIn) {
+					t.Errorf("args = %v, unexpected %s", args, notIn)
+				}
+			}
+		})
+	}
+}
+
+func Test_UnitK3sConfigETCD(t *testing.T) {
+	c := &k3sConfig{
+		dataDir:  "/var/lib/rancher/rke2",
+		nodeIP:   net.ParseIP("fd00::1"),
+		etcdName: "server-1-abcdef01",
+	}
+	c.serviceCIDRs, _ = parseCIDRs([]string{"fd43::/112"}, "")
+	c.etcdInitialOptions = c.newETCDInitialOptions()
+	got := c.etcdConfig()
+
+	if got.Name != "server-1-abcdef01" {
+		t.Errorf("Name = %q", got.Name)
+	}
+	if want := "server-1-abcdef01=https://[fd00::1]:2380"; got.InitialOptions.Cluster != want {
+		t.Errorf("InitialOptions.Cluster = %q, want %q", got.InitialOptions.Cluster, want)
+	}
+	if want := "https://[::1]:2379,https://[fd00::1]:2379"; got.ListenClientURLs != want {
+		t.Errorf("ListenClientURLs = %q, want %q", got.ListenClientURLs, want)
+	}
+	if want := "http://[::1]:2381"; got.ListenMetricsURLs != want {
+		t.Errorf("ListenMetricsURLs = %q, want %q", got.ListenMetricsURLs, want)
+	}
+	if want := "/var/lib/rancher/rke2/server/db/etcd"; got.DataDir != want {
+		t.Errorf("DataDir = %q, want %q", got.DataDir, want)
+	}
+	if want := "/var/lib/rancher/rke2/server/tls/etcd/peer-ca.crt"; got.PeerTrust.TrustedCAFile != want {
+		t.Errorf("PeerTrust.TrustedCAFile = %q, want %q", got.PeerTrust.TrustedCAFile, want)
+	}
+}
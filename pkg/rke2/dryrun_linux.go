@@ -0,0 +1,249 @@
+//go:build linux
+// +build linux
+
+package rke2
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/k3s-io/k3s/pkg/cli/cmds"
+	daemonconfig "github.com/k3s-io/k3s/pkg/daemons/config"
+	"github.com/k3s-io/k3s/pkg/daemons/executor"
+	"github.com/k3s-io/k3s/pkg/util/errors"
+	rke2cli "github.com/rancher/rke2/pkg/cli"
+	"github.com/rancher/rke2/pkg/executor/staticpod"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+)
+
+// dryRun renders the files that RKE2 would write at startup into the dry run directory, at the paths they would be
+// written to on the node, using the executor with the same arguments and etcd configuration that K3s would start it
+// with. The data directory and the node itself are not modified. If any of the files depend on state that is only
+// available once the node has started, nothing is rendered and an error is returned.
+func dryRun(clx *cli.Context, cfg rke2cli.Config, ex executor.Executor, isServer bool) error {
+	spc, ok := ex.(*staticpod.StaticPodConfig)
+	if !ok {
+		return fmt.Errorf("--dry-run is not supported with executor %T", ex)
+	}
+	out := cfg.DryRun
+	ctx := context.Background()
+
+	c, err := newK3sConfig(clx, spc, isServer)
+	if err != nil {
+		return errors.WithMessage(err, "--dry-run cannot render the node configuration")
+	}
+
+	if err := os.MkdirAll(out, 0755); err != nil {
+		return errors.WithMessagef(err, "failed to create dry run directory %s", out)
+	}
+	spc.DryRun(out)
+
+	if isServer {
+		if c.managedETCD {
+			if err := spc.ETCD(ctx, &sync.WaitGroup{}, c.etcdConfig(), extraArgs(cmds.ServerConfig.ExtraEtcdArgs.Value()), nil); err != nil {
+				return errors.WithMessage(err, "failed to render etcd")
+			}
+		}
+		if !clx.Bool("disable-apiserver") {
+			if err := spc.APIServer(ctx, c.apiServerArgs(extraArgs(cmds.ServerConfig.ExtraAPIArgs.Value()))); err != nil {
+				return errors.WithMessage(err, "failed to render kube-apiserver")
+			}
+		}
+		if !clx.Bool("disable-scheduler") {
+			if err := spc.Scheduler(ctx, nil, c.schedulerArgs(extraArgs(cmds.ServerConfig.ExtraSchedulerArgs.Value()))); err != nil {
+				return errors.WithMessage(err, "failed to render kube-scheduler")
+			}
+		}
+		if !clx.Bool("disable-controller-manager") {
+			if err := spc.ControllerManager(ctx, c.controllerManagerArgs(extraArgs(cmds.ServerConfig.ExtraControllerArgs.Value()))); err != nil {
+				return errors.WithMessage(err, "failed to render kube-controller-manager")
+			}
+		}
+		if c.runCloudControllerManager() {
+			if err := spc.CloudControllerManager(ctx, nil, c.cloudControllerManagerArgs(extraArgs(cmds.ServerConfig.ExtraCloudControllerArgs.Value()))); err != nil {
+				return errors.WithMessage(err, "failed to render cloud-controller-manager")
+			}
+		}
+	}
+	if !clx.Bool("disable-kube-proxy") {
+		if err := spc.KubeProxy(ctx, c.kubeProxyArgs(extraArgs(cmds.AgentConfig.ExtraKubeProxyArgs.Value()))); err != nil {
+			return errors.WithMessage(err, "failed to render kube-proxy")
+		}
+	}
+
+	if isServer {
+		nodeConfig := &daemonconfig.Node{}
+		nodeConfig.AgentConfig.ClusterDomain = c.clusterDomain
+		nodeConfig.AgentConfig.SystemDefaultRegistry = clx.String("system-default-registry")
+		nodeConfig.AgentConfig.ClusterCIDRs = c.clusterCIDRs
+		nodeConfig.AgentConfig.ServiceCIDRs = c.serviceCIDRs
+		if nodeConfig.AgentConfig.ClusterDNSs, err = parseIPs(clx.StringSlice("cluster-dns"), "10.43.0.10"); err != nil {
+			return errors.WithMessage(err, "invalid cluster-dns")
+		}
+		agentConfig := cmds.AgentConfig
+		agentConfig.DataDir = c.dataDir
+		manifestsDir := filepath.Join(out, c.dataDir, "server", "manifests")
+		if err := spc.RenderManifests(ctx, nodeConfig, agentConfig, manifestsDir); err != nil {
+			return errors.WithMessage(err, "failed to render bundled charts")
+		}
+		for _, name := range clx.StringSlice("disable") {
+			os.Remove(filepath.Join(manifestsDir, strings.TrimSpace(name)+".yaml"))
+		}
+	}
+
+	logrus.Infof("Rendered dry run into %s", out)
+	return nil
+}
+
+// newK3sConfig reads the configuration that K3s would generate component arguments from at startup. An error is
+// returned if the configuration cannot be determined without starting the node.
+func newK3sConfig(clx *cli.Context, spc *staticpod.StaticPodConfig, isServer bool) (*k3sConfig, error) {
+	c := &k3sConfig{
+		dataDir:              clx.String("data-dir"),
+		nodeName:             clx.String("node-name"),
+		clusterDomain:        clx.String("cluster-domain"),
+		serviceNodePortRange: clx.String("service-node-port-range"),
+		advertisePort:        cmds.ServerConfig.AdvertisePort,
+		apiServerPort:        cmds.ServerConfig.APIServerPort,
+		apiServerBindAddress: cmds.ServerConfig.APIServerBindAddress,
+		egressSelectorMode:   clx.String("egress-selector-mode"),
+		datastoreEndpoint:    clx.String("datastore-endpoint"),
+		datastoreCAFile:      clx.String("datastore-cafile"),
+		datastoreCertFile:    clx.String("datastore-certfile"),
+		datastoreKeyFile:     clx.String("datastore-keyfile"),
+		kine:                 spc.ExternalDatabase,
+		managedETCD:          isServer && !spc.DisableETCD,
+		etcdExposeMetrics:    clx.Bool("etcd-expose-metrics"),
+		disableCCM:           clx.Bool("disable-cloud-controller"),
+		disableServiceLB:     !clx.Bool("enable-servicelb"),
+	}
+
+	if isServer {
+		if clx.IsSet("server") {
+			return nil, fmt.Errorf("the configuration of a server joining an existing cluster is retrieved from the cluster at startup")
+		}
+		if clx.Bool("cluster-reset") {
+			return nil, fmt.Errorf("the configuration of a server resetting the cluster is generated at startup")
+		}
+	} else if !clx.Bool("disable-kube-proxy") {
+		return nil, fmt.Errorf("the cluster CIDRs that kube-proxy is started with on agents are retrieved from the server at startup")
+	}
+	if clx.Bool("with-node-id") {
+		return nil, fmt.Errorf("the node ID appended to the node name is generated at startup")
+	}
+
+	if c.nodeName == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		c.nodeName = strings.ToLower(hostname)
+	}
+
+	nodeIPs, err := parseIPs(clx.StringSlice("node-ip"), "")
+	if err != nil {
+		return nil, errors.WithMessage(err, "invalid node-ip")
+	}
+	if len(nodeIPs) > 0 {
+		c.nodeIP = nodeIPs[0]
+	} else if c.nodeIP, err = utilnet.ChooseHostInterface(); err != nil {
+		return nil, errors.WithMessage(err, "failed to find the default node IP")
+	}
+	c.advertiseIP = clx.String("advertise-address")
+	if c.advertiseIP == "" {
+		c.advertiseIP = c.nodeIP.String()
+	}
+
+	if c.clusterCIDRs, err = parseCIDRs(clx.StringSlice("cluster-cidr"), "10.42.0.0/16"); err != nil {
+		return nil, errors.WithMessage(err, "invalid cluster-cidr")
+	}
+	if c.serviceCIDRs, err = parseCIDRs(clx.StringSlice("service-cidr"), "10.43.0.0/16"); err != nil {
+		return nil, errors.WithMessage(err, "invalid service-cidr")
+	}
+	if c.clusterDomain == "" {
+		c.clusterDomain = "cluster.local"
+	}
+	if c.serviceNodePortRange == "" {
+		c.serviceNodePortRange = "30000-32767"
+	}
+	if c.apiServerPort == 0 {
+		c.apiServerPort = 6443
+	}
+	if c.advertisePort == 0 {
+		c.advertisePort = c.apiServerPort
+	}
+	if c.egressSelectorMode == "" {
+		c.egressSelectorMode = "agent"
+	}
+
+	if c.managedETCD {
+		b, err := os.ReadFile(etcdNameFile(c.dataDir))
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil, fmt.Errorf("the etcd member name is generated when etcd is first started; start the server once before using --dry-run")
+			}
+			return nil, err
+		}
+		c.etcdName = strings.TrimSpace(string(b))
+		if _, err := os.Stat(filepath.Join(c.dataDir, "server", "db", "etcd", "member")); err == nil {
+			if c.etcdInitialOptions, err = spc.CurrentETCDOptions(); err != nil {
+				return nil, errors.WithMessage(err, "failed to read current etcd options")
+			}
+		} else {
+			c.etcdInitialOptions = c.newETCDInitialOptions()
+		}
+	}
+	return c, nil
+}
+
+// parseIPs parses a list of comma-separated IP addresses, returning the default if the list is empty.
+func parseIPs(values []string, def string) ([]net.IP, error) {
+	if len(values) == 0 && def != "" {
+		values = []string{def}
+	}
+	var ips []net.IP
+	for _, s := range splitValues(values) {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %q", s)
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+// parseCIDRs parses a list of comma-separated CIDRs, returning the default if the list is empty.
+func parseCIDRs(values []string, def string) ([]*net.IPNet, error) {
+	if len(values) == 0 {
+		values = []string{def}
+	}
+	var cidrs []*net.IPNet
+	for _, s := range splitValues(values) {
+		_, cidr, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		cidrs = append(cidrs, cidr)
+	}
+	return cidrs, nil
+}
+
+// splitValues splits each comma-separated value in a string slice flag.
+func splitValues(values []string) []string {
+	var split []string
+	for _, value := range values {
+		for _, s := range strings.Split(value, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				split = append(split, s)
+			}
+		}
+	}
+	return split
+}
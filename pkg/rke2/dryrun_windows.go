@@ -0,0 +1,16 @@
+//go:build windows
+// +build windows
+
+package rke2
+
+import (
+	"errors"
+
+	"github.com/k3s-io/k3s/pkg/daemons/executor"
+	rke2cli "github.com/rancher/rke2/pkg/cli"
+	"github.com/urfave/cli/v2"
+)
+
+func dryRun(_ *cli.Context, _ rke2cli.Config, _ executor.Executor, _ bool) error {
+	return errors.New("--dry-run is not supported on Windows")
+}
@@ -0,0 +1,202 @@
+package rke2
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"text/tabwriter"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/k3s-io/k3s/pkg/cli/cmds"
+	"github.com/k3s-io/k3s/pkg/util/errors"
+	"github.com/k3s-io/k3s/pkg/version"
+	"github.com/rancher/rke2/pkg/bootstrap"
+	rke2cli "github.com/rancher/rke2/pkg/cli"
+	"github.com/rancher/rke2/pkg/images"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+	"sigs.k8s.io/yaml"
+)
+
+// imageInfo describes a single image reference, and where it was resolved from.
+type imageInfo struct {
+	Name      string        `json:"name"`
+	Chart     string        `json:"chart,omitempty"`
+	Reference string        `json:"reference"`
+	Source    images.Source `json:"source"`
+}
+
+// ImagesList prints the references for all the images that a node will need, as resolved from
+// the same configuration used by the server and agent. This includes images referenced by the
+// bundled charts, if the charts have already been staged from the runtime image.
+func ImagesList(clx *cli.Context, cfg rke2cli.Config) error {
+	resolver, err := newResolverFromCLI(clx, cfg)
+	if err != nil {
+		return err
+	}
+
+	infos := []imageInfo{}
+	for _, i := range images.All {
+		ref, err := resolver.GetReference(i)
+		if err != nil {
+			return errors.WithMessagef(err, "failed to resolve %s", i)
+		}
+		infos = append(infos, imageInfo{Name: i, Reference: ref.Name(), Source: resolver.GetSource(i)})
+	}
+
+	chartInfos, err := chartImageInfos(clx, resolver, resolver)
+	if err != nil {
+		return err
+	}
+	infos = append(infos, chartInfos...)
+
+	return printImages(clx.String("output"), infos)
+}
+
+// chartImageInfos returns the images referenced by the bundled charts staged for the runtime image resolved by
+// resolver, with the registry settings of imageResolver applied. If the charts have not yet been staged from the
+// runtime image, a warning is logged and no images are returned.
+func chartImageInfos(clx *cli.Context, resolver, imageResolver *images.Resolver) ([]imageInfo, error) {
+	chartsDir, err := bootstrap.ChartsDir(resolver, cmds.Agent{DataDir: clx.String("data-dir")})
+	if err != nil {
+		return nil, err
+	}
+	chartImages, err := bootstrap.ChartImages(chartsDir)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, errors.WithMessagef(err, "failed to list images from charts in %s", chartsDir)
+		}
+		logrus.Warnf("Bundled charts have not been staged to %s; start %s with this configuration once to list chart images", chartsDir, version.Program)
+	}
+	infos := []imageInfo{}
+	for _, ci := range chartImages {
+		ref, source, err := imageResolver.ParseChartReference(ci.Image)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "failed to parse image %s from chart %s", ci.Image, ci.Chart)
+		}
+		infos = append(infos, imageInfo{Name: ref.Context().RepositoryStr(), Chart: ci.Chart, Reference: ref.Name(), Source: source})
+	}
+	return infos, nil
+}
+
+// ImagesLock resolves the current tag for each image to a digest, and writes the digests to the image lock file.
+// Digests are resolved from the OCI image layout at the path specified by the oci-layout flag, or from the
+// registry if no layout is specified, using the mirrors and credentials from the private registry configuration.
+// Images with platform-specific overrides are locked separately for each platform, so that the lock file can be
+// shared by nodes of different architectures. Any existing lock file is not loaded, so that a lock file that is out of date or invalid can be regenerated.
+func ImagesLock(clx *cli.Context, cfg rke2cli.Config) error {
+	cfg.Images.IgnoreLockFile = true
+	resolver, err := newResolverFromCLI(clx, cfg)
+	if err != nil {
+		return err
+	}
+
+	lockFile := cfg.Images.LockFile
+	if lockFile == "" {
+		lockFile = images.DefaultLockFile
+	}
+
+	var index v1.ImageIndex
+	var registry *images.RemoteRegistry
+	if layoutPath := clx.String("oci-layout"); layoutPath != "" {
+		p, err := layout.FromPath(layoutPath)
+		if err != nil {
+			return errors.WithMessagef(err, "failed to open OCI image layout at %s", layoutPath)
+		}
+		index, err = p.ImageIndex()
+		if err != nil {
+			return errors.WithMessagef(err, "failed to read OCI image layout index at %s", layoutPath)
+		}
+	} else {
+		registry, err = images.NewRemoteRegistry(clx.String("private-registry"))
+		if err != nil {
+			return err
+		}
+	}
+
+	digests := map[string]v1.Hash{}
+	for _, i := range images.All {
+		// Images with platform-specific overrides are locked for each platform, not just the one this node runs on
+		refs, err := resolver.GetPlatformReferences(i)
+		if err != nil {
+			return errors.WithMessagef(err, "failed to resolve %s", i)
+		}
+		keys := map[string]name.Reference{}
+		for platform, ref := range refs {
+			keys[images.LockKey(i, platform)] = ref
+		}
+		if len(keys) == 0 {
+			ref, err := resolver.GetUnlockedReference(i)
+			if err != nil {
+				return errors.WithMessagef(err, "failed to resolve %s", i)
+			}
+			keys[i] = ref
+		}
+
+		for key, ref := range keys {
+			if d, ok := ref.(name.Digest); ok {
+				logrus.Infof("Image %s is already pinned to %s", key, d.Name())
+				continue
+			}
+			if index != nil {
+				digests[key], err = images.FindInIndex(index, ref)
+			} else {
+				var desc *v1.Descriptor
+				desc, err = registry.Head(clx.Context, ref)
+				if desc != nil {
+					digests[key] = desc.Digest
+				}
+			}
+			if err != nil {
+				return errors.WithMessagef(err, "failed to get digest for %s %s", key, ref.Name())
+			}
+			logrus.Infof("Locked %s %s to %s", key, ref.Name(), digests[key])
+		}
+	}
+
+	if err := images.WriteLockFile(lockFile, digests); err != nil {
+		return errors.WithMessagef(err, "failed to write image lock file %s", lockFile)
+	}
+	logrus.Infof("Wrote image lock file %s", lockFile)
+	return nil
+}
+
+// newResolverFromCLI creates an image resolver from the system-default-registry and image override
+// flags, using the same defaulting as the server and agent.
+func newResolverFromCLI(clx *cli.Context, cfg rke2cli.Config) (*images.Resolver, error) {
+	if !clx.IsSet("system-default-registry") && clx.Bool("prime") {
+		cfg.Images.SystemDefaultRegistry = images.PrimeRegistry
+	}
+	cfg.Images.RewriteRules = clx.StringSlice("image-rewrite")
+	return images.NewResolver(cfg.Images)
+}
+
+func printImages(format string, infos []imageInfo) error {
+	switch format {
+	case "json":
+		b, err := json.MarshalIndent(infos, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+	case "yaml":
+		b, err := yaml.Marshal(infos)
+		if err != nil {
+			return err
+		}
+		fmt.Print(string(b))
+	case "text", "":
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+		defer w.Flush()
+		fmt.Fprint(w, "IMAGE\tCHART\tREFERENCE\tSOURCE\n")
+		for _, i := range infos {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", i.Name, i.Chart, i.Reference, i.Source)
+		}
+	default:
+		return fmt.Errorf("unsupported output format %q: must be one of text, json, yaml", format)
+	}
+	return nil
+}
@@ -0,0 +1,379 @@
+package rke2
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/match"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/k3s-io/k3s/pkg/util/errors"
+	rke2cli "github.com/rancher/rke2/pkg/cli"
+	"github.com/rancher/rke2/pkg/images"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+// Mirror status values reported in the summary.
+const (
+	mirrorCopied  = "copied"
+	mirrorPresent = "present"
+	mirrorFailed  = "failed"
+)
+
+// mirrorImage is an image to be copied to the mirror target.
+type mirrorImage struct {
+	source name.Reference // reference to pull from; a digest if the image is locked
+	tag    name.Reference // reference used to name the image in the target
+}
+
+// mirrorResult records the outcome of copying a single image.
+type mirrorResult struct {
+	source string
+	target string
+	digest string
+	status string
+}
+
+// ImagesMirror copies all the images that a node will need into a registry, or into an OCI image layout
+// on disk. Images are copied from their upstream registry, rather than from the system-default-registry.
+// Registry mirrors, credentials and TLS settings are loaded from the private registry configuration file.
+// Images that are already present in the target with the same digest are skipped, so an interrupted
+// mirror can be resumed by running the command again. Blobs that already exist in the target are not
+// uploaded again, so layers shared by multiple images are only copied once.
+func ImagesMirror(clx *cli.Context, cfg rke2cli.Config) error {
+	targetRegistry := clx.String("registry")
+	layoutPath := clx.String("oci-layout")
+	if (targetRegistry == "") == (layoutPath == "") {
+		return fmt.Errorf("exactly one of --registry or --oci-layout must be set")
+	}
+
+	platforms := []v1.Platform{}
+	for _, s := range clx.StringSlice("platform") {
+		p, err := v1.ParsePlatform(s)
+		if err != nil {
+			return errors.WithMessagef(err, "invalid platform %q", s)
+		}
+		platforms = append(platforms, *p)
+	}
+
+	resolver, err := newResolverFromCLI(clx, cfg)
+	if err != nil {
+		return err
+	}
+	upstream, err := newUpstreamResolver(cfg, clx.Bool("prime"))
+	if err != nil {
+		return err
+	}
+	todo, err := mirrorImages(clx, resolver, upstream, platforms)
+	if err != nil {
+		return err
+	}
+
+	registry, err := images.NewRemoteRegistry(clx.String("private-registry"))
+	if err != nil {
+		return err
+	}
+
+	var dest mirrorDestination
+	if layoutPath != "" {
+		dest, err = newLayoutDestination(layoutPath)
+	} else {
+		dest, err = newRegistryDestination(clx.Context, targetRegistry, registry)
+	}
+	if err != nil {
+		return err
+	}
+
+	var results []mirrorResult
+	var failed int
+	for _, mi := range todo {
+		result := mirrorResult{source: mi.source.Name(), status: mirrorFailed}
+		if err := mirror(clx.Context, mi, platforms, registry, dest, &result); err != nil {
+			logrus.Errorf("Failed to mirror %s: %v", mi.source.Name(), err)
+			failed++
+		}
+		results = append(results, result)
+	}
+
+	printMirrorResults(results)
+	if failed > 0 {
+		return fmt.Errorf("failed to mirror %d of %d images", failed, len(results))
+	}
+	return nil
+}
+
+// newUpstreamResolver creates an image resolver that resolves images from their upstream registry. The
+// system-default-registry and rewrite rules are not used, as they usually refer to the mirror that is being
+// populated; image overrides and the image lock file are still applied.
+func newUpstreamResolver(cfg rke2cli.Config, prime bool) (*images.Resolver, error) {
+	cfg.Images.SystemDefaultRegistry = ""
+	if prime {
+		cfg.Images.SystemDefaultRegistry = images.PrimeRegistry
+	}
+	cfg.Images.RewriteRules = nil
+	return images.NewResolver(cfg.Images)
+}
+
+// mirrorImages returns the core and chart images, without duplicates. Images are copied from their upstream
+// registry, as resolved by the upstream resolver; the node's resolver is only used to find the staged charts.
+func mirrorImages(clx *cli.Context, resolver, upstream *images.Resolver, platforms []v1.Platform) ([]mirrorImage, error) {
+	todo, seen, err := coreMirrorImages(upstream, platforms)
+	if err != nil {
+		return nil, err
+	}
+
+	infos, err := chartImageInfos(clx, resolver, upstream)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		ref, err := name.ParseReference(info.Reference, name.WeakValidation)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[ref.Name()] {
+			seen[ref.Name()] = true
+			todo = append(todo, mirrorImage{source: ref, tag: ref})
+		}
+	}
+	return todo, nil
+}
+
+// coreMirrorImages returns the core images, without duplicates, and the names of the images that were
+// returned. Images with platform-specific overrides are resolved for each of the requested platforms, as
+// they may be entirely different images on each platform; if no platforms are requested, all platforms
+// are mirrored, so the image for each of the overrides is returned.
+func coreMirrorImages(upstream *images.Resolver, platforms []v1.Platform) ([]mirrorImage, map[string]bool, error) {
+	todo := []mirrorImage{}
+	seen := map[string]bool{}
+	for _, i := range images.All {
+		resolvers := []*images.Resolver{upstream}
+		overrides, err := upstream.GetPlatformReferences(i)
+		if err != nil {
+			return nil, nil, errors.WithMessagef(err, "failed to resolve %s", i)
+		}
+		if len(overrides) > 0 {
+			resolvers = nil
+			for _, p := range overridePlatforms(overrides, platforms) {
+				resolvers = append(resolvers, upstream.ForPlatform(p))
+			}
+		}
+		for _, r := range resolvers {
+			source, err := r.GetReference(i)
+			if err != nil {
+				return nil, nil, errors.WithMessagef(err, "failed to resolve %s", i)
+			}
+			tag, err := r.GetUnlockedReference(i)
+			if err != nil {
+				return nil, nil, errors.WithMessagef(err, "failed to resolve %s", i)
+			}
+			if !seen[source.Name()] {
+				seen[source.Name()] = true
+				todo = append(todo, mirrorImage{source: source, tag: tag})
+			}
+		}
+	}
+	return todo, seen, nil
+}
+
+// overridePlatforms returns the platforms to resolve an image with platform-specific overrides for. If no
+// platforms are requested, a platform is returned for each of the override keys; the empty platform does not
+// match any os or os/arch key, and so selects the default override.
+func overridePlatforms(overrides map[string]name.Reference, platforms []v1.Platform) []v1.Platform {
+	if len(platforms) > 0 {
+		return platforms
+	}
+	keys := make([]string, 0, len(overrides))
+	for key := range overrides {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	result := []v1.Platform{}
+	for _, key := range keys {
+		if key == "default" {
+			result = append(result, v1.Platform{})
+		} else if p, err := v1.ParsePlatform(key); err == nil {
+			result = append(result, *p)
+		}
+	}
+	return result
+}
+
+// mirror copies a single image to the destination, filtering multi-platform images to the requested platforms.
+func mirror(ctx context.Context, mi mirrorImage, platforms []v1.Platform, registry *images.RemoteRegistry, dest mirrorDestination, result *mirrorResult) error {
+	target, err := dest.Target(mi.tag)
+	if err != nil {
+		return err
+	}
+	result.target = target.Name()
+
+	desc, err := registry.Get(ctx, mi.source)
+	if err != nil {
+		return err
+	}
+
+	var t remote.Taggable
+	var digest v1.Hash
+	if desc.MediaType.IsIndex() {
+		idx, err := desc.ImageIndex()
+		if err != nil {
+			return err
+		}
+		if len(platforms) > 0 {
+			idx = mutate.RemoveManifests(idx, func(d v1.Descriptor) bool {
+				return d.Platform != nil && !match.Platforms(platforms...)(d)
+			})
+			if _, ok := mi.source.(name.Digest); ok {
+				logrus.Warnf("Image %s is pinned to a digest; filtering platforms changes the digest of the mirrored image", mi.source.Name())
+			}
+		}
+		if digest, err = idx.Digest(); err != nil {
+			return err
+		}
+		t = idx
+	} else {
+		img, err := desc.Image()
+		if err != nil {
+			return err
+		}
+		if digest, err = img.Digest(); err != nil {
+			return err
+		}
+		t = img
+	}
+	result.digest = digest.String()
+
+	if dest.Has(target, digest) {
+		logrus.Infof("Image %s is already present in target as %s", mi.source.Name(), target.Name())
+		result.status = mirrorPresent
+		return nil
+	}
+
+	logrus.Infof("Copying %s to %s", mi.source.Name(), target.Name())
+	if err := dest.Write(ctx, target, t); err != nil {
+		return err
+	}
+	result.status = mirrorCopied
+	return nil
+}
+
+// mirrorDestination is a target that images can be copied to.
+type mirrorDestination interface {
+	// Target returns the reference to write the image to.
+	Target(ref name.Reference) (name.Reference, error)
+	// Has returns true if the image is already present in the target with the given digest.
+	Has(ref name.Reference, digest v1.Hash) bool
+	// Write writes an image or index to the target.
+	Write(ctx context.Context, ref name.Reference, t remote.Taggable) error
+}
+
+// registryDestination copies images into a registry.
+type registryDestination struct {
+	registry string
+	opts     []remote.Option
+	pusher   *remote.Pusher
+}
+
+func newRegistryDestination(ctx context.Context, target string, registry *images.RemoteRegistry) (*registryDestination, error) {
+	host, _, _ := strings.Cut(target, "/")
+	if _, err := name.NewRegistry(host); err != nil {
+		return nil, errors.WithMessagef(err, "invalid target registry %s", target)
+	}
+	opts, err := registry.Options(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	pusher, err := remote.NewPusher(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &registryDestination{registry: target, opts: opts, pusher: pusher}, nil
+}
+
+func (r *registryDestination) Target(ref name.Reference) (name.Reference, error) {
+	s := r.registry + "/" + ref.Context().RepositoryStr()
+	switch t := ref.(type) {
+	case name.Tag:
+		s += ":" + t.TagStr()
+	case name.Digest:
+		s += "@" + t.DigestStr()
+	}
+	return name.ParseReference(s, name.WeakValidation)
+}
+
+func (r *registryDestination) Has(ref name.Reference, digest v1.Hash) bool {
+	desc, err := remote.Head(ref, r.opts...)
+	return err == nil && desc.Digest == digest
+}
+
+func (r *registryDestination) Write(ctx context.Context, ref name.Reference, t remote.Taggable) error {
+	return r.pusher.Push(ctx, ref, t)
+}
+
+// layoutDestination copies images into an OCI image layout. Images are annotated with their
+// name, so that the layout can be used to generate an image lock file.
+type layoutDestination struct {
+	path layout.Path
+}
+
+func newLayoutDestination(path string) (*layoutDestination, error) {
+	p, err := layout.FromPath(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, errors.WithMessagef(err, "failed to open OCI image layout at %s", path)
+		}
+		if p, err = layout.Write(path, empty.Index); err != nil {
+			return nil, errors.WithMessagef(err, "failed to create OCI image layout at %s", path)
+		}
+	}
+	return &layoutDestination{path: p}, nil
+}
+
+func (l *layoutDestination) Target(ref name.Reference) (name.Reference, error) {
+	return ref, nil
+}
+
+func (l *layoutDestination) Has(ref name.Reference, digest v1.Hash) bool {
+	index, err := l.path.ImageIndex()
+	if err != nil {
+		return false
+	}
+	d, err := images.FindInIndex(index, ref)
+	return err == nil && d == digest
+}
+
+func (l *layoutDestination) Write(_ context.Context, ref name.Reference, t remote.Taggable) error {
+	opt := layout.WithAnnotations(map[string]string{
+		images.AnnotationContainerdImageName: ref.Name(),
+		images.AnnotationRefName:             ref.Name(),
+	})
+	matcher := match.Annotation(images.AnnotationContainerdImageName, ref.Name())
+	switch t := t.(type) {
+	case v1.ImageIndex:
+		return l.path.ReplaceIndex(t, matcher, opt)
+	case v1.Image:
+		return l.path.ReplaceImage(t, matcher, opt)
+	}
+	return fmt.Errorf("unhandled type %T", t)
+}
+
+func printMirrorResults(results []mirrorResult) {
+	counts := map[string]int{}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprint(w, "SOURCE\tTARGET\tDIGEST\tSTATUS\n")
+	for _, r := range results {
+		counts[r.status]++
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", r.source, r.target, r.digest, r.status)
+	}
+	w.Flush()
+	fmt.Printf("\n%d images: %d copied, %d already present, %d failed\n", len(results), counts[mirrorCopied], counts[mirrorPresent], counts[mirrorFailed])
+}
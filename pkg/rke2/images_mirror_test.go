@@ -0,0 +1,218 @@
+package rke2
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	rke2cli "github.com/rancher/rke2/pkg/cli"
+	"github.com/rancher/rke2/pkg/images"
+)
+
+func Test_UnitNewUpstreamResolver(t *testing.T) {
+	cfg := rke2cli.Config{}
+	cfg.Images.SystemDefaultRegistry = "mirror.example.com"
+	cfg.Images.RewriteRules = []string{`^(.*)$=mirror.example.com/rewritten/$1`}
+	cfg.Images.ETCD = "registry.example.com/etcd:v1"
+
+	resolver, err := newUpstreamResolver(cfg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]string{
+		images.KubeAPIServer: images.DefaultRegistry,
+		images.ETCD:          "registry.example.com",
+	}
+	for i, registry := range tests {
+		ref, err := resolver.GetReference(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reg := ref.Context().RegistryStr(); reg != registry {
+			t.Errorf("expected %s to be resolved from %s, got %s", i, registry, ref.Name())
+		}
+	}
+}
+
+func Test_UnitMirror(t *testing.T) {
+	source := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	defer source.Close()
+	target := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	defer target.Close()
+	sourceHost := strings.TrimPrefix(source.URL, "http://")
+	targetHost := strings.TrimPrefix(target.URL, "http://")
+
+	index, err := random.Index(64, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, err := index.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := name.ParseReference(sourceHost + "/rancher/hardened-etcd:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.WriteIndex(ref, index); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	remoteRegistry, err := images.NewRemoteRegistry(filepath.Join(t.TempDir(), "registries.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	layoutDest, err := newLayoutDestination(filepath.Join(t.TempDir(), "layout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	registryDest, err := newRegistryDestination(ctx, targetHost+"/mirror", remoteRegistry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for destName, dest := range map[string]mirrorDestination{"layout": layoutDest, "registry": registryDest} {
+		t.Run(destName, func(t *testing.T) {
+			mi := mirrorImage{source: ref, tag: ref}
+			for _, status := range []string{mirrorCopied, mirrorPresent} {
+				result := mirrorResult{status: mirrorFailed}
+				if err := mirror(ctx, mi, nil, remoteRegistry, dest, &result); err != nil {
+					t.Fatal(err)
+				}
+				if result.status != status {
+					t.Errorf("expected status %s, got %s", status, result.status)
+				}
+				if result.digest != digest.String() {
+					t.Errorf("expected digest %s, got %s", digest, result.digest)
+				}
+			}
+		})
+	}
+
+	mirrored, err := name.ParseReference(targetHost + "/mirror/rancher/hardened-etcd:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc, err := remote.Head(mirrored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc.Digest != digest {
+		t.Errorf("expected mirrored digest %s, got %s", digest, desc.Digest)
+	}
+}
+
+func Test_UnitMirrorPlatformOverrides(t *testing.T) {
+	source := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	defer source.Close()
+	sourceHost := strings.TrimPrefix(source.URL, "http://")
+
+	overrides := map[string]string{
+		"linux/amd64": sourceHost + "/amd64/hardened-kubernetes:v1",
+		"linux/arm64": sourceHost + "/arm64/hardened-kubernetes:v1",
+		"default":     sourceHost + "/other/hardened-kubernetes:v1",
+	}
+	for _, s := range overrides {
+		img, err := random.Image(64, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ref, err := name.ParseReference(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := remote.Write(ref, img); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg := rke2cli.Config{}
+	cfg.Images.IgnoreLockFile = true
+	cfg.Images.KubeAPIServer = "{linux/amd64: " + overrides["linux/amd64"] + ", linux/arm64: " + overrides["linux/arm64"] + ", default: " + overrides["default"] + "}"
+	upstream, err := newUpstreamResolver(cfg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		platforms []string
+		want      []string
+	}{
+		{
+			name:      "requested platforms",
+			platforms: []string{"linux/amd64", "linux/arm64"},
+			want:      []string{overrides["linux/amd64"], overrides["linux/arm64"]},
+		},
+		{
+			name:      "platform without an override",
+			platforms: []string{"linux/arm64", "windows/amd64"},
+			want:      []string{overrides["default"], overrides["linux/arm64"]},
+		},
+		{
+			name: "all platforms",
+			want: []string{overrides["linux/amd64"], overrides["linux/arm64"], overrides["default"]},
+		},
+	}
+
+	ctx := context.Background()
+	remoteRegistry, err := images.NewRemoteRegistry(filepath.Join(t.TempDir(), "registries.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var platforms []v1.Platform
+			for _, s := range tt.platforms {
+				p, err := v1.ParsePlatform(s)
+				if err != nil {
+					t.Fatal(err)
+				}
+				platforms = append(platforms, *p)
+			}
+			todo, _, err := coreMirrorImages(upstream, platforms)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Only the overridden images are in the test registry; the other core images are upstream
+			dest, err := newLayoutDestination(filepath.Join(t.TempDir(), "layout"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, mi := range todo {
+				if mi.source.Context().RegistryStr() != sourceHost {
+					continue
+				}
+				got = append(got, mi.source.Name())
+				result := mirrorResult{status: mirrorFailed}
+				if err := mirror(ctx, mi, platforms, remoteRegistry, dest, &result); err != nil {
+					t.Fatal(err)
+				}
+				if result.status != mirrorCopied {
+					t.Errorf("expected %s to be copied, got %s", mi.source.Name(), result.status)
+				}
+				if digest, err := v1.NewHash(result.digest); err != nil || !dest.Has(mi.tag, digest) {
+					t.Errorf("expected %s to be present in the layout with digest %s", mi.source.Name(), result.digest)
+				}
+			}
+			sort.Strings(got)
+			sort.Strings(tt.want)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected images %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
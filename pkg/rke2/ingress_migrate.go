@@ -0,0 +1,698 @@
+package rke2
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/k3s-io/k3s/pkg/util/errors"
+	"github.com/k3s-io/k3s/pkg/version"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	nginxIngressClass             = "nginx"
+	nginxIngressController        = "k8s.io/ingress-nginx"
+	traefikIngressClass           = "traefik"
+	ingressClassAnnotation        = "kubernetes.io/ingress.class"
+	nginxAnnotationPrefix         = "nginx.ingress.kubernetes.io/"
+	traefikMiddlewaresAnnotation  = "traefik.ingress.kubernetes.io/router.middlewares"
+	nginxDefaultCORSMethods       = "GET, PUT, POST, DELETE, PATCH, OPTIONS"
+	nginxDefaultCORSHeaders       = "DNT,Keep-Alive,User-Agent,X-Requested-With,If-Modified-Since,Cache-Control,Content-Type,Range,Authorization"
+	nginxDefaultCORSMaxAge        = 1728000
+	nginxDefaultBurstMultiplier   = 5
+	nginxBasicAuthFile            = "auth-file"
+	nginxBasicAuthMap             = "auth-map"
+	ingressMigrationRollbackUsage = "Restore the Ingresses and remove the Middlewares and Secrets recorded in this file with: %s ingress migrate --rollback %s\n"
+)
+
+var (
+	middlewareGVR                = schema.GroupVersionResource{Group: "traefik.io", Version: "v1alpha1", Resource: "middlewares"}
+	migratedIngressLabelKey      = version.Program + ".cattle.io/migrated-ingress"
+	ingressMigrationRollbackFile = "ingress-migration-rollback-%s.yaml"
+)
+
+// ingressMigration describes the changes needed to move an Ingress from the nginx ingress class to the traefik ingress class.
+// Annotations that cannot be translated are recorded along with the reason, and notes describe translated annotations
+// that may need additional changes to behave the same way.
+type ingressMigration struct {
+	ingress      *networkingv1.Ingress
+	middlewares  []*unstructured.Unstructured
+	basicAuth    *basicAuthConversion
+	translated   []string
+	untranslated map[string]string
+	notes        []string
+}
+
+// basicAuthConversion describes the Secret holding nginx basic auth credentials, and the Secret that the credentials
+// are copied into in the format read by traefik.
+type basicAuthConversion struct {
+	source     string
+	sourceType string
+	target     string
+}
+
+// ingressMigrationRecord records the state of Ingresses before they were migrated, and the Middlewares and Secrets that
+// were created for them, so that the migration can be rolled back.
+type ingressMigrationRecord struct {
+	Ingresses   []networkingv1.Ingress `json:"ingresses"`
+	Middlewares []objectRef            `json:"middlewares"`
+	Secrets     []objectRef            `json:"secrets,omitempty"`
+}
+
+type objectRef struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+}
+
+// MigrateIngress lists the Ingresses that use the nginx ingress class, and reports how their nginx annotations
+// translate into traefik Middlewares. When applied, the Middlewares are created and the Ingresses are moved to the
+// traefik ingress class, after writing a file that can be used to roll back the migration.
+func MigrateIngress(clx *cli.Context) error {
+	restConfig, err := clientcmd.BuildConfigFromFlags("", clx.String("kubeconfig"))
+	if err != nil {
+		return err
+	}
+	client, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return err
+	}
+	dynamicClient, err := dynamic.NewForConfig(restConfig)
+	if err != nil {
+		return err
+	}
+
+	ctx := clx.Context
+	if file := clx.String("rollback"); file != "" {
+		return rollbackIngressMigration(ctx, clx.App.Writer, client, dynamicClient, file)
+	}
+
+	nginxDefault, err := isNginxDefaultIngressClass(ctx, client)
+	if err != nil {
+		return err
+	}
+	ingresses, err := client.NetworkingV1().Ingresses(clx.String("namespace")).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return errors.WithMessage(err, "failed to list ingresses")
+	}
+	var migrations []*ingressMigration
+	for i := range ingresses.Items {
+		if isNginxIngress(&ingresses.Items[i], nginxDefault) {
+			migrations = append(migrations, planIngressMigration(&ingresses.Items[i]))
+		}
+	}
+	if len(migrations) == 0 {
+		fmt.Fprintln(clx.App.Writer, "No Ingresses use the nginx ingress class")
+		return nil
+	}
+	if err := printIngressMigrations(clx.App.Writer, migrations); err != nil {
+		return err
+	}
+
+	if !clx.Bool("apply") {
+		fmt.Fprintln(clx.App.Writer, "Dry run: no changes were made. Re-run with --apply to migrate these Ingresses")
+		return nil
+	}
+
+	if !clx.Bool("force") {
+		var blocked []string
+		for _, m := range migrations {
+			if len(m.untranslated) > 0 {
+				blocked = append(blocked, m.ingress.Namespace+"/"+m.ingress.Name)
+			}
+		}
+		if len(blocked) > 0 {
+			return fmt.Errorf("%d Ingresses have annotations that cannot be translated: %s. Resolve them, or re-run with --force to migrate without them", len(blocked), strings.Join(blocked, ", "))
+		}
+	}
+
+	if _, err := client.Discovery().ServerResourcesForGroupVersion(middlewareGVR.GroupVersion().String()); err != nil {
+		return errors.WithMessagef(err, "traefik Middleware resources are not available; add %s to ingress-controller and wait for it to be deployed before migrating", traefikIngressClass)
+	}
+
+	file := clx.String("rollback-file")
+	if file == "" {
+		file = fmt.Sprintf(ingressMigrationRollbackFile, time.Now().UTC().Format("20060102T150405Z"))
+	}
+	if err := writeIngressMigrationRecord(file, migrations); err != nil {
+		return errors.WithMessage(err, "failed to write rollback file")
+	}
+	fmt.Fprintf(clx.App.Writer, "Wrote rollback file %s\n", file)
+
+	for _, m := range migrations {
+		if err := applyIngressMigration(ctx, client, dynamicClient, m); err != nil {
+			fmt.Fprintf(clx.App.Writer, ingressMigrationRollbackUsage, version.Program, file)
+			return errors.WithMessagef(err, "failed to migrate ingress %s/%s", m.ingress.Namespace, m.ingress.Name)
+		}
+		logrus.Infof("Migrated ingress %s/%s to the %s ingress class", m.ingress.Namespace, m.ingress.Name, traefikIngressClass)
+	}
+
+	fmt.Fprintf(clx.App.Writer, "Migrated %d Ingresses to the %s ingress class\n", len(migrations), traefikIngressClass)
+	fmt.Fprintf(clx.App.Writer, ingressMigrationRollbackUsage, version.Program, file)
+	fmt.Fprintf(clx.App.Writer, "Once traffic has been verified, set ingress-controller to %s on all servers and restart them\n", traefikIngressClass)
+	return nil
+}
+
+// isNginxIngress returns true if the Ingress uses the nginx ingress class, either through the
+// ingressClassName field or the deprecated ingress class annotation, or by not setting a class
+// when nginx is the default IngressClass.
+func isNginxIngress(ing *networkingv1.Ingress, nginxDefault bool) bool {
+	if ing.Spec.IngressClassName != nil {
+		return *ing.Spec.IngressClassName == nginxIngressClass
+	}
+	if class := ing.Annotations[ingressClassAnnotation]; class != "" {
+		return class == nginxIngressClass
+	}
+	return nginxDefault
+}
+
+// isNginxDefaultIngressClass returns true if an IngressClass handled by the nginx ingress controller
+// is marked as the default IngressClass.
+func isNginxDefaultIngressClass(ctx context.Context, client kubernetes.Interface) (bool, error) {
+	classes, err := client.NetworkingV1().IngressClasses().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return false, errors.WithMessage(err, "failed to list ingress classes")
+	}
+	for _, class := range classes.Items {
+		if class.Annotations[networkingv1.AnnotationIsDefaultIngressClass] != "true" {
+			continue
+		}
+		if class.Name == nginxIngressClass || class.Spec.Controller == nginxIngressController {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// planIngressMigration translates the nginx annotations on an Ingress into traefik Middlewares.
+// Middlewares are added in the order that they should be applied to requests.
+func planIngressMigration(ing *networkingv1.Ingress) *ingressMigration {
+	m := &ingressMigration{ingress: ing, untranslated: map[string]string{}}
+	if ing.Spec.IngressClassName == nil && ing.Annotations[ingressClassAnnotation] == "" {
+		m.notes = append(m.notes, fmt.Sprintf("the Ingress does not set a class and uses the default IngressClass %s; its ingressClassName will be set to %s", nginxIngressClass, traefikIngressClass))
+	}
+	annotations := map[string]string{}
+	for k, v := range ing.Annotations {
+		if name, ok := strings.CutPrefix(k, nginxAnnotationPrefix); ok {
+			annotations[name] = v
+		}
+	}
+	// handle marks annotations as translated.
+	handle := func(names ...string) {
+		for _, name := range names {
+			if _, ok := annotations[name]; ok {
+				m.translated = append(m.translated, nginxAnnotationPrefix+name)
+				delete(annotations, name)
+			}
+		}
+	}
+	reject := func(name, reason string) {
+		if _, ok := annotations[name]; ok {
+			m.untranslated[nginxAnnotationPrefix+name] = reason
+			delete(annotations, name)
+		}
+	}
+
+	// nginx redirects to https by default when the Ingress has TLS configured
+	forceSSLRedirect := annotations["force-ssl-redirect"] == "true"
+	sslRedirect := len(ing.Spec.TLS) > 0 && annotations["ssl-redirect"] != "false"
+	if sslRedirect && !forceSSLRedirect && annotations["ssl-redirect"] == "" {
+		m.notes = append(m.notes, "nginx redirects HTTP to HTTPS by default for Ingresses with TLS; a redirect Middleware was added to match")
+	}
+	handle("force-ssl-redirect", "ssl-redirect")
+	if forceSSLRedirect || sslRedirect {
+		m.addMiddleware("redirect-https", "redirectScheme", map[string]any{"scheme": "https", "permanent": true})
+	}
+
+	if v, ok := annotations["permanent-redirect"]; ok {
+		handle("permanent-redirect")
+		m.addMiddleware("permanent-redirect", "redirectRegex", map[string]any{"regex": "^.*$", "replacement": v, "permanent": true})
+	} else if v, ok := annotations["temporal-redirect"]; ok {
+		handle("temporal-redirect")
+		m.addMiddleware("temporal-redirect", "redirectRegex", map[string]any{"regex": "^.*$", "replacement": v, "permanent": false})
+	}
+
+	if v, ok := annotations["app-root"]; ok {
+		handle("app-root")
+		m.addMiddleware("app-root", "redirectRegex", map[string]any{"regex": "^(https?://[^/]+)/$", "replacement": "${1}" + v})
+	}
+
+	sourceRange := valueOr(annotations["allowlist-source-range"], annotations["whitelist-source-range"])
+	handle("allowlist-source-range", "whitelist-source-range")
+	if sourceRange != "" {
+		m.addMiddleware("ip-allowlist", "ipAllowList", map[string]any{"sourceRange": splitList(sourceRange, ",")})
+	}
+
+	switch authType := annotations["auth-type"]; authType {
+	case "":
+	case "basic":
+		secret := annotations["auth-secret"]
+		namespace, name, found := strings.Cut(secret, "/")
+		if !found {
+			namespace, name = ing.Namespace, secret
+		}
+		if name == "" || namespace != ing.Namespace {
+			reject("auth-type", "basic auth requires an auth-secret in the same namespace as the Ingress")
+			reject("auth-secret", "basic auth requires an auth-secret in the same namespace as the Ingress")
+			break
+		}
+		secretType := valueOr(annotations["auth-secret-type"], nginxBasicAuthFile)
+		if secretType != nginxBasicAuthFile && secretType != nginxBasicAuthMap {
+			reject("auth-secret-type", fmt.Sprintf("basic auth secret type %s is not supported by nginx", secretType))
+			reject("auth-type", "basic auth requires a supported auth-secret-type")
+			reject("auth-secret", "basic auth requires a supported auth-secret-type")
+			break
+		}
+		// traefik reads htpasswd lines from the users key of a Secret, so the credentials are copied into a new Secret
+		m.basicAuth = &basicAuthConversion{source: name, sourceType: secretType, target: ing.Name + "-basic-auth"}
+		spec := map[string]any{"secret": m.basicAuth.target}
+		if realm := annotations["auth-realm"]; realm != "" {
+			spec["realm"] = realm
+		}
+		handle("auth-type", "auth-secret", "auth-realm", "auth-secret-type")
+		m.addMiddleware("basic-auth", "basicAuth", spec)
+		m.notes = append(m.notes, fmt.Sprintf("basic auth credentials are copied from secret %s into secret %s; later changes to %s are not copied", name, m.basicAuth.target, name))
+	default:
+		reject("auth-type", fmt.Sprintf("auth type %s has no traefik equivalent", authType))
+	}
+
+	if annotations["limit-rps"] != "" {
+		multiplier, err := strconv.ParseInt(annotations["limit-burst-multiplier"], 10, 64)
+		if err != nil {
+			multiplier = nginxDefaultBurstMultiplier
+		}
+		rps, err := strconv.ParseInt(annotations["limit-rps"], 10, 64)
+		if err != nil {
+			reject("limit-rps", fmt.Sprintf("invalid request rate: %v", err))
+		} else {
+			handle("limit-rps", "limit-burst-multiplier")
+			m.addMiddleware("rate-limit", "rateLimit", map[string]any{"average": rps, "burst": rps * multiplier})
+		}
+	}
+	if annotations["limit-connections"] != "" {
+		connections, err := strconv.ParseInt(annotations["limit-connections"], 10, 64)
+		if err != nil {
+			reject("limit-connections", fmt.Sprintf("invalid connection limit: %v", err))
+		} else {
+			handle("limit-connections")
+			m.addMiddleware("in-flight", "inFlightReq", map[string]any{"amount": connections})
+		}
+	}
+
+	if _, ok := annotations["enable-cors"]; ok {
+		enabled := annotations["enable-cors"] == "true"
+		spec := map[string]any{
+			"accessControlAllowOriginList":  splitList(valueOr(annotations["cors-allow-origin"], "*"), ","),
+			"accessControlAllowMethods":     splitList(valueOr(annotations["cors-allow-methods"], nginxDefaultCORSMethods), ","),
+			"accessControlAllowHeaders":     splitList(valueOr(annotations["cors-allow-headers"], nginxDefaultCORSHeaders), ","),
+			"accessControlAllowCredentials": annotations["cors-allow-credentials"] != "false",
+			"accessControlMaxAge":           int64(nginxDefaultCORSMaxAge),
+		}
+		if v := annotations["cors-expose-headers"]; v != "" {
+			spec["accessControlExposeHeaders"] = splitList(v, ",")
+		}
+		if v, err := strconv.ParseInt(annotations["cors-max-age"], 10, 64); err == nil {
+			spec["accessControlMaxAge"] = v
+		}
+		handle("enable-cors", "cors-allow-origin", "cors-allow-methods", "cors-allow-headers", "cors-allow-credentials", "cors-expose-headers", "cors-max-age")
+		if enabled {
+			m.addMiddleware("cors", "headers", spec)
+		}
+	}
+
+	if v, ok := annotations["proxy-body-size"]; ok {
+		size, err := parseNginxSize(v)
+		switch {
+		case err != nil:
+			reject("proxy-body-size", fmt.Sprintf("invalid size: %v", err))
+		case size == 0:
+			// nginx does not limit the request body size if the size is 0
+			handle("proxy-body-size")
+		default:
+			handle("proxy-body-size")
+			m.addMiddleware("body-size", "buffering", map[string]any{"maxRequestBodyBytes": size})
+		}
+	}
+
+	if v, ok := annotations["rewrite-target"]; ok {
+		if prefixes, ok := stripPrefixes(ing); ok && v == "/" && annotations["use-regex"] != "true" {
+			handle("rewrite-target")
+			if len(prefixes) > 0 {
+				m.addMiddleware("strip-prefix", "stripPrefix", map[string]any{"prefixes": prefixes})
+			}
+		} else {
+			reject("rewrite-target", "only a rewrite target of / on prefix paths without regular expressions can be translated")
+		}
+	}
+
+	if annotations["use-regex"] == "true" {
+		reject("use-regex", "traefik does not support regular expressions in Ingress paths")
+	} else {
+		handle("use-regex")
+	}
+
+	if v, ok := annotations["backend-protocol"]; ok {
+		if strings.EqualFold(v, "HTTP") {
+			handle("backend-protocol")
+		} else {
+			reject("backend-protocol", "set traefik.ingress.kubernetes.io/service.serversscheme on the backend Service instead")
+		}
+	}
+
+	for name := range annotations {
+		reject(name, "no traefik equivalent")
+	}
+	sort.Strings(m.translated)
+	return m
+}
+
+// addMiddleware adds a Middleware for the Ingress, with a single middleware of the given type.
+func (m *ingressMigration) addMiddleware(suffix, middlewareType string, spec map[string]any) {
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion(middlewareGVR.GroupVersion().String())
+	obj.SetKind("Middleware")
+	obj.SetNamespace(m.ingress.Namespace)
+	obj.SetName(m.ingress.Name + "-" + suffix)
+	obj.SetLabels(map[string]string{migratedIngressLabelKey: m.ingress.Name})
+	obj.Object["spec"] = map[string]any{middlewareType: spec}
+	m.middlewares = append(m.middlewares, obj)
+}
+
+// migrateIngressObject moves an Ingress to the traefik ingress class, and attaches the Middlewares to its routers.
+// The nginx annotations are left in place, as they are ignored by traefik.
+func (m *ingressMigration) migrateIngressObject(ing *networkingv1.Ingress) {
+	if ing.Annotations == nil {
+		ing.Annotations = map[string]string{}
+	}
+	if _, ok := ing.Annotations[ingressClassAnnotation]; ok {
+		ing.Annotations[ingressClassAnnotation] = traefikIngressClass
+	}
+	if ing.Spec.IngressClassName != nil || ing.Annotations[ingressClassAnnotation] == "" {
+		ing.Spec.IngressClassName = ptr.To(traefikIngressClass)
+	}
+	var refs []string
+	for _, ref := range strings.Split(ing.Annotations[traefikMiddlewaresAnnotation], ",") {
+		if ref = strings.TrimSpace(ref); ref != "" {
+			refs = append(refs, ref)
+		}
+	}
+	for _, mw := range m.middlewares {
+		refs = append(refs, mw.GetNamespace()+"-"+mw.GetName()+"@kubernetescrd")
+	}
+	if len(refs) > 0 {
+		ing.Annotations[traefikMiddlewaresAnnotation] = strings.Join(refs, ",")
+	}
+}
+
+// applyIngressMigration creates or updates the Secrets and Middlewares for an Ingress, and then migrates the Ingress.
+// Existing Middlewares and Secrets are only updated if they were created by a previous migration of the same Ingress.
+func applyIngressMigration(ctx context.Context, client kubernetes.Interface, dynamicClient dynamic.Interface, m *ingressMigration) error {
+	if m.basicAuth != nil {
+		if err := applyBasicAuthSecret(ctx, client, m); err != nil {
+			return err
+		}
+	}
+
+	for _, mw := range m.middlewares {
+		middlewares := dynamicClient.Resource(middlewareGVR).Namespace(mw.GetNamespace())
+		if _, err := middlewares.Create(ctx, mw, metav1.CreateOptions{}); err != nil {
+			if !apierrors.IsAlreadyExists(err) {
+				return errors.WithMessagef(err, "failed to create middleware %s", mw.GetName())
+			}
+			existing, err := middlewares.Get(ctx, mw.GetName(), metav1.GetOptions{})
+			if err != nil {
+				return err
+			}
+			if existing.GetLabels()[migratedIngressLabelKey] != m.ingress.Name {
+				return fmt.Errorf("middleware %s already exists and was not created by a migration of this ingress", mw.GetName())
+			}
+			existing.Object["spec"] = mw.Object["spec"]
+			if _, err := middlewares.Update(ctx, existing, metav1.UpdateOptions{}); err != nil {
+				return errors.WithMessagef(err, "failed to update middleware %s", mw.GetName())
+			}
+		}
+	}
+
+	ingresses := client.NetworkingV1().Ingresses(m.ingress.Namespace)
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		ing, err := ingresses.Get(ctx, m.ingress.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		m.migrateIngressObject(ing)
+		_, err = ingresses.Update(ctx, ing, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// applyBasicAuthSecret copies the nginx basic auth credentials for an Ingress into a Secret in the format read by traefik.
+func applyBasicAuthSecret(ctx context.Context, client kubernetes.Interface, m *ingressMigration) error {
+	secrets := client.CoreV1().Secrets(m.ingress.Namespace)
+	source, err := secrets.Get(ctx, m.basicAuth.source, metav1.GetOptions{})
+	if err != nil {
+		return errors.WithMessagef(err, "failed to get basic auth secret %s", m.basicAuth.source)
+	}
+	users, err := convertBasicAuthSecret(source, m.basicAuth.sourceType)
+	if err != nil {
+		return errors.WithMessagef(err, "failed to convert basic auth secret %s", m.basicAuth.source)
+	}
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      m.basicAuth.target,
+			Namespace: m.ingress.Namespace,
+			Labels:    map[string]string{migratedIngressLabelKey: m.ingress.Name},
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: map[string][]byte{"users": users},
+	}
+	if _, err := secrets.Create(ctx, secret, metav1.CreateOptions{}); err != nil {
+		if !apierrors.IsAlreadyExists(err) {
+			return errors.WithMessagef(err, "failed to create secret %s", secret.Name)
+		}
+		existing, err := secrets.Get(ctx, secret.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if existing.Labels[migratedIngressLabelKey] != m.ingress.Name {
+			return fmt.Errorf("secret %s already exists and was not created by a migration of this ingress", secret.Name)
+		}
+		existing.Data = secret.Data
+		if _, err := secrets.Update(ctx, existing, metav1.UpdateOptions{}); err != nil {
+			return errors.WithMessagef(err, "failed to update secret %s", secret.Name)
+		}
+	}
+	return nil
+}
+
+// convertBasicAuthSecret returns the htpasswd lines for the credentials in an nginx basic auth Secret. An auth-file
+// Secret holds htpasswd lines in its auth key, and an auth-map Secret holds a password hash keyed by each user name.
+func convertBasicAuthSecret(secret *corev1.Secret, secretType string) ([]byte, error) {
+	switch secretType {
+	case nginxBasicAuthFile:
+		auth := strings.TrimSpace(string(secret.Data["auth"]))
+		if auth == "" {
+			return nil, fmt.Errorf("secret has no credentials in the auth key")
+		}
+		return []byte(auth + "\n"), nil
+	case nginxBasicAuthMap:
+		users := make([]string, 0, len(secret.Data))
+		for user := range secret.Data {
+			users = append(users, user)
+		}
+		if len(users) == 0 {
+			return nil, fmt.Errorf("secret has no credentials")
+		}
+		sort.Strings(users)
+		var b strings.Builder
+		for _, user := range users {
+			fmt.Fprintf(&b, "%s:%s\n", user, strings.TrimSpace(string(secret.Data[user])))
+		}
+		return []byte(b.String()), nil
+	}
+	return nil, fmt.Errorf("unsupported basic auth secret type %s", secretType)
+}
+
+// writeIngressMigrationRecord writes the Ingresses as they were before migration, and the Middlewares and Secrets that will be created.
+func writeIngressMigrationRecord(file string, migrations []*ingressMigration) error {
+	record := ingressMigrationRecord{}
+	for _, m := range migrations {
+		ing := m.ingress.DeepCopy()
+		ing.ManagedFields = nil
+		ing.ResourceVersion = ""
+		ing.Status = networkingv1.IngressStatus{}
+		record.Ingresses = append(record.Ingresses, *ing)
+		for _, mw := range m.middlewares {
+			record.Middlewares = append(record.Middlewares, objectRef{Namespace: mw.GetNamespace(), Name: mw.GetName()})
+		}
+		if m.basicAuth != nil {
+			record.Secrets = append(record.Secrets, objectRef{Namespace: m.ingress.Namespace, Name: m.basicAuth.target})
+		}
+	}
+	b, err := yaml.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, b, 0600)
+}
+
+// rollbackIngressMigration restores the class, annotations, labels, and spec of Ingresses recorded in a rollback file,
+// and removes the Middlewares and Secrets that were created for them.
+func rollbackIngressMigration(ctx context.Context, w io.Writer, client kubernetes.Interface, dynamicClient dynamic.Interface, file string) error {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	record := ingressMigrationRecord{}
+	if err := yaml.Unmarshal(b, &record); err != nil {
+		return errors.WithMessagef(err, "failed to decode rollback file %s", file)
+	}
+
+	for _, saved := range record.Ingresses {
+		ingresses := client.NetworkingV1().Ingresses(saved.Namespace)
+		err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			ing, err := ingresses.Get(ctx, saved.Name, metav1.GetOptions{})
+			if err != nil {
+				return err
+			}
+			ing.Annotations = saved.Annotations
+			ing.Labels = saved.Labels
+			ing.Spec = saved.Spec
+			_, err = ingresses.Update(ctx, ing, metav1.UpdateOptions{})
+			return err
+		})
+		if err != nil {
+			return errors.WithMessagef(err, "failed to restore ingress %s/%s", saved.Namespace, saved.Name)
+		}
+		fmt.Fprintf(w, "Restored ingress %s/%s\n", saved.Namespace, saved.Name)
+	}
+
+	for _, mw := range record.Middlewares {
+		err := dynamicClient.Resource(middlewareGVR).Namespace(mw.Namespace).Delete(ctx, mw.Name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return errors.WithMessagef(err, "failed to delete middleware %s/%s", mw.Namespace, mw.Name)
+		}
+	}
+	for _, secret := range record.Secrets {
+		err := client.CoreV1().Secrets(secret.Namespace).Delete(ctx, secret.Name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return errors.WithMessagef(err, "failed to delete secret %s/%s", secret.Namespace, secret.Name)
+		}
+	}
+	fmt.Fprintf(w, "Restored %d Ingresses and removed %d Middlewares and %d Secrets\n", len(record.Ingresses), len(record.Middlewares), len(record.Secrets))
+	return nil
+}
+
+// printIngressMigrations prints the Middlewares that will be created for each Ingress,
+// along with the annotations that cannot be translated and any notes.
+func printIngressMigrations(w io.Writer, migrations []*ingressMigration) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "INGRESS\tMIDDLEWARES\tTRANSLATED\tUNTRANSLATED")
+	for _, m := range migrations {
+		var names []string
+		for _, mw := range m.middlewares {
+			names = append(names, mw.GetName())
+		}
+		fmt.Fprintf(tw, "%s/%s\t%s\t%d\t%d\n", m.ingress.Namespace, m.ingress.Name, valueOr(strings.Join(names, ","), "<none>"), len(m.translated), len(m.untranslated))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		keys := make([]string, 0, len(m.untranslated))
+		for k := range m.untranslated {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(w, "Ingress %s/%s: cannot translate %s: %s\n", m.ingress.Namespace, m.ingress.Name, k, m.untranslated[k])
+		}
+		for _, note := range m.notes {
+			fmt.Fprintf(w, "Ingress %s/%s: note: %s\n", m.ingress.Namespace, m.ingress.Name, note)
+		}
+	}
+	return nil
+}
+
+// stripPrefixes returns the non-root prefix paths of the Ingress rules, or false if any paths are not prefix paths.
+func stripPrefixes(ing *networkingv1.Ingress) ([]any, bool) {
+	seen := map[string]bool{}
+	var prefixes []any
+	for _, rule := range ing.Spec.Rules {
+		if rule.HTTP == nil {
+			continue
+		}
+		for _, path := range rule.HTTP.Paths {
+			if path.PathType != nil && *path.PathType == networkingv1.PathTypeExact {
+				return nil, false
+			}
+			if strings.ContainsAny(path.Path, "()[]*+?^$|\\") {
+				return nil, false
+			}
+			p := strings.TrimSuffix(path.Path, "/")
+			if p != "" && !seen[p] {
+				seen[p] = true
+				prefixes = append(prefixes, p)
+			}
+		}
+	}
+	return prefixes, true
+}
+
+// parseNginxSize parses an nginx size, which is a number of bytes with an optional k or m suffix for kibibytes or mebibytes.
+func parseNginxSize(s string) (int64, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(s, "k"):
+		multiplier, s = 1<<10, strings.TrimSuffix(s, "k")
+	case strings.HasSuffix(s, "m"):
+		multiplier, s = 1<<20, strings.TrimSuffix(s, "m")
+	case strings.HasSuffix(s, "g"):
+		multiplier, s = 1<<30, strings.TrimSuffix(s, "g")
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return n * multiplier, nil
+}
+
+// splitList splits a delimited list into Middleware spec values, trimming whitespace and dropping empty items.
+func splitList(s, sep string) []any {
+	var items []any
+	for _, item := range strings.Split(s, sep) {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// valueOr returns s, or def if s is empty.
+func valueOr(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
@@ -0,0 +1,197 @@
+package rke2
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+)
+
+func Test_UnitPlanIngressMigration(t *testing.T) {
+	tests := []struct {
+		name             string
+		ingress          *networkingv1.Ingress
+		nginxDefault     bool
+		wantMiddlewares  []string
+		wantUntranslated []string
+		wantBasicAuth    *basicAuthConversion
+		wantClass        *string
+		wantAnnotation   string
+	}{
+		{
+			name: "common annotations",
+			ingress: &networkingv1.Ingress{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "web",
+					Namespace: "default",
+					Annotations: map[string]string{
+						"nginx.ingress.kubernetes.io/whitelist-source-range": "10.0.0.0/8, 192.168.0.0/16",
+						"nginx.ingress.kubernetes.io/auth-type":              "basic",
+						"nginx.ingress.kubernetes.io/auth-secret":            "htpasswd",
+						"nginx.ingress.kubernetes.io/limit-rps":              "10",
+						"nginx.ingress.kubernetes.io/enable-cors":            "true",
+						"nginx.ingress.kubernetes.io/proxy-body-size":        "8m",
+						"nginx.ingress.kubernetes.io/rewrite-target":         "/",
+						"nginx.ingress.kubernetes.io/configuration-snippet":  "more_set_headers x;",
+						"nginx.ingress.kubernetes.io/backend-protocol":       "HTTPS",
+					},
+				},
+				Spec: networkingv1.IngressSpec{
+					IngressClassName: ptr.To("nginx"),
+					TLS:              []networkingv1.IngressTLS{{Hosts: []string{"web.example.com"}}},
+					Rules: []networkingv1.IngressRule{{
+						IngressRuleValue: networkingv1.IngressRuleValue{
+							HTTP: &networkingv1.HTTPIngressRuleValue{
+								Paths: []networkingv1.HTTPIngressPath{{Path: "/api/"}, {Path: "/"}},
+							},
+						},
+					}},
+				},
+			},
+			wantMiddlewares: []string{"web-redirect-https", "web-ip-allowlist", "web-basic-auth", "web-rate-limit", "web-cors", "web-body-size", "web-strip-prefix"},
+			wantUntranslated: []string{
+				"nginx.ingress.kubernetes.io/backend-protocol",
+				"nginx.ingress.kubernetes.io/configuration-snippet",
+			},
+			wantBasicAuth:  &basicAuthConversion{source: "htpasswd", sourceType: "auth-file", target: "web-basic-auth"},
+			wantClass:      ptr.To("traefik"),
+			wantAnnotation: "",
+		},
+		{
+			name: "class annotation with regex rewrite",
+			ingress: &networkingv1.Ingress{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "app",
+					Namespace: "apps",
+					Annotations: map[string]string{
+						"kubernetes.io/ingress.class":                "nginx",
+						"nginx.ingress.kubernetes.io/rewrite-target": "/$2",
+						"nginx.ingress.kubernetes.io/use-regex":      "true",
+						"nginx.ingress.kubernetes.io/ssl-redirect":   "false",
+					},
+				},
+			},
+			wantUntranslated: []string{
+				"nginx.ingress.kubernetes.io/rewrite-target",
+				"nginx.ingress.kubernetes.io/use-regex",
+			},
+			wantAnnotation: "traefik",
+		},
+		{
+			name: "default ingress class",
+			ingress: &networkingv1.Ingress{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "default",
+					Namespace: "default",
+					Annotations: map[string]string{
+						"nginx.ingress.kubernetes.io/auth-type":        "basic",
+						"nginx.ingress.kubernetes.io/auth-secret":      "other/htpasswd",
+						"nginx.ingress.kubernetes.io/auth-secret-type": "auth-map",
+					},
+				},
+			},
+			nginxDefault: true,
+			wantUntranslated: []string{
+				"nginx.ingress.kubernetes.io/auth-type",
+				"nginx.ingress.kubernetes.io/auth-secret",
+				"nginx.ingress.kubernetes.io/auth-secret-type",
+			},
+			wantClass: ptr.To("traefik"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isNginxIngress(tt.ingress, false); got == tt.nginxDefault {
+				t.Fatalf("isNginxIngress() without a default class = %t, want %t", got, !tt.nginxDefault)
+			}
+			if !isNginxIngress(tt.ingress, true) {
+				t.Fatalf("isNginxIngress() = false, want true")
+			}
+			m := planIngressMigration(tt.ingress)
+
+			var middlewares []string
+			for _, mw := range m.middlewares {
+				middlewares = append(middlewares, mw.GetName())
+			}
+			if !reflect.DeepEqual(middlewares, tt.wantMiddlewares) {
+				t.Errorf("middlewares = %v, want %v", middlewares, tt.wantMiddlewares)
+			}
+			var untranslated []string
+			for k := range m.untranslated {
+				untranslated = append(untranslated, k)
+			}
+			if len(untranslated) != len(tt.wantUntranslated) {
+				t.Errorf("untranslated = %v, want %v", m.untranslated, tt.wantUntranslated)
+			}
+			for _, k := range tt.wantUntranslated {
+				if _, ok := m.untranslated[k]; !ok {
+					t.Errorf("untranslated = %v, missing %s", m.untranslated, k)
+				}
+			}
+
+			if !reflect.DeepEqual(m.basicAuth, tt.wantBasicAuth) {
+				t.Errorf("basicAuth = %+v, want %+v", m.basicAuth, tt.wantBasicAuth)
+			}
+
+			ing := tt.ingress.DeepCopy()
+			m.migrateIngressObject(ing)
+			if !reflect.DeepEqual(ing.Spec.IngressClassName, tt.wantClass) {
+				t.Errorf("ingressClassName = %v, want %v", ing.Spec.IngressClassName, tt.wantClass)
+			}
+			if got := ing.Annotations[ingressClassAnnotation]; got != tt.wantAnnotation {
+				t.Errorf("ingress class annotation = %q, want %q", got, tt.wantAnnotation)
+			}
+			if isNginxIngress(ing, true) {
+				t.Errorf("isNginxIngress() = true after migration, want false")
+			}
+		})
+	}
+}
+
+func Test_UnitConvertBasicAuthSecret(t *testing.T) {
+	tests := []struct {
+		name       string
+		secretType string
+		data       map[string][]byte
+		want       string
+		wantErr    bool
+	}{
+		{
+			name:       "auth file",
+			secretType: "auth-file",
+			data:       map[string][]byte{"auth": []byte("alice:$apr1$a\nbob:$apr1$b")},
+			want:       "alice:$apr1$a\nbob:$apr1$b\n",
+		},
+		{
+			name:       "auth map",
+			secretType: "auth-map",
+			data:       map[string][]byte{"bob": []byte("$apr1$b"), "alice": []byte("$apr1$a\n")},
+			want:       "alice:$apr1$a\nbob:$apr1$b\n",
+		},
+		{
+			name:       "auth file without auth key",
+			secretType: "auth-file",
+			data:       map[string][]byte{"users": []byte("alice:$apr1$a")},
+			wantErr:    true,
+		},
+		{
+			name:       "empty auth map",
+			secretType: "auth-map",
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := convertBasicAuthSecret(&corev1.Secret{Data: tt.data}, tt.secretType)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("convertBasicAuthSecret() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if string(got) != tt.want {
+				t.Errorf("convertBasicAuthSecret() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
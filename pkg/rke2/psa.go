@@ -15,21 +15,21 @@ const (
 // setPSAs sets the default PSA's based on the mode that RKE2 is running in. There is either CIS or non
 // CIS mode. For CIS mode, a default PSA configuration with enforcement for restricted will be applied
 // for non CIS mode, a default PSA configuration will be applied that has privileged restriction
-func setPSAs(cisMode bool) error {
+func setPSAs(file string, cisMode bool) error {
 	logrus.Info("Applying Pod Security Admission Configuration")
-	configDir := filepath.Dir(defaultPSAConfigFile)
+	configDir := filepath.Dir(file)
 	if err := os.MkdirAll(configDir, 0755); err != nil {
 		return err
 	}
 	if !cisMode { // non-CIS mode
 		psaConfig := unrestrictedPSAConfig()
-		if err := os.WriteFile(defaultPSAConfigFile, []byte(psaConfig), 0600); err != nil {
+		if err := os.WriteFile(file, []byte(psaConfig), 0600); err != nil {
 			return errors.WithMessagef(err, "psa: failed to write psa unrestricted config")
 		}
 
 	} else { // CIS mode
 		psaConfig := restrictedPSAConfig()
-		if err := os.WriteFile(defaultPSAConfigFile, []byte(psaConfig), 0600); err != nil {
+		if err := os.WriteFile(file, []byte(psaConfig), 0600); err != nil {
 			return errors.WithMessagef(err, "psa: failed to write psa restricted config")
 		}
 	}
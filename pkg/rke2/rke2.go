@@ -33,7 +33,7 @@ const (
 
 func Server(clx *cli.Context, cfg rke2cli.Config) error {
 	serverControllers, err := setup(clx, cfg, true)
-	if err != nil {
+	if err != nil || cfg.DryRun != "" {
 		return err
 	}
 
@@ -87,7 +87,7 @@ func Server(clx *cli.Context, cfg rke2cli.Config) error {
 }
 
 func Agent(clx *cli.Context, cfg rke2cli.Config) error {
-	if _, err := setup(clx, cfg, false); err != nil {
+	if _, err := setup(clx, cfg, false); err != nil || cfg.DryRun != "" {
 		return err
 	}
 	return agent.Run(clx)
@@ -96,7 +96,7 @@ func Agent(clx *cli.Context, cfg rke2cli.Config) error {
 func setup(clx *cli.Context, cfg rke2cli.Config, isServer bool) (controllers.Server, error) {
 	// If we are pid 1, k3s is about to reexec so we shouldn't bother doing anything
 	// ref: https://github.com/k3s-io/k3s/blob/v1.33.0%2Bk3s1/pkg/cli/cmds/log_linux.go#L21-L24
-	if os.Getpid() == 1 && os.Getenv("_K3S_LOG_REEXEC_") != "true" {
+	if os.Getpid() == 1 && os.Getenv("_K3S_LOG_REEXEC_") != "true" && cfg.DryRun == "" {
 		return nil, nil
 	}
 
@@ -104,6 +104,11 @@ func setup(clx *cli.Context, cfg rke2cli.Config, isServer bool) (controllers.Ser
 	if err != nil {
 		return nil, errors.WithMessage(err, "failed to initialize executor")
 	}
+
+	// When rendering a dry run, the executor is used to render files instead of starting the node
+	if cfg.DryRun != "" {
+		return nil, dryRun(clx, cfg, ex, isServer)
+	}
 	executor.Set(ex)
 
 	// note: controllers are only run on servers, even though we
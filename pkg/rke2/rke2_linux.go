@@ -19,6 +19,7 @@ import (
 	"github.com/k3s-io/k3s/pkg/etcd"
 	"github.com/k3s-io/k3s/pkg/util/errors"
 	"github.com/k3s-io/kine/pkg/util"
+	"github.com/rancher/rke2/pkg/bootstrap"
 	rke2cli "github.com/rancher/rke2/pkg/cli"
 	"github.com/rancher/rke2/pkg/cli/defaults"
 	"github.com/rancher/rke2/pkg/executor/staticpod"
@@ -37,7 +38,12 @@ func initExecutor(clx *cli.Context, cfg rke2cli.Config, isServer bool) (executor
 		clx.Set("system-default-registry", images.PrimeRegistry)
 	} else {
 		cfg.Images.SystemDefaultRegistry = clx.String("system-default-registry")
+		// K3s only supports a single registry; fallback registries are handled by the image resolver
+		if primary := images.PrimaryRegistry(cfg.Images.SystemDefaultRegistry); primary != cfg.Images.SystemDefaultRegistry {
+			clx.Set("system-default-registry", primary)
+		}
 	}
+	cfg.Images.RewriteRules = clx.StringSlice("image-rewrite")
 
 	dataDir := clx.String("data-dir")
 	if err := defaults.Set(clx, dataDir); err != nil {
@@ -83,7 +89,9 @@ func initStaticPodExecutor(clx *cli.Context, cfg rke2cli.Config, isServer bool)
 		}
 	} else {
 		forceRestart = true
-		os.Remove(ForceRestartFile(dataDir))
+		if cfg.DryRun == "" {
+			os.Remove(ForceRestartFile(dataDir))
+		}
 	}
 
 	// check for missing db name file on a server running etcd, indicating we're rejoining after cluster reset on a different node
@@ -92,7 +100,7 @@ func initStaticPodExecutor(clx *cli.Context, cfg rke2cli.Config, isServer bool)
 	}
 
 	// adding force restart file when cluster reset restore path is passed
-	if clusterResetRestorePath != "" {
+	if clusterResetRestorePath != "" && cfg.DryRun == "" {
 		forceRestartFile := ForceRestartFile(dataDir)
 		if err := os.MkdirAll(dataDir, 0755); err != nil {
 			return nil, err
@@ -120,6 +128,9 @@ func initStaticPodExecutor(clx *cli.Context, cfg rke2cli.Config, isServer bool)
 	}
 
 	if cfg.CloudProviderMetadataHostname {
+		if cfg.DryRun != "" {
+			return nil, errors.New("--dry-run cannot render the node name retrieved from the cloud provider metadata endpoint at startup")
+		}
 		fqdn := hostnameFromMetadataEndpoint(context.Background())
 		if fqdn == "" {
 			hostFQDN, err := hostnameFQDN()
@@ -137,6 +148,21 @@ func initStaticPodExecutor(clx *cli.Context, cfg rke2cli.Config, isServer bool)
 		cfg.KubeletPath = "kubelet"
 	}
 
+	stageOptions, err := bootstrap.NewStageOptions(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	chartGlobalValues, err := bootstrap.ParseChartGlobalValues(cfg.ChartGlobalValues.Value())
+	if err != nil {
+		return nil, err
+	}
+
+	manifestConflictPolicy, err := bootstrap.ParseManifestConflictPolicy(cfg.ManifestConflictPolicy)
+	if err != nil {
+		return nil, err
+	}
+
 	templateConfig, err := podtemplate.NewConfigFromCLI(dataDir, cfg)
 	if err != nil {
 		return nil, errors.WithMessage(err, "failed to parse pod template config")
@@ -145,7 +171,7 @@ func initStaticPodExecutor(clx *cli.Context, cfg rke2cli.Config, isServer bool)
 	// Adding PSAs
 	podSecurityConfigFile := clx.String("pod-security-admission-config-file")
 	if podSecurityConfigFile == "" {
-		if err := setPSAs(isCISMode(clx)); err != nil {
+		if err := setPSAs(filepath.Join(cfg.DryRun, defaultPSAConfigFile), isCISMode(clx)); err != nil {
 			return nil, err
 		}
 		podSecurityConfigFile = defaultPSAConfigFile
@@ -164,24 +190,30 @@ func initStaticPodExecutor(clx *cli.Context, cfg rke2cli.Config, isServer bool)
 		"kube-scheduler":           !isServer || forceRestart || clx.Bool("disable-scheduler"),
 	}
 
-	if err := staticpod.RemoveDisabledPods(dataDir, containerRuntimeEndpoint, disabledItems, clusterReset); err != nil {
-		return nil, err
+	if cfg.DryRun == "" {
+		if err := staticpod.RemoveDisabledPods(dataDir, containerRuntimeEndpoint, disabledItems, clusterReset); err != nil {
+			return nil, err
+		}
 	}
 
 	return &staticpod.StaticPodConfig{
-		Config:            *templateConfig,
-		ManifestsDir:      agentManifestsDir,
-		ProfileMode:       profileMode(clx),
-		CloudProvider:     cpConfig,
-		AuditPolicyFile:   clx.String("audit-policy-file"),
-		PSAConfigFile:     podSecurityConfigFile,
-		KubeletPath:       cfg.KubeletPath,
-		RuntimeEndpoint:   containerRuntimeEndpoint,
-		DisableETCD:       disableEtcd,
-		ExternalDatabase:  externalDatabase,
-		IsServer:          isServer,
-		Prime:             clx.Bool("prime"),
-		IngressController: cfg.IngressController.Value(),
+		Config:                 *templateConfig,
+		ManifestsDir:           agentManifestsDir,
+		ProfileMode:            profileMode(clx),
+		CloudProvider:          cpConfig,
+		AuditPolicyFile:        clx.String("audit-policy-file"),
+		PSAConfigFile:          podSecurityConfigFile,
+		KubeletPath:            cfg.KubeletPath,
+		RuntimeEndpoint:        containerRuntimeEndpoint,
+		DisableETCD:            disableEtcd,
+		ExternalDatabase:       externalDatabase,
+		IsServer:               isServer,
+		Prime:                  clx.Bool("prime"),
+		IngressController:      cfg.IngressController.Value(),
+		ChartGlobalValues:      chartGlobalValues,
+		ChartsSource:           cfg.ChartsSource,
+		ManifestConflictPolicy: manifestConflictPolicy,
+		StageOptions:           stageOptions,
 	}, nil
 }
 
@@ -34,7 +34,7 @@ func Test_UnitInitExecutor(t *testing.T) {
 					ControlPlaneResourceLimits:   *cli.NewStringSlice("kube-proxy-cpu=123m"),
 					ControlPlaneResourceRequests: *cli.NewStringSlice("kube-proxy-memory=123Mi"),
 					ExtraEnv:                     rke2cli.ExtraEnv{KubeProxy: *cli.NewStringSlice("FOO=BAR")},
-					ExtraMounts:                  rke2cli.ExtraMounts{KubeProxy: *cli.NewStringSlice("/foo=/bar")},
+					ExtraMounts:                  rke2cli.ExtraMounts{KubeProxy: *cli.NewStringSlice("/foo:/bar")},
 				},
 				isServer: false,
 			},
@@ -55,7 +55,7 @@ func Test_UnitInitExecutor(t *testing.T) {
 						KubeProxy: []string{"FOO=BAR"},
 					},
 					Mounts: &podtemplate.ControlPlaneMounts{
-						KubeProxy: []string{"/foo=/bar"},
+						KubeProxy: []string{"/foo:/bar"},
 					},
 				},
 			},
@@ -69,7 +69,7 @@ func Test_UnitInitExecutor(t *testing.T) {
 					ControlPlaneResourceLimits:   *cli.NewStringSlice("kube-proxy-cpu=42m"),
 					ControlPlaneResourceRequests: *cli.NewStringSlice("kube-proxy-memory=42Mi"),
 					ExtraEnv:                     rke2cli.ExtraEnv{KubeProxy: *cli.NewStringSlice("BAZ=BOP")},
-					ExtraMounts:                  rke2cli.ExtraMounts{KubeProxy: *cli.NewStringSlice("/baz=/bop")},
+					ExtraMounts:                  rke2cli.ExtraMounts{KubeProxy: *cli.NewStringSlice("/baz:/bop")},
 				},
 				isServer: true,
 			},
@@ -90,7 +90,7 @@ func Test_UnitInitExecutor(t *testing.T) {
 						KubeProxy: []string{"BAZ=BOP"},
 					},
 					Mounts: &podtemplate.ControlPlaneMounts{
-						KubeProxy: []string{"/baz=/bop"},
+						KubeProxy: []string{"/baz:/bop"},
 					},
 				},
 			},
@@ -105,6 +105,33 @@ func Test_UnitInitExecutor(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name: "bad probe kind",
+			args: args{
+				cfg: rke2cli.Config{
+					ControlPlaneProbeConf: *cli.NewStringSlice("kube-proxy-liveness-kind=udp"),
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "bad probe port",
+			args: args{
+				cfg: rke2cli.Config{
+					ControlPlaneProbeConf: *cli.NewStringSlice("kube-proxy-liveness-port=70000"),
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "bad extra mount",
+			args: args{
+				cfg: rke2cli.Config{
+					ExtraMounts: rke2cli.ExtraMounts{KubeProxy: *cli.NewStringSlice("/foo=/bar")},
+				},
+			},
+			wantErr: true,
+		},
 		{
 			name: "bad control plane limits",
 			args: args{
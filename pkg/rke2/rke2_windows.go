@@ -13,6 +13,7 @@ import (
 	"github.com/k3s-io/k3s/pkg/cluster/managed"
 	"github.com/k3s-io/k3s/pkg/daemons/executor"
 	"github.com/k3s-io/k3s/pkg/etcd"
+	"github.com/rancher/rke2/pkg/bootstrap"
 	rke2cli "github.com/rancher/rke2/pkg/cli"
 	"github.com/rancher/rke2/pkg/cli/defaults"
 	"github.com/rancher/rke2/pkg/executor/pebinary"
@@ -29,7 +30,12 @@ func initExecutor(clx *cli.Context, cfg rke2cli.Config, isServer bool) (executor
 		cfg.Images.SystemDefaultRegistry = images.PrimeRegistry
 	} else {
 		cfg.Images.SystemDefaultRegistry = clx.String("system-default-registry")
+		// K3s only supports a single registry; fallback registries are handled by the image resolver
+		if primary := images.PrimaryRegistry(cfg.Images.SystemDefaultRegistry); primary != cfg.Images.SystemDefaultRegistry {
+			clx.Set("system-default-registry", primary)
+		}
 	}
+	cfg.Images.RewriteRules = clx.StringSlice("image-rewrite")
 	resolver, err := images.NewResolver(cfg.Images)
 	if err != nil {
 		return nil, err
@@ -80,20 +86,39 @@ func initExecutor(clx *cli.Context, cfg rke2cli.Config, isServer bool) (executor
 		cfg.KubeletPath = "kubelet"
 	}
 
+	stageOptions, err := bootstrap.NewStageOptions(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	chartGlobalValues, err := bootstrap.ParseChartGlobalValues(cfg.ChartGlobalValues.Value())
+	if err != nil {
+		return nil, err
+	}
+
+	manifestConflictPolicy, err := bootstrap.ParseManifestConflictPolicy(cfg.ManifestConflictPolicy)
+	if err != nil {
+		return nil, err
+	}
+
 	return &pebinary.PEBinaryConfig{
-		Resolver:          resolver,
-		ImagesDir:         agentImagesDir,
-		ManifestsDir:      agentManifestsDir,
-		CISMode:           isCISMode(clx),
-		CloudProvider:     cpConfig,
-		DataDir:           dataDir,
-		AuditPolicyFile:   clx.String("audit-policy-file"),
-		KubeletPath:       cfg.KubeletPath,
-		DisableETCD:       clx.Bool("disable-etcd"),
-		IsServer:          isServer,
-		Prime:             clx.Bool("prime"),
-		IngressController: cfg.IngressController.Value(),
-		CNIName:           "",
+		Resolver:               resolver,
+		ImagesDir:              agentImagesDir,
+		ManifestsDir:           agentManifestsDir,
+		CISMode:                isCISMode(clx),
+		CloudProvider:          cpConfig,
+		DataDir:                dataDir,
+		AuditPolicyFile:        clx.String("audit-policy-file"),
+		KubeletPath:            cfg.KubeletPath,
+		DisableETCD:            clx.Bool("disable-etcd"),
+		IsServer:               isServer,
+		Prime:                  clx.Bool("prime"),
+		IngressController:      cfg.IngressController.Value(),
+		ChartGlobalValues:      chartGlobalValues,
+		ChartsSource:           cfg.ChartsSource,
+		ManifestConflictPolicy: manifestConflictPolicy,
+		StageOptions:           stageOptions,
+		CNIName:                "",
 	}, nil
 }
 
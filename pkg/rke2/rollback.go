@@ -0,0 +1,93 @@
+package rke2
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+
+	"github.com/k3s-io/k3s/pkg/util/errors"
+	"github.com/k3s-io/k3s/pkg/version"
+	"github.com/rancher/rke2/pkg/bootstrap"
+	"github.com/rancher/rke2/pkg/images"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+	"sigs.k8s.io/yaml"
+)
+
+const rollbackConfigHeader = `# This file was written by "%s rollback" to run the runtime and component images from %s.
+# Remove this file before upgrading, or the images configured here will continue to be used.
+`
+
+// Rollback points the runtime bin directory at a previously extracted runtime image, and writes a config file
+// that overrides the runtime and component images with the images that were in use when it was extracted.
+// The force-restart marker is set, so that static pod manifests are regenerated with these images on the next start.
+func Rollback(clx *cli.Context) error {
+	dataDir := clx.String("data-dir")
+	if clx.Bool("list") {
+		return listRuntimeDataDirs(clx, dataDir)
+	}
+
+	dir, err := bootstrap.FindRollback(dataDir, clx.String("to"))
+	if err != nil {
+		return err
+	}
+	if dir.Current {
+		return fmt.Errorf("runtime data directory %s is already in use", dir.Name)
+	}
+
+	refs, err := bootstrap.ReadImageRefs(dataDir, dir.Name)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		logrus.Warnf("Component images were not recorded when %s was extracted; only the runtime image will be rolled back", dir.Name)
+		refs = map[string]string{images.Runtime: dir.Image}
+	}
+	// The runtime image must be given exactly as it was when the directory was extracted, so that it is reused
+	refs[images.Runtime], err = bootstrap.RuntimeImageForDataDir(dir.Name, refs[images.Runtime])
+	if err != nil {
+		return err
+	}
+
+	b, err := yaml.Marshal(refs)
+	if err != nil {
+		return err
+	}
+	configDir := clx.String("config") + ".d"
+	configFile := filepath.Join(configDir, "99-"+version.Program+"-rollback.yaml")
+	if err := os.MkdirAll(configDir, 0755); err != nil {
+		return err
+	}
+	header := fmt.Sprintf(rollbackConfigHeader, version.Program, dir.Name)
+	if err := os.WriteFile(configFile, append([]byte(header), b...), 0600); err != nil {
+		return errors.WithMessage(err, "failed to write rollback config")
+	}
+
+	if err := os.WriteFile(ForceRestartFile(dataDir), []byte(""), 0600); err != nil {
+		return errors.WithMessage(err, "failed to write force restart file")
+	}
+
+	if err := bootstrap.Rollback(dataDir, dir); err != nil {
+		return errors.WithMessage(err, "failed to update runtime bin directory")
+	}
+
+	fmt.Fprintf(clx.App.Writer, "Rolled back to runtime image %s from %s\n", dir.Image, dir.Path)
+	fmt.Fprintf(clx.App.Writer, "Image overrides were written to %s\n", configFile)
+	fmt.Fprintf(clx.App.Writer, "Restart the %s service to apply the rollback\n", version.Program)
+	return nil
+}
+
+// listRuntimeDataDirs prints the runtime data directories that are available to roll back to.
+func listRuntimeDataDirs(clx *cli.Context, dataDir string) error {
+	dirs, err := bootstrap.ListRuntimeDataDirs(dataDir)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(clx.App.Writer, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tIMAGE\tEXTRACTED\tSIZE\tCURRENT")
+	for _, dir := range dirs {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%.1fMiB\t%t\n", dir.Name, dir.Image, dir.Extracted.Format("2006-01-02 15:04:05"), float64(dir.Size)/(1<<20), dir.Current)
+	}
+	return w.Flush()
+}
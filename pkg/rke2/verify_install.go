@@ -0,0 +1,26 @@
+package rke2
+
+import (
+	"fmt"
+
+	"github.com/rancher/rke2/pkg/bootstrap"
+	"github.com/urfave/cli/v2"
+)
+
+// VerifyInstall checks the binaries and charts currently in use against the checksums
+// recorded when they were extracted from the runtime image, and prints any differences.
+// An error is returned if any files were modified, removed, or added.
+func VerifyInstall(clx *cli.Context) error {
+	refDir, problems, err := bootstrap.VerifyInstall(clx.String("data-dir"))
+	if err != nil {
+		return err
+	}
+	for _, p := range problems {
+		fmt.Fprintln(clx.App.Writer, p)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%d files in %s do not match checksums recorded at extract time", len(problems), refDir)
+	}
+	fmt.Fprintf(clx.App.Writer, "All files in %s match checksums recorded at extract time\n", refDir)
+	return nil
+}